@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usersGroup is a group of domains grants can be given on
+type usersGroup struct {
+	Name    string
+	Domains []string
+}
+
+// usersPage is the data for the users template
+type usersPage struct {
+	Local  bool
+	Users  []storage.User
+	Grants []storage.Grant
+	Groups []usersGroup
+	Roles  []string
+	CSRF   string
+	Error  string
+}
+
+func handleUsers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil {
+		http.Error(w, "Authentication is disabled", http.StatusNotFound)
+		return
+	}
+	if !isAdmin(ctx) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	gs, ok := s.(storage.GrantStore)
+	if !ok {
+		http.Error(w, "The storage driver does not support grants", http.StatusNotImplemented)
+		return
+	}
+	// Passwords are only managed here when users log in with them
+	us, _ := s.(storage.UserStore)
+	if _, local := auth.password.(localUsers); !local {
+		us = nil
+	}
+
+	var data usersPage
+	status := http.StatusOK
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil || !validCSRF(r) {
+			http.Error(w, "form is not valid", http.StatusBadRequest)
+			return
+		}
+		err := updateUsers(ctx, gs, us, r)
+		if err == nil {
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+
+	var err error
+	if data.Grants, err = gs.ReadGrants(ctx, ""); err != nil {
+		errors <- err
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if us != nil {
+		data.Local = true
+		if data.Users, err = us.ReadUsers(ctx); err != nil {
+			errors <- err
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	for name, domains := range auth.groups {
+		data.Groups = append(data.Groups, usersGroup{Name: name, Domains: domains})
+	}
+	sort.Slice(data.Groups, func(i, j int) bool { return data.Groups[i].Name < data.Groups[j].Name })
+	data.Roles = roleNames[roleViewer:]
+	data.CSRF = csrfToken(r)
+
+	render(w, status, "users.html", data)
+}
+
+// updateUsers runs the action posted from the users page. us is nil when
+// local users are not used
+func updateUsers(ctx context.Context, gs storage.GrantStore, us storage.UserStore, r *http.Request) error {
+
+	admin := userFromContext(ctx)
+	user := strings.TrimSpace(r.PostForm.Get("user"))
+	if user == "" {
+		return fmt.Errorf("The user is missing")
+	}
+
+	switch action := r.PostForm.Get("action"); action {
+	case "grant":
+		scope := strings.ToLower(strings.TrimSpace(r.PostForm.Get("scope")))
+		if _, ok := auth.groups[strings.TrimPrefix(scope, groupPrefix)]; strings.HasPrefix(scope, groupPrefix) && !ok {
+			return fmt.Errorf("Unknown group %s", strings.TrimPrefix(scope, groupPrefix))
+		}
+		g, err := newGrant(user, r.PostForm.Get("role"), scope)
+		if err != nil {
+			return err
+		}
+		if err = gs.WriteGrant(ctx, g); err != nil {
+			return err
+		}
+		log.Infof("%s granted %s %s on %s", admin, g.User, g.Role, g.Scope)
+	case "revoke":
+		scope := r.PostForm.Get("scope")
+		if err := revokeGrant(ctx, gs, user, scope, auth.defaultRole); err != nil {
+			return err
+		}
+		log.Infof("%s revoked %s on %s", admin, user, scope)
+	case "password":
+		if us == nil {
+			return fmt.Errorf("Passwords are not stored locally")
+		}
+		hash, err := hashPassword(r.PostForm.Get("password"))
+		if err != nil {
+			return err
+		}
+		if err = us.WriteUser(ctx, storage.User{Name: user, PasswordHash: hash}); err != nil {
+			return err
+		}
+		log.Infof("%s set the password of %s", admin, user)
+	case "delete":
+		if us == nil {
+			return fmt.Errorf("Passwords are not stored locally")
+		}
+		ts, _ := s.(storage.TokenStore)
+		if err := deleteUser(ctx, us, gs, ts, user); err != nil {
+			return err
+		}
+		auth.sessions.deleteUser(user)
+		log.Infof("%s deleted %s", admin, user)
+	default:
+		return fmt.Errorf("Unknown action %q", action)
+	}
+	return nil
+}
+
+// tokensPage is the data for the tokens template
+type tokensPage struct {
+	Tokens []storage.Token
+	Scopes []string
+	CSRF   string
+	Error  string
+	// Created is the secret of a new token which is only shown once
+	Created string
+}
+
+func handleTokens(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil {
+		http.Error(w, "Authentication is disabled", http.StatusNotFound)
+		return
+	}
+	if !isAdmin(ctx) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	ts, ok := s.(storage.TokenStore)
+	if !ok {
+		http.Error(w, "The storage driver does not support API tokens", http.StatusNotImplemented)
+		return
+	}
+
+	var data tokensPage
+	status := http.StatusOK
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil || !validCSRF(r) {
+			http.Error(w, "form is not valid", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if data.Created, err = updateTokens(ctx, ts, r); err != nil {
+			data.Error = err.Error()
+			status = http.StatusBadRequest
+		} else if data.Created == "" {
+			http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+			return
+		}
+	}
+
+	var err error
+	if data.Tokens, err = ts.ReadTokens(ctx, ""); err != nil {
+		errors <- err
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data.Scopes = tokenScopes
+	data.CSRF = csrfToken(r)
+
+	// The page may hold a new secret
+	w.Header().Set("Cache-Control", "no-store")
+	render(w, status, "tokens.html", data)
+}
+
+// updateTokens runs the action posted from the tokens page and returns the
+// secret of a created token
+func updateTokens(ctx context.Context, ts storage.TokenStore, r *http.Request) (string, error) {
+
+	admin := userFromContext(ctx)
+
+	switch action := r.PostForm.Get("action"); action {
+	case "create":
+		days, err := strconv.Atoi(strings.TrimSpace(r.PostForm.Get("days")))
+		if err != nil || days < 0 {
+			return "", fmt.Errorf("days must be a positive number or 0 for never")
+		}
+		t, raw, err := newToken(r.PostForm.Get("user"), r.PostForm.Get("name"), r.PostForm.Get("kind") == "service",
+			r.PostForm["scope"], time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return "", err
+		}
+		t.Tenant = storage.TenantFromContext(ctx)
+		if err = ts.WriteToken(ctx, t); err != nil {
+			return "", err
+		}
+		log.Infof("%s created token %s for %s with %s", admin, t.ID, t.User, strings.Join(t.Scopes, ","))
+		return raw, nil
+	case "revoke":
+		id := r.PostForm.Get("id")
+		if err := ts.RevokeToken(ctx, id); err != nil {
+			return "", err
+		}
+		log.Infof("%s revoked token %s", admin, id)
+		return "", nil
+	default:
+		return "", fmt.Errorf("Unknown action %q", action)
+	}
+}
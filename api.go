@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/spf"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// openAPI describes the JSON API
+//
+//go:embed static/openapi.json
+var openAPI []byte
+
+// maxAPIPageSize is the largest number of reports returned per request
+const maxAPIPageSize = 1000
+
+// statDimensions are the dimensions the statistics can be grouped by
+var statDimensions = []string{
+	storage.StatDay,
+	storage.StatDomain,
+	storage.StatHeaderFrom,
+	storage.StatSourceIP,
+	storage.StatReporter,
+	storage.StatDisposition,
+	storage.StatDKIMAlign,
+	storage.StatSPFAlign,
+}
+
+// apiError is the body of every failed API request
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiReport struct {
+	ID                     int64     `json:"id"`
+	Begin                  time.Time `json:"begin"`
+	End                    time.Time `json:"end"`
+	PolicyDomain           string    `json:"policy_domain"`
+	ReportOrg              string    `json:"report_org"`
+	ReportID               string    `json:"report_id"`
+	ReportEmail            string    `json:"report_email"`
+	ReportExtraContactInfo string    `json:"report_extra_contact_info"`
+	PolicyAdkim            string    `json:"policy_adkim"`
+	PolicyAspf             string    `json:"policy_aspf"`
+	PolicyP                string    `json:"policy_p"`
+	PolicySP               string    `json:"policy_sp"`
+	PolicyPCT              string    `json:"policy_pct"`
+	Messages               int64     `json:"messages"`
+	DKIMResult             string    `json:"dkim_result"`
+	SPFResult              string    `json:"spf_result"`
+}
+
+type apiRow struct {
+	SourceIP        string `json:"source_ip"`
+	Count           int64  `json:"count"`
+	EvalDisposition string `json:"eval_disposition"`
+	EvalSPFAlign    string `json:"eval_spf_align"`
+	EvalDKIMAlign   string `json:"eval_dkim_align"`
+	Reason          string `json:"reason"`
+	DKIMDomain      string `json:"dkim_domain"`
+	DKIMResult      string `json:"dkim_result"`
+	SPFDomain       string `json:"spf_domain"`
+	SPFResult       string `json:"spf_result"`
+	HeaderFrom      string `json:"header_from"`
+}
+
+// apiReportList is a page of reports. Next and Prev are cursors for the
+// after and before parameters when sorted by begin date
+type apiReportList struct {
+	Reports []apiReport `json:"reports"`
+	Total   int         `json:"total"`
+	Size    int         `json:"size"`
+	Page    int         `json:"page,omitempty"`
+	Next    string      `json:"next,omitempty"`
+	Prev    string      `json:"prev,omitempty"`
+}
+
+type apiReportDetail struct {
+	Report apiReport `json:"report"`
+	Rows   []apiRow  `json:"rows"`
+}
+
+// apiStat is an aggregate of the daily statistics. Dimensions that are not
+// grouped by are left out and Day is the first day of the aggregate
+type apiStat struct {
+	Day          string `json:"day"`
+	PolicyDomain string `json:"policy_domain,omitempty"`
+	HeaderFrom   string `json:"header_from,omitempty"`
+	SourceIP     string `json:"source_ip,omitempty"`
+	Reporter     string `json:"reporter,omitempty"`
+	Disposition  string `json:"disposition,omitempty"`
+	DKIMAlign    string `json:"dkim_align,omitempty"`
+	SPFAlign     string `json:"spf_align,omitempty"`
+	Messages     int64  `json:"messages"`
+}
+
+type apiCidr struct {
+	Cidr   string `json:"cidr"`
+	Within bool   `json:"within"`
+}
+
+type apiSPFRule struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type apiSPF struct {
+	Domain   string       `json:"domain"`
+	Record   string       `json:"record"`
+	Rules    []apiSPFRule `json:"rules"`
+	Includes []apiSPF     `json:"includes"`
+}
+
+type apiAnalysis struct {
+	Domain    string    `json:"domain"`
+	IP        string    `json:"ip"`
+	Reverse   []string  `json:"reverse"`
+	Record    string    `json:"record"`
+	Cidrs     []apiCidr `json:"cidrs"`
+	Within    bool      `json:"within"`
+	Breakdown apiSPF    `json:"breakdown"`
+}
+
+func newAPIReport(r dmarc.Report) apiReport {
+	return apiReport{
+		ID:                     r.ID,
+		Begin:                  r.ReportBegin.UTC(),
+		End:                    r.ReportEnd.UTC(),
+		PolicyDomain:           r.PolicyDomain,
+		ReportOrg:              r.ReportOrg,
+		ReportID:               r.ReportID,
+		ReportEmail:            r.ReportEmail,
+		ReportExtraContactInfo: r.ReportExtraContactInfo,
+		PolicyAdkim:            r.PolicyAdkim,
+		PolicyAspf:             r.PolicyAspf,
+		PolicyP:                r.PolicyP,
+		PolicySP:               r.PolicySP,
+		PolicyPCT:              r.PolicyPCT,
+		Messages:               r.Count,
+		DKIMResult:             r.DKIMResult,
+		SPFResult:              r.SPFResult,
+	}
+}
+
+func newAPISPF(b spf.BreakDown) apiSPF {
+	a := apiSPF{Domain: b.Domain, Record: b.Record, Rules: []apiSPFRule{}, Includes: []apiSPF{}}
+	for _, r := range b.Rules {
+		a.Rules = append(a.Rules, apiSPFRule{Key: r.Key, Value: r.Value})
+	}
+	for _, i := range b.Includes {
+		a.Includes = append(a.Includes, newAPISPF(i))
+	}
+	return a
+}
+
+// writeJSON sends v as the response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Unable to send data: %v", err)
+	}
+}
+
+// writeError sends an error body
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorDetail{Status: status, Message: message}})
+}
+
+// apiHandler is the statusHandler of the API which reports errors as JSON.
+// Requests can authenticate with an API token that has the scope
+func apiHandler(ctx context.Context, scope string, fn func(context.Context, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tctx, ok := tenantContext(ctx, r)
+		if !ok {
+			writeError(w, http.StatusNotFound, "Unknown tenant")
+			return
+		}
+		user, ok := auth.user(r)
+
+		t, bearer, err := auth.bearer(r.Context(), r)
+		switch {
+		case err == errInvalidToken:
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		case err != nil:
+			errors <- err
+			writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		case bearer && !hasScope(t.Scopes, scope):
+			writeError(w, http.StatusForbidden, fmt.Sprintf("The token does not have the %s scope", scope))
+			return
+		case bearer && t.Tenant != storage.TenantFromContext(tctx):
+			writeError(w, http.StatusForbidden, "The token belongs to another tenant")
+			return
+		case bearer:
+			user, ok = t.User, true
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		actx, ok, err := authorize(withUser(tctx, user), user)
+		if err != nil {
+			errors <- err
+			writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusForbidden, "Access denied")
+			return
+		}
+		fn(actx, w, r)
+	}
+}
+
+func handleAPIReports(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	v := r.URL.Query()
+
+	q, err := reportQuery(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := positive(v, "page", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.PageSize, err = positive(v, "size", 30)
+	if err != nil || q.PageSize > maxAPIPageSize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d", maxAPIPageSize))
+		return
+	}
+
+	keyset := q.Sort == "" || q.Sort == storage.SortBegin
+	switch {
+	case v.Get("after") != "":
+		q.Cursor, err = storage.ParseCursor(v.Get("after"), false)
+	case v.Get("before") != "":
+		q.Cursor, err = storage.ParseCursor(v.Get("before"), true)
+	default:
+		q.Offset = (page - 1) * q.PageSize
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "cursor is not valid")
+		return
+	}
+	if q.Cursor != nil && !keyset {
+		writeError(w, http.StatusBadRequest, "cursors can only be used when sorted by begin")
+		return
+	}
+
+	total, err := reportCounts.get(countKey(ctx, string(filterQuery(v))), func() (int, error) {
+		return s.CountReports(ctx, q)
+	})
+	if err != nil {
+		errors <- fmt.Errorf("Unable to count reports: %v", err)
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	reports, err := s.ReadReports(ctx, q)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read reports: %v", err)
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	list := apiReportList{Reports: []apiReport{}, Total: total, Size: q.PageSize}
+	for _, rp := range reports {
+		list.Reports = append(list.Reports, newAPIReport(rp))
+	}
+
+	if q.Cursor == nil {
+		list.Page = page
+	}
+	if keyset && len(reports) > 0 {
+		first, last := reports[0], reports[len(reports)-1]
+		if q.Cursor != nil || page > 1 {
+			list.Prev = storage.Cursor{Begin: first.ReportBegin, ID: first.ID}.String()
+		}
+		if len(reports) == q.PageSize {
+			list.Next = storage.Cursor{Begin: last.ReportBegin, ID: last.ID}.String()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// positive parses the query parameter as a positive number
+func positive(v url.Values, name string, def int) (int, error) {
+	p := v.Get(name)
+	if p == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(p)
+	if err != nil || i < 1 {
+		return 0, fmt.Errorf("%s is not a positive number", name)
+	}
+	return i, nil
+}
+
+func handleAPIReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "id is not a number")
+		return
+	}
+
+	report, err := s.ReadReport(ctx, id)
+	if storage.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Report %d not found", id))
+		return
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read report %d: %v", id, err)
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	detail := apiReportDetail{Report: newAPIReport(report.Report), Rows: []apiRow{}}
+	for _, rw := range report.Rows {
+		detail.Rows = append(detail.Rows, apiRow{
+			SourceIP:        rw.SourceIP,
+			Count:           rw.Count,
+			EvalDisposition: rw.EvalDisposition,
+			EvalSPFAlign:    rw.EvalSPFAlign,
+			EvalDKIMAlign:   rw.EvalDKIMAalign,
+			Reason:          rw.Reason,
+			DKIMDomain:      rw.DKIMDomain,
+			DKIMResult:      rw.DKIMResult,
+			SPFDomain:       rw.SPFDomain,
+			SPFResult:       rw.SPFResult,
+			HeaderFrom:      rw.IdentifierHFrom,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// statsQuery parses the filters and grouping of the statistics
+func statsQuery(v url.Values) (q storage.StatsQuery, err error) {
+
+	q.PolicyDomain = strings.TrimSpace(v.Get("domain"))
+	q.HeaderFrom = strings.TrimSpace(v.Get("hfrom"))
+	q.SourceIP = strings.TrimSpace(v.Get("ip"))
+	q.Reporter = strings.TrimSpace(v.Get("reporter"))
+	q.Disposition = v.Get("disposition")
+	q.DKIMAlign = v.Get("dkim")
+	q.SPFAlign = v.Get("spf")
+
+	// The days are in UTC like the statistics and to is inclusive
+	if f := v.Get("from"); f != "" {
+		if q.From, err = time.Parse("2006-01-02", f); err != nil {
+			return q, fmt.Errorf("from is not a valid date")
+		}
+	}
+	if t := v.Get("to"); t != "" {
+		if q.To, err = time.Parse("2006-01-02", t); err != nil {
+			return q, fmt.Errorf("to is not a valid date")
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+
+	if g := v.Get("groupby"); g != "" {
+		for _, dim := range strings.Split(g, ",") {
+			dim = strings.TrimSpace(dim)
+			found := false
+			for _, d := range statDimensions {
+				found = found || d == dim
+			}
+			if !found {
+				return q, fmt.Errorf("groupby must be a list of %s", strings.Join(statDimensions, ", "))
+			}
+			q.GroupBy = append(q.GroupBy, dim)
+		}
+	}
+
+	if t := v.Get("top"); t != "" {
+		if q.Top, err = strconv.Atoi(t); err != nil || q.Top < 0 {
+			return q, fmt.Errorf("top is not a valid number")
+		}
+	}
+
+	return q, nil
+}
+
+func handleAPIStats(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	sr, ok := s.(storage.StatsReader)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "The storage driver does not support statistics")
+		return
+	}
+
+	q, err := statsQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := sr.ReadStats(ctx, q)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read statistics: %v", err)
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	list := struct {
+		Stats []apiStat `json:"stats"`
+	}{Stats: []apiStat{}}
+	for _, st := range stats {
+		list.Stats = append(list.Stats, apiStat{
+			Day:          st.Day.Format("2006-01-02"),
+			PolicyDomain: st.PolicyDomain,
+			HeaderFrom:   st.HeaderFrom,
+			SourceIP:     st.SourceIP,
+			Reporter:     st.Reporter,
+			Disposition:  st.Disposition,
+			DKIMAlign:    st.DKIMAlign,
+			SPFAlign:     st.SPFAlign,
+			Messages:     st.Messages,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleAPIAnalyse(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	domain := vars["domain"]
+	ip := vars["ip"]
+
+	if !allowed(ctx, domain, roleAnalyst) {
+		writeError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+	if !validDomain(domain) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%q is not a valid domain name", domain))
+		return
+	}
+	if !isip.MatchString(ip) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%q is not a valid IP address", ip))
+		return
+	}
+
+	analasis, spfresults, err := analyse(domain, ip)
+	if err != nil {
+		log.Error(err)
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Unable to look up the SPF record of %s", domain))
+		return
+	}
+
+	a := apiAnalysis{
+		Domain:    analasis.Domain,
+		IP:        analasis.IP,
+		Reverse:   []string{},
+		Record:    analasis.Spfrecord,
+		Cidrs:     []apiCidr{},
+		Breakdown: newAPISPF(spfresults),
+	}
+	if analasis.Reverse != "" {
+		a.Reverse = strings.Split(analasis.Reverse, ",")
+	}
+	for _, c := range analasis.Cidrs {
+		a.Cidrs = append(a.Cidrs, apiCidr{Cidr: c.Cidr, Within: c.Within})
+		a.Within = a.Within || c.Within
+	}
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPI); err != nil {
+		log.Errorf("Unable to send data: %v", err)
+	}
+}
+
+// apiRoutes adds the JSON API to the router of /api/v1
+func apiRoutes(ctx context.Context, r *mux.Router) {
+
+	r.HandleFunc("/openapi.json", LogHTTP(http.HandlerFunc(handleOpenAPI)))
+	r.HandleFunc("/reports", LogHTTP(apiHandler(ctx, scopeUpload, handleAPIUpload))).Methods(http.MethodPost)
+	r.HandleFunc("/reports", LogHTTP(apiHandler(ctx, scopeRead, handleAPIReports)))
+	r.HandleFunc("/reports/{id:[0-9]+}", LogHTTP(apiHandler(ctx, scopeRead, handleAPIReport)))
+	r.HandleFunc("/stats", LogHTTP(apiHandler(ctx, scopeRead, handleAPIStats)))
+	r.HandleFunc("/analyse/{domain}/{ip}", LogHTTP(apiHandler(ctx, scopeRead, handleAPIAnalyse)))
+	r.HandleFunc("/tokens", LogHTTP(apiHandler(ctx, scopeAdmin, handleAPITokens))).Methods(http.MethodGet)
+	r.HandleFunc("/tokens/{id:[0-9a-f]+}", LogHTTP(apiHandler(ctx, scopeAdmin, handleAPIRevokeToken))).Methods(http.MethodDelete)
+
+	// Unknown API paths gets an error body like everything else
+	r.PathPrefix("/").Handler(LogHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	})))
+}
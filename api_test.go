@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/spf"
+)
+
+func TestAPI(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	oldLookupSPF := lookupSPF
+	lookupSPF = func(domain string) (spf.BreakDown, error) {
+		return spf.BreakDown{
+			Domain: domain,
+			Record: "v=spf1 ip4:127.0.0.0/8 -all",
+			Rules:  []spf.Rule{{Key: "ip4", Value: "127.0.0.0/8"}, {Key: "-all"}},
+		}, nil
+	}
+	t.Cleanup(func() { lookupSPF = oldLookupSPF })
+
+	tt := []struct {
+		name     string
+		path     string
+		status   int
+		contains string
+	}{
+		{"reports", "/api/v1/reports", http.StatusOK, `"report_id": "myid123"`},
+		{"reports_total", "/api/v1/reports?size=10", http.StatusOK, `"total": 1`},
+		{"reports_filter", "/api/v1/reports?domain=greyhat.dk&disposition=quarantine&ip=10.10.10.0/24", http.StatusOK, `"id": 1`},
+		{"reports_nomatch", "/api/v1/reports?disposition=reject", http.StatusOK, `"reports": []`},
+		{"reports_cursor", "/api/v1/reports?after=1300000000-1", http.StatusOK, `"reports": []`},
+		{"reports_badsize", "/api/v1/reports?size=1001", http.StatusBadRequest, `"message": "size must be between 1 and 1000"`},
+		{"reports_badpage", "/api/v1/reports?page=0", http.StatusBadRequest, "page is not a positive number"},
+		{"reports_badip", "/api/v1/reports?ip=10.10.10", http.StatusBadRequest, `"status": 400`},
+		{"reports_badcursor", "/api/v1/reports?before=abc", http.StatusBadRequest, "cursor is not valid"},
+		{"reports_cursor_sort", "/api/v1/reports?after=1300000000-1&sort=org", http.StatusBadRequest, "sorted by begin"},
+		{"report", "/api/v1/reports/1", http.StatusOK, `"source_ip": "10.10.10.1"`},
+		{"report_missing", "/api/v1/reports/2", http.StatusNotFound, `"message": "Report 2 not found"`},
+		{"stats", "/api/v1/stats?groupby=domain,disposition&from=2018-08-12&to=2018-08-13", http.StatusOK, `"policy_domain": "greyhat.dk"`},
+		{"stats_badgroupby", "/api/v1/stats?groupby=id", http.StatusBadRequest, "groupby must be a list of"},
+		{"stats_baddate", "/api/v1/stats?to=tomorrow", http.StatusBadRequest, "to is not a valid date"},
+		{"analyse", "/api/v1/analyse/greyhat.dk/127.0.0.1", http.StatusOK, `"within": true`},
+		{"analyse_baddomain", "/api/v1/analyse/greyhat/127.0.0.1", http.StatusBadRequest, "not a valid domain name"},
+		{"analyse_badip", "/api/v1/analyse/greyhat.dk/localhost", http.StatusBadRequest, "not a valid IP address"},
+		{"openapi", "/api/v1/openapi.json", http.StatusOK, `"openapi": "3.0.3"`},
+		{"notfound", "/api/v1/nothing", http.StatusNotFound, `"status": 404`},
+	}
+
+	h := httpHandler(ctx)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d:\n%s", tc.status, w.Code, w.Body.String())
+			}
+
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected JSON but got %q", ct)
+			}
+
+			var v interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+				t.Errorf("Expected valid JSON: %v", err)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected body to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+// Package archive reads and writes the portable backup format. An archive is
+// a tar file, optionally compressed with zstd or gzip, holding a manifest and
+// a JSON Lines file per table
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Format and Version identifies the archive format. The Version is increased
+// on changes that older versions can't read or would leave out. Version 2
+// added the documents, reporter counts, users, grants and tokens
+const (
+	Format  = "godmarcparser"
+	Version = 2
+)
+
+const manifestName = "manifest.json"
+
+// tableName is the allowed names of tables, which keeps extracted files
+// within the temporary directory
+var tableName = regexp.MustCompile(`^[a-z_]+$`)
+
+// Manifest describes the content of an archive
+type Manifest struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Source is the storage type the archive was exported from
+	Source string `json:"source"`
+	// Tables is the number of entries per table in the order they were
+	// written
+	Tables []Table `json:"tables"`
+}
+
+// Table is the name and number of entries of a table
+type Table struct {
+	Name    string `json:"name"`
+	Entries int64  `json:"entries"`
+}
+
+// Writer writes the tables to temporary files since the size of each file
+// has to be known before it is added to the tar file
+type Writer struct {
+	out      io.Writer
+	compress io.WriteCloser
+	dir      string
+	tables   map[string]*table
+	manifest Manifest
+}
+
+type table struct {
+	f   *os.File
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// Create returns a Writer for an archive named name. The compression is
+// chosen by the extension of the name: .zst for zstd, .gz for gzip and no
+// compression otherwise
+func Create(out io.Writer, name, source string) (*Writer, error) {
+
+	dir, err := ioutil.TempDir("", "godmarcparser-export-")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create temporary directory: %v", err)
+	}
+
+	w := &Writer{
+		out:    out,
+		dir:    dir,
+		tables: make(map[string]*table),
+		manifest: Manifest{
+			Format:  Format,
+			Version: Version,
+			Created: time.Now().UTC(),
+			Source:  source,
+		},
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".zstd"):
+		w.compress, err = zstd.NewWriter(out)
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		w.compress = gzip.NewWriter(out)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Unable to create compressor: %v", err)
+	}
+	if w.compress != nil {
+		w.out = w.compress
+	}
+
+	return w, nil
+}
+
+// Write adds an entry to a table
+func (w *Writer) Write(name string, v interface{}) error {
+
+	t, ok := w.tables[name]
+	if !ok {
+		if !tableName.MatchString(name) {
+			return fmt.Errorf("Invalid table name %q", name)
+		}
+
+		f, err := os.Create(filepath.Join(w.dir, name+".jsonl"))
+		if err != nil {
+			return fmt.Errorf("Unable to create %s: %v", name, err)
+		}
+		t = &table{f: f, buf: bufio.NewWriter(f)}
+		t.enc = json.NewEncoder(t.buf)
+		w.tables[name] = t
+		w.manifest.Tables = append(w.manifest.Tables, Table{Name: name})
+	}
+
+	if err := t.enc.Encode(v); err != nil {
+		return fmt.Errorf("Unable to write to %s: %v", name, err)
+	}
+
+	for i := range w.manifest.Tables {
+		if w.manifest.Tables[i].Name == name {
+			w.manifest.Tables[i].Entries++
+		}
+	}
+	return nil
+}
+
+// Close writes the manifest and the tables to the archive and removes the
+// temporary files
+func (w *Writer) Close() (err error) {
+
+	defer func() {
+		if rerr := os.RemoveAll(w.dir); rerr != nil {
+			log.Errorf("Unable to remove %s: %v", w.dir, rerr)
+		}
+	}()
+
+	for _, t := range w.tables {
+		if err = t.buf.Flush(); err != nil {
+			return fmt.Errorf("Unable to write %s: %v", t.f.Name(), err)
+		}
+		if err = t.f.Close(); err != nil {
+			return fmt.Errorf("Unable to close %s: %v", t.f.Name(), err)
+		}
+	}
+
+	tw := tar.NewWriter(w.out)
+
+	b, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode manifest: %v", err)
+	}
+	if err = add(tw, manifestName, int64(len(b)), bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	for _, t := range w.manifest.Tables {
+		if err = w.addTable(tw, t.Name); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("Unable to close archive: %v", err)
+	}
+	if w.compress != nil {
+		if err = w.compress.Close(); err != nil {
+			return fmt.Errorf("Unable to close compressor: %v", err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) addTable(tw *tar.Writer, name string) error {
+
+	f, err := os.Open(filepath.Join(w.dir, name+".jsonl"))
+	if err != nil {
+		return fmt.Errorf("Unable to open %s: %v", name, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Unable to stat %s: %v", name, err)
+	}
+	return add(tw, name+".jsonl", fi.Size(), f)
+}
+
+func add(tw *tar.Writer, name string, size int64, r io.Reader) error {
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Unable to add %s: %v", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("Unable to add %s: %v", name, err)
+	}
+	return nil
+}
+
+// Reader extracts an archive to a temporary directory so the tables can be
+// read in any order
+type Reader struct {
+	Manifest Manifest
+	dir      string
+}
+
+// Open extracts an archive. The compression is detected from the content
+func Open(in io.Reader) (*Reader, error) {
+
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(4)
+
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read zstd: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read gzip: %v", err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	dir, err := ioutil.TempDir("", "godmarcparser-import-")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create temporary directory: %v", err)
+	}
+	a := &Reader{dir: dir}
+
+	if err = a.extract(tar.NewReader(r)); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Reader) extract(tr *tar.Reader) error {
+
+	manifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read archive: %v", err)
+		}
+
+		if hdr.Name == manifestName {
+			if err = json.NewDecoder(tr).Decode(&a.Manifest); err != nil {
+				return fmt.Errorf("Unable to read manifest: %v", err)
+			}
+			if a.Manifest.Format != Format {
+				return fmt.Errorf("Not a %s archive", Format)
+			}
+			if a.Manifest.Version > Version {
+				return fmt.Errorf("Archive version %d is newer than the supported version %d", a.Manifest.Version, Version)
+			}
+			manifest = true
+			continue
+		}
+
+		name := strings.TrimSuffix(hdr.Name, ".jsonl")
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".jsonl") || !tableName.MatchString(name) {
+			log.Warnf("Skipping unknown entry %s in archive", hdr.Name)
+			continue
+		}
+
+		f, err := os.Create(filepath.Join(a.dir, hdr.Name))
+		if err != nil {
+			return fmt.Errorf("Unable to extract %s: %v", hdr.Name, err)
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to extract %s: %v", hdr.Name, err)
+		}
+	}
+
+	if !manifest {
+		return fmt.Errorf("Archive has no manifest")
+	}
+	return nil
+}
+
+// Entries returns the number of entries of a table according to the manifest
+func (a *Reader) Entries(name string) int64 {
+	for _, t := range a.Manifest.Tables {
+		if t.Name == name {
+			return t.Entries
+		}
+	}
+	return 0
+}
+
+// Scan returns a Scanner for a table. A table missing from the archive has
+// no entries
+func (a *Reader) Scan(name string) (*Scanner, error) {
+
+	if !tableName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid table name %q", name)
+	}
+
+	f, err := os.Open(filepath.Join(a.dir, name+".jsonl"))
+	if os.IsNotExist(err) {
+		return &Scanner{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %v", name, err)
+	}
+	return &Scanner{f: f, dec: json.NewDecoder(bufio.NewReader(f))}, nil
+}
+
+// Close removes the extracted files
+func (a *Reader) Close() error {
+	return os.RemoveAll(a.dir)
+}
+
+// Scanner reads the entries of a table one at a time
+type Scanner struct {
+	f   *os.File
+	dec *json.Decoder
+}
+
+// Next decodes the next entry into v. It returns false when there are no
+// more entries
+func (s *Scanner) Next(v interface{}) (bool, error) {
+	if s.dec == nil {
+		return false, nil
+	}
+	if err := s.dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to decode %s: %v", s.f.Name(), err)
+	}
+	return true, nil
+}
+
+// Close closes the table
+func (s *Scanner) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+type entry struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	for _, name := range []string{"dump.tar.zst", "dump.tar.gz", "dump.tar"} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w, err := Create(&buf, name, "memory")
+			if err != nil {
+				t.Fatalf("Unable to create archive: %v", err)
+			}
+			for i := int64(1); i <= 3; i++ {
+				if err := w.Write("report", entry{ID: i, Name: "report"}); err != nil {
+					t.Fatalf("Unable to write: %v", err)
+				}
+			}
+			if err := w.Write("reportrow", entry{ID: 1, Name: "row"}); err != nil {
+				t.Fatalf("Unable to write: %v", err)
+			}
+			if err := w.Write("../escape", entry{}); err == nil {
+				t.Errorf("Expected invalid table name to fail")
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Unable to close archive: %v", err)
+			}
+
+			r, err := Open(&buf)
+			if err != nil {
+				t.Fatalf("Unable to open archive: %v", err)
+			}
+			defer r.Close()
+
+			if r.Manifest.Source != "memory" || r.Manifest.Version != Version {
+				t.Errorf("Unexpected manifest %#v", r.Manifest)
+			}
+			if r.Entries("report") != 3 || r.Entries("reportrow") != 1 {
+				t.Errorf("Unexpected entries in manifest %#v", r.Manifest.Tables)
+			}
+
+			s, err := r.Scan("report")
+			if err != nil {
+				t.Fatalf("Unable to scan: %v", err)
+			}
+			defer s.Close()
+
+			var got []entry
+			for {
+				var e entry
+				ok, err := s.Next(&e)
+				if err != nil {
+					t.Fatalf("Unable to read: %v", err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, e)
+			}
+			if len(got) != 3 || got[2].ID != 3 {
+				t.Errorf("Unexpected entries %#v", got)
+			}
+
+			// Missing tables has no entries
+			s, err = r.Scan("daily_stats")
+			if err != nil {
+				t.Fatalf("Unable to scan: %v", err)
+			}
+			if ok, err := s.Next(&entry{}); ok || err != nil {
+				t.Errorf("Expected no entries: %v %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+
+	if _, err := Open(bytes.NewBufferString("not an archive")); err == nil {
+		t.Errorf("Expected error on invalid archive")
+	}
+
+	// A tar file without a manifest
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := add(tw, "report.jsonl", 2, bytes.NewBufferString("{}")); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if _, err := Open(&buf); err == nil {
+		t.Errorf("Expected error on missing manifest")
+	}
+
+	// A newer version
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	m := `{"format":"godmarcparser","version":99}`
+	if err := add(tw, manifestName, int64(len(m)), bytes.NewBufferString(m)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if _, err := Open(&buf); err == nil {
+		t.Errorf("Expected error on newer version")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// embedded are the templates and static files built into the binary
+//
+//go:embed templates static
+var embedded embed.FS
+
+// overlayFS serves files from a directory and falls back to the embedded
+// files for the ones it does not have
+type overlayFS struct {
+	dir  fs.FS
+	base fs.FS
+}
+
+// assetsFS returns the files of the web interface. Files in dir replace the
+// embedded files with the same path
+func assetsFS(dir string) fs.FS {
+	if dir == "" {
+		return embedded
+	}
+	return overlayFS{dir: os.DirFS(dir), base: embedded}
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.dir.Open(name); err == nil {
+		return f, nil
+	}
+	return o.base.Open(name)
+}
+
+// ReadDir lists the files of both directories
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := make(map[string]fs.DirEntry)
+	found := false
+	for _, fsys := range []fs.FS{o.base, o.dir} {
+		es, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, e := range es {
+			entries[e.Name()] = e
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// pageNames are the pages the handlers render and staticNames the static
+// files they link to
+var (
+	pageNames   = []string{"analyse.html", "dashboard.html", "domain.html", "ip.html", "login.html", "logout.html", "report.html", "reporter.html", "reporters.html", "reports.html", "tokens.html", "users.html"}
+	staticNames = []string{"style.css", "openapi.json"}
+)
+
+// pageSet are the parsed pages of the web interface. Every page defines the
+// title and content of the shared layout and can use the partials
+type pageSet struct {
+	pages  map[string]*template.Template
+	static http.Handler
+	fsys   fs.FS
+}
+
+// pages are parsed once at startup
+var pages *pageSet
+
+// loadPages parses the templates and prepares the static files
+func loadPages(fsys fs.FS) (*pageSet, error) {
+	base, err := template.New("").Funcs(templateFuncs).ParseFS(fsys, "templates/layout.html", "templates/partials/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse layout and partials: %v", err)
+	}
+
+	files, err := fs.Glob(fsys, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list templates: %v", err)
+	}
+
+	ps := &pageSet{pages: make(map[string]*template.Template), fsys: fsys}
+	for _, f := range files {
+		name := path.Base(f)
+		if name == "layout.html" {
+			continue
+		}
+		t, err := base.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to clone layout for %s: %v", name, err)
+		}
+		if _, err = t.ParseFS(fsys, f); err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", f, err)
+		}
+		ps.pages[name] = t
+	}
+
+	static, err := fs.Sub(fsys, "static")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open static files: %v", err)
+	}
+	ps.static = http.FileServer(http.FS(static))
+
+	return ps, nil
+}
+
+// check returns an error if a page or static file is missing
+func (ps *pageSet) check() error {
+	if ps == nil {
+		return fmt.Errorf("The templates are not loaded")
+	}
+	for _, name := range pageNames {
+		if _, ok := ps.pages[name]; !ok {
+			return fmt.Errorf("The template %s is missing", name)
+		}
+	}
+	for _, name := range staticNames {
+		if _, err := fs.Stat(ps.fsys, "static/"+name); err != nil {
+			return fmt.Errorf("The static file %s is missing: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// render writes a page with the status. Nothing is sent if the template
+// fails so the error can be reported
+func render(w http.ResponseWriter, status int, name string, data interface{}) {
+	t, ok := pages.pages[name]
+	if !ok {
+		errors <- fmt.Errorf("Unknown template %s", name)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", data); err != nil {
+		errors <- fmt.Errorf("Error running template %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Debugf("Unable to write %s: %v", name, err)
+	}
+}
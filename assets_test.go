@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPages(t *testing.T) {
+
+	ps, err := loadPages(embedded)
+	if err != nil {
+		t.Fatalf("Unable to load templates: %v", err)
+	}
+	if err = ps.check(); err != nil {
+		t.Errorf("Expected all pages and static files: %v", err)
+	}
+	if _, ok := ps.pages["layout.html"]; ok {
+		t.Error("The layout is not a page")
+	}
+}
+
+func TestAssetsOverride(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, d := range []string{"templates/partials", "static"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("Unable to create %s: %v", d, err)
+		}
+	}
+	files := map[string]string{
+		"templates/login.html":          `{{ define "title" }}ACME login{{ end }}{{ define "content" }}{{ template "brand" }}{{ end }}`,
+		"templates/partials/brand.html": `{{ define "brand" }}<img src="/static/logo.svg">{{ end }}`,
+		"static/logo.svg":               "<svg></svg>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+	}
+
+	ps, err := loadPages(assetsFS(dir))
+	if err != nil {
+		t.Fatalf("Unable to load templates: %v", err)
+	}
+	oldPages := pages
+	defer func() { pages = oldPages }()
+	pages = ps
+
+	// The overridden page uses the embedded layout and the new partial
+	w := httptest.NewRecorder()
+	render(w, http.StatusOK, "login.html", loginPage{})
+	body := w.Body.String()
+	for _, expected := range []string{"<title>DMARC ACME login</title>", `<img src="/static/logo.svg">`, "/static/style.css"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in %s", expected, body)
+		}
+	}
+	if _, ok := ps.pages["reports.html"]; !ok {
+		t.Error("Expected the embedded pages to be kept")
+	}
+
+	// Static files are served from both
+	for name, expected := range map[string]string{"logo.svg": "<svg></svg>", "style.css": "body"} {
+		w = httptest.NewRecorder()
+		http.StripPrefix("/static/", ps.static).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/"+name, nil))
+		b, _ := io.ReadAll(w.Body)
+		if w.Code != http.StatusOK || !strings.Contains(string(b), expected) {
+			t.Errorf("Expected %s to be served but got %d", name, w.Code)
+		}
+	}
+
+	// A broken template is found at startup
+	if err = os.WriteFile(filepath.Join(dir, "templates/login.html"), []byte(`{{ define "content" }}{{ end`), 0644); err != nil {
+		t.Fatalf("Unable to write login.html: %v", err)
+	}
+	if _, err = loadPages(assetsFS(dir)); err == nil {
+		t.Error("A broken template should fail")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// sessionCookie holds the session of a logged in user
+	sessionCookie = "godmarcparser_session"
+	// oidcCookie holds the state, nonce and page to return to during an
+	// OpenID Connect login
+	oidcCookie = "godmarcparser_oidc"
+	// loginCookie ties the password form to the browser it was shown in
+	// before there is a session
+	loginCookie = "godmarcparser_login"
+)
+
+// auth authenticates the users of the web interface. It is nil when
+// authentication is disabled
+var auth *authenticator
+
+// passwordChecker verifies the password of a user
+type passwordChecker interface {
+	checkPassword(ctx context.Context, user, password string) (bool, error)
+}
+
+// localUsers checks the passwords of the users in the storage
+type localUsers struct {
+	store storage.UserStore
+}
+
+func (l localUsers) checkPassword(ctx context.Context, user, password string) (bool, error) {
+	u, err := l.store.ReadUser(ctx, user)
+	if storage.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil, nil
+}
+
+// session is a user logged in on the hosts of a tenant
+type session struct {
+	user    string
+	tenant  string
+	expires time.Time
+}
+
+// sessionStore keeps the sessions in memory so they are lost on restart
+type sessionStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// randomToken returns n random bytes encoded for use in a cookie
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create starts a session for the user on the tenant and returns its token
+func (ss *sessionStore) create(user, tenant string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	if ss.sessions == nil {
+		ss.sessions = make(map[string]session)
+	}
+	for t, sess := range ss.sessions {
+		if now.After(sess.expires) {
+			delete(ss.sessions, t)
+		}
+	}
+	ss.sessions[token] = session{user: user, tenant: tenant, expires: now.Add(ss.ttl)}
+	return token, nil
+}
+
+// get returns the user of an unexpired session on the tenant
+func (ss *sessionStore) get(token, tenant string) (string, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.sessions[token]
+	if !ok || sess.tenant != tenant || time.Now().After(sess.expires) {
+		return "", false
+	}
+	return sess.user, true
+}
+
+// delete ends a session
+func (ss *sessionStore) delete(token string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	delete(ss.sessions, token)
+}
+
+// deleteUser ends all sessions of a user
+func (ss *sessionStore) deleteUser(user string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for t, sess := range ss.sessions {
+		if strings.EqualFold(sess.user, user) {
+			delete(ss.sessions, t)
+		}
+	}
+}
+
+// authenticator logs users in with a password or OpenID Connect and keeps
+// track of their sessions
+type authenticator struct {
+	password passwordChecker
+	oidc     *oidcProvider
+	sessions *sessionStore
+	secure   bool
+	// csrfKey signs the form tokens
+	csrfKey []byte
+
+	// groups are the domains of the groups grants can be given on and
+	// defaultRole the role of users without grants
+	groups      map[string][]string
+	defaultRole role
+
+	// clientUser is the field of verified client certificates users are
+	// taken from, cn or email. Empty ignores client certificates
+	clientUser string
+}
+
+// newAuthenticator returns the authenticator of the configuration or nil if
+// authentication is disabled
+func newAuthenticator(ctx context.Context, c cfg.AuthCfg) (*authenticator, error) {
+
+	a := &authenticator{
+		sessions: &sessionStore{ttl: time.Duration(c.SessionTTL) * time.Second},
+		secure:   c.SecureCookie,
+		groups:   c.Groups,
+		csrfKey:  make([]byte, 32),
+	}
+	if _, err := rand.Read(a.csrfKey); err != nil {
+		return nil, fmt.Errorf("Unable to read random bytes: %v", err)
+	}
+	if c.DefaultRole != "" {
+		r, err := parseRole(c.DefaultRole)
+		if err != nil {
+			return nil, err
+		}
+		a.defaultRole = r
+	}
+
+	switch c.Type {
+	case "", "none":
+		return nil, nil
+	case "htpasswd":
+		h, err := loadHtpasswd(c.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.password = h
+	case "local":
+		us, ok := s.(storage.UserStore)
+		if !ok {
+			return nil, fmt.Errorf("The storage driver does not support local users")
+		}
+		a.password = localUsers{store: us}
+	case "oidc":
+		p, err := newOIDCProvider(ctx, c.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		a.oidc = p
+	case "certificate":
+		// The users are taken from the client certificates
+		a.clientUser = "cn"
+	default:
+		return nil, fmt.Errorf("Unknown auth type %s", c.Type)
+	}
+	return a, nil
+}
+
+// user returns the user of the client certificate or the session of the
+// request. It returns false if authentication is enabled and the request has
+// neither or the session belongs to another tenant
+func (a *authenticator) user(r *http.Request) (string, bool) {
+	if a == nil {
+		return "", true
+	}
+	if user, ok := a.certUser(r); ok {
+		return user, true
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	tenant, _ := tenants.forRequest(r)
+	return a.sessions.get(c.Value, tenant)
+}
+
+// setCookie sets a cookie only readable by the server. A negative maxAge
+// deletes it
+func (a *authenticator) setCookie(w http.ResponseWriter, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// login starts a session for the user and redirects to next
+func (a *authenticator) login(w http.ResponseWriter, r *http.Request, user, next string) {
+	tenant, _ := tenants.forRequest(r)
+	token, err := a.sessions.create(user, tenant)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to create session: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("User %s logged in from %s", user, r.RemoteAddr)
+
+	a.setCookie(w, sessionCookie, token, "/", int(a.sessions.ttl/time.Second))
+	http.Redirect(w, r, safeNext(next), http.StatusSeeOther)
+}
+
+// userKey is the context key of the logged in user
+type userKey struct{}
+
+// withUser returns a context with the logged in user
+func withUser(ctx context.Context, user string) context.Context {
+	if user == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userFromContext returns the logged in user or an empty string if
+// authentication is disabled
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// safeNext returns the page to return to after login if it is on this site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginURL returns the login page returning to the requested page
+func loginURL(r *http.Request) string {
+	return "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+}
+
+// loginPage is the data for the login template
+type loginPage struct {
+	Next        string
+	Error       string
+	Password    bool
+	OIDC        bool
+	Certificate bool
+	CSRF        string
+}
+
+// loginToken returns the form token of the login cookie and sets the cookie
+// if the request has none
+func loginToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(loginCookie); err == nil && c.Value != "" {
+		return auth.signCSRF("login:" + c.Value), nil
+	}
+	value, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	auth.setCookie(w, loginCookie, value, "/login", 3600)
+	return auth.signCSRF("login:" + value), nil
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "form is not valid", http.StatusBadRequest)
+		return
+	}
+
+	data := loginPage{Next: safeNext(r.Form.Get("next")), Password: auth.password != nil, OIDC: auth.oidc != nil, Certificate: auth.clientUser != ""}
+	status := http.StatusOK
+
+	if r.Method == http.MethodPost && auth.password != nil {
+		// The token must come from the cookie the browser already had, so
+		// other sites cannot log it in as someone else
+		c, err := r.Cookie(loginCookie)
+		if err != nil || c.Value == "" ||
+			subtle.ConstantTimeCompare([]byte(auth.signCSRF("login:"+c.Value)), []byte(r.PostForm.Get("csrf"))) != 1 {
+			http.Error(w, "form is not valid", http.StatusBadRequest)
+			return
+		}
+
+		user := strings.TrimSpace(r.PostForm.Get("user"))
+		ok, err := auth.password.checkPassword(r.Context(), user, r.PostForm.Get("password"))
+		if err != nil {
+			errors <- fmt.Errorf("Unable to check password of %s: %v", user, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			auth.setCookie(w, loginCookie, "", "/login", -1)
+			auth.login(w, r, user, data.Next)
+			return
+		}
+		log.Warnf("Failed login for %s from %s", user, r.RemoteAddr)
+		data.Error = "Invalid user or password"
+		status = http.StatusUnauthorized
+	}
+
+	if auth.password != nil {
+		token, err := loginToken(w, r)
+		if err != nil {
+			errors <- err
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data.CSRF = token
+	}
+	render(w, status, "login.html", data)
+}
+
+// logoutPage is the data for the logout template
+type logoutPage struct {
+	CSRF string
+}
+
+// handleLogout ends the session on a POST with the form token of the
+// session. A GET asks for confirmation so other sites cannot log users out
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		token := csrfToken(r)
+		if token == "" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		render(w, http.StatusOK, "logout.html", logoutPage{CSRF: token})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || !validCSRF(r) {
+		http.Error(w, "form is not valid", http.StatusBadRequest)
+		return
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		auth.sessions.delete(c.Value)
+	}
+	auth.setCookie(w, sessionCookie, "", "/", -1)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil || auth.oidc == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	state, err := randomToken(16)
+	var nonce string
+	if err == nil {
+		nonce, err = randomToken(16)
+	}
+	if err != nil {
+		errors <- err
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	next := base64.RawURLEncoding.EncodeToString([]byte(safeNext(r.URL.Query().Get("next"))))
+	auth.setCookie(w, oidcCookie, state+"."+nonce+"."+next, "/auth", 600)
+	http.Redirect(w, r, auth.oidc.authCodeURL(state, nonce), http.StatusFound)
+}
+
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+
+	if auth == nil || auth.oidc == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	v := r.URL.Query()
+	if e := v.Get("error"); e != "" {
+		log.Warnf("OpenID Connect login failed: %s %s", e, v.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "Login has expired", http.StatusBadRequest)
+		return
+	}
+	auth.setCookie(w, oidcCookie, "", "/auth", -1)
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || v.Get("state") != parts[0] {
+		http.Error(w, "state is not valid", http.StatusBadRequest)
+		return
+	}
+	next, _ := base64.RawURLEncoding.DecodeString(parts[2])
+
+	user, err := auth.oidc.exchange(r.Context(), v.Get("code"), parts[1])
+	if err != nil {
+		log.Warnf("OpenID Connect login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	auth.login(w, r, user, string(next))
+}
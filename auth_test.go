@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Unable to hash password: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\nalice:" + string(hash) + "\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\ncarol:$apr1$abc$def\n"
+	if err = os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write htpasswd: %v", err)
+	}
+
+	h, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("Unable to load htpasswd: %v", err)
+	}
+
+	tt := []struct {
+		user, password string
+		expected       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "password", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"dave", "secret", false},
+	}
+	for _, tc := range tt {
+		ok, err := h.checkPassword(context.Background(), tc.user, tc.password)
+		if err != nil {
+			t.Fatalf("Unable to check password: %v", err)
+		}
+		if ok != tc.expected {
+			t.Errorf("Expected %v for %s with %s but got %v", tc.expected, tc.user, tc.password, ok)
+		}
+	}
+
+	// The file is read again when it changes
+	if err = os.WriteFile(path, []byte("dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatalf("Unable to write htpasswd: %v", err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Unable to touch htpasswd: %v", err)
+	}
+	if ok, _ := h.checkPassword(context.Background(), "dave", "password"); !ok {
+		t.Error("Expected dave to be added")
+	}
+	if ok, _ := h.checkPassword(context.Background(), "alice", "secret"); ok {
+		t.Error("Expected alice to be removed")
+	}
+
+	if _, err = loadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("A missing htpasswd file should fail")
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, expected := range map[string]string{
+		"/reports?page=2":    "/reports?page=2",
+		"":                   "/",
+		"//evil.com/":        "/",
+		"/\\evil.com":        "/",
+		"https://evil.com/x": "/",
+	} {
+		if got := safeNext(next); got != expected {
+			t.Errorf("Expected %q for %q but got %q", expected, next, got)
+		}
+	}
+}
+
+func TestLocalLogin(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Unable to hash password: %v", err)
+	}
+	if err = s.(storage.UserStore).WriteUser(ctx, storage.User{Name: "alice", PasswordHash: string(hash)}); err != nil {
+		t.Fatalf("Unable to write user: %v", err)
+	}
+	if err = s.(storage.GrantStore).WriteGrant(ctx, storage.Grant{User: "alice", Role: "viewer", Scope: "*"}); err != nil {
+		t.Fatalf("Unable to write grant: %v", err)
+	}
+
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "local", SessionTTL: 3600}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	h := httpHandler(ctx)
+	var cookie, login *http.Cookie
+
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, path, nil)
+		}
+		for _, c := range []*http.Cookie{cookie, login} {
+			if c != nil {
+				req.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, contains string) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("Expected status %d but got %d", status, w.Code)
+		}
+		if !strings.Contains(w.Body.String()+w.Header().Get("Location"), contains) {
+			t.Errorf("Expected response to contain %q:\n%s", contains, w.Body.String())
+		}
+	}
+
+	expect(do(http.MethodGet, "/reports?page=1", nil), http.StatusSeeOther, "/login?next=%2Freports%3Fpage%3D1")
+	expect(do(http.MethodGet, "/api/v1/reports", nil), http.StatusUnauthorized, "Authentication required")
+	expect(do(http.MethodGet, "/static/style.css", nil), http.StatusOK, "blueTable")
+	// The login form only works in the browser that got the login cookie
+	w := do(http.MethodGet, "/login?next=/reports", nil)
+	expect(w, http.StatusOK, `name="password"`)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loginCookie {
+			login = c
+		}
+	}
+	if login == nil {
+		t.Fatal("Expected a login cookie")
+	}
+	loginCSRF := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(w.Body.String())
+	if loginCSRF == nil {
+		t.Fatalf("Expected a form token on the login page:\n%s", w.Body.String())
+	}
+
+	expect(do(http.MethodPost, "/login", url.Values{"user": {"alice"}, "password": {"secret"}}), http.StatusBadRequest, "form is not valid")
+	expect(do(http.MethodPost, "/login", url.Values{"csrf": {loginCSRF[1]}, "user": {"alice"}, "password": {"wrong"}}), http.StatusUnauthorized, "Invalid user or password")
+	expect(do(http.MethodPost, "/login", url.Values{"csrf": {loginCSRF[1]}, "user": {"mallory"}, "password": {"secret"}}), http.StatusUnauthorized, "Invalid user or password")
+
+	stolen := login
+	login = &http.Cookie{Name: loginCookie, Value: "other"}
+	expect(do(http.MethodPost, "/login", url.Values{"csrf": {loginCSRF[1]}, "user": {"alice"}, "password": {"secret"}}), http.StatusBadRequest, "form is not valid")
+	login = stolen
+
+	w = do(http.MethodPost, "/login", url.Values{"csrf": {loginCSRF[1]}, "user": {"alice"}, "password": {"secret"}, "next": {"/reports"}})
+	expect(w, http.StatusSeeOther, "/reports")
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("Expected an HTTP only session cookie but got %v", w.Result().Cookies())
+	}
+
+	expect(do(http.MethodGet, "/reports", nil), http.StatusOK, `<a href="/logout">Log out</a>`)
+	expect(do(http.MethodGet, "/api/v1/reports", nil), http.StatusOK, "myid123")
+
+	// Logging out needs a POST with the form token of the session
+	expect(do(http.MethodGet, "/logout", nil), http.StatusOK, `<form class="login" method="post" action="/logout">`)
+	expect(do(http.MethodGet, "/reports", nil), http.StatusOK, "Reports")
+	expect(do(http.MethodPost, "/logout", url.Values{}), http.StatusBadRequest, "form is not valid")
+	expect(do(http.MethodPost, "/logout", url.Values{"csrf": {"0123"}}), http.StatusBadRequest, "form is not valid")
+	expect(do(http.MethodGet, "/reports", nil), http.StatusOK, "Reports")
+
+	csrf := csrfToken(&http.Request{Header: http.Header{"Cookie": {cookie.String()}}})
+	expect(do(http.MethodPost, "/logout", url.Values{"csrf": {csrf}}), http.StatusSeeOther, "/login")
+	expect(do(http.MethodGet, "/reports", nil), http.StatusSeeOther, "/login")
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ss := &sessionStore{ttl: -time.Second}
+	token, err := ss.create("alice", "")
+	if err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+	if _, ok := ss.get(token, ""); ok {
+		t.Error("Expected an expired session to be rejected")
+	}
+	if _, err = ss.create("bob", ""); err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+	if len(ss.sessions) != 1 {
+		t.Errorf("Expected the expired session to be removed but got %d sessions", len(ss.sessions))
+	}
+}
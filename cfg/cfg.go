@@ -5,22 +5,61 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// HTTPCfg hold the http configuration
+// TLSCfg hold the certificate of the web server, which is read again when
+// the files change. ClientAuth is none, optional or require and client
+// certificates are verified against ClientCA. A verified certificate logs in
+// as the user in its ClientUser field, cn or email, when that is set. Plain
+// HTTP requests to RedirectPort are redirected to HTTPS
+type TLSCfg struct {
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+	MinVersion   string `json:"minVersion"`
+	ClientCA     string `json:"clientCA"`
+	ClientAuth   string `json:"clientAuth"`
+	ClientUser   string `json:"clientUser"`
+	RedirectPort string `json:"redirectPort"`
+}
+
+// HTTPCfg hold the http configuration. HTTPS is served when TLS has a
+// certificate. Files in the templates and static directories of Assets
+// replace the built in ones. The metrics are also served without
+// authentication on MetricsPort if set
 type HTTPCfg struct {
 	Port         string `json:"port"`
 	WriteTimeout int    `json:"writeTimeout"`
 	ReadTimeout  int    `json:"readTimeout"`
 	IdleTimeout  int    `json:"idleTimeout"`
+	TLS          TLSCfg `json:"tls"`
+	Assets       string `json:"assets"`
+	MetricsPort  string `json:"metricsPort"`
+}
+
+// DedupeCfg hold the action taken on a report that is already stored: skip,
+// replace or revision. Identical is used when the content is the same and
+// Changed when the reporter has sent a corrected report
+type DedupeCfg struct {
+	Identical string `json:"identical"`
+	Changed   string `json:"changed"`
 }
 
-// StorageCfg hold the storage configuration
+// StorageCfg hold the storage configuration. The connection lifetimes are in
+// seconds and zero keeps the defaults. Writes failing with a transient error
+// are retried and then spooled to the Spool directory if set
 type StorageCfg struct {
-	Type string `json:"type"`
-	URL  string `json:"url"`
+	Type            string    `json:"type"`
+	URL             string    `json:"url"`
+	MaxOpenConns    int       `json:"maxOpenConns"`
+	MaxIdleConns    int       `json:"maxIdleConns"`
+	ConnMaxLifetime int       `json:"connMaxLifetime"`
+	ConnMaxIdleTime int       `json:"connMaxIdleTime"`
+	Retries         int       `json:"retries"`
+	Spool           string    `json:"spool"`
+	Dedupe          DedupeCfg `json:"dedupe"`
 }
 
 // LogCfg hold the log configuration
@@ -34,15 +73,63 @@ type ScanDirectory struct {
 	Interval int    `json:"interval"`
 }
 
+// RetentionCfg hold the retention configuration. Row level details are kept
+// for Days and the daily statistics for Months. Zero means forever
+type RetentionCfg struct {
+	Days     int `json:"days"`
+	Months   int `json:"months"`
+	Interval int `json:"interval"`
+}
+
+// TenantCfg hold a tenant owning a set of policy domains. Reports are routed
+// to the tenant by policy domain or else by the mailbox directory they are
+// found in. The web interface is scoped to the tenant on its hosts
+type TenantCfg struct {
+	Name      string   `json:"name"`
+	Domains   []string `json:"domains"`
+	Mailboxes []string `json:"mailboxes"`
+	Hosts     []string `json:"hosts"`
+}
+
+// OIDCCfg hold an OpenID Connect provider. The user is identified by the
+// UserClaim of the ID token which defaults to email
+type OIDCCfg struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectURL"`
+	Scopes       []string `json:"scopes"`
+	UserClaim    string   `json:"userClaim"`
+}
+
+// AuthCfg hold the authentication of the web interface. Type is none,
+// htpasswd, local, oidc or certificate. Sessions expire after SessionTTL
+// seconds and the cookie is only sent over HTTPS if SecureCookie is set.
+// Groups name lists of policy domains that roles can be granted on and users
+// without any grants get DefaultRole on all domains, which is none unless
+// set
+type AuthCfg struct {
+	Type         string              `json:"type"`
+	Htpasswd     string              `json:"htpasswd"`
+	OIDC         OIDCCfg             `json:"oidc"`
+	SessionTTL   int                 `json:"sessionTTL"`
+	SecureCookie bool                `json:"secureCookie"`
+	Groups       map[string][]string `json:"groups"`
+	DefaultRole  string              `json:"defaultRole"`
+}
+
 // Config hold the configuration for dmarc
 type Config struct {
 	HTTP      HTTPCfg       `json:"http"`
 	Storage   StorageCfg    `json:"storage"`
 	Log       LogCfg        `json:"log"`
 	Directory ScanDirectory `json:"directory"`
+	Retention RetentionCfg  `json:"retention"`
+	Tenants   []TenantCfg   `json:"tenants"`
+	Auth      AuthCfg       `json:"auth"`
 }
 
-func (c *Config) sanitize() {
+func (c *Config) sanitize() error {
 
 	// HTTP
 	if c.HTTP.Port == "" {
@@ -57,11 +144,138 @@ func (c *Config) sanitize() {
 	if c.HTTP.IdleTimeout < 30 {
 		c.HTTP.IdleTimeout = 30
 	}
+	c.HTTP.TLS.MinVersion = strings.TrimSpace(c.HTTP.TLS.MinVersion)
+	switch c.HTTP.TLS.MinVersion {
+	case "1.2", "1.3":
+	case "":
+		c.HTTP.TLS.MinVersion = "1.2"
+	default:
+		log.Warnf("Unsupported minimum TLS version %s, using 1.2", c.HTTP.TLS.MinVersion)
+		c.HTTP.TLS.MinVersion = "1.2"
+	}
+	c.HTTP.TLS.ClientAuth = strings.ToLower(strings.TrimSpace(c.HTTP.TLS.ClientAuth))
+	switch c.HTTP.TLS.ClientAuth {
+	case "none", "optional", "require":
+	case "":
+		c.HTTP.TLS.ClientAuth = "none"
+	default:
+		log.Warnf("Unknown client auth %s, using require", c.HTTP.TLS.ClientAuth)
+		c.HTTP.TLS.ClientAuth = "require"
+	}
+	c.HTTP.TLS.ClientUser = strings.ToLower(strings.TrimSpace(c.HTTP.TLS.ClientUser))
+	switch c.HTTP.TLS.ClientUser {
+	case "", "cn", "email":
+	default:
+		log.Warnf("Unknown client user field %s, using cn", c.HTTP.TLS.ClientUser)
+		c.HTTP.TLS.ClientUser = "cn"
+	}
+
+	// Storage
+	for _, v := range []*int{&c.Storage.MaxOpenConns, &c.Storage.MaxIdleConns, &c.Storage.ConnMaxLifetime, &c.Storage.ConnMaxIdleTime} {
+		if *v < 0 {
+			*v = 0
+		}
+	}
+	if c.Storage.Retries < 1 {
+		c.Storage.Retries = 3
+	}
+	c.Storage.Dedupe.Identical = dedupeAction(c.Storage.Dedupe.Identical, "skip")
+	c.Storage.Dedupe.Changed = dedupeAction(c.Storage.Dedupe.Changed, "replace")
 
 	// Directory
 	if c.Directory.Interval < 30 {
 		c.Directory.Interval = 30
 	}
+
+	// Retention
+	if c.Retention.Days < 0 {
+		c.Retention.Days = 0
+	}
+	if c.Retention.Months < 0 {
+		c.Retention.Months = 0
+	}
+	if c.Retention.Interval < 3600 {
+		c.Retention.Interval = 3600
+	}
+
+	// Tenants
+	var tenants []TenantCfg
+	for _, t := range c.Tenants {
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" {
+			log.Warn("Ignoring tenant without a name")
+			continue
+		}
+		for i := range t.Domains {
+			t.Domains[i] = strings.ToLower(strings.TrimSpace(t.Domains[i]))
+		}
+		for i := range t.Hosts {
+			t.Hosts[i] = strings.ToLower(strings.TrimSpace(t.Hosts[i]))
+		}
+		tenants = append(tenants, t)
+	}
+	c.Tenants = tenants
+
+	// Auth
+	c.Auth.Type = strings.ToLower(strings.TrimSpace(c.Auth.Type))
+	switch c.Auth.Type {
+	case "none", "htpasswd", "local", "oidc", "certificate":
+	case "":
+		c.Auth.Type = "none"
+	default:
+		return fmt.Errorf("Unknown auth type %s", c.Auth.Type)
+	}
+	if c.Auth.Type == "certificate" && c.HTTP.TLS.ClientUser == "" {
+		c.HTTP.TLS.ClientUser = "cn"
+	}
+	if c.Auth.SessionTTL < 300 {
+		c.Auth.SessionTTL = 28800
+	}
+	if c.Auth.Type == "oidc" {
+		c.Auth.OIDC.Issuer = strings.TrimSuffix(c.Auth.OIDC.Issuer, "/")
+		if len(c.Auth.OIDC.Scopes) == 0 {
+			c.Auth.OIDC.Scopes = []string{"openid", "email", "profile"}
+		}
+		if c.Auth.OIDC.UserClaim == "" {
+			c.Auth.OIDC.UserClaim = "email"
+		}
+	}
+	c.Auth.DefaultRole = strings.ToLower(strings.TrimSpace(c.Auth.DefaultRole))
+	switch c.Auth.DefaultRole {
+	case "none", "viewer", "analyst", "admin":
+	case "":
+		c.Auth.DefaultRole = "none"
+	default:
+		log.Warnf("Unknown default role %s, using none", c.Auth.DefaultRole)
+		c.Auth.DefaultRole = "none"
+	}
+	if c.Auth.DefaultRole != "none" && (c.Auth.Type == "oidc" || c.Auth.Type == "certificate") {
+		log.Warnf("Every user the identity provider accepts gets %s on all domains until they are granted a role", c.Auth.DefaultRole)
+	}
+	if len(c.Auth.Groups) > 0 {
+		groups := make(map[string][]string, len(c.Auth.Groups))
+		for name, domains := range c.Auth.Groups {
+			name = strings.ToLower(strings.TrimSpace(name))
+			for _, d := range domains {
+				groups[name] = append(groups[name], strings.ToLower(strings.TrimSpace(d)))
+			}
+		}
+		c.Auth.Groups = groups
+	}
+	return nil
+}
+
+// dedupeAction returns the action or the default if it is not valid
+func dedupeAction(action, def string) string {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case "skip", "replace", "revision":
+		return action
+	case "":
+	default:
+		log.Warnf("Unknown dedupe action %s, using %s", action, def)
+	}
+	return def
 }
 
 // ReadConfig reads a config file and returns the Config
@@ -89,7 +303,9 @@ func ReadConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("Unable parse json: %v", err)
 	}
 
-	cfg.sanitize()
+	if err = cfg.sanitize(); err != nil {
+		return Config{}, err
+	}
 
 	return cfg, nil
 }
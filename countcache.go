@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// countCache keeps the number of reports per filter for a while, since
+// counting gets expensive on large tables
+type countCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]countEntry
+}
+
+type countEntry struct {
+	count   int
+	expires time.Time
+}
+
+// get returns the cached count for key or calls count to get it
+func (c *countCache) get(key string, count func() (int, error)) (int, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.count, nil
+	}
+
+	n, err := count()
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]countEntry)
+	}
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = countEntry{count: n, expires: now.Add(c.ttl)}
+
+	return n, nil
+}
+
+// countKey returns the cache key of a filter within the tenant and domains of
+// the context so users never see counts of data they cannot see
+func countKey(ctx context.Context, query string) string {
+	key := storage.TenantFromContext(ctx) + "?" + query
+	if domains, ok := storage.DomainsFromContext(ctx); ok {
+		key += "#" + strings.Join(domains, ",")
+	}
+	return key
+}
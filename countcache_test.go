@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountCache(t *testing.T) {
+	c := &countCache{ttl: time.Hour}
+
+	calls := 0
+	count := func() (int, error) {
+		calls++
+		return 42, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		n, err := c.get("domain=greyhat.dk&", count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 42 {
+			t.Fatalf("Expected 42 got %d", n)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected count to be called once, got %d", calls)
+	}
+
+	if _, err := c.get("", count); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected a new key to be counted, got %d calls", calls)
+	}
+
+	c.ttl = -time.Second
+	c.entries = nil
+	c.get("", count)
+	c.get("", count)
+	if calls != 4 {
+		t.Fatalf("Expected expired entries to be counted again, got %d calls", calls)
+	}
+}
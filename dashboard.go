@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// dashboardWindow is a selectable time window of the dashboard. Zero days is
+// everything in the statistics
+type dashboardWindow struct {
+	Name string
+	Days int
+}
+
+var dashboardWindows = []dashboardWindow{
+	{"7d", 7},
+	{"30d", 30},
+	{"90d", 90},
+	{"365d", 365},
+	{"all", 0},
+}
+
+// dashboardTop is the number of source IPs and reporters shown
+const dashboardTop = 10
+
+// Size of the volume chart in pixels
+const (
+	chartWidth  = 800
+	chartHeight = 200
+	chartLeft   = 60
+	chartBottom = 20
+	chartLabels = 8
+)
+
+// dashboardBucket is the messages of a period in the volume chart
+type dashboardBucket struct {
+	Start      time.Time
+	Pass, Fail int64
+}
+
+// dashboardShare is the messages of a disposition, source IP or reporter and
+// its percentage of the messages in the window
+type dashboardShare struct {
+	Name     string
+	Messages int64
+	Percent  float64
+}
+
+// dashboardDomain is the DMARC pass rate of a policy domain or another key
+// of the statistics
+type dashboardDomain struct {
+	Domain         string
+	Messages, Pass int64
+	Rate           float64
+}
+
+type svgRect struct {
+	X, Y, Width, Height float64
+	Class, Title        string
+}
+
+type svgText struct {
+	X, Y   float64
+	Anchor string
+	Text   string
+}
+
+// svgChart is a chart rendered as SVG by the template
+type svgChart struct {
+	Width, Height float64
+	Rects         []svgRect
+	Texts         []svgText
+}
+
+// dashboardPage is the data for the dashboard template
+type dashboardPage struct {
+	Window  string
+	Windows []dashboardWindow
+	From    time.Time
+	To      time.Time
+
+	Messages int64
+	Pass     int64
+	Rate     float64
+
+	Volume       svgChart
+	Domains      []dashboardDomain
+	Dispositions []dashboardShare
+	FailingIPs   []dashboardShare
+	Reporters    []dashboardShare
+}
+
+// passed returns true if the messages passed DMARC, which needs either DKIM
+// or SPF to pass and align
+func passed(st storage.DailyStat) bool {
+	return st.DKIMAlign == "pass" || st.SPFAlign == "pass"
+}
+
+// percent returns n of total in percent
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// bucketStart returns the start of the period of the volume chart holding
+// day. Long windows are summed per week or month so the bars stay readable
+func bucketStart(from, day time.Time, days int) time.Time {
+	switch {
+	case days > 731:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case days > 92:
+		return from.AddDate(0, 0, int(day.Sub(from).Hours()/24)/7*7)
+	}
+	return day
+}
+
+// nextBucket returns the start of the period after start
+func nextBucket(start time.Time, days int) time.Time {
+	switch {
+	case days > 731:
+		return start.AddDate(0, 1, 0)
+	case days > 92:
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// volumeBuckets sums the daily statistics into the periods from from to to
+func volumeBuckets(stats []storage.DailyStat, from, to time.Time) []dashboardBucket {
+
+	days := int(to.Sub(from).Hours() / 24)
+
+	var buckets []dashboardBucket
+	index := make(map[time.Time]int)
+	for start := bucketStart(from, from, days); start.Before(to); start = nextBucket(start, days) {
+		index[start] = len(buckets)
+		buckets = append(buckets, dashboardBucket{Start: start})
+	}
+
+	for _, st := range stats {
+		i, ok := index[bucketStart(from, st.Day, days)]
+		if !ok {
+			continue
+		}
+		if passed(st) {
+			buckets[i].Pass += st.Messages
+		} else {
+			buckets[i].Fail += st.Messages
+		}
+	}
+	return buckets
+}
+
+// volumeChart draws the buckets as stacked bars of passed and failed messages
+func volumeChart(buckets []dashboardBucket) svgChart {
+
+	c := svgChart{Width: chartWidth, Height: chartHeight}
+
+	var max int64
+	for _, b := range buckets {
+		if b.Pass+b.Fail > max {
+			max = b.Pass + b.Fail
+		}
+	}
+
+	plotWidth := float64(chartWidth - chartLeft)
+	plotHeight := float64(chartHeight - chartBottom)
+
+	c.Texts = append(c.Texts,
+		svgText{X: chartLeft - 5, Y: 12, Anchor: "end", Text: fmt.Sprint(max)},
+		svgText{X: chartLeft - 5, Y: plotHeight, Anchor: "end", Text: "0"},
+	)
+	c.Rects = append(c.Rects, svgRect{X: chartLeft, Y: plotHeight, Width: plotWidth, Height: 1, Class: "axis"})
+
+	if len(buckets) == 0 {
+		return c
+	}
+
+	width := plotWidth / float64(len(buckets))
+	every := (len(buckets) + chartLabels - 1) / chartLabels
+
+	for i, b := range buckets {
+		x := chartLeft + float64(i)*width
+		title := fmt.Sprintf("%s: %d passed, %d failed", b.Start.Format("2006-01-02"), b.Pass, b.Fail)
+
+		if max > 0 {
+			pass := float64(b.Pass) / float64(max) * plotHeight
+			fail := float64(b.Fail) / float64(max) * plotHeight
+			if b.Pass > 0 {
+				c.Rects = append(c.Rects, svgRect{X: x, Y: plotHeight - pass, Width: width * 0.9, Height: pass, Class: "pass", Title: title})
+			}
+			if b.Fail > 0 {
+				c.Rects = append(c.Rects, svgRect{X: x, Y: plotHeight - pass - fail, Width: width * 0.9, Height: fail, Class: "fail", Title: title})
+			}
+		}
+
+		if i%every == 0 {
+			c.Texts = append(c.Texts, svgText{X: x, Y: chartHeight - 5, Anchor: "start", Text: b.Start.Format("2006-01-02")})
+		}
+	}
+	return c
+}
+
+// shares returns the messages per name sorted by the most messages
+func shares(stats []storage.DailyStat, name func(storage.DailyStat) string, total int64) []dashboardShare {
+	var list []dashboardShare
+	for _, st := range stats {
+		list = append(list, dashboardShare{Name: name(st), Messages: st.Messages, Percent: percent(st.Messages, total)})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Messages > list[j].Messages })
+	return list
+}
+
+// rates returns the pass rate per key of statistics grouped by the key and
+// alignment, sorted by the most messages
+func rates(stats []storage.DailyStat, key func(storage.DailyStat) string) []dashboardDomain {
+	var list []dashboardDomain
+	index := make(map[string]int)
+	for _, st := range stats {
+		i, ok := index[key(st)]
+		if !ok {
+			i = len(list)
+			index[key(st)] = i
+			list = append(list, dashboardDomain{Domain: key(st)})
+		}
+		list[i].Messages += st.Messages
+		if passed(st) {
+			list[i].Pass += st.Messages
+		}
+	}
+	for i := range list {
+		list[i].Rate = percent(list[i].Pass, list[i].Messages)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Messages > list[j].Messages })
+	return list
+}
+
+// tomorrow returns the end of today in UTC like the days of the statistics,
+// which is used as To since it is not included
+func tomorrow() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+}
+
+// firstDay returns the first day of the statistics or the day before to if
+// there are none
+func firstDay(stats []storage.DailyStat, to time.Time) time.Time {
+	first := to.AddDate(0, 0, -1)
+	for _, st := range stats {
+		if st.Day.Before(first) {
+			first = st.Day
+		}
+	}
+	return first
+}
+
+func handleDashboard(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	sr, ok := s.(storage.StatsReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support statistics", http.StatusNotImplemented)
+		return
+	}
+
+	data := dashboardPage{Window: r.URL.Query().Get("window"), Windows: dashboardWindows}
+	if data.Window == "" {
+		data.Window = "30d"
+	}
+
+	days := -1
+	for _, dw := range dashboardWindows {
+		if dw.Name == data.Window {
+			days = dw.Days
+		}
+	}
+	if days < 0 {
+		http.Error(w, "window is not valid", http.StatusBadRequest)
+		return
+	}
+
+	data.To = tomorrow()
+	if days > 0 {
+		data.From = data.To.AddDate(0, 0, -days)
+	}
+
+	read := func(q storage.StatsQuery) ([]storage.DailyStat, error) {
+		q.From, q.To = data.From, data.To
+		return sr.ReadStats(ctx, q)
+	}
+
+	volume, err := read(storage.StatsQuery{GroupBy: []string{storage.StatDay, storage.StatDKIMAlign, storage.StatSPFAlign}})
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read statistics: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if days == 0 {
+		data.From = firstDay(volume, data.To)
+	}
+
+	for _, st := range volume {
+		data.Messages += st.Messages
+		if passed(st) {
+			data.Pass += st.Messages
+		}
+	}
+	data.Rate = percent(data.Pass, data.Messages)
+	data.Volume = volumeChart(volumeBuckets(volume, data.From, data.To))
+
+	var domains, dispositions, ips, reporters []storage.DailyStat
+	domains, err = read(storage.StatsQuery{GroupBy: []string{storage.StatDomain, storage.StatDKIMAlign, storage.StatSPFAlign}})
+	if err == nil {
+		dispositions, err = read(storage.StatsQuery{GroupBy: []string{storage.StatDisposition}})
+	}
+	if err == nil {
+		// Failing is when neither DKIM nor SPF passed and aligned
+		ips, err = read(storage.StatsQuery{GroupBy: []string{storage.StatSourceIP}, DKIMAlign: "fail", SPFAlign: "fail", Top: dashboardTop})
+	}
+	if err == nil {
+		reporters, err = read(storage.StatsQuery{GroupBy: []string{storage.StatReporter}, Top: dashboardTop})
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read statistics: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data.Domains = rates(domains, func(st storage.DailyStat) string { return st.PolicyDomain })
+
+	var failed int64
+	for _, st := range volume {
+		if st.DKIMAlign == "fail" && st.SPFAlign == "fail" {
+			failed += st.Messages
+		}
+	}
+
+	data.Dispositions = shares(dispositions, func(st storage.DailyStat) string { return st.Disposition }, data.Messages)
+	data.FailingIPs = shares(ips, func(st storage.DailyStat) string { return st.SourceIP }, failed)
+	data.Reporters = shares(reporters, func(st storage.DailyStat) string { return st.Reporter }, data.Messages)
+
+	render(w, http.StatusOK, "dashboard.html", data)
+}
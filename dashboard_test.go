@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestVolumeBuckets(t *testing.T) {
+
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	stats := []storage.DailyStat{
+		{Day: day("2018-08-12"), DKIMAlign: "pass", SPFAlign: "fail", Messages: 3},
+		{Day: day("2018-08-12"), DKIMAlign: "fail", SPFAlign: "fail", Messages: 2},
+		{Day: day("2018-08-20"), DKIMAlign: "fail", SPFAlign: "pass", Messages: 5},
+		{Day: day("2016-01-01"), DKIMAlign: "pass", SPFAlign: "pass", Messages: 7},
+	}
+
+	tt := []struct {
+		name    string
+		from    string
+		to      string
+		buckets int
+		first   dashboardBucket
+	}{
+		{"daily", "2018-08-12", "2018-08-21", 9, dashboardBucket{Start: day("2018-08-12"), Pass: 3, Fail: 2}},
+		{"weekly", "2018-05-01", "2018-08-21", 16, dashboardBucket{Start: day("2018-05-01")}},
+		{"monthly", "2016-01-01", "2018-08-21", 32, dashboardBucket{Start: day("2016-01-01"), Pass: 7}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			buckets := volumeBuckets(stats, day(tc.from), day(tc.to))
+			if len(buckets) != tc.buckets {
+				t.Fatalf("Expected %d buckets but got %d", tc.buckets, len(buckets))
+			}
+			if buckets[0] != tc.first {
+				t.Errorf("Expected first bucket %+v but got %+v", tc.first, buckets[0])
+			}
+
+			var total int64
+			for _, b := range buckets {
+				total += b.Pass + b.Fail
+			}
+			var expected int64
+			for _, st := range stats {
+				if !st.Day.Before(day(tc.from)) {
+					expected += st.Messages
+				}
+			}
+			if total != expected {
+				t.Errorf("Expected %d messages but got %d", expected, total)
+			}
+		})
+	}
+}
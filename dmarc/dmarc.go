@@ -9,6 +9,7 @@ import (
 
 var brokenschema = regexp.MustCompile(`\<xs:schema[^>]*>`)
 var matchschema = regexp.MustCompile(`\<\/xs:schema[^>]*>`)
+var orgname = regexp.MustCompile(`(?s)<org_name>\s*([^<]*?)\s*</org_name>`)
 
 // Content is the structure for processing data
 type Content struct {
@@ -56,7 +57,6 @@ type Report struct {
 	Count                  int64
 	DKIMResult             string
 	SPFResult              string
-	Items                  int
 }
 
 // Reports is the collection of reports
@@ -150,6 +150,11 @@ type Feedback struct {
 	ReportMetadata  reportMetadata  `xml:"report_metadata"`
 	PolicyPublished policyPublished `xml:"policy_published"`
 	Records         []record        `xml:"record"`
+
+	// Raw is the document the report was read from and Received when it was
+	// read. They are kept so the report can be exported and read again
+	Raw      []byte    `xml:"-"`
+	Received time.Time `xml:"-"`
 }
 
 // Read a dmarc xml report
@@ -169,3 +174,13 @@ func Read(b []byte) (Feedback, error) {
 	}
 	return f, nil
 }
+
+// OrgName finds the reporting organisation of a report that could not be
+// read. It is empty if there is no org_name
+func OrgName(b []byte) string {
+	m := orgname.FindSubmatch(b)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
@@ -56,3 +56,24 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestOrgName(t *testing.T) {
+
+	tt := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"truncated", "<feedback><report_metadata><org_name>\n  Example.com </org_name><email>", "Example.com"},
+		{"missing", "<feedback><report_metadata><email>", ""},
+		{"notxml", "garbage", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := OrgName([]byte(tc.data)); got != tc.expected {
+				t.Errorf("Expected %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
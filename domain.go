@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// domainSources is the number of authorised and unknown sources shown
+const domainSources = 100
+
+// domainPage is the data for the policy domain template
+type domainPage struct {
+	Domain string
+	From   time.Time
+	To     time.Time
+
+	Messages int64
+	Pass     int64
+	DKIM     int64
+	SPF      int64
+	Rate     float64
+	DKIMRate float64
+	SPFRate  float64
+
+	Volume   svgChart
+	Policies []storage.PolicyState
+
+	// Authorised sources has sent messages passing DMARC while the unknown
+	// ones never did
+	Authorised []dashboardDomain
+	Unknown    []dashboardDomain
+	// Subdomains are the subdomains of the domain seen in header from
+	Subdomains []dashboardDomain
+}
+
+func handleDomain(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	domain := strings.ToLower(mux.Vars(r)["domain"])
+	if !validDomain(domain) {
+		http.Error(w, "domain is not a valid domain name", http.StatusBadRequest)
+		return
+	}
+	if !allowed(ctx, domain, roleViewer) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	sr, ok := s.(storage.StatsReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support statistics", http.StatusNotImplemented)
+		return
+	}
+	pr, ok := s.(storage.PolicyReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support reading policies", http.StatusNotImplemented)
+		return
+	}
+
+	data := domainPage{Domain: domain, To: tomorrow()}
+
+	read := func(groupby ...string) ([]storage.DailyStat, error) {
+		return sr.ReadStats(ctx, storage.StatsQuery{PolicyDomain: domain, GroupBy: groupby})
+	}
+
+	volume, err := read(storage.StatDay, storage.StatDKIMAlign, storage.StatSPFAlign)
+	var sources, hfroms []storage.DailyStat
+	if err == nil {
+		sources, err = read(storage.StatSourceIP, storage.StatDKIMAlign, storage.StatSPFAlign)
+	}
+	if err == nil {
+		hfroms, err = read(storage.StatHeaderFrom, storage.StatDKIMAlign, storage.StatSPFAlign)
+	}
+	if err == nil {
+		data.Policies, err = pr.ReadPolicies(ctx, domain)
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read overview of %s: %v", domain, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for _, st := range volume {
+		data.Messages += st.Messages
+		if passed(st) {
+			data.Pass += st.Messages
+		}
+		if st.DKIMAlign == "pass" {
+			data.DKIM += st.Messages
+		}
+		if st.SPFAlign == "pass" {
+			data.SPF += st.Messages
+		}
+	}
+	data.Rate = percent(data.Pass, data.Messages)
+	data.DKIMRate = percent(data.DKIM, data.Messages)
+	data.SPFRate = percent(data.SPF, data.Messages)
+	data.From = firstDay(volume, data.To)
+	data.Volume = volumeChart(volumeBuckets(volume, data.From, data.To))
+
+	for _, src := range rates(sources, func(st storage.DailyStat) string { return st.SourceIP }) {
+		switch {
+		case src.Pass > 0 && len(data.Authorised) < domainSources:
+			data.Authorised = append(data.Authorised, src)
+		case src.Pass == 0 && len(data.Unknown) < domainSources:
+			data.Unknown = append(data.Unknown, src)
+		}
+	}
+
+	for _, sub := range rates(hfroms, func(st storage.DailyStat) string { return st.HeaderFrom }) {
+		if strings.HasSuffix(sub.Domain, "."+domain) {
+			data.Subdomains = append(data.Subdomains, sub)
+		}
+	}
+
+	render(w, http.StatusOK, "domain.html", data)
+}
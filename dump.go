@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/desdic/godmarcparser/archive"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// The tables of an archive
+const (
+	tableReport   = "report"
+	tableRow      = "reportrow"
+	tableStats    = "daily_stats"
+	tableReporter = "reporter_stats"
+	tableNote     = "report_note"
+	tableUser     = "users"
+	tableGrant    = "grants"
+	tableToken    = "api_tokens"
+)
+
+// exportCommand writes everything in the storage to an archive
+func exportCommand(ctx context.Context, s storage.Storage, source string, args []string) error {
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("out", "", "Archive to write, compressed by extension .zst or .gz")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("export needs -out")
+	}
+
+	a, ok := s.(storage.Archiver)
+	if !ok {
+		return fmt.Errorf("The storage driver does not support export")
+	}
+	if err := s.Initialize(ctx); err != nil {
+		return fmt.Errorf("Unable to initialize storage: %v", err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s: %v", *out, err)
+	}
+
+	err = export(ctx, a, f, *out, source)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Printf("Exported to %s\n", *out)
+	return nil
+}
+
+func export(ctx context.Context, a storage.Archiver, f *os.File, name, source string) error {
+
+	w, err := archive.Create(f, name, source)
+	if err != nil {
+		return err
+	}
+
+	err = a.ExportReports(ctx, func(r storage.ArchiveReport) error {
+		if err := w.Write(tableReport, r); err != nil {
+			return err
+		}
+		for _, rw := range r.Rows {
+			if err := w.Write(tableRow, rw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = a.ExportStats(ctx, func(st storage.ArchiveStat) error { return w.Write(tableStats, st) })
+	}
+	if err == nil {
+		err = a.ExportReporters(ctx, func(rp storage.ArchiveReporter) error { return w.Write(tableReporter, rp) })
+	}
+	if err == nil {
+		err = a.ExportNotes(ctx, func(n storage.ArchiveNote) error { return w.Write(tableNote, n) })
+	}
+	if err == nil {
+		err = exportAuth(ctx, a, w)
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportAuth writes the local users, grants and API tokens of drivers that
+// store them
+func exportAuth(ctx context.Context, s interface{}, w *archive.Writer) error {
+
+	if us, ok := s.(storage.UserStore); ok {
+		users, err := us.ReadUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err = w.Write(tableUser, storage.ArchiveUser{Name: u.Name, PasswordHash: u.PasswordHash, Created: u.Created.UTC()}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if gs, ok := s.(storage.GrantStore); ok {
+		grants, err := gs.ReadGrants(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, g := range grants {
+			if err = w.Write(tableGrant, storage.ArchiveGrant{User: g.User, Role: g.Role, Scope: g.Scope}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ts, ok := s.(storage.TokenStore); ok {
+		tokens, err := ts.ReadTokens(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			err = w.Write(tableToken, storage.ArchiveToken{
+				ID:       t.ID,
+				Hash:     t.Hash,
+				Name:     t.Name,
+				User:     t.User,
+				Tenant:   t.Tenant,
+				Service:  t.Service,
+				Scopes:   t.Scopes,
+				Created:  t.Created.UTC(),
+				Expires:  t.Expires.UTC(),
+				LastUsed: t.LastUsed.UTC(),
+				Revoked:  t.Revoked,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importCommand restores an archive into the storage. Reports, users, grants
+// and tokens that already exist are skipped and the larger of the existing
+// and imported statistics is kept, so importing an archive again changes
+// nothing
+func importCommand(ctx context.Context, s storage.Storage, args []string) error {
+
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := fs.String("in", "", "Archive to read")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("import needs -in")
+	}
+
+	a, ok := s.(storage.Archiver)
+	if !ok {
+		return fmt.Errorf("The storage driver does not support import")
+	}
+	if err := s.Initialize(ctx); err != nil {
+		return fmt.Errorf("Unable to initialize storage: %v", err)
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s: %v", *in, err)
+	}
+	defer f.Close()
+
+	r, err := archive.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fmt.Printf("Importing archive from %s created %s\n", r.Manifest.Source, r.Manifest.Created.Local())
+	return restore(ctx, a, r)
+}
+
+func restore(ctx context.Context, a storage.Archiver, r *archive.Reader) error {
+
+	reports, err := r.Scan(tableReport)
+	if err != nil {
+		return err
+	}
+	defer reports.Close()
+
+	rows, err := r.Scan(tableRow)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// The rows are ordered by the ID of their report like the reports
+	var next storage.ArchiveRow
+	more, err := rows.Next(&next)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped := 0, 0
+	for {
+		var rp storage.ArchiveReport
+		ok, err := reports.Next(&rp)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		for more && next.RID <= rp.ID {
+			if next.RID == rp.ID {
+				rp.Rows = append(rp.Rows, next)
+			}
+			next = storage.ArchiveRow{}
+			if more, err = rows.Next(&next); err != nil {
+				return err
+			}
+		}
+
+		ok, err = a.ImportReport(ctx, rp)
+		if err != nil {
+			return fmt.Errorf("Unable to import report %s from %s: %v", rp.ReportID, rp.ReportOrg, err)
+		}
+		if ok {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+	fmt.Printf("Imported %d reports, skipped %d existing\n", imported, skipped)
+
+	n := 0
+	err = scanTable(r, tableStats, func() interface{} { return &storage.ArchiveStat{} }, func(v interface{}) error {
+		n++
+		return a.ImportStat(ctx, *v.(*storage.ArchiveStat))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d daily statistics\n", n)
+
+	n = 0
+	err = scanTable(r, tableReporter, func() interface{} { return &storage.ArchiveReporter{} }, func(v interface{}) error {
+		n++
+		return a.ImportReporter(ctx, *v.(*storage.ArchiveReporter))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d reporter counts\n", n)
+
+	imported, skipped = 0, 0
+	err = scanTable(r, tableNote, func() interface{} { return &storage.ArchiveNote{} }, func(v interface{}) error {
+		ok, err := a.ImportNote(ctx, *v.(*storage.ArchiveNote))
+		if ok {
+			imported++
+		} else if err == nil {
+			skipped++
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d notes, skipped %d existing\n", imported, skipped)
+
+	return restoreAuth(ctx, a, r)
+}
+
+// restoreAuth imports the local users, grants and API tokens that do not
+// exist yet into drivers that store them
+func restoreAuth(ctx context.Context, s interface{}, r *archive.Reader) error {
+
+	if us, ok := s.(storage.UserStore); ok {
+		imported := 0
+		err := scanTable(r, tableUser, func() interface{} { return &storage.ArchiveUser{} }, func(v interface{}) error {
+			u := v.(*storage.ArchiveUser)
+			_, err := us.ReadUser(ctx, u.Name)
+			if !storage.IsNotFound(err) {
+				return err
+			}
+			imported++
+			return us.WriteUser(ctx, storage.User{Name: u.Name, PasswordHash: u.PasswordHash, Created: u.Created})
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d users\n", imported)
+	} else if n := r.Entries(tableUser); n > 0 {
+		fmt.Printf("Skipped %d users, the storage driver does not support local users\n", n)
+	}
+
+	if gs, ok := s.(storage.GrantStore); ok {
+		existing := make(map[storage.Grant]bool)
+		grants, err := gs.ReadGrants(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, g := range grants {
+			existing[storage.Grant{User: g.User, Scope: g.Scope}] = true
+		}
+
+		imported := 0
+		err = scanTable(r, tableGrant, func() interface{} { return &storage.ArchiveGrant{} }, func(v interface{}) error {
+			g := v.(*storage.ArchiveGrant)
+			if existing[storage.Grant{User: g.User, Scope: g.Scope}] {
+				return nil
+			}
+			imported++
+			return gs.WriteGrant(ctx, storage.Grant{User: g.User, Role: g.Role, Scope: g.Scope})
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d grants\n", imported)
+	} else if n := r.Entries(tableGrant); n > 0 {
+		fmt.Printf("Skipped %d grants, the storage driver does not support grants\n", n)
+	}
+
+	if ts, ok := s.(storage.TokenStore); ok {
+		imported := 0
+		err := scanTable(r, tableToken, func() interface{} { return &storage.ArchiveToken{} }, func(v interface{}) error {
+			t := v.(*storage.ArchiveToken)
+			_, err := ts.ReadToken(ctx, t.ID)
+			if !storage.IsNotFound(err) {
+				return err
+			}
+			err = ts.WriteToken(ctx, storage.Token{
+				ID:      t.ID,
+				Hash:    t.Hash,
+				Name:    t.Name,
+				User:    t.User,
+				Tenant:  t.Tenant,
+				Service: t.Service,
+				Scopes:  t.Scopes,
+				Created: t.Created,
+				Expires: t.Expires,
+			})
+			// A revoked token must never be usable after the import
+			if err == nil && t.Revoked {
+				err = ts.RevokeToken(ctx, t.ID)
+			}
+			if err == nil && !t.LastUsed.IsZero() {
+				err = ts.TouchToken(ctx, t.ID, t.LastUsed)
+			}
+			imported++
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d API tokens\n", imported)
+	} else if n := r.Entries(tableToken); n > 0 {
+		fmt.Printf("Skipped %d API tokens, the storage driver does not support them\n", n)
+	}
+
+	return nil
+}
+
+// scanTable calls fn with every entry of a table decoded into a value
+// returned by alloc
+func scanTable(r *archive.Reader, name string, alloc func() interface{}, fn func(interface{}) error) error {
+
+	sc, err := r.Scan(name)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	for {
+		v := alloc()
+		ok, err := sc.Next(v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err = fn(v); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestExportImport(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	src := s.(*storage.Memory)
+	if err := src.ImportStat(ctx, storage.ArchiveStat{Tenant: "acme", Day: time.Unix(86400, 0), PolicyDomain: "acme.com", Messages: 7}); err != nil {
+		t.Fatalf("Unable to add statistics: %v", err)
+	}
+	if err := src.ImportReporter(ctx, storage.ArchiveReporter{Tenant: "acme", Reporter: "google.com", Duplicates: 2, Malformed: 1}); err != nil {
+		t.Fatalf("Unable to add reporter counts: %v", err)
+	}
+	if err := src.WriteNote(ctx, 1, storage.Note{User: "alice", Text: "Forwarded mail"}); err != nil {
+		t.Fatalf("Unable to add note: %v", err)
+	}
+	if err := src.WriteUser(ctx, storage.User{Name: "alice", PasswordHash: "x"}); err != nil {
+		t.Fatalf("Unable to add user: %v", err)
+	}
+	if err := src.WriteGrant(ctx, storage.Grant{User: "alice", Role: "admin", Scope: "*"}); err != nil {
+		t.Fatalf("Unable to add grant: %v", err)
+	}
+	for _, id := range []string{"live", "revoked"} {
+		if err := src.WriteToken(ctx, storage.Token{ID: id, Hash: "h", User: "alice", Scopes: []string{"read"}}); err != nil {
+			t.Fatalf("Unable to add token: %v", err)
+		}
+	}
+	if err := src.RevokeToken(ctx, "revoked"); err != nil {
+		t.Fatalf("Unable to revoke token: %v", err)
+	}
+
+	name := filepath.Join(t.TempDir(), "dump.tar.zst")
+	if err := exportCommand(ctx, src, "memory", []string{"-out", name}); err != nil {
+		t.Fatalf("Unable to export: %v", err)
+	}
+
+	dst := &storage.Memory{}
+	for i := 0; i < 2; i++ {
+		// The second import changes nothing
+		if err := importCommand(ctx, dst, []string{"-in", name}); err != nil {
+			t.Fatalf("Unable to import: %v", err)
+		}
+	}
+
+	expected, err := src.ReadReport(ctx, 1)
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	got, err := dst.ReadReport(ctx, 1)
+	if err != nil {
+		t.Fatalf("Unable to read imported report: %v", err)
+	}
+	if got.Report != expected.Report || len(got.Rows) != len(expected.Rows) || got.Rows[0] != expected.Rows[0] {
+		t.Errorf("Imported report differs:\n%#v\n%#v", got, expected)
+	}
+	if n, _ := dst.CountReports(ctx, storage.ReportQuery{}); n != 1 {
+		t.Errorf("Expected 1 report got %d", n)
+	}
+
+	var docs []storage.ArchiveReport
+	err = dst.ExportReports(ctx, func(r storage.ArchiveReport) error {
+		docs = append(docs, r)
+		return nil
+	})
+	if err != nil || len(docs) != 1 || len(docs[0].Document) == 0 || docs[0].Source != "dmarc/testdata/valid.xml" {
+		t.Errorf("Expected the document to be imported: %v", err)
+	}
+
+	notes, err := dst.ReadNotes(ctx, 1)
+	if err != nil || len(notes) != 1 || notes[0].Text != "Forwarded mail" {
+		t.Errorf("Expected the note to be imported once: %#v %v", notes, err)
+	}
+
+	stats, err := dst.ReadStats(storage.WithTenant(ctx, "acme"), storage.StatsQuery{})
+	if err != nil || len(stats) != 1 || stats[0].Messages != 7 {
+		t.Errorf("Expected statistics to be imported once: %#v %v", stats, err)
+	}
+	counts, err := dst.ReporterCounts(storage.WithTenant(ctx, "acme"))
+	if err != nil || len(counts) != 1 || counts[0] != (storage.ReporterCount{Reporter: "google.com", Duplicates: 2, Malformed: 1}) {
+		t.Errorf("Expected reporter counts to be imported once: %#v %v", counts, err)
+	}
+
+	if _, err := dst.ReadUser(ctx, "alice"); err != nil {
+		t.Errorf("Expected user to be imported: %v", err)
+	}
+	if grants, err := dst.ReadGrants(ctx, "alice"); err != nil || len(grants) != 1 || grants[0].Role != "admin" {
+		t.Errorf("Expected grant to be imported: %#v %v", grants, err)
+	}
+	for _, tc := range []struct {
+		id      string
+		revoked bool
+	}{
+		{"live", false},
+		{"revoked", true},
+	} {
+		tok, err := dst.ReadToken(ctx, tc.id)
+		if err != nil || tok.Revoked != tc.revoked {
+			t.Errorf("Token %s should be revoked %v: %#v %v", tc.id, tc.revoked, tok, err)
+		}
+	}
+
+	if err := exportCommand(ctx, src, "memory", nil); err == nil {
+		t.Errorf("Expected export without -out to fail")
+	}
+	if err := importCommand(ctx, dst, []string{"-in", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("Expected import of missing file to fail")
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Archive is missing: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// exportColumns are the columns of an exported row
+var exportColumns = []string{
+	"id", "report_id", "report_org", "report_email", "policy_domain", "begin", "end",
+	"policy_p", "policy_sp", "policy_pct", "policy_adkim", "policy_aspf",
+	"source_ip", "count", "disposition", "dkim_align", "spf_align", "reason",
+	"dkim_domain", "dkim_result", "spf_domain", "spf_result", "header_from",
+}
+
+// exportNumeric are the indexes of the numeric columns
+var exportNumeric = []int{0, 13}
+
+// recordWriter writes the records of an export
+type recordWriter interface {
+	Write(record []string) error
+	Close() error
+}
+
+// csvWriter is a recordWriter for CSV
+type csvWriter struct {
+	*csv.Writer
+}
+
+// Close flushes the records
+func (c csvWriter) Close() error {
+	c.Flush()
+	return c.Error()
+}
+
+// exportRecord returns the columns of a row
+func exportRecord(r dmarc.Report, row dmarc.Row) []string {
+	record := []string{
+		strconv.FormatInt(r.ID, 10), r.ReportID, r.ReportOrg, r.ReportEmail, r.PolicyDomain,
+		r.ReportBegin.UTC().Format(time.RFC3339), r.ReportEnd.UTC().Format(time.RFC3339),
+		r.PolicyP, r.PolicySP, r.PolicyPCT, r.PolicyAdkim, r.PolicyAspf,
+		row.SourceIP, strconv.FormatInt(row.Count, 10), row.EvalDisposition, row.EvalDKIMAalign, row.EvalSPFAlign, row.Reason,
+		row.DKIMDomain, row.DKIMResult, row.SPFDomain, row.SPFResult, row.IdentifierHFrom,
+	}
+	for i, v := range record {
+		record[i] = safeCell(v)
+	}
+	return record
+}
+
+// safeCell returns the value with a ' in front if a spreadsheet would read it
+// as a formula. The reports are written by the senders so any text field can
+// hold one
+func safeCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// startExport sets the headers of the download and returns the writer for
+// the format with the header written
+func startExport(w http.ResponseWriter, format, name string) (recordWriter, error) {
+
+	if format != "xlsx" {
+		format = "csv"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+
+	var rw recordWriter = csvWriter{csv.NewWriter(w)}
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		x, err := newXLSXWriter(w, exportNumeric...)
+		if err != nil {
+			return nil, err
+		}
+		rw = x
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+
+	return rw, rw.Write(exportColumns)
+}
+
+// exportFormat returns the requested format or an error if it is unknown
+func exportFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "csv", "xlsx":
+		return f, nil
+	default:
+		return "", fmt.Errorf("format is not csv or xlsx")
+	}
+}
+
+// finishExport closes the export. The headers are already sent so errors can
+// only be logged and the download is left incomplete
+func finishExport(rw recordWriter, name string, err error) {
+	if err == nil {
+		err = rw.Close()
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to export %s: %v", name, err)
+	}
+}
+
+func handleReportsExport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := reportQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rr, ok := s.(storage.RowReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support exporting rows", http.StatusNotImplemented)
+		return
+	}
+
+	rw, err := startExport(w, format, "reports")
+	if err != nil {
+		errors <- fmt.Errorf("Unable to start export: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = rr.WalkRows(ctx, q, func(row storage.ReportRow) error {
+		return rw.Write(exportRecord(row.Report, row.Row))
+	})
+	finishExport(rw, "reports", err)
+}
+
+func handleReportExport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	format, err := exportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "id is not a number", http.StatusBadRequest)
+		return
+	}
+
+	report, err := s.ReadReport(ctx, id)
+	if storage.IsNotFound(err) {
+		http.Error(w, "Unknown report", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read report %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := fmt.Sprintf("report-%d", id)
+	rw, err := startExport(w, format, name)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to start export: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for _, row := range report.Rows {
+		if err = rw.Write(exportRecord(report.Report, row)); err != nil {
+			break
+		}
+	}
+	finishExport(rw, name, err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+func TestSafeCell(t *testing.T) {
+
+	tt := []struct {
+		value    string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"", ""},
+		{"42", "42"},
+		{`=HYPERLINK("http://evil.example","x")`, `'=HYPERLINK("http://evil.example","x")`},
+		{"+1+1", "'+1+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"a=1", "a=1"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := safeCell(tc.value); got != tc.expected {
+				t.Errorf("Expected %q but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExportFormulas(t *testing.T) {
+
+	report := dmarc.Report{ID: 1, ReportID: "=1+1", ReportOrg: "@example.com", PolicyDomain: "greyhat.dk"}
+	row := dmarc.Row{SourceIP: "10.10.10.1", Count: 3, Reason: "-2", IdentifierHFrom: "+greyhat.dk"}
+
+	tt := []struct {
+		format   string
+		expected []string
+	}{
+		{"csv", []string{"1,'=1+1,'@example.com,", ",3,", ",'-2,", ",'+greyhat.dk\n"}},
+		{"xlsx", []string{"<c><v>1</v></c>", ">&#39;=1+1<", ">&#39;@example.com<", "<c><v>3</v></c>", ">&#39;-2<", ">&#39;+greyhat.dk<"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rw, err := startExport(w, tc.format, "report")
+			if err != nil {
+				t.Fatalf("Unable to start export: %v", err)
+			}
+			if err = rw.Write(exportRecord(report, row)); err != nil {
+				t.Fatalf("Unable to write record: %v", err)
+			}
+			if err = rw.Close(); err != nil {
+				t.Fatalf("Unable to close export: %v", err)
+			}
+
+			body := w.Body.String()
+			if tc.format == "xlsx" {
+				body = readSheet(t, w.Body.Bytes())
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Expected export to contain %q:\n%s", expected, body)
+				}
+			}
+		})
+	}
+}
+
+// readSheet returns the first sheet of a workbook
+func readSheet(t *testing.T, b []byte) string {
+	t.Helper()
+
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("Unable to read workbook: %v", err)
+	}
+	f, err := z.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatalf("Unable to open sheet: %v", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Unable to read sheet: %v", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pingTimeout is how long the storage may take to answer the readiness
+	// check
+	pingTimeout = 2 * time.Second
+	// queueStall is how long the queue may hold reports without any being
+	// taken before the ingestion is stuck
+	queueStall = 5 * time.Minute
+	// scanSlack is added to the allowed age of the last scan since a scan
+	// takes time and waits for the queue
+	scanSlack = time.Minute
+)
+
+// ingestion tracks the progress of the directory scans and the queue for the
+// readiness check
+type ingestion struct {
+	mu       sync.Mutex
+	started  time.Time
+	scans    map[string]scanState
+	dequeued time.Time
+}
+
+// scanState is the interval of a scanned directory and the time the last
+// scan completed. Last is zero until the first scan completes
+type scanState struct {
+	interval time.Duration
+	last     time.Time
+}
+
+// ingest is the progress of the ingestion
+var ingest = newIngestion(time.Now())
+
+func newIngestion(started time.Time) *ingestion {
+	return &ingestion{started: started, scans: make(map[string]scanState)}
+}
+
+// watch adds a directory scanned every interval
+func (i *ingestion) watch(path string, interval time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.scans[path] = scanState{interval: interval}
+}
+
+// scanned records a completed scan of a watched directory
+func (i *ingestion) scanned(path string, now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if st, ok := i.scans[path]; ok {
+		st.last = now
+		i.scans[path] = st
+	}
+}
+
+// dequeue records that a report was taken from the queue
+func (i *ingestion) dequeue(now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dequeued = now
+}
+
+// check returns an error if a directory has not been scanned for three
+// intervals or the queue has reports but none have been taken for a while.
+// It also returns the time of the last scan per directory
+func (i *ingestion) check(now time.Time, depth int) (map[string]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	scans := make(map[string]string, len(i.scans))
+	var stale []string
+	for path, st := range i.scans {
+		last := st.last
+		if last.IsZero() {
+			scans[path] = "never"
+			last = i.started
+		} else {
+			scans[path] = st.last.UTC().Format(time.RFC3339)
+		}
+		if now.Sub(last) > 3*st.interval+scanSlack {
+			stale = append(stale, path)
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return scans, fmt.Errorf("No completed scan of %s for more than three intervals", strings.Join(stale, ", "))
+	}
+
+	last := i.dequeued
+	if last.Before(i.started) {
+		last = i.started
+	}
+	if depth > 0 && now.Sub(last) > queueStall {
+		return scans, fmt.Errorf("%d reports queued but none taken for %v", depth, now.Sub(last).Round(time.Second))
+	}
+	return scans, nil
+}
+
+// healthCheck is the result of a readiness check. The probes need no
+// authentication so why a check failed is only logged
+type healthCheck struct {
+	Status string `json:"status"`
+}
+
+// health is the answer of the health and readiness checks
+type health struct {
+	Status string                 `json:"status"`
+	Uptime int64                  `json:"uptime,omitempty"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// probeLog remembers which readiness checks failed so a check is logged
+// when it starts failing and when it recovers rather than on every probe
+type probeLog struct {
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+// readiness is the state of the readiness checks
+var readiness = &probeLog{failed: make(map[string]bool)}
+
+// check returns the result of the named check that failed with err or
+// passed if nil. detail is logged with the error
+func (p *probeLog) check(name string, err error, detail string) healthCheck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failed := err != nil
+	if failed != p.failed[name] {
+		p.failed[name] = failed
+		if failed {
+			log.Warnf("Readiness check %s failed: %v%s", name, err, detail)
+		} else {
+			log.Infof("Readiness check %s is ok again", name)
+		}
+	}
+
+	if failed {
+		return healthCheck{Status: "fail"}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// handleHealthz answers the liveness probe. The process is alive if it can
+// answer
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, health{Status: "ok", Uptime: int64(time.Since(ingest.started).Seconds())})
+}
+
+// handleReadyz answers the readiness probe. It fails if the storage is not
+// reachable, the templates and static files are missing or the ingestion is
+// stuck
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+
+	var err error
+	if storageDown.Load() {
+		err = errStorageDown
+	} else if p, ok := s.(storage.Pinger); ok {
+		err = p.Ping(ctx)
+	}
+	checks := map[string]healthCheck{
+		"storage": readiness.check("storage", err, ""),
+		"assets":  readiness.check("assets", pages.check(), ""),
+	}
+
+	depth := len(queue)
+	scans, err := ingest.check(time.Now(), depth)
+	checks["ingestion"] = readiness.check("ingestion", err, fmt.Sprintf(" (queue %d, scans %v)", depth, scans))
+
+	h := health{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			h.Status, status = "fail", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, h)
+}
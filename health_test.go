@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestionCheck(t *testing.T) {
+
+	start := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	interval := time.Minute
+
+	tt := []struct {
+		name    string
+		scanned time.Duration
+		dequeue time.Duration
+		now     time.Duration
+		depth   int
+		fail    bool
+	}{
+		{"starting", -1, -1, 2 * time.Minute, 0, false},
+		{"never_scanned", -1, -1, 5 * time.Minute, 0, true},
+		{"scanned", 9 * time.Minute, -1, 10 * time.Minute, 0, false},
+		{"scan_too_old", time.Minute, -1, 10 * time.Minute, 0, true},
+		{"queue_moving", 9 * time.Minute, 8 * time.Minute, 10 * time.Minute, 5, false},
+		{"queue_stuck", 9 * time.Minute, time.Minute, 10 * time.Minute, 5, true},
+		{"queue_empty", 9 * time.Minute, time.Minute, 10 * time.Minute, 0, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			i := newIngestion(start)
+			i.watch("/files", interval)
+			// Scans of directories that are not watched are ignored
+			i.scanned("/other", start)
+			if tc.scanned >= 0 {
+				i.scanned("/files", start.Add(tc.scanned))
+			}
+			if tc.dequeue >= 0 {
+				i.dequeue(start.Add(tc.dequeue))
+			}
+
+			scans, err := i.check(start.Add(tc.now), tc.depth)
+			if tc.fail != (err != nil) {
+				t.Errorf("Expected failure %v but got %v", tc.fail, err)
+			}
+			if len(scans) != 1 || scans["/files"] == "" {
+				t.Errorf("Expected the scan of /files but got %v", scans)
+			}
+		})
+	}
+}
+
+func TestProbes(t *testing.T) {
+
+	ctx := setupMemory(t)
+	h := httpHandler(ctx)
+
+	oldIngest := ingest
+	t.Cleanup(func() { ingest = oldIngest })
+	ingest = newIngestion(time.Now())
+
+	get := func(path string) (int, health) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		// The probes need no authentication so they only tell the status
+		for _, secret := range []string{"/files", "error", errStorageDown.Error()} {
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("Expected %s to hide %q: %s", path, secret, w.Body.String())
+			}
+		}
+		var hl health
+		if err := json.Unmarshal(w.Body.Bytes(), &hl); err != nil {
+			t.Fatalf("Unable to parse %s: %v", w.Body.String(), err)
+		}
+		return w.Code, hl
+	}
+
+	if code, hl := get("/healthz"); code != http.StatusOK || hl.Status != "ok" {
+		t.Errorf("Expected healthz to be ok but got %d %+v", code, hl)
+	}
+
+	code, hl := get("/readyz")
+	if code != http.StatusOK || hl.Status != "ok" {
+		t.Errorf("Expected readyz to be ok but got %d %+v", code, hl)
+	}
+	for _, name := range []string{"storage", "assets", "ingestion"} {
+		if hl.Checks[name].Status != "ok" {
+			t.Errorf("Expected %s to be ok but got %+v", name, hl.Checks[name])
+		}
+	}
+
+	// A directory that has not been scanned for long makes it not ready
+	ingest = newIngestion(time.Now().Add(-time.Hour))
+	ingest.watch("/files", time.Minute)
+	code, hl = get("/readyz")
+	if code != http.StatusServiceUnavailable || hl.Status != "fail" || hl.Checks["ingestion"].Status != "fail" {
+		t.Errorf("Expected the ingestion to fail but got %d %+v", code, hl)
+	}
+	ingest = newIngestion(time.Now())
+
+	// So does missing templates
+	oldPages := pages
+	pages = nil
+	code, hl = get("/readyz")
+	pages = oldPages
+	if code != http.StatusServiceUnavailable || hl.Checks["assets"].Status != "fail" || hl.Checks["storage"].Status != "ok" {
+		t.Errorf("Expected the assets to fail but got %d %+v", code, hl)
+	}
+
+	// And storage that is not available yet
+	storageDown.Store(true)
+	code, hl = get("/readyz")
+	storageDown.Store(false)
+	if code != http.StatusServiceUnavailable || hl.Checks["storage"].Status != "fail" {
+		t.Errorf("Expected the storage to fail but got %d %+v", code, hl)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd checks passwords against an Apache htpasswd file with bcrypt or
+// SHA1 hashes. The file is read again when it changes
+type htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+// loadHtpasswd reads an htpasswd file
+func loadHtpasswd(path string) (*htpasswd, error) {
+	if path == "" {
+		return nil, fmt.Errorf("No htpasswd file is configured")
+	}
+	h := &htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload reads the file if it has changed since it was last read
+func (h *htpasswd) reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("Unable to stat %s: %v", h.path, err)
+	}
+	if h.users != nil && fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s: %v", h.path, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			log.Warnf("Ignoring line %d of %s", n, h.path)
+			continue
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			log.Warnf("Ignoring %s in %s, only bcrypt and SHA1 are supported", user, h.path)
+			continue
+		}
+		users[user] = hash
+	}
+	if err = sc.Err(); err != nil {
+		return fmt.Errorf("Unable to read %s: %v", h.path, err)
+	}
+
+	h.users, h.modTime = users, fi.ModTime()
+	return nil
+}
+
+func (h *htpasswd) checkPassword(ctx context.Context, user, password string) (bool, error) {
+	if err := h.reload(); err != nil {
+		return false, err
+	}
+
+	h.mu.Lock()
+	hash, ok := h.users[user]
+	h.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(hash, "{SHA}")), []byte(expected)) == 1, nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
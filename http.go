@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
@@ -19,20 +19,165 @@ import (
 	"github.com/desdic/godmarcparser/cfg"
 	"github.com/desdic/godmarcparser/dmarc"
 	"github.com/desdic/godmarcparser/spf"
+	"github.com/desdic/godmarcparser/storage"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	isdomain = regexp.MustCompile(`^(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})$`)
-	isip     = regexp.MustCompile(`((^\s*((([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5]))\s*$)|(^\s*((([0-9A-Fa-f]{1,4}:){7}([0-9A-Fa-f]{1,4}|:))|(([0-9A-Fa-f]{1,4}:){6}(:[0-9A-Fa-f]{1,4}|((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){5}(((:[0-9A-Fa-f]{1,4}){1,2})|:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){4}(((:[0-9A-Fa-f]{1,4}){1,3})|((:[0-9A-Fa-f]{1,4})?:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){3}(((:[0-9A-Fa-f]{1,4}){1,4})|((:[0-9A-Fa-f]{1,4}){0,2}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){2}(((:[0-9A-Fa-f]{1,4}){1,5})|((:[0-9A-Fa-f]{1,4}){0,3}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){1}(((:[0-9A-Fa-f]{1,4}){1,6})|((:[0-9A-Fa-f]{1,4}){0,4}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(:(((:[0-9A-Fa-f]{1,4}){1,7})|((:[0-9A-Fa-f]{1,4}){0,5}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:)))(%.+)?\s*$))`)
+	isip = regexp.MustCompile(`((^\s*((([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5]))\s*$)|(^\s*((([0-9A-Fa-f]{1,4}:){7}([0-9A-Fa-f]{1,4}|:))|(([0-9A-Fa-f]{1,4}:){6}(:[0-9A-Fa-f]{1,4}|((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){5}(((:[0-9A-Fa-f]{1,4}){1,2})|:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3})|:))|(([0-9A-Fa-f]{1,4}:){4}(((:[0-9A-Fa-f]{1,4}){1,3})|((:[0-9A-Fa-f]{1,4})?:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){3}(((:[0-9A-Fa-f]{1,4}){1,4})|((:[0-9A-Fa-f]{1,4}){0,2}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){2}(((:[0-9A-Fa-f]{1,4}){1,5})|((:[0-9A-Fa-f]{1,4}){0,3}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(([0-9A-Fa-f]{1,4}:){1}(((:[0-9A-Fa-f]{1,4}){1,6})|((:[0-9A-Fa-f]{1,4}){0,4}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:))|(:(((:[0-9A-Fa-f]{1,4}){1,7})|((:[0-9A-Fa-f]{1,4}){0,5}:((25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(\.(25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}))|:)))(%.+)?\s*$))`)
 )
 
+// validDomain returns true if name is a host name of two or more labels of
+// letters, digits and hyphens
+func validDomain(name string) bool {
+	labels := strings.Split(strings.ToLower(name), ".")
+	if len(labels) < 2 || len(name) > 253 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func statusHandler(ctx context.Context, fn func(context.Context, http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fn(ctx, w, r)
+		// Everything is scoped to the tenant of the host
+		tctx, ok := tenantContext(ctx, r)
+		if !ok {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		user, ok := auth.user(r)
+		if !ok {
+			http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+			return
+		}
+		actx, ok, err := authorize(withUser(tctx, user), user)
+		if err != nil {
+			errors <- err
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		fn(actx, w, r)
+	}
+}
+
+// lookupSPF and lookupAddr does the DNS lookups and are replaced in tests
+var (
+	lookupSPF = func(domain string) (spf.BreakDown, error) {
+		start := time.Now()
+		b, err := spf.Get(domain)
+		observeLookup("spf", start, err)
+		return b, err
+	}
+	lookupAddr = func(ip string) ([]string, error) {
+		start := time.Now()
+		names, err := net.LookupAddr(ip)
+		observeLookup("ptr", start, err)
+		return names, err
+	}
+)
+
+// templateFuncs are the helper functions available in the templates
+var templateFuncs = template.FuncMap{
+	"list": func(v ...string) []string { return v },
+	"mul":  func(a, b float64) float64 { return a * b },
+	"days": func(d time.Duration) string { return fmt.Sprintf("%.1f", d.Hours()/24) },
+	"auth": func() bool { return auth != nil },
+}
+
+// reportFilters are the query parameters used for filtering the reports list
+var reportFilters = []string{"domain", "org", "from", "to", "disposition", "dkim", "spf", "ip", "hfrom", "sort", "order", "size"}
+
+// pageSizes are the selectable number of reports per page
+var pageSizes = []int{10, 30, 50, 100, 250}
+
+// reportCounts caches the number of reports per filter
+var reportCounts = &countCache{ttl: 30 * time.Second}
+
+// reportsPage is the data for the reports list template
+type reportsPage struct {
+	dmarc.Reports
+	Filter url.Values
+	// Query is the filters encoded for use in links
+	Query     template.URL
+	Total     int
+	PageSize  int
+	PageSizes []int
+	// Links to the first, previous, next and last page. Empty if there is
+	// no such page
+	First, Prev, Next, Last template.URL
+}
+
+// filterQuery returns the filters from v encoded for use in a link
+func filterQuery(v url.Values) template.URL {
+	f := url.Values{}
+	for _, k := range reportFilters {
+		if v.Get(k) != "" {
+			f.Set(k, v.Get(k))
+		}
 	}
+	if len(f) == 0 {
+		return ""
+	}
+	return template.URL(f.Encode() + "&")
+}
+
+// reportQuery parses the filters of the reports list
+func reportQuery(v url.Values) (q storage.ReportQuery, err error) {
+
+	q.PolicyDomain = strings.TrimSpace(v.Get("domain"))
+	q.ReportOrg = strings.TrimSpace(v.Get("org"))
+	q.HeaderFrom = strings.TrimSpace(v.Get("hfrom"))
+	q.SourceIP = strings.TrimSpace(v.Get("ip"))
+	q.Disposition = v.Get("disposition")
+	q.DKIMResult = v.Get("dkim")
+	q.SPFResult = v.Get("spf")
+
+	if q.SourceIP != "" {
+		_, _, cerr := net.ParseCIDR(q.SourceIP)
+		if net.ParseIP(q.SourceIP) == nil && cerr != nil {
+			return q, fmt.Errorf("ip is not a valid IP address or CIDR")
+		}
+	}
+
+	// The dates are inclusive so to is the end of the day
+	if f := v.Get("from"); f != "" {
+		if q.From, err = time.ParseInLocation("2006-01-02", f, time.Local); err != nil {
+			return q, fmt.Errorf("from is not a valid date")
+		}
+	}
+	if t := v.Get("to"); t != "" {
+		if q.To, err = time.ParseInLocation("2006-01-02", t, time.Local); err != nil {
+			return q, fmt.Errorf("to is not a valid date")
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+
+	switch sort := v.Get("sort"); sort {
+	case "", storage.SortBegin, storage.SortEnd, storage.SortDomain, storage.SortOrg, storage.SortCount:
+		q.Sort = sort
+	default:
+		return q, fmt.Errorf("sort is not valid")
+	}
+	q.Ascending = v.Get("order") == "asc"
+
+	return q, nil
 }
 
 func handleReports(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -57,96 +202,115 @@ func handleReports(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	pagesize := 30
+	if size := v.Get("size"); size != "" {
+		i, err := strconv.Atoi(size)
+		if err != nil || !validPageSize(i) {
+			http.Error(w, "size is not a valid page size", http.StatusBadRequest)
+			return
+		}
+		pagesize = i
+	}
 
-	offset := (page - 1) * pagesize
-
-	reports, err := s.ReadReports(ctx, offset, pagesize)
+	q, err := reportQuery(v)
 	if err != nil {
-		errors <- fmt.Errorf("Unable to read reports: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	q.PageSize = pagesize
 
-	totalpages := 1
-	if len(reports) > 0 {
-		totalpages = int(math.Ceil(float64(reports[0].Items / pagesize)))
-	}
-
-	var pages []int
-
-	before := page - 1
-	if before < 0 {
-		before = 0
-	}
-
-	if before > 3 {
-		before = 3
-	}
-
-	after := page + 3
-	if after > 3 {
-		after = 3
+	query := filterQuery(v)
+	total, err := reportCounts.get(countKey(ctx, string(query)), func() (int, error) {
+		return s.CountReports(ctx, q)
+	})
+	if err != nil {
+		errors <- fmt.Errorf("Unable to count reports: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	if page+3 > totalpages {
-		after = 1 + (totalpages - page)
+	totalpages := (total + pagesize - 1) / pagesize
+	if totalpages < 1 {
+		totalpages = 1
 	}
-
-	for i := before; i > 0; i-- {
-		pages = append(pages, page-i)
+	if page > totalpages {
+		page = totalpages
 	}
 
-	pages = append(pages, page)
-
-	for i := 1; i < after+1; i++ {
-		pages = append(pages, page+i)
+	// Keyset pagination is used when sorted by begin date. The last page is
+	// read backwards from the end so it is as fast as the first
+	keyset := q.Sort == "" || q.Sort == storage.SortBegin
+	switch {
+	case keyset && v.Get("after") != "":
+		q.Cursor, err = storage.ParseCursor(v.Get("after"), false)
+	case keyset && v.Get("before") != "":
+		q.Cursor, err = storage.ParseCursor(v.Get("before"), true)
+	case keyset && page > 1 && page == totalpages:
+		q.Cursor = &storage.Cursor{Backward: true}
+		q.PageSize = total - (totalpages-1)*pagesize
+	default:
+		q.Offset = (page - 1) * pagesize
 	}
-
-	data := dmarc.Reports{Reports: reports, CurPage: page, LastPage: page - 1, NextPage: page + 1, TotalPages: totalpages + 1, Pages: pages}
-
-	tmpl, err := template.ParseFiles("templates/reports.html")
 	if err != nil {
-		errors <- fmt.Errorf("Unable to parse templates/reports.html: %v", err)
+		http.Error(w, "cursor is not valid", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/html")
-	if err = tmpl.Execute(w, data); err != nil {
+	reports, err := s.ReadReports(ctx, q)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read reports: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		errors <- fmt.Errorf("Error running template: %v", err)
 		return
 	}
-}
 
-func handleReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+	var pages []int
+	for i := page - 3; i <= page+3; i++ {
+		if i >= 1 && i <= totalpages {
+			pages = append(pages, i)
+		}
+	}
 
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
-	if err != nil {
-		errors <- fmt.Errorf("Unable to convert %s to int64", vars["id"])
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	data := reportsPage{
+		Reports:   dmarc.Reports{Reports: reports, CurPage: page, LastPage: page - 1, NextPage: page + 1, TotalPages: totalpages, Pages: pages},
+		Filter:    v,
+		Query:     query,
+		Total:     total,
+		PageSize:  pagesize,
+		PageSizes: pageSizes,
 	}
 
-	report, err := s.ReadReport(ctx, id)
-	if err != nil {
-		errors <- fmt.Errorf("Unable to read report %d: %v", id, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	link := func(format string, a ...interface{}) template.URL {
+		return query + template.URL(fmt.Sprintf(format, a...))
+	}
+	cursor := func(r dmarc.Report) string {
+		return storage.Cursor{Begin: r.ReportBegin, ID: r.ID}.String()
 	}
 
-	tmpl, err := template.ParseFiles("templates/report.html")
-	if err != nil {
-		errors <- fmt.Errorf("Unable to parse templates/report.html: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	if page > 1 {
+		data.First = link("page=1")
+		data.Prev = link("page=%d", page-1)
+		if keyset && len(reports) > 0 {
+			data.Prev = link("page=%d&before=%s", page-1, cursor(reports[0]))
+		}
 	}
-	w.Header().Set("Content-Type", "text/html")
-	if err = tmpl.Execute(w, report); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		errors <- fmt.Errorf("Error running template: %v", err)
-		return
+	if page < totalpages {
+		data.Last = link("page=%d", totalpages)
+		data.Next = link("page=%d", page+1)
+		if keyset && len(reports) > 0 {
+			data.Next = link("page=%d&after=%s", page+1, cursor(reports[len(reports)-1]))
+		}
 	}
+
+	render(w, http.StatusOK, "reports.html", data)
+}
+
+// validPageSize returns true if size is one of the selectable page sizes
+func validPageSize(size int) bool {
+	for _, s := range pageSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
 }
 
 func isIPv4(address string) bool {
@@ -196,13 +360,51 @@ func flattenBreakDown(ip net.IP, b spf.BreakDown) (list []acidr) {
 	return list
 }
 
+// analyse looks up the SPF record of the domain and checks which of the
+// networks allowed by it contains the IP address
+func analyse(domain, ip string) (analasis alist, spfresults spf.BreakDown, err error) {
+
+	spfresults, err = lookupSPF(domain)
+	if err != nil {
+		return analasis, spfresults, fmt.Errorf("Unable to lookup IPs: %v", err)
+	}
+
+	analasis.Domain = domain
+	analasis.IP = ip
+	analasis.Spfrecord = spfresults.Record
+
+	l, err := lookupAddr(ip)
+	if err != nil {
+		log.Warningf("Unable to do reverse lookup on %s: %v", ip, err)
+	}
+	analasis.Reverse = strings.Join(l, ",")
+
+	ipcidr := ip + "/128"
+	if isIPv4(ip) {
+		ipcidr = ip + "/32"
+	}
+
+	ipB, _, err := net.ParseCIDR(ipcidr)
+	if err != nil {
+		return analasis, spfresults, fmt.Errorf("Error creating CIDR %s: %v", ipcidr, err)
+	}
+
+	analasis.Cidrs = flattenBreakDown(ipB, spfresults)
+	return analasis, spfresults, nil
+}
+
 func handleAnalyse(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	domain := vars["domain"]
 	ip := vars["ip"]
 
-	if !isdomain.MatchString(domain) {
+	if !allowed(ctx, domain, roleAnalyst) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if !validDomain(domain) {
 		_, err := fmt.Fprintf(w, "Got %#v but its not a valid domain name", domain)
 		if err != nil {
 			log.Errorf("Unable to send data: %v", err)
@@ -218,25 +420,13 @@ func handleAnalyse(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	spfresults, err := spf.Get(domain)
+	analasis, spfresults, err := analyse(domain, ip)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		log.Errorf("Unable to lookup IPs: %v", err)
+		log.Error(err)
 		return
 	}
 
-	var analasis alist
-
-	analasis.Domain = domain
-	analasis.IP = ip
-	analasis.Spfrecord = spfresults.Record
-
-	l, err := net.LookupAddr(ip)
-	if err != nil {
-		log.Warningf("Unable to do reverse lookup on %s: %v", ip, err)
-	}
-	analasis.Reverse = strings.Join(l, ",")
-
 	b, err := json.MarshalIndent(spfresults, "", "\t")
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -246,31 +436,7 @@ func handleAnalyse(ctx context.Context, w http.ResponseWriter, r *http.Request)
 
 	analasis.Breakdown = string(b)
 
-	ipcidr := ip + "/128"
-	if isIPv4(ip) {
-		ipcidr = ip + "/32"
-	}
-
-	ipB, _, err := net.ParseCIDR(ipcidr)
-	if err != nil {
-		log.Errorf("Error creating CIDR %s: %v:", ipcidr, err)
-		return
-	}
-
-	analasis.Cidrs = flattenBreakDown(ipB, spfresults)
-
-	tmpl, err := template.ParseFiles("templates/analyse.html")
-	if err != nil {
-		errors <- fmt.Errorf("Unable to parse templates/analyse.html: %v", err)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/html")
-	if err = tmpl.Execute(w, analasis); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		errors <- fmt.Errorf("Error running template: %v", err)
-		return
-	}
+	render(w, http.StatusOK, "analyse.html", analasis)
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -278,21 +444,81 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
 
+// storageGuard answers 503 while the storage is down, except for the probes,
+// the static files and the metrics when they need no token
+func storageGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !storageDown.Load():
+		case r.URL.Path == "/healthz", r.URL.Path == "/readyz", strings.HasPrefix(r.URL.Path, "/static/"):
+		case r.URL.Path == "/metrics" && auth == nil:
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(int(spoolInterval.Seconds())))
+			http.Error(w, errStorageDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func httpHandler(ctx context.Context) http.Handler {
 
 	r := mux.NewRouter()
+	r.Use(storageGuard)
+	// The probes are not logged since they are called every few seconds
+	log.Debug("Adding handlers for /healthz and /readyz")
+	r.HandleFunc("/healthz", handleHealthz).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/readyz", handleReadyz).Methods(http.MethodGet, http.MethodHead)
+
+	log.Debug("Adding handler for /metrics")
+	r.Handle("/metrics", LogHTTP(metricsHandler())).Methods(http.MethodGet)
+
 	log.Debug("Adding /static")
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", pages.static))
+
+	log.Debug("Adding handlers for /login and /logout")
+	r.HandleFunc("/login", LogHTTP(http.HandlerFunc(handleLogin))).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/login/oidc", LogHTTP(http.HandlerFunc(handleOIDCLogin)))
+	r.HandleFunc("/auth/callback", LogHTTP(http.HandlerFunc(handleOIDCCallback)))
+	r.HandleFunc("/logout", LogHTTP(http.HandlerFunc(handleLogout))).Methods(http.MethodGet, http.MethodPost)
 
 	log.Debug("Adding handler for /")
-	r.HandleFunc("/", LogHTTP(statusHandler(ctx, handleReports)))
+	r.HandleFunc("/", LogHTTP(statusHandler(ctx, handleDashboard)))
+
+	log.Debug("Adding handler for /reports")
+	r.HandleFunc("/reports", LogHTTP(statusHandler(ctx, handleReports)))
+
+	log.Debug("Adding handler for /reports/export")
+	r.HandleFunc("/reports/export", LogHTTP(statusHandler(ctx, handleReportsExport)))
 
 	log.Debug("Adding handler for /report")
-	r.HandleFunc("/report/{id:[0-9]+}", LogHTTP(statusHandler(ctx, handleReport))).Name("report")
+	r.HandleFunc("/report/{id:[0-9]+}", LogHTTP(statusHandler(ctx, handleReport))).Methods(http.MethodGet, http.MethodPost).Name("report")
+	r.HandleFunc("/report/{id:[0-9]+}/export", LogHTTP(statusHandler(ctx, handleReportExport)))
+
+	log.Debug("Adding handler for /domain")
+	r.HandleFunc("/domain/{domain}", LogHTTP(statusHandler(ctx, handleDomain))).Name("domain")
+
+	log.Debug("Adding handler for /ip")
+	r.HandleFunc("/ip/{ip}", LogHTTP(statusHandler(ctx, handleIP))).Name("ip")
+
+	log.Debug("Adding handler for /reporters")
+	r.HandleFunc("/reporters", LogHTTP(statusHandler(ctx, handleReporters)))
+
+	log.Debug("Adding handler for /reporter")
+	r.HandleFunc("/reporter/{org}", LogHTTP(statusHandler(ctx, handleReporter))).Name("reporter")
 
 	log.Debug("Adding handler for /analyze")
 	r.HandleFunc("/analyse/{domain:[a-z0-9.-]+}/{ip:[a-f0-9.:]+}", LogHTTP(statusHandler(ctx, handleAnalyse))).Name("analyse")
 
+	log.Debug("Adding handler for /admin/users")
+	r.HandleFunc("/admin/users", LogHTTP(statusHandler(ctx, handleUsers))).Methods(http.MethodGet, http.MethodPost)
+
+	log.Debug("Adding handler for /admin/tokens")
+	r.HandleFunc("/admin/tokens", LogHTTP(statusHandler(ctx, handleTokens))).Methods(http.MethodGet, http.MethodPost)
+
+	log.Debug("Adding handlers for /api/v1")
+	apiRoutes(ctx, r.PathPrefix("/api/v1").Subrouter())
+
 	// Default handler (Used for logging 404)
 	r.NotFoundHandler = LogHTTP(http.HandlerFunc(defaultHandler))
 
@@ -309,17 +535,81 @@ func httpStart(ctx context.Context, cancel context.CancelFunc, cfg cfg.HTTPCfg)
 		IdleTimeout:  time.Second * time.Duration(cfg.IdleTimeout),
 	}
 
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	if cfg.MetricsPort != "" {
+		m := http.NewServeMux()
+		m.Handle("/metrics", promhttp.Handler())
+		metrics := &http.Server{
+			Handler:      m,
+			Addr:         cfg.MetricsPort,
+			WriteTimeout: srv.WriteTimeout,
+			ReadTimeout:  srv.ReadTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+		}
+		go func() {
+			<-ctx.Done()
+			metrics.Close()
+		}()
+		go func() {
+			log.Infof("Starting metrics on port %s", metrics.Addr)
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("ListenAndServe: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	if cfg.TLS.Cert == "" {
+		go func(srv *http.Server) {
+			log.Infof("Starting webserver on port %s", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil {
+				log.Errorf("ListenAndServe: %v", err)
+				cancel()
+				return
+			}
+		}(srv)
+		return srv, c
+	}
+
+	tc, err := tlsConfig(cfg.TLS)
+	if err != nil {
+		log.Errorf("Unable to set up TLS: %v", err)
+		cancel()
+		return srv, c
+	}
+	srv.TLSConfig = tc
+
 	go func(srv *http.Server) {
-		log.Infof("Starting webserver on port %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil {
-			log.Errorf("ListenAndServe: %v", err)
+		log.Infof("Starting webserver with TLS on port %s", srv.Addr)
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Errorf("ListenAndServeTLS: %v", err)
 			cancel()
 			return
 		}
 	}(srv)
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	if cfg.TLS.RedirectPort != "" {
+		redirect := &http.Server{
+			Handler:      LogHTTP(redirectHandler(cfg.Port)),
+			Addr:         cfg.TLS.RedirectPort,
+			WriteTimeout: srv.WriteTimeout,
+			ReadTimeout:  srv.ReadTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+		}
+		go func() {
+			<-ctx.Done()
+			redirect.Close()
+		}()
+		go func() {
+			log.Infof("Redirecting HTTP on port %s to HTTPS", redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("ListenAndServe: %v", err)
+				cancel()
+			}
+		}()
+	}
 
 	return srv, c
 }
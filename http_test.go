@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func setupMemory(t *testing.T) context.Context {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	errors = make(chan error)
+	go func(errs chan error) {
+		for range errs {
+		}
+	}(errors)
+	t.Cleanup(func() { close(errors) })
+
+	// Reverse lookups needs DNS
+	oldLookupAddr := lookupAddr
+	lookupAddr = func(ip string) ([]string, error) { return []string{"mail.example.com."}, nil }
+	t.Cleanup(func() { lookupAddr = oldLookupAddr })
+
+	var err error
+	if pages, err = loadPages(embedded); err != nil {
+		t.Fatalf("Unable to load templates: %v", err)
+	}
+
+	tenants = nil
+	auth = nil
+	s = &storage.Memory{}
+	if err := s.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize storage: %v", err)
+	}
+
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	f, err := dmarc.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to parse report: %v", err)
+	}
+	f.FromFile, f.Raw = "dmarc/testdata/valid.xml", b
+	if err := s.Write(ctx, f); err != nil {
+		t.Fatalf("Unable to store report: %v", err)
+	}
+
+	return ctx
+}
+
+func TestHandlers(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	tt := []struct {
+		name     string
+		path     string
+		status   int
+		contains string
+	}{
+		{"dashboard", "/", http.StatusOK, "Dashboard"},
+		{"dashboard_all", "/?window=all", http.StatusOK, `<a href="/domain/greyhat.dk">greyhat.dk</a>`},
+		{"dashboard_badwindow", "/?window=2d", http.StatusBadRequest, "window is not valid"},
+		{"reports", "/reports", http.StatusOK, `<a href="/report/1">myid123</a>`},
+		{"reports_page", "/reports?page=2", http.StatusOK, "Reports"},
+		{"reports_badpage", "/reports?page=abc", http.StatusBadRequest, "page is not a number"},
+		{"reports_size", "/reports?size=10", http.StatusOK, `<option selected>10</option>`},
+		{"reports_badsize", "/reports?size=7", http.StatusBadRequest, "size is not a valid page size"},
+		{"reports_after", "/reports?page=2&after=1300000000-1", http.StatusOK, "Reports"},
+		{"reports_badcursor", "/reports?after=abc", http.StatusBadRequest, "cursor is not valid"},
+		{"reports_filter", "/reports?domain=greyhat.dk&disposition=quarantine&ip=10.10.10.0/24&from=2018-08-12&to=2018-08-13", http.StatusOK, "myid123"},
+		{"reports_filter_links", "/reports?domain=greyhat.dk&sort=org&order=asc", http.StatusOK, `href="?domain=greyhat.dk&amp;order=asc&amp;sort=org&amp;page=1"`},
+		{"reports_nomatch", "/reports?disposition=reject", http.StatusOK, `<option selected>reject</option>`},
+		{"reports_badip", "/reports?ip=10.10.10", http.StatusBadRequest, "ip is not a valid"},
+		{"reports_baddate", "/reports?from=yesterday", http.StatusBadRequest, "from is not a valid date"},
+		{"reports_badsort", "/reports?sort=id", http.StatusBadRequest, "sort is not valid"},
+		{"report", "/report/1", http.StatusOK, "/analyse/greyhat.dk/10.10.10.1"},
+		{"ip", "/ip/10.10.10.1", http.StatusOK, `<a href="/analyse/greyhat.dk/10.10.10.1">Check SPF</a>`},
+		{"ip_ptr", "/ip/10.10.10.1", http.StatusOK, "PTR: mail.example.com."},
+		{"ip_rows", "/ip/10.10.10.1", http.StatusOK, `<a href="/report/1">myid123</a>`},
+		{"ip_unknown", "/ip/10.10.10.2", http.StatusOK, "0 messages"},
+		{"ip_bad", "/ip/10.10.10", http.StatusBadRequest, "ip is not a valid IP address"},
+		{"domain", "/domain/greyhat.dk", http.StatusOK, `<a href="/ip/10.10.10.1">10.10.10.1</a>`},
+		{"domain_policy", "/domain/GREYHAT.dk", http.StatusOK, "<td>quarantine</td>"},
+		{"domain_unknown", "/domain/example.com", http.StatusOK, "0 messages"},
+		{"domain_bad", "/domain/greyhat", http.StatusBadRequest, "domain is not a valid domain name"},
+		{"reporters", "/reporters", http.StatusOK, `<a href="/reporter/example.com">example.com</a>`},
+		{"reporter", "/reporter/Example.com", http.StatusOK, `<a href="/domain/greyhat.dk">greyhat.dk</a>`},
+		{"reporter_stopped", "/reporter/example.com", http.StatusOK, "stopped"},
+		{"reporter_unknown", "/reporter/google.com", http.StatusNotFound, "Unknown reporter"},
+		{"export_reports", "/reports/export?domain=greyhat.dk", http.StatusOK, "1,myid123,example.com,"},
+		{"export_reports_auth", "/reports/export?format=csv", http.StatusOK, ",neutral,greyhat.dk,permerror,greyhat.dk"},
+		{"export_reports_filtered", "/reports/export?domain=example.com", http.StatusOK, "id,report_id,"},
+		{"export_reports_xlsx", "/reports/export?format=xlsx", http.StatusOK, "xl/worksheets/sheet1.xml"},
+		{"export_reports_badformat", "/reports/export?format=pdf", http.StatusBadRequest, "format is not csv or xlsx"},
+		{"export_reports_baddate", "/reports/export?from=abc", http.StatusBadRequest, "from is not a valid date"},
+		{"export_report", "/report/1/export", http.StatusOK, "1,myid123,example.com,"},
+		{"export_report_missing", "/report/2/export", http.StatusNotFound, "Unknown report"},
+		{"report_missing", "/report/2", http.StatusNotFound, "Unknown report"},
+		{"notfound", "/nothing", http.StatusNotFound, ""},
+	}
+
+	h := httpHandler(ctx)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d", tc.status, w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected body to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+
+	tt := []struct {
+		name     string
+		expected bool
+	}{
+		{"example.com", true},
+		{"a.mail.example.com", true},
+		{"shop.example.co.uk", true},
+		{"example.technology", true},
+		{"Greyhat.DK", true},
+		{"xn--bcher-kva.example", true},
+		{"localhost", false},
+		{"", false},
+		{"example..com", false},
+		{".example.com", false},
+		{"example.com.", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa_mple.com", false},
+		{"exam ple.com", false},
+		{"example.com/x", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a", 63) + ".com", true},
+		{strings.Repeat(strings.Repeat("a", 49)+".", 5) + "com", true},
+		{strings.Repeat(strings.Repeat("a", 49)+".", 5) + "info", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := validDomain(tc.name); got != tc.expected {
+				t.Errorf("Expected %v for %q but got %v", tc.expected, tc.name, got)
+			}
+		})
+	}
+}
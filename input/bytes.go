@@ -0,0 +1,58 @@
+package input
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// Contents returns the reports of data that is a zip or gzip archive or a
+// plain XML document. from names where the data came from
+func Contents(from string, data []byte) ([]dmarc.Content, error) {
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return zipContents(from, data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return gzipContents(from, data)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")):
+		return []dmarc.Content{{From: from, Name: from, Data: bytes.NewBuffer(data)}}, nil
+	}
+	return nil, fmt.Errorf("%s is not a zip, gzip or xml file", from)
+}
+
+func zipContents(from string, data []byte) ([]dmarc.Content, error) {
+
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open zip file %s: %v", from, err)
+	}
+
+	var cs []dmarc.Content
+	err = newExtractor(from).zip(z, func(c dmarc.Content) error {
+		cs = append(cs, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(cs) == 0 {
+		return nil, fmt.Errorf("The zip file %s has no xml files", from)
+	}
+	return cs, nil
+}
+
+func gzipContents(from string, data []byte) ([]dmarc.Content, error) {
+
+	var cs []dmarc.Content
+	err := newExtractor(from).gzip(bytes.NewReader(data), func(c dmarc.Content) error {
+		cs = append(cs, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
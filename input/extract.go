@@ -0,0 +1,113 @@
+package input
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// maxExtracted is the largest report extracted from an archive and
+// maxArchive the most extracted from one archive in total, so a small file
+// cannot expand without bounds
+const (
+	maxExtracted = 100 << 20
+	maxArchive   = 200 << 20
+)
+
+// extractor copies the reports out of an archive and stops when a report or
+// all reports together are too large
+type extractor struct {
+	from string
+	// maxFile and maxTotal are the limits in bytes
+	maxFile, maxTotal int64
+	total             int64
+}
+
+func newExtractor(from string) *extractor {
+	return &extractor{from: from, maxFile: maxExtracted, maxTotal: maxArchive}
+}
+
+// extract copies a report of the archive
+func (x *extractor) extract(name string, r io.Reader) (dmarc.Content, error) {
+
+	limit := x.maxFile
+	if left := x.maxTotal - x.total; left < limit {
+		limit = left
+	}
+
+	c := dmarc.Content{From: x.from, Name: name, Data: new(bytes.Buffer)}
+	n, err := io.Copy(c.Data, io.LimitReader(r, limit+1))
+	x.total += n
+	if err != nil {
+		return c, fmt.Errorf("Unable to extract data from %s within %s: %v", name, x.from, err)
+	}
+	if n > x.maxFile {
+		return c, fmt.Errorf("%s within %s is larger than %d bytes", name, x.from, x.maxFile)
+	}
+	if x.total > x.maxTotal {
+		return c, fmt.Errorf("%s extracts to more than %d bytes", x.from, x.maxTotal)
+	}
+	return c, nil
+}
+
+// zip calls fn with each XML report in the zip archive
+func (x *extractor) zip(z *zip.Reader, fn func(dmarc.Content) error) error {
+
+	for _, f := range z.File {
+		// Skip if zip file contains anything else than xml
+		if !strings.HasSuffix(f.Name, ".xml") {
+			continue
+		}
+		zc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Unable to read %s from %s: %v", f.Name, x.from, err)
+		}
+		c, err := x.extract(f.Name, zc)
+		zc.Close()
+		if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzip calls fn with each member of the gzip stream
+func (x *extractor) gzip(r io.Reader, fn func(dmarc.Content) error) error {
+
+	// Reset needs a reader that does not read past the member
+	br := bufio.NewReader(r)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return fmt.Errorf("Unable to read gzip file %s: %v", x.from, err)
+	}
+	defer zr.Close()
+
+	for {
+		zr.Multistream(false)
+
+		c, err := x.extract(zr.Name, zr)
+		if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			return err
+		}
+
+		err = zr.Reset(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Reset failed on %s within %s: %v", zr.Name, x.from, err)
+		}
+	}
+}
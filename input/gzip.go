@@ -1,12 +1,8 @@
 package input
 
 import (
-	"bufio"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"fmt"
-	"io"
 	"os"
 	"strings"
 
@@ -35,41 +31,12 @@ func (r GzipInput) Read(ctx context.Context, filename string, queue chan<- dmarc
 		}
 	}()
 
-	buf := bufio.NewReader(f)
-	zr, err := gzip.NewReader(buf)
-	if err != nil {
-		return fmt.Errorf("Unable to read file %s: %v", filename, err)
-	}
-
-	defer func() {
-		if zerr := zr.Close(); zerr != nil {
-			log.Errorf("Unable to close stream on %s: %v", filename, zerr)
-		}
-	}()
-
-	for {
-		zr.Multistream(false)
-
-		c := dmarc.Content{From: filename, Name: zr.Name}
-		c.Data = new(bytes.Buffer)
-
-		if _, err := io.Copy(c.Data, zr); err != nil {
-			return fmt.Errorf("Unable to extract data from %s within %s: %v", zr.Name, filename, err)
-		}
-
+	return newExtractor(filename).gzip(f, func(c dmarc.Content) error {
 		select {
 		case <-ctx.Done():
 			return fmt.Errorf("Reading gzip file cancelled")
 		case queue <- c:
 		}
-
-		err = zr.Reset(f)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("Reset failed on %s within %s: %v", zr.Name, filename, err)
-		}
-	}
-	return nil
+		return nil
+	})
 }
@@ -1,10 +1,15 @@
 package input
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -69,3 +74,119 @@ func TestInput(t *testing.T) {
 		})
 	}
 }
+
+func TestContents(t *testing.T) {
+
+	tt := []struct {
+		name     string
+		filename string
+		reports  int
+	}{
+		{"xml", "testdata/valid.xml", 1},
+		{"zip", "testdata/valid.zip", 1},
+		{"gz", "testdata/valid.xml.gz", 1},
+		{"text", "testdata/text.txt", 0},
+		{"corrupt_zip", "testdata/corrupt.zip", 0},
+		{"corrupt_gz", "testdata/corrupt.xml.gz", 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+
+			data, err := ioutil.ReadFile(tc.filename)
+			if err != nil {
+				t.Fatalf("Unable to read file: %v", err)
+			}
+
+			cs, err := Contents("upload", data)
+			if tc.reports == 0 {
+				if err == nil {
+					t.Fatalf("Expected %s to fail", tc.filename)
+				}
+				return
+			}
+			if err != nil || len(cs) != tc.reports {
+				t.Fatalf("Expected %d reports but got %d: %v", tc.reports, len(cs), err)
+			}
+			if _, err = dmarc.Read(cs[0].Data.Bytes()); err != nil {
+				t.Errorf("Unable to parse the extracted report: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+
+	report := bytes.Repeat([]byte("x"), 1000)
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range []string{"a.xml", "b.xml", "c.xml"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Unable to create %s: %v", name, err)
+		}
+		w.Write(report)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Unable to create zip: %v", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	if err != nil {
+		t.Fatalf("Unable to open zip: %v", err)
+	}
+
+	var gzipped bytes.Buffer
+	for i := 0; i < 3; i++ {
+		gw := gzip.NewWriter(&gzipped)
+		gw.Write(report)
+		if err := gw.Close(); err != nil {
+			t.Fatalf("Unable to create gzip: %v", err)
+		}
+	}
+
+	tt := []struct {
+		name     string
+		gzip     bool
+		maxFile  int64
+		maxTotal int64
+		reports  int
+		err      string
+	}{
+		{"zip", false, 1000, 3000, 3, ""},
+		{"zip_file", false, 999, 3000, 0, "larger than 999 bytes"},
+		{"zip_total", false, 1000, 2500, 2, "more than 2500 bytes"},
+		{"gzip", true, 1000, 3000, 3, ""},
+		{"gzip_file", true, 999, 3000, 0, "larger than 999 bytes"},
+		{"gzip_total", true, 1000, 2500, 2, "more than 2500 bytes"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+
+			x := &extractor{from: "upload", maxFile: tc.maxFile, maxTotal: tc.maxTotal}
+			reports := 0
+			count := func(c dmarc.Content) error {
+				reports++
+				return nil
+			}
+
+			var err error
+			if tc.gzip {
+				err = x.gzip(bytes.NewReader(gzipped.Bytes()), count)
+			} else {
+				err = x.zip(z, count)
+			}
+
+			if reports != tc.reports {
+				t.Errorf("Expected %d reports but got %d", tc.reports, reports)
+			}
+			if tc.err == "" && err != nil {
+				t.Errorf("Unable to extract: %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("Expected error containing %q but got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ipRows is the number of rows shown on the source IP page
+const ipRows = 500
+
+// alignment is the messages of a combination of DKIM and SPF alignment
+type alignment struct {
+	DKIM, SPF string
+	Messages  int64
+	Percent   float64
+}
+
+// ipPage is the data for the source IP template
+type ipPage struct {
+	IP   string
+	PTR  []string
+	From time.Time
+	To   time.Time
+
+	Messages int64
+	Pass     int64
+	Rate     float64
+
+	Volume     svgChart
+	Domains    []dashboardDomain
+	Alignments []alignment
+	Reporters  []dashboardShare
+
+	Rows []storage.ReportRow
+	// Truncated is true if there are more rows than shown
+	Truncated bool
+}
+
+// alignments returns the messages per DKIM and SPF alignment
+func alignments(stats []storage.DailyStat, total int64) []alignment {
+	var list []alignment
+	for _, st := range stats {
+		list = append(list, alignment{DKIM: st.DKIMAlign, SPF: st.SPFAlign, Messages: st.Messages, Percent: percent(st.Messages, total)})
+	}
+	return list
+}
+
+func handleIP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		http.Error(w, "ip is not a valid IP address", http.StatusBadRequest)
+		return
+	}
+
+	sr, ok := s.(storage.StatsReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support statistics", http.StatusNotImplemented)
+		return
+	}
+	rr, ok := s.(storage.RowReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support reading rows", http.StatusNotImplemented)
+		return
+	}
+
+	data := ipPage{IP: ip.String(), To: tomorrow()}
+
+	read := func(groupby ...string) ([]storage.DailyStat, error) {
+		return sr.ReadStats(ctx, storage.StatsQuery{SourceIP: data.IP, GroupBy: groupby})
+	}
+
+	volume, err := read(storage.StatDay, storage.StatDKIMAlign, storage.StatSPFAlign)
+	var domains, aligns, reporters []storage.DailyStat
+	if err == nil {
+		domains, err = read(storage.StatDomain, storage.StatDKIMAlign, storage.StatSPFAlign)
+	}
+	if err == nil {
+		aligns, err = read(storage.StatDKIMAlign, storage.StatSPFAlign)
+	}
+	if err == nil {
+		reporters, err = read(storage.StatReporter)
+	}
+	if err == nil {
+		data.Rows, err = rr.ReadRows(ctx, storage.ReportQuery{SourceIP: data.IP, PageSize: ipRows + 1})
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read history of %s: %v", data.IP, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(data.Rows) > ipRows {
+		data.Rows, data.Truncated = data.Rows[:ipRows], true
+	}
+
+	for _, st := range volume {
+		data.Messages += st.Messages
+		if passed(st) {
+			data.Pass += st.Messages
+		}
+	}
+	data.Rate = percent(data.Pass, data.Messages)
+	data.From = firstDay(volume, data.To)
+	data.Volume = volumeChart(volumeBuckets(volume, data.From, data.To))
+
+	data.Domains = rates(domains, func(st storage.DailyStat) string { return st.PolicyDomain })
+	data.Alignments = alignments(aligns, data.Messages)
+	data.Reporters = shares(reporters, func(st storage.DailyStat) string { return st.Reporter }, data.Messages)
+
+	if data.PTR, err = lookupAddr(data.IP); err != nil {
+		log.Warningf("Unable to do reverse lookup on %s: %v", data.IP, err)
+	}
+
+	render(w, http.StatusOK, "ip.html", data)
+}
@@ -16,19 +16,26 @@ import (
 )
 
 var (
-	s storage.Storage
+	s       storage.Storage
+	tenants *tenantRouter
 
 	errors chan error
 	queue  chan dmarc.Content
 )
 
-func run(ctx context.Context, cancel context.CancelFunc, cfg cfg.HTTPCfg) error {
+// queueSize is the number of reports that can wait to be stored before the
+// scans and uploads block
+const queueSize = 64
 
-	if err := s.Initialize(ctx); err != nil {
-		return fmt.Errorf("Unable to initialize storage: %v", err)
+func run(ctx context.Context, cancel context.CancelFunc, cfg cfg.Config) error {
+
+	if p, ok := s.(storage.Purger); ok {
+		go purgeLoop(ctx, p, cfg.Retention)
+	} else if cfg.Retention.Days > 0 || cfg.Retention.Months > 0 {
+		log.Warnf("Storage %s does not support retention", cfg.Storage.Type)
 	}
 
-	srv, c := httpStart(ctx, cancel, cfg)
+	srv, c := httpStart(ctx, cancel, cfg.HTTP)
 
 	// Gracefull shutdown via ctrl+c or if something fails during startup
 	log.Debug("Web service started")
@@ -45,14 +52,47 @@ func run(ctx context.Context, cancel context.CancelFunc, cfg cfg.HTTPCfg) error
 	return nil
 }
 
+// pool returns the connection pool settings of the storage configuration
+func pool(c cfg.StorageCfg) storage.Pool {
+	return storage.Pool{
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(c.ConnMaxLifetime) * time.Second,
+		ConnMaxIdleTime: time.Duration(c.ConnMaxIdleTime) * time.Second,
+	}
+}
+
+// scanLoop scans a directory for reports until the context is cancelled
+func scanLoop(ctx context.Context, path string, interval int) {
+	if path == "" {
+		return
+	}
+	ingest.watch(path, time.Duration(interval)*time.Second)
+DONE:
+	for {
+		log.Debugf("Scanning directory %s", path)
+		ScanDirectory(ctx, queue, errors, path)
+
+		select {
+		case <-ctx.Done():
+			break DONE
+		default:
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
 func main() {
 
 	var (
 		showVersion bool
+		demo        bool
 		cfgfile     string
 	)
 	// Parse flags
 	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.BoolVar(&demo, "demo", false, "Use in-memory storage instead of the configured database")
 	flag.StringVar(&cfgfile, "cfgfile", "config.json", "Path to config file")
 	flag.Parse()
 
@@ -66,12 +106,32 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if demo {
+		c.Storage.Type = "memory"
+	}
+
+	dedupe := storage.DedupePolicy{
+		Identical: c.Storage.Dedupe.Identical,
+		Changed:   c.Storage.Dedupe.Changed,
+	}
+
 	// Support for multiple drivers
 	switch c.Storage.Type {
 	case "postgresql":
 		s = &storage.Postgresql{
-			URL: c.Storage.URL,
+			URL:    c.Storage.URL,
+			Pool:   pool(c.Storage),
+			Dedupe: dedupe,
 		}
+	case "mysql":
+		s = &storage.MySQL{
+			URL:    c.Storage.URL,
+			Pool:   pool(c.Storage),
+			Dedupe: dedupe,
+		}
+	case "memory":
+		log.Warn("Using in-memory storage, reports are lost on exit")
+		s = &storage.Memory{Dedupe: dedupe}
 	default:
 		log.Fatalf("Unsupported driver %s", c.Storage.Type)
 	}
@@ -87,53 +147,117 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	errors = make(chan error)
-	queue = make(chan dmarc.Content)
+	tenants = &tenantRouter{tenants: c.Tenants}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		if err := migrateCommand(ctx, s, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "export":
+		if err := exportCommand(ctx, s, c.Storage.Type, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "import":
+		if err := importCommand(ctx, s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "user":
+		def, err := parseRole(c.Auth.DefaultRole)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = userCommand(ctx, s, def, flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %s", flag.Arg(0))
+	}
+
+	// The storage has to be ready before reports are read or replayed unless
+	// they can wait in the spool
+	initErr := s.Initialize(ctx)
+	if initErr != nil {
+		if c.Storage.Spool == "" || !storage.IsTransient(initErr) {
+			log.Fatalf("Unable to initialize storage: %v", initErr)
+		}
+		log.Warnf("Starting without storage, reports are spooled to %s: %v", c.Storage.Spool, initErr)
+		storageDown.Store(true)
+	}
+
+	if auth, err = newAuthenticator(ctx, c.Auth); err != nil {
+		log.Fatalf("Unable to set up authentication: %v", err)
+	}
+	if auth != nil {
+		if c.HTTP.TLS.ClientUser != "" {
+			if c.HTTP.TLS.Cert == "" || c.HTTP.TLS.ClientAuth == "none" {
+				log.Fatalf("Users from client certificates need TLS with client auth optional or require")
+			}
+			auth.clientUser = c.HTTP.TLS.ClientUser
+		}
+		// Cookies set over HTTPS should not be sent in the clear
+		auth.secure = auth.secure || c.HTTP.TLS.Cert != ""
+	}
+
+	if pages, err = loadPages(assetsFS(c.HTTP.Assets)); err != nil {
+		log.Fatalf("Unable to load templates: %v", err)
+	}
+
+	errors = make(chan error)
+	queue = make(chan dmarc.Content, queueSize)
+
 	go func() {
 		for e := range errors {
 			log.Errorf("Got error %#v\n", e)
 		}
 	}()
 
+	if initErr != nil {
+		go initializeLater(ctx, initErr)
+	} else {
+		loadReportEnds(ctx)
+	}
+
+	w := &writer{s: s, retries: c.Storage.Retries, spool: c.Storage.Spool, backoff: storage.Backoff}
+	go w.replayLoop(ctx)
+
 	go func() {
 		for q := range queue {
+			ingest.dequeue(time.Now())
 			log.Debugf("Reading %s", q.From)
 			f, err := dmarc.Read(q.Data.Bytes())
 			if err != nil {
+				parseFailures.WithLabelValues(failureInvalidXML).Inc()
 				errors <- fmt.Errorf("Unable to parse %s: %v", q.Name, err)
+				countMalformed(ctx, q)
 				continue
 			}
+			reportsParsed.Inc()
 			f.FromFile = q.From
-			if err = s.Write(ctx, f); err != nil {
+			f.Raw, f.Received = q.Data.Bytes(), time.Now().UTC()
+
+			tenant := tenants.forReport(f.PolicyPublished.Domain, q.From)
+			if err = w.write(ctx, tenant, f); err != nil {
 				errors <- fmt.Errorf("Unable to store feedback: %v", err)
 			}
 		}
 	}()
 
-	go func(ctx context.Context, c cfg.ScanDirectory) {
-		if c.Path == "" {
-			return
-		}
-	DONE:
-		for {
-			log.Debugf("Scanning directory %s", c.Path)
-			ScanDirectory(ctx, queue, errors, c.Path)
-
-			select {
-			case <-ctx.Done():
-				break DONE
-			default:
-			}
-
-			time.Sleep(time.Duration(c.Interval) * time.Second)
-		}
-	}(ctx, c.Directory)
+	// The mailboxes of the tenants are scanned like the directory
+	go scanLoop(ctx, c.Directory.Path, c.Directory.Interval)
+	for _, dir := range tenants.mailboxes() {
+		go scanLoop(ctx, dir, c.Directory.Interval)
+	}
 
-	if err := run(ctx, cancel, c.HTTP); err != nil {
+	if err := run(ctx, cancel, c); err != nil {
 		log.Errorf("Stopping server: %v", err)
 	}
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons a report could not be parsed
+const (
+	failureUnknownType = "unknown_type"
+	failureUnreadable  = "unreadable"
+	failureInvalidXML  = "invalid_xml"
+)
+
+var (
+	filesScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "godmarcparser_files_scanned_total",
+		Help: "Files found when scanning the report directories",
+	})
+	lastScan = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "godmarcparser_last_scan_timestamp_seconds",
+		Help: "Time the directory was last scanned",
+	}, []string{"path"})
+	reportsParsed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "godmarcparser_reports_parsed_total",
+		Help: "Reports parsed from files and uploads",
+	})
+	parseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "godmarcparser_parse_failures_total",
+		Help: "Files and reports that could not be parsed by reason",
+	}, []string{"reason"})
+	duplicateReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "godmarcparser_duplicate_reports_total",
+		Help: "Reports that were already stored by the dedupe action taken",
+	}, []string{"action"})
+	reportsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "godmarcparser_reports_stored_total",
+		Help: "Reports written to the storage",
+	})
+	rowsStored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "godmarcparser_rows_stored_total",
+		Help: "Report rows written to the storage counted by their messages",
+	})
+	storeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "godmarcparser_store_failures_total",
+		Help: "Reports that could not be written after all retries",
+	})
+	storeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "godmarcparser_store_duration_seconds",
+		Help:    "Time to write a report including retries",
+		Buckets: prometheus.DefBuckets,
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "godmarcparser_queue_depth",
+		Help: "Reports waiting to be parsed and stored",
+	}, func() float64 { return float64(len(queue)) })
+	dnsLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "godmarcparser_dns_lookups_total",
+		Help: "SPF and reverse DNS lookups by type and result",
+	}, []string{"type", "result"})
+	dnsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "godmarcparser_dns_lookup_duration_seconds",
+		Help:    "Time of SPF and reverse DNS lookups",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "godmarcparser_http_requests_total",
+		Help: "HTTP requests by route, method and status",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "godmarcparser_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests by route and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	lastReport = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "godmarcparser_last_report_timestamp_seconds",
+		Help: "End of the newest report stored per policy domain",
+	}, []string{"domain"})
+)
+
+// lastReports is the end of the newest report per policy domain so older
+// reports arriving late do not move the gauge back
+var lastReports = struct {
+	sync.Mutex
+	ends map[string]time.Time
+}{ends: make(map[string]time.Time)}
+
+// observeReportEnd moves the last report time of the domain forward
+func observeReportEnd(domain string, end time.Time) {
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return
+	}
+
+	lastReports.Lock()
+	defer lastReports.Unlock()
+
+	if !end.After(lastReports.ends[domain]) {
+		return
+	}
+	lastReports.ends[domain] = end
+	lastReport.WithLabelValues(domain).Set(float64(end.Unix()))
+}
+
+// loadReportEnds sets the last report time of the domains already stored
+func loadReportEnds(ctx context.Context) {
+	rr, ok := s.(storage.ReporterReader)
+	if !ok {
+		return
+	}
+	domains, err := rr.ReadReporters(ctx, "")
+	if err != nil {
+		log.Warnf("Unable to read the last reports per domain: %v", err)
+		return
+	}
+	for _, d := range domains {
+		observeReportEnd(d.Domain, d.Last)
+	}
+}
+
+// observeStore counts a report written to the storage
+func observeStore(f dmarc.Feedback, outcome storage.WriteOutcome, took time.Duration, err error) {
+	storeDuration.Observe(took.Seconds())
+	if err != nil {
+		storeFailures.Inc()
+		return
+	}
+	if outcome.Duplicate != "" {
+		duplicateReports.WithLabelValues(outcome.Duplicate).Inc()
+		if outcome.Duplicate == storage.DedupeSkip {
+			return
+		}
+	}
+	reportsStored.Inc()
+	var rows int64
+	for _, r := range f.Records {
+		for _, rw := range r.Rows {
+			rows += rw.Count
+		}
+	}
+	rowsStored.Add(float64(rows))
+	observeReportEnd(f.PolicyPublished.Domain, time.Unix(f.ReportMetadata.DateRange.End, 0))
+}
+
+// observeLookup counts a DNS lookup of the type
+func observeLookup(kind string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	dnsLookups.WithLabelValues(kind, result).Inc()
+	dnsDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// observeHTTP counts a request by the route it matched
+func observeHTTP(r *http.Request, status int, took time.Duration) {
+	route := "none"
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if tmpl, err := cr.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(route, r.Method).Observe(took.Seconds())
+}
+
+// metricsHandler serves the metrics for Prometheus. The metrics cover all
+// tenants so with authentication enabled a token with the metrics scope is
+// needed
+func metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			t, bearer, err := auth.bearer(r.Context(), r)
+			switch {
+			case err == errInvalidToken:
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case err != nil:
+				errors <- err
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			case !bearer:
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			case !hasScope(t.Scopes, scopeMetrics):
+				http.Error(w, "The token does not have the metrics scope", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
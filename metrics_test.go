@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStoreMetrics(t *testing.T) {
+
+	ctx := context.Background()
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	f, err := dmarc.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to parse report: %v", err)
+	}
+	// Rows are counted by their messages
+	f.Records[0].Rows[0].Count = 5
+
+	m := &storage.Memory{Dedupe: storage.DedupePolicy{Identical: storage.DedupeSkip, Changed: storage.DedupeReplace}}
+	if err = m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize storage: %v", err)
+	}
+	w := &writer{s: m, backoff: storage.Backoff}
+
+	stored, rows := testutil.ToFloat64(reportsStored), testutil.ToFloat64(rowsStored)
+	skipped := testutil.ToFloat64(duplicateReports.WithLabelValues(storage.DedupeSkip))
+
+	// The second copy is a duplicate that is skipped
+	for i := 0; i < 2; i++ {
+		if err = w.store(ctx, "", f); err != nil {
+			t.Fatalf("Unable to store report: %v", err)
+		}
+	}
+
+	if n := testutil.ToFloat64(reportsStored) - stored; n != 1 {
+		t.Errorf("Expected 1 report stored but got %v", n)
+	}
+	if n := testutil.ToFloat64(rowsStored) - rows; n != 5 {
+		t.Errorf("Expected 5 rows stored but got %v", n)
+	}
+	if n := testutil.ToFloat64(duplicateReports.WithLabelValues(storage.DedupeSkip)) - skipped; n != 1 {
+		t.Errorf("Expected 1 skipped duplicate but got %v", n)
+	}
+	if ts := testutil.ToFloat64(lastReport.WithLabelValues("greyhat.dk")); ts != float64(f.ReportMetadata.DateRange.End) {
+		t.Errorf("Expected last report at %d but got %v", f.ReportMetadata.DateRange.End, ts)
+	}
+
+	// Older reports do not move the last report back
+	observeReportEnd("GreyHat.dk", time.Unix(f.ReportMetadata.DateRange.End-86400, 0))
+	if ts := testutil.ToFloat64(lastReport.WithLabelValues("greyhat.dk")); ts != float64(f.ReportMetadata.DateRange.End) {
+		t.Errorf("Expected last report to stay at %d but got %v", f.ReportMetadata.DateRange.End, ts)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+
+	ctx := setupMemory(t)
+	ts := s.(storage.TokenStore)
+
+	h := httpHandler(ctx)
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requests are counted by route
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("/report/{id:[0-9]+}", http.MethodGet, "200"))
+	get("/report/1", "")
+	if n := testutil.ToFloat64(httpRequests.WithLabelValues("/report/{id:[0-9]+}", http.MethodGet, "200")) - before; n != 1 {
+		t.Errorf("Expected 1 request counted but got %v", n)
+	}
+
+	// Without authentication everybody can read the metrics
+	w := get("/metrics", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `godmarcparser_http_requests_total{method="GET",route="/report/{id:[0-9]+}",status="200"}`) {
+		t.Errorf("Expected the metrics but got %d: %s", w.Code, w.Body.String())
+	}
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "local", SessionTTL: 3600}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	token := func(scopes ...string) string {
+		tk, raw, err := newToken("prometheus", "scrape", true, scopes, 0)
+		if err != nil {
+			t.Fatalf("Unable to create token: %v", err)
+		}
+		if err = ts.WriteToken(ctx, tk); err != nil {
+			t.Fatalf("Unable to write token: %v", err)
+		}
+		return raw
+	}
+
+	tt := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no_token", "", http.StatusUnauthorized},
+		{"invalid_token", tokenPrefix + "00_00", http.StatusUnauthorized},
+		{"read_scope", token(scopeRead), http.StatusForbidden},
+		{"metrics_scope", token(scopeMetrics), http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := get("/metrics", tc.token); w.Code != tc.status {
+				t.Errorf("Expected %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
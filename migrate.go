@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// migrateCommand shows the status of the schema migrations and applies the
+// pending ones unless only the status is requested
+func migrateCommand(ctx context.Context, s storage.Storage, action string) error {
+
+	m, ok := s.(storage.Migrator)
+	if !ok {
+		return fmt.Errorf("The storage driver does not support migrations")
+	}
+
+	if action == "" {
+		action = "up"
+	}
+	if action != "up" && action != "status" {
+		return fmt.Errorf("Unknown migrate action %q, use status or up", action)
+	}
+
+	status, err := m.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, st := range status {
+		applied := "pending"
+		if st.Applied {
+			applied = st.AppliedAt.Local().Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		fmt.Printf("%4d %-30s %s\n", st.Version, st.Name, applied)
+	}
+
+	if action == "status" || pending == 0 {
+		fmt.Printf("%d pending migration(s)\n", pending)
+		return nil
+	}
+
+	done, err := m.Migrate(ctx)
+	for _, st := range done {
+		fmt.Printf("Applied %d %s\n", st.Version, st.Name)
+	}
+	return err
+}
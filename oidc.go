@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+)
+
+const (
+	// oidcLeeway is the clock skew allowed when checking the expiry of a token
+	oidcLeeway = time.Minute
+	// jwksRefresh is the shortest time between reading the keys again for an
+	// unknown key ID, so tokens with made up key IDs cannot flood the provider
+	jwksRefresh = time.Minute
+)
+
+// oidcProvider logs users in with the authorization code flow of an OpenID
+// Connect provider. Only ID tokens signed with RS256 are accepted
+type oidcProvider struct {
+	cfg    cfg.OIDCCfg
+	client *http.Client
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	// mu guards the keys and fetching is held while they are read so the
+	// provider is not waited for with mu held
+	mu       sync.Mutex
+	fetching sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	// fetched is when the keys were last read
+	fetched time.Time
+}
+
+// oidcDiscovery is the part of the provider metadata that is used
+type oidcDiscovery struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// newOIDCProvider reads the metadata of the provider
+func newOIDCProvider(ctx context.Context, c cfg.OIDCCfg) (*oidcProvider, error) {
+
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, fmt.Errorf("OpenID Connect needs an issuer, client ID and redirect URL")
+	}
+
+	p := &oidcProvider{cfg: c, client: &http.Client{Timeout: 10 * time.Second}}
+
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, c.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != c.Issuer {
+		return nil, fmt.Errorf("The provider has issuer %s instead of %s", d.Issuer, c.Issuer)
+	}
+	if d.AuthEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("The provider %s is missing endpoints", c.Issuer)
+	}
+	p.authURL, p.tokenURL, p.jwksURL = d.AuthEndpoint, d.TokenEndpoint, d.JWKSURI
+
+	return p, nil
+}
+
+// getJSON decodes the response of a GET request
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create request for %s: %v", u, err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to get %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to get %s: %s", u, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Unable to decode %s: %v", u, err)
+	}
+	return nil
+}
+
+// authCodeURL returns the URL of the provider the user is sent to
+func (p *oidcProvider) authCodeURL(state, nonce string) string {
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {strings.Join(p.cfg.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return p.authURL + sep + v.Encode()
+}
+
+// exchange redeems the authorization code and returns the user of the
+// verified ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, nonce string) (string, error) {
+
+	if code == "" {
+		return "", fmt.Errorf("No authorization code")
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.cfg.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("Unable to create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to redeem code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to redeem code: %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Unable to decode token response: %v", err)
+	}
+
+	claims, err := p.verify(ctx, token.IDToken, nonce, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	if v, ok := claims["email_verified"].(bool); ok && !v && p.cfg.UserClaim == "email" {
+		return "", fmt.Errorf("The email of %v is not verified", claims["sub"])
+	}
+	user, _ := claims[p.cfg.UserClaim].(string)
+	if user == "" {
+		return "", fmt.Errorf("The ID token has no %s", p.cfg.UserClaim)
+	}
+	return user, nil
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token and returns its claims
+func (p *oidcProvider) verify(ctx context.Context, raw, nonce string, now time.Time) (map[string]interface{}, error) {
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("The ID token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("The ID token is signed with %s instead of RS256", header.Alg)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token signature: %v", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, fmt.Errorf("The ID token signature is not valid: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Unable to decode ID token claims: %v", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("The ID token is issued by %s", iss)
+	}
+	if !audience(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("The ID token is not issued to %s", p.cfg.ClientID)
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, fmt.Errorf("The ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("The ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// audience returns true if the aud claim contains the client
+func audience(aud interface{}, client string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == client
+	case []interface{}:
+		for _, v := range a {
+			if v == client {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the signing key with the key ID. The keys are read again when
+// an unknown key is requested so rotated keys are picked up, at most once
+// per jwksRefresh
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if k, ok := p.cached(kid); ok {
+		return k, nil
+	}
+
+	// One read at a time and the others wait for its keys
+	p.fetching.Lock()
+	defer p.fetching.Unlock()
+
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	// Failed reads count too so an unreachable provider is not retried on
+	// every login
+	recent := !p.fetched.IsZero() && time.Since(p.fetched) < jwksRefresh
+	if !ok && !recent {
+		p.fetched = time.Now()
+	}
+	p.mu.Unlock()
+
+	switch {
+	case ok:
+		return k, nil
+	case recent:
+		return nil, fmt.Errorf("The provider has no key %s", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	k, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("The provider has no key %s", kid)
+	}
+	return k, nil
+}
+
+// cached returns the key if it has been read
+func (p *oidcProvider) cached(kid string) (*rsa.PublicKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// fetchKeys reads the RSA signing keys of the provider
+func (p *oidcProvider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURL, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
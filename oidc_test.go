@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// mockIdP is an OpenID Connect provider issuing ID tokens for a single code
+type mockIdP struct {
+	t      *testing.T
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	nonce  string
+	claims map[string]interface{}
+	// fetches is the number of times the keys were read
+	fetches int
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	m := &mockIdP{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || id != "dmarc" || secret != "s3cret" || r.FormValue("code") != "code1" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign("k1", m.token())})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+
+	return m
+}
+
+// token returns the claims of a valid ID token
+func (m *mockIdP) token() map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":            m.srv.URL,
+		"aud":            "dmarc",
+		"sub":            "1234",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          m.nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// sign returns the claims as a JWT signed with RS256
+func (m *mockIdP) sign(kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			m.t.Fatalf("Unable to encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	payload := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		m.t.Fatalf("Unable to sign token: %v", err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+
+	ctx := setupMemory(t)
+	idp := newMockIdP(t)
+
+	err := s.(storage.GrantStore).WriteGrant(ctx, storage.Grant{User: "alice@example.com", Role: "viewer", Scope: "*"})
+	if err != nil {
+		t.Fatalf("Unable to write grant: %v", err)
+	}
+	auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "oidc", SessionTTL: 3600, OIDC: cfg.OIDCCfg{
+		Issuer:       idp.srv.URL,
+		ClientID:     "dmarc",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://dmarc.example.com/auth/callback",
+		Scopes:       []string{"openid", "email"},
+		UserClaim:    "email",
+	}})
+	if err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	h := httpHandler(ctx)
+	do := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		t.Fatalf("Expected cookie %s", name)
+		return nil
+	}
+
+	w := do("/login?next=/reports")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/login/oidc?next=%2freports") || strings.Contains(w.Body.String(), `name="password"`) {
+		t.Fatalf("Expected only single sign-on on the login page but got %d:\n%s", w.Code, w.Body.String())
+	}
+
+	// The user is sent to the provider which returns a code to the callback
+	start := func() (*http.Cookie, url.Values) {
+		w := do("/login/oidc?next=/reports")
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected a redirect to the provider but got %d", w.Code)
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(loc.String(), idp.srv.URL+"/authorize?") {
+			t.Fatalf("Expected a redirect to the provider but got %s", w.Header().Get("Location"))
+		}
+		q := loc.Query()
+		if q.Get("client_id") != "dmarc" || q.Get("scope") != "openid email" || q.Get("redirect_uri") != "http://dmarc.example.com/auth/callback" {
+			t.Errorf("Unexpected authorization request %s", loc)
+		}
+		idp.nonce = q.Get("nonce")
+		return cookie(w, oidcCookie), q
+	}
+
+	tt := []struct {
+		name   string
+		claims map[string]interface{}
+		state  string
+		code   string
+		status int
+	}{
+		{"state", nil, "wrong", "code1", http.StatusBadRequest},
+		{"code", nil, "", "code2", http.StatusUnauthorized},
+		{"audience", map[string]interface{}{"aud": []string{"other"}}, "", "code1", http.StatusUnauthorized},
+		{"issuer", map[string]interface{}{"iss": "https://evil.example.com"}, "", "code1", http.StatusUnauthorized},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, "", "code1", http.StatusUnauthorized},
+		{"nonce", map[string]interface{}{"nonce": "replayed"}, "", "code1", http.StatusUnauthorized},
+		{"unverified", map[string]interface{}{"email_verified": false}, "", "code1", http.StatusUnauthorized},
+		{"valid", map[string]interface{}{"aud": []string{"other", "dmarc"}}, "", "code1", http.StatusSeeOther},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c, q := start()
+			idp.claims = tc.claims
+
+			state := q.Get("state")
+			if tc.state != "" {
+				state = tc.state
+			}
+			w := do("/auth/callback?"+url.Values{"code": {tc.code}, "state": {state}}.Encode(), c)
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if tc.status != http.StatusSeeOther {
+				return
+			}
+
+			if loc := w.Header().Get("Location"); loc != "/reports" {
+				t.Errorf("Expected a redirect to /reports but got %s", loc)
+			}
+			if w = do("/reports", cookie(w, sessionCookie)); w.Code != http.StatusOK {
+				t.Errorf("Expected the session to be logged in but got %d", w.Code)
+			}
+		})
+	}
+
+	if w = do("/auth/callback?code=code1&state=abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback without a login to fail but got %d", w.Code)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+
+	idp := newMockIdP(t)
+	p, err := newOIDCProvider(context.Background(), cfg.OIDCCfg{Issuer: idp.srv.URL, ClientID: "dmarc", RedirectURL: "http://localhost/auth/callback"})
+	if err != nil {
+		t.Fatalf("Unable to create provider: %v", err)
+	}
+
+	idp.nonce = "n1"
+	valid := idp.sign("k1", idp.token())
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	forged := &mockIdP{t: t, key: other, srv: idp.srv, nonce: "n1"}
+
+	parts := strings.Split(valid, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + "."
+
+	tt := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"forged", forged.sign("k1", idp.token()), false},
+		{"unknown_key", idp.sign("k2", idp.token()), false},
+		{"alg_none", none, false},
+		{"garbage", "abc", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := p.verify(context.Background(), tc.token, "n1", time.Now())
+			if (err == nil) != tc.ok {
+				t.Errorf("Expected ok %v but got %v", tc.ok, err)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRefetch(t *testing.T) {
+
+	ctx := context.Background()
+	idp := newMockIdP(t)
+
+	p, err := newOIDCProvider(ctx, cfg.OIDCCfg{Issuer: idp.srv.URL, ClientID: "dmarc", RedirectURL: "http://dmarc.example.com/auth/callback"})
+	if err != nil {
+		t.Fatalf("Unable to create provider: %v", err)
+	}
+
+	tt := []struct {
+		name    string
+		kid     string
+		age     time.Duration
+		fetches int
+		err     bool
+	}{
+		{"first", "k1", 0, 1, false},
+		{"known", "k1", 0, 1, false},
+		{"unknown", "k2", 0, 1, true},
+		{"unknown_again", "k2", jwksRefresh / 2, 1, true},
+		{"unknown_later", "k2", jwksRefresh, 2, true},
+		{"known_after", "k1", 0, 2, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p.fetched = p.fetched.Add(-tc.age)
+			k, err := p.key(ctx, tc.kid)
+			if tc.err != (err != nil) || (!tc.err && k == nil) {
+				t.Errorf("Expected error %v but got %v", tc.err, err)
+			}
+			if idp.fetches != tc.fetches {
+				t.Errorf("Expected %d fetches but got %d", tc.fetches, idp.fetches)
+			}
+		})
+	}
+}
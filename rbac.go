@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// role is what a user can do on a policy domain. Every role can do what the
+// roles before it can
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer can see the reports and statistics
+	roleViewer
+	// roleAnalyst can also run the SPF analysis and add notes to reports
+	roleAnalyst
+	// roleAdmin can also delete and re-ingest reports and manage the users
+	// and their grants
+	roleAdmin
+)
+
+// roleNames are the names of the roles as stored in the grants
+var roleNames = []string{"none", "viewer", "analyst", "admin"}
+
+func (r role) String() string {
+	if r < roleNone || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+// parseRole returns the role of a name
+func parseRole(name string) (role, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range roleNames {
+		if n == name {
+			return role(i), nil
+		}
+	}
+	return roleNone, fmt.Errorf("Unknown role %q, use viewer, analyst or admin", name)
+}
+
+// groupPrefix is the prefix of grants on a group of domains
+const groupPrefix = "group:"
+
+// access is the role of a user on all domains and on single domains
+type access struct {
+	all     role
+	domains map[string]role
+}
+
+// fullAccess is the access of everybody when authentication is disabled
+var fullAccess = access{all: roleAdmin}
+
+// on returns the role on a policy domain
+func (a access) on(domain string) role {
+	if r := a.domains[strings.ToLower(domain)]; r > a.all {
+		return r
+	}
+	return a.all
+}
+
+// restricted returns true if only some domains can be seen
+func (a access) restricted() bool {
+	return a.all < roleViewer
+}
+
+// visible returns the domains that can be seen when access is restricted
+func (a access) visible() []string {
+	var ds []string
+	for d, r := range a.domains {
+		if r >= roleViewer {
+			ds = append(ds, d)
+		}
+	}
+	sort.Strings(ds)
+	return ds
+}
+
+// grant raises the role on a domain
+func (a *access) grant(domain string, r role) {
+	if a.domains == nil {
+		a.domains = make(map[string]role)
+	}
+	if r > a.domains[domain] {
+		a.domains[domain] = r
+	}
+}
+
+// access returns the access of a user from the grants in the storage. Users
+// without grants get the default role on all domains but services only get
+// what they are granted and unknown local users get nothing
+func (a *authenticator) access(ctx context.Context, user string) (access, error) {
+	if a == nil {
+		return fullAccess, nil
+	}
+
+	def := access{all: a.defaultRole}
+	if strings.HasPrefix(user, servicePrefix) {
+		def = access{}
+	} else if l, ok := a.password.(localUsers); ok {
+		// Deleted users may still have a session or a token
+		_, err := l.store.ReadUser(ctx, user)
+		if storage.IsNotFound(err) {
+			return access{}, nil
+		}
+		if err != nil {
+			return access{}, fmt.Errorf("Unable to read user %s: %v", user, err)
+		}
+	}
+
+	gs, ok := s.(storage.GrantStore)
+	if !ok {
+		return def, nil
+	}
+	grants, err := gs.ReadGrants(ctx, user)
+	if err != nil {
+		return access{}, fmt.Errorf("Unable to read grants of %s: %v", user, err)
+	}
+	if len(grants) == 0 {
+		return def, nil
+	}
+
+	var acc access
+	for _, g := range grants {
+		r, err := parseRole(g.Role)
+		if err != nil {
+			log.Warnf("Ignoring grant of %s on %s: %v", g.User, g.Scope, err)
+			continue
+		}
+		switch {
+		case g.Scope == "*":
+			if r > acc.all {
+				acc.all = r
+			}
+		case strings.HasPrefix(g.Scope, groupPrefix):
+			domains, ok := a.groups[strings.TrimPrefix(g.Scope, groupPrefix)]
+			if !ok {
+				log.Warnf("Ignoring grant of %s on unknown %s", g.User, g.Scope)
+			}
+			for _, d := range domains {
+				acc.grant(d, r)
+			}
+		default:
+			acc.grant(g.Scope, r)
+		}
+	}
+	return acc, nil
+}
+
+// accessKey is the context key of the access of the user
+type accessKey struct{}
+
+// accessFromContext returns the access of the user. A context without access
+// can do nothing
+func accessFromContext(ctx context.Context) access {
+	a, _ := ctx.Value(accessKey{}).(access)
+	return a
+}
+
+// authorize returns a context with the access of the user where the storage
+// is scoped to the domains the user can see. It returns false if the user
+// cannot see anything
+func authorize(ctx context.Context, user string) (context.Context, bool, error) {
+	a, err := auth.access(ctx, user)
+	if err != nil {
+		return ctx, false, err
+	}
+	if a.restricted() && len(a.visible()) == 0 {
+		return ctx, false, nil
+	}
+
+	ctx = context.WithValue(ctx, accessKey{}, a)
+	if a.restricted() {
+		ctx = storage.WithDomains(ctx, a.visible())
+	}
+	return ctx, true, nil
+}
+
+// allowed returns true if the user has at least the role on the domain
+func allowed(ctx context.Context, domain string, r role) bool {
+	return accessFromContext(ctx).on(domain) >= r
+}
+
+// isAdmin returns true if the user is admin on all domains
+func isAdmin(ctx context.Context) bool {
+	return accessFromContext(ctx).all >= roleAdmin
+}
+
+// csrfToken returns the token forms must post back. It is derived from the
+// client certificate user or else the session, so it changes on every login,
+// and signed with the key of the server
+func csrfToken(r *http.Request) string {
+	if auth == nil {
+		return ""
+	}
+	var subject string
+	if user, ok := auth.certUser(r); ok {
+		subject = "user:" + user
+	} else if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		subject = "session:" + c.Value
+	} else {
+		return ""
+	}
+	return auth.signCSRF(subject)
+}
+
+// signCSRF returns the form token of the subject
+func (a *authenticator) signCSRF(subject string) string {
+	mac := hmac.New(sha256.New, a.csrfKey)
+	mac.Write([]byte(subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF returns true if the form has the token of the session
+func validCSRF(r *http.Request) bool {
+	token := csrfToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.PostForm.Get("csrf"))) == 1
+}
+
+// validScope returns an error if the scope of a grant is not *, a group or a
+// domain name
+func validScope(scope string) error {
+	switch {
+	case scope == "*":
+	case strings.HasPrefix(scope, groupPrefix):
+		if strings.TrimPrefix(scope, groupPrefix) == "" {
+			return fmt.Errorf("The group has no name")
+		}
+	case !validDomain(scope):
+		return fmt.Errorf("%q is not *, a group or a domain name", scope)
+	}
+	return nil
+}
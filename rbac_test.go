@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestAccess(t *testing.T) {
+
+	ctx := setupMemory(t)
+	gs := s.(storage.GrantStore)
+
+	for _, g := range []storage.Grant{
+		{User: "vera", Role: "viewer", Scope: "group:dk"},
+		{User: "vera", Role: "analyst", Scope: "greyhat.dk"},
+		{User: "otto", Role: "admin", Scope: "*"},
+		{User: "otto", Role: "viewer", Scope: "example.com"},
+		{User: "lost", Role: "viewer", Scope: "group:unknown"},
+	} {
+		if err := gs.WriteGrant(ctx, g); err != nil {
+			t.Fatalf("Unable to write grant: %v", err)
+		}
+	}
+
+	a := &authenticator{
+		groups:      map[string][]string{"dk": {"greyhat.dk", "example.dk"}},
+		defaultRole: roleViewer,
+	}
+
+	for _, tc := range []struct {
+		user     string
+		expected access
+	}{
+		{"vera", access{domains: map[string]role{"greyhat.dk": roleAnalyst, "example.dk": roleViewer}}},
+		{"otto", access{all: roleAdmin, domains: map[string]role{"example.com": roleViewer}}},
+		{"lost", access{}},
+		{"new", access{all: roleViewer}},
+		{"service:ci", access{}},
+	} {
+		t.Run(tc.user, func(t *testing.T) {
+			acc, err := a.access(ctx, tc.user)
+			if err != nil {
+				t.Fatalf("Unable to resolve access: %v", err)
+			}
+			if !reflect.DeepEqual(acc, tc.expected) {
+				t.Errorf("Expected %+v but got %+v", tc.expected, acc)
+			}
+		})
+	}
+
+	acc, _ := a.access(ctx, "vera")
+	if acc.on("GREYHAT.dk") != roleAnalyst || acc.on("other.com") != roleNone {
+		t.Errorf("Unexpected roles of %+v", acc)
+	}
+	if !reflect.DeepEqual(acc.visible(), []string{"example.dk", "greyhat.dk"}) {
+		t.Errorf("Unexpected visible domains %v", acc.visible())
+	}
+	if acc, _ = a.access(ctx, "otto"); acc.on("example.com") != roleAdmin || acc.restricted() {
+		t.Errorf("Expected otto to be admin everywhere but got %+v", acc)
+	}
+}
+
+func TestRoles(t *testing.T) {
+
+	ctx := setupMemory(t)
+	gs := s.(storage.GrantStore)
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{
+		Type:        "local",
+		SessionTTL:  3600,
+		Groups:      map[string][]string{"dk": {"greyhat.dk"}},
+		DefaultRole: "none",
+	}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	for _, g := range []storage.Grant{
+		{User: "vera", Role: "viewer", Scope: "group:dk"},
+		{User: "otto", Role: "analyst", Scope: "other.com"},
+		{User: "root", Role: "admin", Scope: "*"},
+	} {
+		if err = gs.WriteGrant(ctx, g); err != nil {
+			t.Fatalf("Unable to write grant: %v", err)
+		}
+	}
+
+	h := httpHandler(ctx)
+	sessions := make(map[string]*http.Cookie)
+	for _, user := range []string{"vera", "otto", "root", "nobody"} {
+		if err = s.(storage.UserStore).WriteUser(ctx, storage.User{Name: user, PasswordHash: "x"}); err != nil {
+			t.Fatalf("Unable to write user: %v", err)
+		}
+		token, err := auth.sessions.create(user, "")
+		if err != nil {
+			t.Fatalf("Unable to create session: %v", err)
+		}
+		sessions[user] = &http.Cookie{Name: sessionCookie, Value: token}
+	}
+
+	do := func(user, method, path string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, path, nil)
+		}
+		req.AddCookie(sessions[user])
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	tt := []struct {
+		user     string
+		path     string
+		status   int
+		contains string
+		hidden   string
+	}{
+		{"vera", "/reports", http.StatusOK, "myid123", ""},
+		{"vera", "/report/1", http.StatusOK, "myid123", ""},
+		{"vera", "/domain/greyhat.dk", http.StatusOK, "greyhat.dk", ""},
+		{"vera", "/api/v1/reports", http.StatusOK, "myid123", ""},
+		{"vera", "/analyse/greyhat.dk/10.10.10.1", http.StatusForbidden, "Access denied", ""},
+		{"vera", "/api/v1/analyse/greyhat.dk/10.10.10.1", http.StatusForbidden, "Access denied", ""},
+		{"vera", "/admin/users", http.StatusForbidden, "Access denied", ""},
+		{"otto", "/reports", http.StatusOK, "Reports", "myid123"},
+		{"otto", "/reporters", http.StatusOK, "Reporters", "example.com"},
+		{"otto", "/report/1", http.StatusNotFound, "Unknown report", ""},
+		{"otto", "/report/1/export?format=csv", http.StatusNotFound, "Unknown report", ""},
+		{"otto", "/reports/export?format=csv", http.StatusOK, "source_ip", "10.10.10.1"},
+		{"otto", "/domain/greyhat.dk", http.StatusForbidden, "Access denied", ""},
+		{"otto", "/api/v1/reports", http.StatusOK, `"total": 0`, "myid123"},
+		{"otto", "/api/v1/reports/1", http.StatusNotFound, "", ""},
+		{"otto", "/api/v1/analyse/greyhat.dk/10.10.10.1", http.StatusForbidden, "Access denied", ""},
+		{"nobody", "/reports", http.StatusForbidden, "Access denied", ""},
+		{"nobody", "/api/v1/reports", http.StatusForbidden, "Access denied", ""},
+		{"root", "/admin/users", http.StatusOK, "group:dk", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.user+tc.path, func(t *testing.T) {
+			w := do(tc.user, http.MethodGet, tc.path, nil)
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected response to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+			if tc.hidden != "" && strings.Contains(w.Body.String(), tc.hidden) {
+				t.Errorf("Expected response to hide %q:\n%s", tc.hidden, w.Body.String())
+			}
+		})
+	}
+
+	// Changes need the form token of the session
+	grant := url.Values{"action": {"grant"}, "user": {"otto"}, "role": {"viewer"}, "scope": {"greyhat.dk"}}
+	if w := do("root", http.MethodPost, "/admin/users", grant); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a form without token to fail but got %d", w.Code)
+	}
+	grant.Set("csrf", csrfToken(&http.Request{Header: http.Header{"Cookie": {sessions["root"].String()}}}))
+	if w := do("vera", http.MethodPost, "/admin/users", grant); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be denied but got %d", w.Code)
+	}
+	if w := do("root", http.MethodPost, "/admin/users", grant); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the grant to redirect but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("otto", http.MethodGet, "/report/1", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected otto to see the report after the grant but got %d", w.Code)
+	}
+
+	grant.Set("scope", "group:unknown")
+	if w := do("root", http.MethodPost, "/admin/users", grant); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Unknown group") {
+		t.Errorf("Expected an unknown group to fail but got %d: %s", w.Code, w.Body.String())
+	}
+
+	revoke := url.Values{"action": {"revoke"}, "user": {"otto"}, "scope": {"greyhat.dk"}, "csrf": grant["csrf"]}
+	if w := do("root", http.MethodPost, "/admin/users", revoke); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the revoke to redirect but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("otto", http.MethodGet, "/report/1", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected otto to lose the report after the revoke but got %d", w.Code)
+	}
+
+	// Deleted users are logged out and users removed behind the back of the
+	// server get nothing
+	del := url.Values{"action": {"delete"}, "user": {"vera"}, "csrf": grant["csrf"]}
+	if w := do("root", http.MethodPost, "/admin/users", del); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the delete to redirect but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("vera", http.MethodGet, "/reports", nil); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected vera to be logged out but got %d", w.Code)
+	}
+	if err = s.(storage.UserStore).DeleteUser(ctx, "otto"); err != nil {
+		t.Fatalf("Unable to delete user: %v", err)
+	}
+	if w := do("otto", http.MethodGet, "/reports", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected otto to be denied but got %d", w.Code)
+	}
+}
+
+func TestNewGrant(t *testing.T) {
+
+	for _, tc := range []struct {
+		role, scope string
+		valid       bool
+	}{
+		{"Viewer", " Example.COM", true},
+		{"admin", "*", true},
+		{"analyst", "group:emea", true},
+		{"analyst", "group:", false},
+		{"none", "*", false},
+		{"owner", "*", false},
+		{"viewer", "not a domain", false},
+		{"viewer", "a.mail.example.com", true},
+		{"viewer", "shop.example.co.uk", true},
+		{"viewer", "example.technology", true},
+	} {
+		g, err := newGrant("alice", tc.role, tc.scope)
+		if (err == nil) != tc.valid {
+			t.Errorf("Expected %s on %s to be valid %v but got %v", tc.role, tc.scope, tc.valid, err)
+		}
+		if err == nil && (g.Role != strings.ToLower(tc.role) || g.Scope != strings.ToLower(strings.TrimSpace(tc.scope))) {
+			t.Errorf("Expected the grant to be normalised but got %+v", g)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// reportPage is the data for the report template
+type reportPage struct {
+	Report dmarc.Report
+	Rows   []dmarc.Row
+	Notes  []storage.Note
+	// Annotate is true if the user can add notes
+	Annotate bool
+	// Manage is true if the user can delete and re-ingest the report
+	Manage bool
+	CSRF   string
+	Error  string
+}
+
+func handleReport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to convert %s to int64", vars["id"])
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	report, err := s.ReadReport(ctx, id)
+	if storage.IsNotFound(err) {
+		http.Error(w, "Unknown report", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read report %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data := reportPage{Report: report.Report, Rows: report.Rows}
+
+	// Changes are made by a known user with the form token of the session
+	ns, _ := s.(storage.NoteStore)
+	rm, _ := s.(storage.ReportManager)
+	domain := data.Report.PolicyDomain
+	data.Annotate = auth != nil && ns != nil && allowed(ctx, domain, roleAnalyst)
+	data.Manage = auth != nil && rm != nil && allowed(ctx, domain, roleAdmin)
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil || !validCSRF(r) {
+			http.Error(w, "form is not valid", http.StatusBadRequest)
+			return
+		}
+
+		next, err := updateReport(ctx, ns, rm, data, r)
+		if err == errDenied {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+
+	if ns != nil {
+		if data.Notes, err = ns.ReadNotes(ctx, id); err != nil {
+			errors <- fmt.Errorf("Unable to read notes of report %d: %v", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	data.CSRF = csrfToken(r)
+
+	render(w, status, "report.html", data)
+}
+
+// errDenied is returned when the user lacks the role for an action
+var errDenied = fmt.Errorf("Access denied")
+
+// updateReport runs the action posted from the report page and returns the
+// page to go to next
+func updateReport(ctx context.Context, ns storage.NoteStore, rm storage.ReportManager, data reportPage, r *http.Request) (string, error) {
+
+	user, id := userFromContext(ctx), data.Report.ID
+
+	switch action := r.PostForm.Get("action"); action {
+	case "note":
+		if !data.Annotate {
+			return "", errDenied
+		}
+		if err := ns.WriteNote(ctx, id, storage.Note{User: user, Text: r.PostForm.Get("note")}); err != nil {
+			return "", err
+		}
+		log.Infof("%s added a note to report %d", user, id)
+		return fmt.Sprintf("/report/%d", id), nil
+	case "delete":
+		if !data.Manage {
+			return "", errDenied
+		}
+		if err := rm.DeleteReport(ctx, id); err != nil {
+			return "", err
+		}
+		log.Infof("%s deleted report %s from %s", user, data.Report.ReportID, data.Report.ReportOrg)
+		return "/reports", nil
+	case "reingest":
+		if !data.Manage {
+			return "", errDenied
+		}
+		if err := reingestReport(ctx, rm, id); err != nil {
+			return "", err
+		}
+		log.Infof("%s re-ingested report %s from %s", user, data.Report.ReportID, data.Report.ReportOrg)
+		return "/reports", nil
+	default:
+		return "", fmt.Errorf("Unknown action %q", action)
+	}
+}
+
+// reingestReport reads a report again from the document it was read from and
+// replaces the stored report. The notes are kept
+func reingestReport(ctx context.Context, rm storage.ReportManager, id int64) error {
+
+	doc, err := rm.ReadDocument(ctx, id)
+	if storage.IsNotFound(err) {
+		return fmt.Errorf("The report was stored before documents were kept and cannot be re-ingested")
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := dmarc.Read(doc.Data)
+	if err != nil {
+		return fmt.Errorf("Unable to parse the document: %v", err)
+	}
+	// The document decides the domain, so it must be one the user manages
+	if !allowed(ctx, f.PolicyPublished.Domain, roleAdmin) {
+		return errDenied
+	}
+
+	f.FromFile, f.Raw, f.Received = doc.Source, doc.Data, doc.Received
+	return s.Write(storage.WithReplace(storage.WithTenant(ctx, doc.Tenant)), f)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestReportActions(t *testing.T) {
+
+	ctx := setupMemory(t)
+	gs := s.(storage.GrantStore)
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "local", SessionTTL: 3600, DefaultRole: "none"}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	for _, g := range []storage.Grant{
+		{User: "vera", Role: "viewer", Scope: "greyhat.dk"},
+		{User: "anna", Role: "analyst", Scope: "greyhat.dk"},
+		{User: "root", Role: "admin", Scope: "greyhat.dk"},
+	} {
+		if err = gs.WriteGrant(ctx, g); err != nil {
+			t.Fatalf("Unable to write grant: %v", err)
+		}
+	}
+
+	h := httpHandler(ctx)
+	sessions := make(map[string]*http.Cookie)
+	for _, user := range []string{"vera", "anna", "root"} {
+		if err = s.(storage.UserStore).WriteUser(ctx, storage.User{Name: user, PasswordHash: "x"}); err != nil {
+			t.Fatalf("Unable to write user: %v", err)
+		}
+		token, err := auth.sessions.create(user, "")
+		if err != nil {
+			t.Fatalf("Unable to create session: %v", err)
+		}
+		sessions[user] = &http.Cookie{Name: sessionCookie, Value: token}
+	}
+
+	// The steps run in order against the same storage. Re-ingesting stores
+	// the report under a new ID
+	tt := []struct {
+		name     string
+		user     string
+		path     string
+		action   string
+		note     string
+		noToken  bool
+		status   int
+		contains string
+		hidden   string
+	}{
+		{"viewer_page", "vera", "/report/1", "", "", false, http.StatusOK, "myid123", `value="note"`},
+		{"no_token", "root", "/report/1", "note", "Forwarded", true, http.StatusBadRequest, "form is not valid", ""},
+		{"viewer_note", "vera", "/report/1", "note", "Forwarded", false, http.StatusForbidden, "Access denied", ""},
+		{"analyst_page", "anna", "/report/1", "", "", false, http.StatusOK, `value="note"`, `value="delete"`},
+		{"analyst_note", "anna", "/report/1", "note", "Forwarded by the list", false, http.StatusSeeOther, "", ""},
+		{"analyst_delete", "anna", "/report/1", "delete", "", false, http.StatusForbidden, "Access denied", ""},
+		{"analyst_reingest", "anna", "/report/1", "reingest", "", false, http.StatusForbidden, "Access denied", ""},
+		{"notes", "vera", "/report/1", "", "", false, http.StatusOK, "Forwarded by the list", ""},
+		{"empty_note", "root", "/report/1", "note", " ", false, http.StatusBadRequest, "The note is empty", ""},
+		{"unknown_action", "root", "/report/1", "purge", "", false, http.StatusBadRequest, "Unknown action", ""},
+		{"admin_page", "root", "/report/1", "", "", false, http.StatusOK, `value="delete"`, ""},
+		{"reingest", "root", "/report/1", "reingest", "", false, http.StatusSeeOther, "", ""},
+		{"reingested", "vera", "/report/1", "", "", false, http.StatusNotFound, "Unknown report", ""},
+		{"notes_kept", "vera", "/report/2", "", "", false, http.StatusOK, "Forwarded by the list", ""},
+		{"delete", "root", "/report/2", "delete", "", false, http.StatusSeeOther, "", ""},
+		{"deleted", "root", "/report/2", "", "", false, http.StatusNotFound, "Unknown report", ""},
+		{"delete_missing", "root", "/report/2", "delete", "", false, http.StatusNotFound, "Unknown report", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.action != "" {
+				form := url.Values{
+					"action": {tc.action},
+					"note":   {tc.note},
+				}
+				if !tc.noToken {
+					form.Set("csrf", csrfToken(&http.Request{Header: http.Header{"Cookie": {sessions[tc.user].String()}}}))
+				}
+				req = httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.AddCookie(sessions[tc.user])
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected response to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+			if tc.hidden != "" && strings.Contains(w.Body.String(), tc.hidden) {
+				t.Errorf("Expected response to hide %q:\n%s", tc.hidden, w.Body.String())
+			}
+		})
+	}
+
+	mem := s.(*storage.Memory)
+	if n, _ := mem.CountReports(ctx, storage.ReportQuery{}); n != 0 {
+		t.Errorf("Expected the report to be deleted but found %d", n)
+	}
+	if stats, _ := mem.ReadStats(ctx, storage.StatsQuery{}); len(stats) != 0 {
+		t.Errorf("Expected the deleted report to leave the statistics: %#v", stats)
+	}
+	if counts, err := mem.ReporterCounts(ctx); err != nil || len(counts) != 0 {
+		t.Errorf("Expected the re-ingest not to count as a duplicate: %#v %v", counts, err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// minStale is the shortest time without reports before a reporter is
+// considered to have stopped sending for a domain
+const minStale = 48 * time.Hour
+
+// reporterDomain is the reports of a reporter for a policy domain
+type reporterDomain struct {
+	storage.ReporterDomain
+	// Interval is the average time between the reports
+	Interval time.Duration
+	// Stale is true if no report has been received for more than twice the
+	// interval
+	Stale bool
+}
+
+// reporterSummary is the reports of a reporter across its policy domains
+type reporterSummary struct {
+	Reporter   string
+	Reports    int64
+	Messages   int64
+	Rows       int64
+	Duplicates int64
+	Malformed  int64
+	First      time.Time
+	Last       time.Time
+	Interval   time.Duration
+	// Stale is the number of domains the reporter has stopped sending for
+	Stale   int
+	Domains []reporterDomain
+}
+
+// AvgMessages is the average number of messages per report
+func (r reporterSummary) AvgMessages() float64 {
+	if r.Reports == 0 {
+		return 0
+	}
+	return float64(r.Messages) / float64(r.Reports)
+}
+
+// AvgRows is the average number of rows per report
+func (r reporterSummary) AvgRows() float64 {
+	if r.Reports == 0 {
+		return 0
+	}
+	return float64(r.Rows) / float64(r.Reports)
+}
+
+// interval returns the average time between the reports of a period
+func interval(first, last time.Time, reports int64) time.Duration {
+	if reports == 0 {
+		return 0
+	}
+	return last.Sub(first) / time.Duration(reports)
+}
+
+// stale returns true if the last report is older than twice the interval
+func stale(last time.Time, interval time.Duration, now time.Time) bool {
+	after := 2 * interval
+	if after < minStale {
+		after = minStale
+	}
+	return now.Sub(last) > after
+}
+
+// summarise returns the summary per reporter sorted by reporter
+func summarise(domains []storage.ReporterDomain, counts []storage.ReporterCount, now time.Time) []reporterSummary {
+
+	var list []reporterSummary
+	index := make(map[string]int)
+	get := func(reporter string) *reporterSummary {
+		i, ok := index[reporter]
+		if !ok {
+			i = len(list)
+			index[reporter] = i
+			list = append(list, reporterSummary{Reporter: reporter})
+		}
+		return &list[i]
+	}
+
+	var span = make(map[string]time.Duration)
+	for _, d := range domains {
+		r := get(d.Reporter)
+		rd := reporterDomain{ReporterDomain: d, Interval: interval(d.First, d.Last, d.Reports)}
+		rd.Stale = stale(d.Last, rd.Interval, now)
+
+		r.Domains = append(r.Domains, rd)
+		r.Reports += d.Reports
+		r.Messages += d.Messages
+		r.Rows += d.Rows
+		if r.First.IsZero() || d.First.Before(r.First) {
+			r.First = d.First
+		}
+		if d.Last.After(r.Last) {
+			r.Last = d.Last
+		}
+		if rd.Stale {
+			r.Stale++
+		}
+		span[d.Reporter] += d.Last.Sub(d.First)
+	}
+
+	for _, c := range counts {
+		r := get(c.Reporter)
+		r.Duplicates += c.Duplicates
+		r.Malformed += c.Malformed
+	}
+
+	for i := range list {
+		if list[i].Reports > 0 {
+			list[i].Interval = span[list[i].Reporter] / time.Duration(list[i].Reports)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Reporter < list[j].Reporter })
+	return list
+}
+
+// readReporters reads the summaries of the reporter or all of them if empty
+func readReporters(ctx context.Context, rr storage.ReporterReader, org string) ([]reporterSummary, error) {
+
+	domains, err := rr.ReadReporters(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []storage.ReporterCount
+	if rc, ok := s.(storage.ReporterCounter); ok {
+		if counts, err = rc.ReporterCounts(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if org != "" {
+		var own []storage.ReporterCount
+		for _, c := range counts {
+			if c.Reporter == org {
+				own = append(own, c)
+			}
+		}
+		counts = own
+	}
+
+	return summarise(domains, counts, time.Now()), nil
+}
+
+// countMalformed counts a report that could not be parsed for its reporter
+// if the organisation can be found in it
+func countMalformed(ctx context.Context, q dmarc.Content) {
+	rc, ok := s.(storage.ReporterCounter)
+	org := dmarc.OrgName(q.Data.Bytes())
+	if !ok || org == "" {
+		return
+	}
+	if storageDown.Load() {
+		errors <- fmt.Errorf("Unable to count malformed report %s: %v", q.Name, errStorageDown)
+		return
+	}
+
+	if tenant := tenants.forReport("", q.From); tenant != "" {
+		ctx = storage.WithTenant(ctx, tenant)
+	}
+	if err := rc.AddMalformed(ctx, org); err != nil {
+		errors <- fmt.Errorf("Unable to count malformed report %s: %v", q.Name, err)
+	}
+}
+
+func handleReporters(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	rr, ok := s.(storage.ReporterReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support reporters", http.StatusNotImplemented)
+		return
+	}
+
+	reporters, err := readReporters(ctx, rr, "")
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read reporters: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	render(w, http.StatusOK, "reporters.html", reporters)
+}
+
+// reporterPage is the data for the reporter template
+type reporterPage struct {
+	reporterSummary
+	From   time.Time
+	To     time.Time
+	Volume svgChart
+}
+
+func handleReporter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	org := strings.ToLower(strings.TrimSpace(mux.Vars(r)["org"]))
+
+	rr, ok := s.(storage.ReporterReader)
+	if !ok {
+		http.Error(w, "The storage driver does not support reporters", http.StatusNotImplemented)
+		return
+	}
+
+	reporters, err := readReporters(ctx, rr, org)
+	if err != nil {
+		errors <- fmt.Errorf("Unable to read reporter %s: %v", org, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(reporters) == 0 {
+		http.Error(w, "Unknown reporter", http.StatusNotFound)
+		return
+	}
+
+	data := reporterPage{reporterSummary: reporters[0], To: tomorrow()}
+
+	if sr, ok := s.(storage.StatsReader); ok {
+		volume, err := sr.ReadStats(ctx, storage.StatsQuery{Reporter: org,
+			GroupBy: []string{storage.StatDay, storage.StatDKIMAlign, storage.StatSPFAlign}})
+		if err != nil {
+			errors <- fmt.Errorf("Unable to read statistics of %s: %v", org, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data.From = firstDay(volume, data.To)
+		data.Volume = volumeChart(volumeBuckets(volume, data.From, data.To))
+	}
+
+	render(w, http.StatusOK, "reporter.html", data)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestSummarise(t *testing.T) {
+
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	domains := []storage.ReporterDomain{
+		{Reporter: "google.com", Domain: "a.dk", Reports: 10, Messages: 100, Rows: 20, First: day(1), Last: day(11)},
+		{Reporter: "google.com", Domain: "b.dk", Reports: 2, Messages: 20, Rows: 4, First: day(1), Last: day(3)},
+		{Reporter: "aol.com", Domain: "a.dk", Reports: 1, Messages: 1, Rows: 1, First: day(10), Last: day(11)},
+	}
+	counts := []storage.ReporterCount{
+		{Reporter: "google.com", Duplicates: 3, Malformed: 1},
+		{Reporter: "yahoo.com", Malformed: 2},
+	}
+
+	list := summarise(domains, counts, day(12))
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 reporters but got %d", len(list))
+	}
+
+	var names []string
+	for _, r := range list {
+		names = append(names, r.Reporter)
+	}
+	if names[0] != "aol.com" || names[1] != "google.com" || names[2] != "yahoo.com" {
+		t.Errorf("Expected the reporters sorted by name but got %v", names)
+	}
+
+	g := list[1]
+	if g.Reports != 12 || g.Messages != 120 || g.Rows != 24 || g.Duplicates != 3 || g.Malformed != 1 {
+		t.Errorf("Expected the totals of google.com but got %+v", g)
+	}
+	if !g.First.Equal(day(1)) || !g.Last.Equal(day(11)) {
+		t.Errorf("Expected google.com from %v to %v but got %v to %v", day(1), day(11), g.First, g.Last)
+	}
+	if g.Interval != 24*time.Hour {
+		t.Errorf("Expected an interval of a day but got %v", g.Interval)
+	}
+	if g.AvgMessages() != 10 || g.AvgRows() != 2 {
+		t.Errorf("Expected 10 messages and 2 rows per report but got %v and %v", g.AvgMessages(), g.AvgRows())
+	}
+	if g.Stale != 1 || g.Domains[0].Stale || !g.Domains[1].Stale {
+		t.Errorf("Expected only b.dk to be stopped but got %+v", g.Domains)
+	}
+
+	if y := list[2]; y.Reports != 0 || y.Malformed != 2 || y.AvgMessages() != 0 {
+		t.Errorf("Expected only malformed reports from yahoo.com but got %+v", y)
+	}
+}
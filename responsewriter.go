@@ -41,6 +41,7 @@ func LogHTTP(handler http.Handler) http.HandlerFunc {
 		sw := statusWriter{ResponseWriter: w}
 		handler.ServeHTTP(&sw, r)
 		duration := time.Now().Sub(start)
+		observeHTTP(r, sw.status, duration)
 
 		log.Infof("%s [%s] %s %d %d %s %s %s",
 			r.RemoteAddr, start, strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto),
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeLoop expires old reports and daily statistics at the configured interval
+func purgeLoop(ctx context.Context, p storage.Purger, c cfg.RetentionCfg) {
+
+	if c.Days == 0 && c.Months == 0 {
+		return
+	}
+
+	for {
+		var rows, stats time.Time
+
+		now := time.Now()
+		if c.Days > 0 {
+			rows = now.AddDate(0, 0, -c.Days)
+		}
+		if c.Months > 0 {
+			stats = now.AddDate(0, -c.Months, 0)
+		}
+
+		log.Debugf("Purging reports before %v and daily statistics before %v", rows, stats)
+		if storageDown.Load() {
+			log.Warnf("Skipping purge: %v", errStorageDown)
+		} else if res, err := p.Purge(ctx, rows, stats); err != nil {
+			errors <- err
+		} else {
+			log.Infof("Purged %d reports with %d rows and %d daily statistics", res.Reports, res.Rows, res.Stats)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(c.Interval) * time.Second):
+		}
+	}
+}
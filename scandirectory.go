@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/desdic/godmarcparser/dmarc"
 	"github.com/desdic/godmarcparser/input"
@@ -22,8 +23,8 @@ func ScanDirectory(ctx context.Context, queue chan<- dmarc.Content, errors chan<
 
 	var i input.Handler
 
-DONE:
 	for _, f := range files {
+		filesScanned.Inc()
 
 		switch {
 		case strings.HasSuffix(f.Name(), ".xml.gz"):
@@ -33,13 +34,14 @@ DONE:
 		case strings.HasSuffix(f.Name(), ".xml"):
 			i = input.XmlInput{}
 		default:
+			parseFailures.WithLabelValues(failureUnknownType).Inc()
 			errors <- fmt.Errorf("Unknown filetype %s, skipping", f.Name())
 			continue
 		}
 
 		select {
 		case <-ctx.Done():
-			break DONE
+			return
 		default:
 		}
 
@@ -47,7 +49,10 @@ DONE:
 		log.Debugf("Found %s", fname)
 		err := i.Read(ctx, fname, queue)
 		if err != nil {
+			parseFailures.WithLabelValues(failureUnreadable).Inc()
 			errors <- err
 		}
 	}
+	lastScan.WithLabelValues(path).SetToCurrentTime()
+	ingest.scanned(path, time.Now())
 }
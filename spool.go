@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spoolInterval is how often spooled reports are replayed
+const spoolInterval = 30 * time.Second
+
+// storageDown is set while the storage could not be initialized at startup.
+// Reports are spooled until it is and everything else that needs the
+// storage is unavailable
+var storageDown atomic.Bool
+
+// errStorageDown is returned for work that needs the storage while it is down
+var errStorageDown = fmt.Errorf("The storage is not available yet")
+
+// spooled is a report waiting in the spool directory for the storage to
+// become available
+type spooled struct {
+	Tenant   string         `json:"tenant"`
+	Feedback dmarc.Feedback `json:"feedback"`
+}
+
+// writer stores feedback retrying transient errors. Feedback that still
+// can't be stored is spooled to disk and replayed later
+type writer struct {
+	s       storage.Storage
+	retries int
+	spool   string
+	// backoff returns the time to wait before retry n
+	backoff func(n int) time.Duration
+}
+
+// write stores the feedback for the tenant
+func (w *writer) write(ctx context.Context, tenant string, f dmarc.Feedback) error {
+
+	err := errStorageDown
+	if !storageDown.Load() {
+		err = w.store(ctx, tenant, f)
+	}
+	if err == nil || (err != errStorageDown && !storage.IsTransient(err)) || w.spool == "" {
+		return err
+	}
+
+	log.Warnf("Spooling report %s from %s: %v", f.ReportMetadata.ReportID, f.ReportMetadata.OrgName, err)
+	if serr := w.save(spooled{Tenant: tenant, Feedback: f}); serr != nil {
+		return fmt.Errorf("Unable to spool report after %v: %v", err, serr)
+	}
+	return nil
+}
+
+// store writes to the storage with retries
+func (w *writer) store(ctx context.Context, tenant string, f dmarc.Feedback) (err error) {
+
+	var outcome storage.WriteOutcome
+	wctx := storage.WithOutcome(ctx, &outcome)
+	if tenant != "" {
+		wctx = storage.WithTenant(wctx, tenant)
+	}
+
+	start := time.Now()
+	defer func() { observeStore(f, outcome, time.Since(start), err) }()
+
+	for n := 0; n <= w.retries; n++ {
+		if n > 0 {
+			log.Debugf("Retrying write in %v: %v", w.backoff(n), err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(w.backoff(n)):
+			}
+		}
+
+		if err = w.s.Write(wctx, f); err == nil || !storage.IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// save writes the report to a new file in the spool directory. The file is
+// renamed into place so replay never sees a partial file
+func (w *writer) save(r spooled) error {
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(w.spool, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(w.spool, ".spool-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	name := filepath.Join(w.spool, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+	return os.Rename(tmp.Name(), name)
+}
+
+// replay writes the spooled reports in the order they were spooled. It stops
+// at the first transient error since the storage is still unavailable
+func (w *writer) replay(ctx context.Context) (n int, err error) {
+
+	if storageDown.Load() {
+		return 0, errStorageDown
+	}
+
+	files, err := ioutil.ReadDir(w.spool)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Unable to list spool: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		name := filepath.Join(w.spool, fi.Name())
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return n, fmt.Errorf("Unable to read %s: %v", name, err)
+		}
+
+		var r spooled
+		if err = json.Unmarshal(b, &r); err != nil {
+			errors <- fmt.Errorf("Unable to parse %s, skipping: %v", name, err)
+			continue
+		}
+
+		wctx := ctx
+		if r.Tenant != "" {
+			wctx = storage.WithTenant(ctx, r.Tenant)
+		}
+		if err = w.s.Write(wctx, r.Feedback); err != nil {
+			if storage.IsTransient(err) {
+				return n, err
+			}
+			// It will never succeed so it is dropped like a failed write
+			errors <- fmt.Errorf("Unable to store spooled %s: %v", name, err)
+		} else {
+			n++
+		}
+
+		if err = os.Remove(name); err != nil {
+			return n, fmt.Errorf("Unable to remove %s: %v", name, err)
+		}
+	}
+	return n, nil
+}
+
+// replayLoop replays the spool at spoolInterval until the context is
+// cancelled
+func (w *writer) replayLoop(ctx context.Context) {
+	if w.spool == "" {
+		return
+	}
+
+	for {
+		n, err := w.replay(ctx)
+		if n > 0 {
+			log.Infof("Replayed %d spooled reports", n)
+		}
+		if err != nil {
+			log.Warnf("Spooled reports are not replayed yet: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(spoolInterval):
+		}
+	}
+}
+
+// initializeLater retries initializing the storage after it failed at
+// startup until it succeeds or the context is cancelled
+func initializeLater(ctx context.Context, err error) {
+
+	for n := 1; err != nil; n++ {
+		wait := storage.Backoff(n)
+		log.Warnf("Storage is not available, retrying in %v: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		err = s.Initialize(ctx)
+	}
+
+	storageDown.Store(false)
+	log.Info("Storage is available, replaying the spool")
+	loadReportEnds(ctx)
+}
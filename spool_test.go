@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// flakyStorage fails writes with err until it is cleared
+type flakyStorage struct {
+	storage.Memory
+	err    error
+	writes int
+}
+
+func (f *flakyStorage) Write(ctx context.Context, fb dmarc.Feedback) error {
+	f.writes++
+	if f.err != nil {
+		return f.err
+	}
+	return f.Memory.Write(ctx, fb)
+}
+
+func TestWriterSpool(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	f, err := dmarc.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to parse report: %v", err)
+	}
+
+	fs := &flakyStorage{err: fmt.Errorf("Unable to start transactions: %w", driver.ErrBadConn)}
+	w := &writer{
+		s:       fs,
+		retries: 2,
+		spool:   t.TempDir(),
+		backoff: func(n int) time.Duration { return time.Millisecond },
+	}
+
+	if err := w.write(ctx, "acme", f); err != nil {
+		t.Fatalf("Expected report to be spooled: %v", err)
+	}
+	if fs.writes != 3 {
+		t.Errorf("Expected 3 attempts got %d", fs.writes)
+	}
+
+	files, _ := ioutil.ReadDir(w.spool)
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 spooled report got %d", len(files))
+	}
+
+	// Still unavailable so nothing is replayed
+	if n, err := w.replay(ctx); n != 0 || err == nil {
+		t.Errorf("Expected replay to fail: %d %v", n, err)
+	}
+
+	fs.err = nil
+	if n, err := w.replay(ctx); n != 1 || err != nil {
+		t.Fatalf("Expected 1 replayed report: %d %v", n, err)
+	}
+
+	files, _ = ioutil.ReadDir(w.spool)
+	if len(files) != 0 {
+		t.Errorf("Expected spool to be empty got %d files", len(files))
+	}
+
+	reports, err := fs.ReadReports(storage.WithTenant(ctx, "acme"), storage.ReportQuery{PageSize: 10})
+	if err != nil || len(reports) != 1 {
+		t.Errorf("Expected replayed report to belong to the tenant: %v %v", reports, err)
+	}
+
+	// Permanent errors are returned right away and not spooled
+	fs.err = fmt.Errorf("Invalid id returned: 0")
+	fs.writes = 0
+	if err := w.write(ctx, "", f); err == nil || fs.writes != 1 {
+		t.Errorf("Expected a single failed write: %d %v", fs.writes, err)
+	}
+	files, _ = ioutil.ReadDir(w.spool)
+	if len(files) != 0 {
+		t.Errorf("Expected nothing to be spooled got %d files", len(files))
+	}
+}
+
+func TestSpoolOrder(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	received := time.Now().UTC().Truncate(time.Second)
+	read := func(count int64, received time.Time) dmarc.Feedback {
+		t.Helper()
+		f, err := dmarc.Read(b)
+		if err != nil {
+			t.Fatalf("Unable to parse report: %v", err)
+		}
+		f.Records[0].Rows[0].Count = count
+		f.Raw, f.Received = b, received
+		return f
+	}
+
+	fs := &flakyStorage{
+		Memory: storage.Memory{Dedupe: storage.DedupePolicy{Identical: storage.DedupeSkip, Changed: storage.DedupeReplace}},
+		err:    fmt.Errorf("Unable to start transactions: %w", driver.ErrBadConn),
+	}
+	w := &writer{s: fs, spool: t.TempDir(), backoff: func(n int) time.Duration { return time.Millisecond }}
+
+	// The first copy is spooled and a corrected copy received later is
+	// stored before the spool is replayed
+	if err = w.write(ctx, "", read(2, received)); err != nil {
+		t.Fatalf("Expected report to be spooled: %v", err)
+	}
+	fs.err = nil
+	if err = w.write(ctx, "", read(7, received.Add(time.Hour))); err != nil {
+		t.Fatalf("Unable to store report: %v", err)
+	}
+	if n, err := w.replay(ctx); n != 1 || err != nil {
+		t.Fatalf("Expected 1 replayed report: %d %v", n, err)
+	}
+
+	reports, err := fs.ReadReports(ctx, storage.ReportQuery{PageSize: 10})
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("Expected one report: %v %v", reports, err)
+	}
+	rows, err := fs.ReadReport(ctx, reports[0].ID)
+	if err != nil || len(rows.Rows) != 1 || rows.Rows[0].Count != 7 {
+		t.Errorf("Expected the corrected report to be kept: %+v %v", rows, err)
+	}
+}
+
+func TestStorageDown(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	f, err := dmarc.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to parse report: %v", err)
+	}
+
+	storageDown.Store(true)
+	t.Cleanup(func() { storageDown.Store(false) })
+
+	fs := &flakyStorage{}
+	w := &writer{s: fs, spool: t.TempDir(), backoff: func(n int) time.Duration { return 0 }}
+
+	// Reports go straight to the spool and stay there
+	if err := w.write(ctx, "", f); err != nil || fs.writes != 0 {
+		t.Fatalf("Expected the report to be spooled without writes: %d %v", fs.writes, err)
+	}
+	if n, err := w.replay(ctx); n != 0 || err != errStorageDown {
+		t.Errorf("Expected no replay while the storage is down: %d %v", n, err)
+	}
+
+	tt := []struct {
+		path   string
+		status int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusServiceUnavailable},
+		{"/metrics", http.StatusOK},
+		{"/reports", http.StatusServiceUnavailable},
+		{"/api/v1/reports", http.StatusServiceUnavailable},
+		{"/login", http.StatusServiceUnavailable},
+	}
+
+	h := httpHandler(ctx)
+	for _, tc := range tt {
+		t.Run(tc.path, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if rw.Code != tc.status {
+				t.Errorf("Expected status %d but got %d: %s", tc.status, rw.Code, rw.Body.String())
+			}
+		})
+	}
+
+	storageDown.Store(false)
+	if n, err := w.replay(ctx); n != 1 || err != nil {
+		t.Errorf("Expected the spooled report to be replayed: %d %v", n, err)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/reports", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the pages to work again but got %d", rw.Code)
+	}
+}
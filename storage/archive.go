@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ArchiveReport is a report with its rows as stored, used for moving data
+// between drivers. ID is only used for relating the rows to the report
+type ArchiveReport struct {
+	ID                     int64     `json:"id"`
+	Tenant                 string    `json:"tenant"`
+	Begin                  time.Time `json:"begin"`
+	End                    time.Time `json:"end"`
+	PolicyDomain           string    `json:"policy_domain"`
+	ReportOrg              string    `json:"report_org"`
+	ReportID               string    `json:"report_id"`
+	ReportEmail            string    `json:"report_email"`
+	ReportExtraContactInfo string    `json:"report_extra_contact_info"`
+	PolicyAdkim            string    `json:"policy_adkim"`
+	PolicyAspf             string    `json:"policy_aspf"`
+	PolicyP                string    `json:"policy_p"`
+	PolicySP               string    `json:"policy_sp"`
+	PolicyPCT              string    `json:"policy_pct"`
+	ContentHash            string    `json:"content_hash"`
+	Revision               int       `json:"revision"`
+	Superseded             bool      `json:"superseded"`
+
+	// Document is the XML the report was read from, Source the file or
+	// upload and Received when it was read. Reports stored before the
+	// documents were kept have none and the zero time
+	Source   string    `json:"source,omitempty"`
+	Received time.Time `json:"received"`
+	Document []byte    `json:"document,omitempty"`
+
+	Rows []ArchiveRow `json:"-"`
+}
+
+// ArchiveRow is a row of a report including the auth results
+type ArchiveRow struct {
+	RID             int64  `json:"rid"`
+	SourceIP        string `json:"source_ip"`
+	Count           int64  `json:"count"`
+	EvalDisposition string `json:"eval_disposition"`
+	EvalSPFAlign    string `json:"eval_spf_align"`
+	EvalDKIMAlign   string `json:"eval_dkim_align"`
+	Reason          string `json:"reason"`
+	DKIMDomain      string `json:"dkim_domain"`
+	DKIMResult      string `json:"dkim_result"`
+	SPFDomain       string `json:"spf_domain"`
+	SPFResult       string `json:"spf_result"`
+	HeaderFrom      string `json:"header_from"`
+}
+
+// ArchiveStat is an entry of the daily statistics
+type ArchiveStat struct {
+	Tenant       string    `json:"tenant"`
+	Day          time.Time `json:"day"`
+	PolicyDomain string    `json:"policy_domain"`
+	HeaderFrom   string    `json:"header_from"`
+	SourceIP     string    `json:"source_ip"`
+	Reporter     string    `json:"reporter"`
+	Disposition  string    `json:"disposition"`
+	DKIMAlign    string    `json:"dkim_align"`
+	SPFAlign     string    `json:"spf_align"`
+	Messages     int64     `json:"messages"`
+}
+
+// ArchiveReporter is the number of duplicate and malformed reports of a
+// reporter in a tenant
+type ArchiveReporter struct {
+	Tenant     string `json:"tenant"`
+	Reporter   string `json:"reporter"`
+	Duplicates int64  `json:"duplicates"`
+	Malformed  int64  `json:"malformed"`
+}
+
+// ArchiveNote is a note on the report with the key in the tenant
+type ArchiveNote struct {
+	Tenant    string    `json:"tenant"`
+	ReportKey string    `json:"report_key"`
+	User      string    `json:"user"`
+	Text      string    `json:"text"`
+	Created   time.Time `json:"created"`
+}
+
+// ArchiveUser is a local user
+type ArchiveUser struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+}
+
+// ArchiveGrant is the role of a user on a scope
+type ArchiveGrant struct {
+	User  string `json:"user"`
+	Role  string `json:"role"`
+	Scope string `json:"scope"`
+}
+
+// ArchiveToken is an API token. Only the hash of the secret is stored and
+// the zero time is used for a token that never expires or was never used
+type ArchiveToken struct {
+	ID       string    `json:"id"`
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Tenant   string    `json:"tenant"`
+	Service  bool      `json:"service"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used"`
+	Revoked  bool      `json:"revoked"`
+}
+
+// key returns the normalised key of the report
+func (r ArchiveReport) key() string {
+	return reportKey(r.Begin.Unix(), r.End.Unix(), r.ReportOrg, r.ReportID)
+}
+
+// Archiver is implemented by drivers that can export and import everything
+// they store. The export is not scoped to a tenant
+type Archiver interface {
+	// ExportReports calls fn with every report and its rows ordered by ID
+	ExportReports(ctx context.Context, fn func(ArchiveReport) error) error
+	ExportStats(ctx context.Context, fn func(ArchiveStat) error) error
+	ExportReporters(ctx context.Context, fn func(ArchiveReporter) error) error
+	ExportNotes(ctx context.Context, fn func(ArchiveNote) error) error
+
+	// ImportReport stores the report, its rows and document unless the
+	// revision already exists, in which case false is returned. The daily
+	// statistics are not updated since they are imported on their own
+	ImportReport(ctx context.Context, r ArchiveReport) (bool, error)
+	// ImportStat and ImportReporter keep the larger of the existing and the
+	// imported counts, so importing an archive again changes nothing
+	ImportStat(ctx context.Context, s ArchiveStat) error
+	ImportReporter(ctx context.Context, r ArchiveReporter) error
+	// ImportNote returns false if the same note already exists
+	ImportNote(ctx context.Context, n ArchiveNote) (bool, error)
+}
+
+// exportReports reads the reports and rows with two queries ordered by the
+// report ID and joins them. The reports query must select the columns in the
+// order of ArchiveReport and the rows query in the order of ArchiveRow
+func exportReports(ctx context.Context, db *sql.DB, reports, rows string, fn func(ArchiveReport) error) error {
+
+	rs, err := db.QueryContext(ctx, reports)
+	if err != nil {
+		return fmt.Errorf("Unable to query report: %v", err)
+	}
+	defer rs.Close()
+
+	rr, err := db.QueryContext(ctx, rows)
+	if err != nil {
+		return fmt.Errorf("Unable to query reportrow: %v", err)
+	}
+	defer rr.Close()
+
+	var (
+		next    *ArchiveRow
+		hasNext = true
+	)
+	nextRow := func() error {
+		if !rr.Next() {
+			hasNext = false
+			return rr.Err()
+		}
+		next = &ArchiveRow{}
+		return rr.Scan(&next.RID, &next.SourceIP, &next.Count, &next.EvalDisposition, &next.EvalSPFAlign,
+			&next.EvalDKIMAlign, &next.Reason, &next.DKIMDomain, &next.DKIMResult, &next.SPFDomain,
+			&next.SPFResult, &next.HeaderFrom)
+	}
+	if err = nextRow(); err != nil {
+		return fmt.Errorf("Unable to scan reportrow: %v", err)
+	}
+
+	for rs.Next() {
+		var (
+			r                    ArchiveReport
+			begin, end, received sql.NullTime
+		)
+		err = rs.Scan(&r.ID, &r.Tenant, &begin, &end, &r.PolicyDomain, &r.ReportOrg, &r.ReportID,
+			&r.ReportEmail, &r.ReportExtraContactInfo, &r.PolicyAdkim, &r.PolicyAspf, &r.PolicyP,
+			&r.PolicySP, &r.PolicyPCT, &r.ContentHash, &r.Revision, &r.Superseded,
+			&r.Source, &received, &r.Document)
+		if err != nil {
+			return fmt.Errorf("Unable to scan report: %v", err)
+		}
+		if begin.Valid {
+			r.Begin = begin.Time.UTC()
+		}
+		if end.Valid {
+			r.End = end.Time.UTC()
+		}
+		if received.Valid {
+			r.Received = received.Time.UTC()
+		}
+
+		// Rows without a report are skipped
+		for hasNext && next.RID <= r.ID {
+			if next.RID == r.ID {
+				r.Rows = append(r.Rows, *next)
+			}
+			if err = nextRow(); err != nil {
+				return fmt.Errorf("Unable to scan reportrow: %v", err)
+			}
+		}
+
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+// exportReporters reads the counts of the reporters selected by query
+func exportReporters(ctx context.Context, db *sql.DB, query string, fn func(ArchiveReporter) error) error {
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Unable to query reporter_stats: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r ArchiveReporter
+		if err = rows.Scan(&r.Tenant, &r.Reporter, &r.Duplicates, &r.Malformed); err != nil {
+			return fmt.Errorf("Unable to scan reporter_stats: %v", err)
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportNotes reads the notes selected by query
+func exportNotes(ctx context.Context, db *sql.DB, query string, fn func(ArchiveNote) error) error {
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Unable to query report_note: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n ArchiveNote
+		if err = rows.Scan(&n.Tenant, &n.ReportKey, &n.User, &n.Text, &n.Created); err != nil {
+			return fmt.Errorf("Unable to scan report_note: %v", err)
+		}
+		n.Created = n.Created.UTC()
+		if err = fn(n); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// largeFeedback creates a feedback document with n rows like the ones
+// received from the large providers
+func largeFeedback(b *testing.B, n int) dmarc.Feedback {
+	b.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <email>noreply-dmarc-support@google.com</email>
+    <report_id>0</report_id>
+    <date_range><begin>1534111200</begin><end>1534197600</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf><p>none</p><sp>none</sp><pct>100</pct>
+  </policy_published>`)
+
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, `
+  <record>
+    <row>
+      <source_ip>10.%d.%d.%d</source_ip>
+      <count>%d</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><result>pass</result></dkim>
+      <spf><domain>example.com</domain><result>softfail</result></spf>
+    </auth_results>
+  </record>`, (i>>16)&0xff, (i>>8)&0xff, i&0xff, i%7+1)
+	}
+	buf.WriteString("\n</feedback>\n")
+
+	f, err := dmarc.Read(buf.Bytes())
+	if err != nil {
+		b.Fatalf("Unable to create feedback: %v", err)
+	}
+	return f
+}
+
+// benchmarkDrivers returns the drivers to benchmark. The database drivers
+// are only used if DMARC_PGSQL_URL or DMARC_MYSQL_URL is set
+func benchmarkDrivers() map[string]Storage {
+	drivers := map[string]Storage{"memory": &Memory{}}
+
+	if url := os.Getenv("DMARC_PGSQL_URL"); url != "" {
+		drivers["postgresql"] = &Postgresql{URL: url}
+	}
+	if url := os.Getenv("DMARC_MYSQL_URL"); url != "" {
+		drivers["mysql"] = &MySQL{URL: url}
+	}
+	return drivers
+}
+
+func BenchmarkWrite(b *testing.B) {
+	ctx := context.Background()
+
+	for name, s := range benchmarkDrivers() {
+		if err := s.Initialize(ctx); err != nil {
+			b.Fatalf("Unable to initialize %s: %v", name, err)
+		}
+
+		for _, rows := range []int{100, 10000, 100000} {
+			f := largeFeedback(b, rows)
+
+			// b.Run calls the function once per round and the report IDs
+			// must not repeat between rounds or they are skipped as duplicates
+			prefix := fmt.Sprintf("bench-%d-%d-", os.Getpid(), rows)
+			n := 0
+			b.Run(fmt.Sprintf("%s/%d", name, rows), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					n++
+					f.ReportMetadata.ReportID = fmt.Sprint(prefix, n)
+					if err := s.Write(ctx, f); err != nil {
+						b.Fatalf("Unable to write: %v", err)
+					}
+				}
+				b.ReportMetric(float64(rows*b.N)/b.Elapsed().Seconds(), "rows/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// Actions taken when a report has already been stored
+const (
+	// DedupeSkip drops the new copy
+	DedupeSkip = "skip"
+	// DedupeReplace deletes the stored report and stores the new copy
+	DedupeReplace = "replace"
+	// DedupeRevision keeps the stored report as a superseded revision. Only
+	// the latest revision is listed and counted in the statistics
+	DedupeRevision = "revision"
+)
+
+// DedupePolicy is the action taken per case of duplicate. A duplicate has
+// the same begin, end, report id and organisation ignoring case and spaces.
+// It is Identical if the content is the same and Changed if the reporter
+// has sent a corrected report
+type DedupePolicy struct {
+	Identical string
+	Changed   string
+}
+
+// action returns the action for the case. Identical copies are skipped and
+// changed ones replaced unless configured otherwise
+func (p DedupePolicy) action(identical bool) string {
+	if identical {
+		if p.Identical == "" {
+			return DedupeSkip
+		}
+		return p.Identical
+	}
+	if p.Changed == "" {
+		return DedupeReplace
+	}
+	return p.Changed
+}
+
+type replaceKey struct{}
+
+// WithReplace returns a context where a report that is already stored is
+// replaced whatever the policy. It is used when a report is read again from
+// its document, which is not counted as a duplicate
+func WithReplace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replaceKey{}, true)
+}
+
+// replacing returns true if the context replaces stored reports
+func replacing(ctx context.Context) bool {
+	replace, _ := ctx.Value(replaceKey{}).(bool)
+	return replace
+}
+
+// actionFor returns the action for the case when writing with the context.
+// A copy received before the stored one is skipped, so a late copy such as
+// one replayed from the spool never takes the place of a newer report.
+// Reports without a received time are never older
+func (p DedupePolicy) actionFor(ctx context.Context, identical bool, received, stored time.Time) string {
+	if replacing(ctx) {
+		return DedupeReplace
+	}
+	if !received.IsZero() && !stored.IsZero() && received.Before(stored) {
+		return DedupeSkip
+	}
+	return p.action(identical)
+}
+
+// reportKey is the normalised key of a report used for finding duplicates
+func reportKey(begin, end int64, org, id string) string {
+	k := fmt.Sprintf("%d|%d|%s|%s", begin, end, strings.ToLower(strings.TrimSpace(org)), strings.TrimSpace(id))
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:])
+}
+
+// feedbackKey returns the normalised key of the feedback
+func feedbackKey(f dmarc.Feedback) string {
+	return reportKey(f.ReportMetadata.DateRange.Begin, f.ReportMetadata.DateRange.End,
+		f.ReportMetadata.OrgName, f.ReportMetadata.ReportID)
+}
+
+// reporter returns the normalised organisation of a report
+func reporter(org string) string {
+	return strings.ToLower(strings.TrimSpace(org))
+}
+
+// contentHash returns a hash of the policy and rows of the feedback as they
+// are stored, so whitespace and casing does not make reports differ
+func contentHash(f dmarc.Feedback) string {
+
+	content := struct {
+		Domain string
+		Policy []string
+		PCT    interface{}
+		Rows   []dmarc.Row
+	}{
+		Domain: strings.ToLower(strings.TrimSpace(f.PolicyPublished.Domain)),
+		Policy: []string{
+			normalize(f.PolicyPublished.ADKIM, alignments...),
+			normalize(f.PolicyPublished.ASPF, alignments...),
+			normalize(f.PolicyPublished.P, dispositions...),
+			normalize(f.PolicyPublished.SP, dispositions...),
+		},
+		PCT:  percentage(f.PolicyPublished.PCT),
+		Rows: feedbackRows(f),
+	}
+
+	b, err := json.Marshal(content)
+	if err != nil {
+		// Can't happen for strings and numbers
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
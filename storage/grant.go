@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Grant gives a user a role on a scope. The scope is a policy domain, a
+// group of domains prefixed with group: or * for all domains
+type Grant struct {
+	User  string
+	Role  string
+	Scope string
+}
+
+// GrantStore is implemented by drivers that store the roles of the users.
+// The grants are shared by all tenants and the users and scopes are in lower
+// case. DeleteGrant returns ErrNotFound if the user has no grant on the scope
+type GrantStore interface {
+	// ReadGrants fetches the grants of a user or of all users if user is
+	// empty
+	ReadGrants(ctx context.Context, user string) ([]Grant, error)
+	// WriteGrant adds the grant or replaces the role of an existing one
+	WriteGrant(ctx context.Context, g Grant) error
+	DeleteGrant(ctx context.Context, user, scope string) error
+}
+
+// grantScope normalises the scope of a grant
+func grantScope(scope string) string {
+	return strings.ToLower(strings.TrimSpace(scope))
+}
+
+// validGrant returns the grant with the user and scope normalised or an error
+// if it cannot be stored
+func validGrant(g Grant) (Grant, error) {
+	g.User = userName(g.User)
+	g.Scope = grantScope(g.Scope)
+	g.Role = strings.ToLower(strings.TrimSpace(g.Role))
+	if g.User == "" {
+		return g, fmt.Errorf("The grant has no user")
+	}
+	if g.Scope == "" || g.Role == "" {
+		return g, fmt.Errorf("The grant of %s needs a role and a scope", g.User)
+	}
+	return g, nil
+}
+
+// readGrants reads the user, role and scope of the grants selected by query
+func readGrants(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Grant, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query grants: %v", err)
+	}
+	defer rows.Close()
+
+	var gs []Grant
+	for rows.Next() {
+		var g Grant
+		if err = rows.Scan(&g.User, &g.Role, &g.Scope); err != nil {
+			return nil, fmt.Errorf("Unable to scan grants: %v", err)
+		}
+		gs = append(gs, g)
+	}
+	return gs, rows.Err()
+}
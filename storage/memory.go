@@ -0,0 +1,1434 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryKey is the equivalent of the unique constraint on the report table
+type memoryKey struct {
+	tenant   string
+	key      string
+	revision int
+}
+
+// memoryReporter is the key of the duplicate and malformed counters
+type memoryReporter struct {
+	tenant, reporter string
+}
+
+// memoryStat is the key of the daily statistics
+type memoryStat struct {
+	tenant                           string
+	day                              time.Time
+	domain, hfrom, ip, reporter      string
+	disposition, dkimAlign, spfAlign string
+}
+
+type memoryReport struct {
+	tenant     string
+	key, hash  string
+	revision   int
+	superseded bool
+	report     dmarc.Report
+	rows       []dmarc.Row
+
+	source   string
+	received time.Time
+	document []byte
+}
+
+// Memory storage keeps everything in memory and is lost on exit. It is
+// intended for demos, tests and one-off analysis of a set of reports
+type Memory struct {
+	Dedupe DedupePolicy
+
+	mu         sync.RWMutex
+	reports    []*memoryReport
+	keys       map[memoryKey]*memoryReport
+	nextID     int64
+	stats      map[memoryStat]int64
+	duplicates map[memoryReporter]int64
+	malformed  map[memoryReporter]int64
+	users      map[string]User
+	grants     map[memoryGrant]string
+	tokens     map[string]Token
+	notes      []memoryNote
+	nextNote   int64
+}
+
+// memoryNote is a note on the report with the key in the tenant
+type memoryNote struct {
+	tenant, key string
+	Note
+}
+
+// Initialize prepares the in-memory tables
+func (h *Memory) Initialize(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.keys == nil {
+		h.keys = make(map[memoryKey]*memoryReport)
+	}
+	return nil
+}
+
+// ReadReport fetches a report
+func (h *Memory) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, err error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tenant, scope := TenantFromContext(ctx), scopeFromContext(ctx)
+	for _, m := range h.reports {
+		if m.report.ID != id || (tenant != "" && m.tenant != tenant) || !scope.allows(m.report.PolicyDomain) {
+			continue
+		}
+
+		rs.Report = m.summary()
+		rs.Report.PolicyP = m.report.PolicyP
+		rs.Report.PolicySP = m.report.PolicySP
+		rs.Report.PolicyDomain = m.report.PolicyDomain
+
+		for _, r := range m.rows {
+			d := r
+			d.EvalSPFAlign = strings.ToLower(d.EvalSPFAlign)
+			d.EvalDKIMAalign = strings.ToLower(d.EvalDKIMAalign)
+			d.DKIMDomain = strings.ToLower(d.DKIMDomain)
+			d.DKIMResult = strings.ToLower(d.DKIMResult)
+			d.SPFDomain = strings.ToLower(d.SPFDomain)
+			d.SPFResult = strings.ToLower(d.SPFResult)
+
+			if d.SPFResult == "" {
+				d.SPFResult = "neutral"
+			}
+			if d.DKIMResult == "" {
+				d.DKIMResult = "neutral"
+			}
+			rs.Rows = append(rs.Rows, d)
+		}
+		return rs, nil
+	}
+
+	return rs, fmt.Errorf("Failed to query reportrow: report %d %w", id, ErrNotFound)
+}
+
+// ReadReports fetches the list of reports matching the query paginated
+func (h *Memory) ReadReports(ctx context.Context, q ReportQuery) (rs []dmarc.Report, err error) {
+
+	q.fromContext(ctx)
+
+	var network *net.IPNet
+	if q.SourceIP != "" {
+		if network, err = q.network(); err != nil {
+			return nil, err
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var matches []dmarc.Report
+	for _, m := range h.reports {
+		if m.matches(q, network) && m.after(q) {
+			matches = append(matches, m.summary())
+		}
+	}
+
+	sortBy := q.Sort
+	if q.Cursor != nil {
+		sortBy = SortBegin
+	}
+
+	less := func(a, b dmarc.Report) bool {
+		switch sortBy {
+		case SortEnd:
+			return a.ReportEnd.Before(b.ReportEnd)
+		case SortDomain:
+			return a.PolicyDomain < b.PolicyDomain
+		case SortOrg:
+			return strings.ToLower(a.ReportOrg) < strings.ToLower(b.ReportOrg)
+		case SortCount:
+			return a.Count < b.Count
+		}
+		return a.ReportBegin.Before(b.ReportBegin)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if q.descending() {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+
+	offset := q.Offset
+	if offset < 0 || q.Cursor != nil {
+		offset = 0
+	}
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	end := offset + q.PageSize
+	if q.PageSize < 0 || end > len(matches) {
+		end = len(matches)
+	}
+
+	rs = append(rs, matches[offset:end]...)
+
+	if q.Cursor != nil && q.Cursor.Backward {
+		reverse(rs)
+	}
+	return rs, nil
+}
+
+// CountReports returns the number of reports matching the query
+func (h *Memory) CountReports(ctx context.Context, q ReportQuery) (n int, err error) {
+
+	q.fromContext(ctx)
+
+	var network *net.IPNet
+	if q.SourceIP != "" {
+		if network, err = q.network(); err != nil {
+			return 0, err
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, m := range h.reports {
+		if m.matches(q, network) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// after returns true if the report is on the side of the cursor that is read
+func (m *memoryReport) after(q ReportQuery) bool {
+	c := q.Cursor
+	if c == nil || c.Begin.IsZero() {
+		return true
+	}
+
+	begin := m.report.ReportBegin.Unix()
+	if begin == c.Begin.Unix() {
+		if q.descending() {
+			return m.report.ID < c.ID
+		}
+		return m.report.ID > c.ID
+	}
+	if q.descending() {
+		return begin < c.Begin.Unix()
+	}
+	return begin > c.Begin.Unix()
+}
+
+// matches returns true if the report matches the query
+func (m *memoryReport) matches(q ReportQuery, network *net.IPNet) bool {
+
+	if m.superseded {
+		return false
+	}
+	if q.tenant != "" && m.tenant != q.tenant {
+		return false
+	}
+	if !q.scope.allows(m.report.PolicyDomain) {
+		return false
+	}
+
+	if q.PolicyDomain != "" && !strings.EqualFold(m.report.PolicyDomain, q.PolicyDomain) {
+		return false
+	}
+	if q.ReportOrg != "" && !strings.EqualFold(m.report.ReportOrg, q.ReportOrg) {
+		return false
+	}
+	if !q.From.IsZero() && m.report.ReportEnd.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !m.report.ReportBegin.Before(q.To) {
+		return false
+	}
+
+	if q.Disposition == "" && q.DKIMResult == "" && q.SPFResult == "" && network == nil && q.HeaderFrom == "" {
+		return true
+	}
+
+	for _, rw := range m.rows {
+		if rowMatches(q, network, rw) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rowMatches returns true if the row matches the row filters of the query
+func rowMatches(q ReportQuery, network *net.IPNet, rw dmarc.Row) bool {
+	if q.Disposition != "" && !strings.EqualFold(rw.EvalDisposition, q.Disposition) {
+		return false
+	}
+	if q.DKIMResult != "" && !strings.EqualFold(rw.DKIMResult, q.DKIMResult) {
+		return false
+	}
+	if q.SPFResult != "" && !strings.EqualFold(rw.SPFResult, q.SPFResult) {
+		return false
+	}
+	if q.HeaderFrom != "" && !strings.EqualFold(rw.IdentifierHFrom, q.HeaderFrom) {
+		return false
+	}
+	if network != nil {
+		ip := net.ParseIP(rw.SourceIP)
+		if ip == nil || !network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadRows fetches the rows matching the query across reports
+func (h *Memory) ReadRows(ctx context.Context, q ReportQuery) (rs []ReportRow, err error) {
+
+	q.fromContext(ctx)
+
+	var network *net.IPNet
+	if q.SourceIP != "" {
+		if network, err = q.network(); err != nil {
+			return nil, err
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var matches []*memoryReport
+	for _, m := range h.reports {
+		if m.matches(q, network) {
+			matches = append(matches, m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i].report, matches[j].report
+		if !a.ReportBegin.Equal(b.ReportBegin) {
+			return a.ReportBegin.After(b.ReportBegin)
+		}
+		return a.ID > b.ID
+	})
+
+	for _, m := range matches {
+		report := m.summary()
+		report.Count, report.DKIMResult, report.SPFResult = 0, "", ""
+
+		for _, rw := range m.rows {
+			if !rowMatches(q, network, rw) {
+				continue
+			}
+			if q.PageSize > 0 && len(rs) == q.PageSize {
+				return rs, nil
+			}
+
+			d := rw
+			d.EvalSPFAlign = strings.ToLower(d.EvalSPFAlign)
+			d.EvalDKIMAalign = strings.ToLower(d.EvalDKIMAalign)
+			d.DKIMDomain = strings.ToLower(d.DKIMDomain)
+			d.DKIMResult = strings.ToLower(d.DKIMResult)
+			d.SPFDomain = strings.ToLower(d.SPFDomain)
+			d.SPFResult = strings.ToLower(d.SPFResult)
+			if d.SPFResult == "" {
+				d.SPFResult = "neutral"
+			}
+			if d.DKIMResult == "" {
+				d.DKIMResult = "neutral"
+			}
+			rs = append(rs, ReportRow{Report: report, Row: d})
+		}
+	}
+	return rs, nil
+}
+
+// WalkRows calls fn with the rows matching the query across reports. The
+// rows are copied first so fn is called without holding the lock
+func (h *Memory) WalkRows(ctx context.Context, q ReportQuery, fn func(ReportRow) error) error {
+
+	rs, err := h.ReadRows(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summary returns the report with the aggregated values of its rows
+func (m *memoryReport) summary() dmarc.Report {
+	r := m.report
+	r.PolicyDomain = strings.ToLower(r.PolicyDomain)
+	r.PolicyAdkim = strings.ToLower(r.PolicyAdkim)
+	r.PolicyAspf = strings.ToLower(r.PolicyAspf)
+	r.PolicyP = strings.ToLower(r.PolicyP)
+	r.PolicySP = strings.ToLower(r.PolicySP)
+
+	for i, rw := range m.rows {
+		r.Count += rw.Count
+
+		dkim := strings.ToLower(rw.DKIMResult)
+		spf := strings.ToLower(rw.SPFResult)
+		if i == 0 || dkim < r.DKIMResult {
+			r.DKIMResult = dkim
+		}
+		if i == 0 || spf < r.SPFResult {
+			r.SPFResult = spf
+		}
+	}
+
+	if r.SPFResult == "" {
+		r.SPFResult = "neutral"
+	}
+	if r.DKIMResult == "" {
+		r.DKIMResult = "neutral"
+	}
+	return r
+}
+
+// ReadPolicies fetches the policies seen for the policy domain
+func (h *Memory) ReadPolicies(ctx context.Context, domain string) ([]PolicyState, error) {
+
+	q := ReportQuery{PolicyDomain: domain}
+	q.fromContext(ctx)
+
+	type policy struct {
+		state     PolicyState
+		reporters map[string]bool
+	}
+
+	h.mu.RLock()
+	var policies []*policy
+	index := make(map[PolicyState]*policy)
+	for _, m := range h.reports {
+		if !m.matches(q, nil) {
+			continue
+		}
+
+		r := m.summary()
+		key := PolicyState{Adkim: r.PolicyAdkim, Aspf: r.PolicyAspf, P: r.PolicyP, SP: r.PolicySP, PCT: strings.TrimSpace(r.PolicyPCT)}
+		p, ok := index[key]
+		if !ok {
+			p = &policy{state: key, reporters: make(map[string]bool)}
+			p.state.First, p.state.Last = r.ReportBegin, r.ReportEnd
+			index[key] = p
+			policies = append(policies, p)
+		}
+
+		p.state.Reports++
+		p.reporters[reporter(r.ReportOrg)] = true
+		if r.ReportBegin.Before(p.state.First) {
+			p.state.First = r.ReportBegin
+		}
+		if r.ReportEnd.After(p.state.Last) {
+			p.state.Last = r.ReportEnd
+		}
+	}
+	h.mu.RUnlock()
+
+	ps := make([]PolicyState, 0, len(policies))
+	for _, p := range policies {
+		p.state.Reporters = int64(len(p.reporters))
+		ps = append(ps, p.state)
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].First.Before(ps[j].First) })
+	return ps, nil
+}
+
+// Write stores the feedback. A report that already exists is skipped,
+// replaced or stored as a new revision depending on the dedupe policy
+func (h *Memory) Write(ctx context.Context, f dmarc.Feedback) error {
+
+	m := &memoryReport{
+		tenant: TenantFromContext(ctx),
+		key:    feedbackKey(f),
+		hash:   contentHash(f),
+		report: dmarc.Report{
+			ReportBegin:            time.Unix(f.ReportMetadata.DateRange.Begin, 0),
+			ReportEnd:              time.Unix(f.ReportMetadata.DateRange.End, 0),
+			PolicyDomain:           f.PolicyPublished.Domain,
+			ReportOrg:              f.ReportMetadata.OrgName,
+			ReportID:               f.ReportMetadata.ReportID,
+			ReportEmail:            f.ReportMetadata.Email,
+			ReportExtraContactInfo: f.ReportMetadata.ExtraContactInfo,
+			PolicyAdkim:            f.PolicyPublished.ADKIM,
+			PolicyAspf:             f.PolicyPublished.ASPF,
+			PolicyP:                f.PolicyPublished.P,
+			PolicySP:               f.PolicyPublished.SP,
+			PolicyPCT:              f.PolicyPublished.PCT,
+		},
+	}
+
+	m.rows = feedbackRows(f)
+	if len(f.Raw) > 0 {
+		m.source, m.received, m.document = f.FromFile, f.Received, f.Raw
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	setDuplicate(ctx, "")
+
+	if h.keys == nil {
+		h.keys = make(map[memoryKey]*memoryReport)
+	}
+
+	if old := h.latest(m.tenant, m.key); old != nil {
+		action := h.Dedupe.actionFor(ctx, old.hash == m.hash, f.Received, old.received)
+		setDuplicate(ctx, action)
+		log.Debugf("Report %s from %s already exists, action %s", m.report.ReportID, m.report.ReportOrg, action)
+
+		if h.duplicates == nil {
+			h.duplicates = make(map[memoryReporter]int64)
+		}
+		if !replacing(ctx) {
+			h.duplicates[memoryReporter{tenant: m.tenant, reporter: reporter(m.report.ReportOrg)}]++
+		}
+
+		switch action {
+		case DedupeSkip:
+			return nil
+		case DedupeRevision:
+			h.addStats(old, -1)
+			old.superseded = true
+			m.revision = old.revision + 1
+		default:
+			h.addStats(old, -1)
+			h.remove(old)
+			m.revision = old.revision
+		}
+	}
+
+	h.nextID++
+	m.report.ID = h.nextID
+
+	h.keys[m.uniqueKey()] = m
+	h.reports = append(h.reports, m)
+	h.addStats(m, 1)
+
+	return nil
+}
+
+// uniqueKey returns the unique key of the report
+func (m *memoryReport) uniqueKey() memoryKey {
+	return memoryKey{tenant: m.tenant, key: m.key, revision: m.revision}
+}
+
+// latest returns the current revision of the report with the key in the
+// tenant
+func (h *Memory) latest(tenant, key string) *memoryReport {
+	var latest *memoryReport
+	for revision := 0; ; revision++ {
+		m, ok := h.keys[memoryKey{tenant: tenant, key: key, revision: revision}]
+		if !ok {
+			return latest
+		}
+		if !m.superseded {
+			latest = m
+		}
+	}
+}
+
+// remove deletes a report
+func (h *Memory) remove(m *memoryReport) {
+	delete(h.keys, m.uniqueKey())
+	for i, r := range h.reports {
+		if r == m {
+			h.reports = append(h.reports[:i], h.reports[i+1:]...)
+			return
+		}
+	}
+}
+
+// addStats adds the rows of the report to the daily statistics multiplied
+// by sign, so -1 removes the report again
+func (h *Memory) addStats(m *memoryReport, sign int64) {
+	if h.stats == nil {
+		h.stats = make(map[memoryStat]int64)
+	}
+	for _, rw := range m.rows {
+		key := memoryStat{
+			tenant:      m.tenant,
+			day:         statsDay(m.report.ReportBegin),
+			domain:      strings.ToLower(m.report.PolicyDomain),
+			hfrom:       strings.ToLower(rw.IdentifierHFrom),
+			ip:          rw.SourceIP,
+			reporter:    m.report.ReportOrg,
+			disposition: rw.EvalDisposition,
+			dkimAlign:   rw.EvalDKIMAalign,
+			spfAlign:    rw.EvalSPFAlign,
+		}
+		h.stats[key] += sign * rw.Count
+		if h.stats[key] == 0 {
+			delete(h.stats, key)
+		}
+	}
+}
+
+// ReporterCounts returns the number of duplicate and malformed reports
+// received per reporter
+func (h *Memory) ReporterCounts(ctx context.Context) ([]ReporterCount, error) {
+	if scopeFromContext(ctx).restricted {
+		return nil, nil
+	}
+	tenant := TenantFromContext(ctx)
+
+	h.mu.RLock()
+	counts := make(map[string]*ReporterCount)
+	count := func(k memoryReporter) *ReporterCount {
+		c, ok := counts[k.reporter]
+		if !ok {
+			c = &ReporterCount{Reporter: k.reporter}
+			counts[k.reporter] = c
+		}
+		return c
+	}
+	for k, n := range h.duplicates {
+		if tenant == "" || k.tenant == tenant {
+			count(k).Duplicates += n
+		}
+	}
+	for k, n := range h.malformed {
+		if tenant == "" || k.tenant == tenant {
+			count(k).Malformed += n
+		}
+	}
+	h.mu.RUnlock()
+
+	cs := make([]ReporterCount, 0, len(counts))
+	for _, c := range counts {
+		cs = append(cs, *c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Reporter < cs[j].Reporter })
+	return cs, nil
+}
+
+// AddMalformed counts a malformed report from the reporter
+func (h *Memory) AddMalformed(ctx context.Context, org string) error {
+	rp, err := malformedReporter(org)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.malformed == nil {
+		h.malformed = make(map[memoryReporter]int64)
+	}
+	h.malformed[memoryReporter{tenant: TenantFromContext(ctx), reporter: rp}]++
+	return nil
+}
+
+// ReadReporters summarises the reports per reporter and policy domain
+func (h *Memory) ReadReporters(ctx context.Context, org string) ([]ReporterDomain, error) {
+
+	var q ReportQuery
+	q.fromContext(ctx)
+
+	h.mu.RLock()
+	index := make(map[[2]string]*ReporterDomain)
+	for _, m := range h.reports {
+		if !m.matches(q, nil) {
+			continue
+		}
+		rp := reporter(m.report.ReportOrg)
+		if org != "" && rp != reporter(org) {
+			continue
+		}
+
+		r := m.summary()
+		key := [2]string{rp, r.PolicyDomain}
+		d, ok := index[key]
+		if !ok {
+			d = &ReporterDomain{Reporter: rp, Domain: r.PolicyDomain, First: r.ReportBegin, Last: r.ReportEnd}
+			index[key] = d
+		}
+
+		d.Reports++
+		d.Messages += r.Count
+		d.Rows += int64(len(m.rows))
+		if r.ReportBegin.Before(d.First) {
+			d.First = r.ReportBegin
+		}
+		if r.ReportEnd.After(d.Last) {
+			d.Last = r.ReportEnd
+		}
+	}
+	h.mu.RUnlock()
+
+	rs := make([]ReporterDomain, 0, len(index))
+	for _, d := range index {
+		rs = append(rs, *d)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Reporter != rs[j].Reporter {
+			return rs[i].Reporter < rs[j].Reporter
+		}
+		return rs[i].Domain < rs[j].Domain
+	})
+	return rs, nil
+}
+
+// ReadStats sums the daily statistics
+func (h *Memory) ReadStats(ctx context.Context, q StatsQuery) ([]DailyStat, error) {
+
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	q.fromContext(ctx)
+
+	type group struct {
+		stat  DailyStat
+		first time.Time
+	}
+
+	h.mu.RLock()
+	groups := make(map[DailyStat]*group)
+	for key, messages := range h.stats {
+		if !key.matches(q) {
+			continue
+		}
+
+		var g DailyStat
+		for _, c := range statColumns {
+			if !q.grouped(c.dim) {
+				continue
+			}
+			switch c.dim {
+			case StatDay:
+				g.Day = key.day
+			case StatDomain:
+				g.PolicyDomain = key.domain
+			case StatHeaderFrom:
+				g.HeaderFrom = key.hfrom
+			case StatSourceIP:
+				g.SourceIP = key.ip
+			case StatReporter:
+				g.Reporter = key.reporter
+			case StatDisposition:
+				g.Disposition = key.disposition
+			case StatDKIMAlign:
+				g.DKIMAlign = key.dkimAlign
+			case StatSPFAlign:
+				g.SPFAlign = key.spfAlign
+			}
+		}
+
+		e, ok := groups[g]
+		if !ok {
+			e = &group{stat: g, first: key.day}
+			groups[g] = e
+		}
+		e.stat.Messages += messages
+		if key.day.Before(e.first) {
+			e.first = key.day
+		}
+	}
+	h.mu.RUnlock()
+
+	stats := make([]DailyStat, 0, len(groups))
+	for _, g := range groups {
+		g.stat.Day = g.first
+		stats = append(stats, g.stat)
+	}
+
+	if q.Top > 0 {
+		sort.Slice(stats, func(i, j int) bool {
+			if stats[i].Messages != stats[j].Messages {
+				return stats[i].Messages > stats[j].Messages
+			}
+			return stats[i].less(stats[j])
+		})
+		if len(stats) > q.Top {
+			stats = stats[:q.Top]
+		}
+		return stats, nil
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].less(stats[j]) })
+	return stats, nil
+}
+
+// less orders the statistics by their dimensions
+func (s DailyStat) less(o DailyStat) bool {
+	if !s.Day.Equal(o.Day) {
+		return s.Day.Before(o.Day)
+	}
+	a := []string{s.PolicyDomain, s.HeaderFrom, s.SourceIP, s.Reporter, s.Disposition, s.DKIMAlign, s.SPFAlign}
+	b := []string{o.PolicyDomain, o.HeaderFrom, o.SourceIP, o.Reporter, o.Disposition, o.DKIMAlign, o.SPFAlign}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// matches returns true if the statistic matches the filters of the query
+func (k memoryStat) matches(q StatsQuery) bool {
+	if q.tenant != "" && k.tenant != q.tenant {
+		return false
+	}
+	if !q.scope.allows(k.domain) {
+		return false
+	}
+	for _, c := range []struct{ value, filter string }{
+		{k.domain, q.PolicyDomain},
+		{k.hfrom, q.HeaderFrom},
+		{k.ip, q.SourceIP},
+		{k.reporter, q.Reporter},
+		{k.disposition, q.Disposition},
+		{k.dkimAlign, q.DKIMAlign},
+		{k.spfAlign, q.SPFAlign},
+	} {
+		if c.filter != "" && !strings.EqualFold(c.value, strings.TrimSpace(c.filter)) {
+			return false
+		}
+	}
+	if !q.From.IsZero() && k.day.Before(statsDay(q.From)) {
+		return false
+	}
+	if !q.To.IsZero() && !k.day.Before(statsDay(q.To)) {
+		return false
+	}
+	return true
+}
+
+// Purge deletes the reports ending before rows and the daily statistics older
+// than stats
+func (h *Memory) Purge(ctx context.Context, rows time.Time, stats time.Time) (res PurgeResult, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !rows.IsZero() {
+		var keep []*memoryReport
+		for _, m := range h.reports {
+			if !m.report.ReportEnd.Before(rows) {
+				keep = append(keep, m)
+				continue
+			}
+
+			delete(h.keys, m.uniqueKey())
+			res.Reports++
+			res.Rows += int64(len(m.rows))
+		}
+		h.reports = keep
+
+		var notes []memoryNote
+		for _, n := range h.notes {
+			if h.stored(n.tenant, n.key) {
+				notes = append(notes, n)
+			}
+		}
+		h.notes = notes
+	}
+
+	if !stats.IsZero() {
+		u := stats.UTC()
+		cutoff := time.Date(u.Year(), u.Month(), u.Day(), 0, 0, 0, 0, time.UTC)
+		for key := range h.stats {
+			if key.day.Before(cutoff) {
+				delete(h.stats, key)
+				res.Stats++
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// ExportReports reads all reports and their rows ordered by ID
+func (h *Memory) ExportReports(ctx context.Context, fn func(ArchiveReport) error) error {
+
+	h.mu.RLock()
+	reports := make([]*memoryReport, len(h.reports))
+	copy(reports, h.reports)
+	h.mu.RUnlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].report.ID < reports[j].report.ID })
+
+	for _, m := range reports {
+		r := ArchiveReport{
+			ID:                     m.report.ID,
+			Tenant:                 m.tenant,
+			Begin:                  m.report.ReportBegin.UTC(),
+			End:                    m.report.ReportEnd.UTC(),
+			PolicyDomain:           m.report.PolicyDomain,
+			ReportOrg:              m.report.ReportOrg,
+			ReportID:               m.report.ReportID,
+			ReportEmail:            m.report.ReportEmail,
+			ReportExtraContactInfo: m.report.ReportExtraContactInfo,
+			PolicyAdkim:            m.report.PolicyAdkim,
+			PolicyAspf:             m.report.PolicyAspf,
+			PolicyP:                m.report.PolicyP,
+			PolicySP:               m.report.PolicySP,
+			PolicyPCT:              m.report.PolicyPCT,
+			ContentHash:            m.hash,
+			Revision:               m.revision,
+			Superseded:             m.superseded,
+			Source:                 m.source,
+			Received:               m.received,
+			Document:               m.document,
+		}
+		for _, rw := range m.rows {
+			r.Rows = append(r.Rows, ArchiveRow{
+				RID:             m.report.ID,
+				SourceIP:        rw.SourceIP,
+				Count:           rw.Count,
+				EvalDisposition: rw.EvalDisposition,
+				EvalSPFAlign:    rw.EvalSPFAlign,
+				EvalDKIMAlign:   rw.EvalDKIMAalign,
+				Reason:          rw.Reason,
+				DKIMDomain:      rw.DKIMDomain,
+				DKIMResult:      rw.DKIMResult,
+				SPFDomain:       rw.SPFDomain,
+				SPFResult:       rw.SPFResult,
+				HeaderFrom:      rw.IdentifierHFrom,
+			})
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportStats reads all daily statistics
+func (h *Memory) ExportStats(ctx context.Context, fn func(ArchiveStat) error) error {
+
+	h.mu.RLock()
+	var stats []ArchiveStat
+	for k, messages := range h.stats {
+		stats = append(stats, ArchiveStat{
+			Tenant:       k.tenant,
+			Day:          k.day,
+			PolicyDomain: k.domain,
+			HeaderFrom:   k.hfrom,
+			SourceIP:     k.ip,
+			Reporter:     k.reporter,
+			Disposition:  k.disposition,
+			DKIMAlign:    k.dkimAlign,
+			SPFAlign:     k.spfAlign,
+			Messages:     messages,
+		})
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Day.Before(stats[j].Day) })
+	for _, s := range stats {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportReport stores an exported report and its rows as they are
+func (h *Memory) ImportReport(ctx context.Context, r ArchiveReport) (bool, error) {
+
+	m := &memoryReport{
+		tenant:     r.Tenant,
+		key:        r.key(),
+		hash:       r.ContentHash,
+		revision:   r.Revision,
+		superseded: r.Superseded,
+		source:     r.Source,
+		received:   r.Received,
+		document:   r.Document,
+		report: dmarc.Report{
+			ReportBegin:            time.Unix(r.Begin.Unix(), 0),
+			ReportEnd:              time.Unix(r.End.Unix(), 0),
+			PolicyDomain:           r.PolicyDomain,
+			ReportOrg:              r.ReportOrg,
+			ReportID:               r.ReportID,
+			ReportEmail:            r.ReportEmail,
+			ReportExtraContactInfo: r.ReportExtraContactInfo,
+			PolicyAdkim:            r.PolicyAdkim,
+			PolicyAspf:             r.PolicyAspf,
+			PolicyP:                r.PolicyP,
+			PolicySP:               r.PolicySP,
+			PolicyPCT:              r.PolicyPCT,
+		},
+	}
+	for _, rw := range r.Rows {
+		m.rows = append(m.rows, dmarc.Row{
+			SourceIP:        rw.SourceIP,
+			Count:           rw.Count,
+			EvalDisposition: rw.EvalDisposition,
+			EvalSPFAlign:    rw.EvalSPFAlign,
+			EvalDKIMAalign:  rw.EvalDKIMAlign,
+			Reason:          rw.Reason,
+			DKIMDomain:      rw.DKIMDomain,
+			DKIMResult:      rw.DKIMResult,
+			SPFDomain:       rw.SPFDomain,
+			SPFResult:       rw.SPFResult,
+			IdentifierHFrom: rw.HeaderFrom,
+		})
+	}
+
+	key := m.uniqueKey()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.keys == nil {
+		h.keys = make(map[memoryKey]*memoryReport)
+	}
+	if _, ok := h.keys[key]; ok {
+		return false, nil
+	}
+
+	h.nextID++
+	m.report.ID = h.nextID
+	h.keys[key] = m
+	h.reports = append(h.reports, m)
+
+	return true, nil
+}
+
+// ImportStat stores an exported entry of the daily statistics
+func (h *Memory) ImportStat(ctx context.Context, s ArchiveStat) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stats == nil {
+		h.stats = make(map[memoryStat]int64)
+	}
+	key := memoryStat{
+		tenant:      s.Tenant,
+		day:         statsDay(s.Day),
+		domain:      s.PolicyDomain,
+		hfrom:       s.HeaderFrom,
+		ip:          s.SourceIP,
+		reporter:    s.Reporter,
+		disposition: s.Disposition,
+		dkimAlign:   s.DKIMAlign,
+		spfAlign:    s.SPFAlign,
+	}
+	if s.Messages > h.stats[key] {
+		h.stats[key] = s.Messages
+	}
+	return nil
+}
+
+// ExportReporters reads the duplicate and malformed counts of all reporters
+func (h *Memory) ExportReporters(ctx context.Context, fn func(ArchiveReporter) error) error {
+
+	h.mu.RLock()
+	counts := make(map[memoryReporter]*ArchiveReporter)
+	count := func(k memoryReporter) *ArchiveReporter {
+		c, ok := counts[k]
+		if !ok {
+			c = &ArchiveReporter{Tenant: k.tenant, Reporter: k.reporter}
+			counts[k] = c
+		}
+		return c
+	}
+	for k, n := range h.duplicates {
+		count(k).Duplicates = n
+	}
+	for k, n := range h.malformed {
+		count(k).Malformed = n
+	}
+	h.mu.RUnlock()
+
+	rs := make([]ArchiveReporter, 0, len(counts))
+	for _, c := range counts {
+		rs = append(rs, *c)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Tenant != rs[j].Tenant {
+			return rs[i].Tenant < rs[j].Tenant
+		}
+		return rs[i].Reporter < rs[j].Reporter
+	})
+	for _, r := range rs {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportReporter stores the exported counts of a reporter
+func (h *Memory) ImportReporter(ctx context.Context, r ArchiveReporter) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.duplicates == nil {
+		h.duplicates = make(map[memoryReporter]int64)
+	}
+	if h.malformed == nil {
+		h.malformed = make(map[memoryReporter]int64)
+	}
+	key := memoryReporter{tenant: r.Tenant, reporter: r.Reporter}
+	if r.Duplicates > h.duplicates[key] {
+		h.duplicates[key] = r.Duplicates
+	}
+	if r.Malformed > h.malformed[key] {
+		h.malformed[key] = r.Malformed
+	}
+	return nil
+}
+
+// ExportNotes reads the notes on all reports
+func (h *Memory) ExportNotes(ctx context.Context, fn func(ArchiveNote) error) error {
+	h.mu.RLock()
+	notes := append([]memoryNote(nil), h.notes...)
+	h.mu.RUnlock()
+
+	for _, n := range notes {
+		err := fn(ArchiveNote{Tenant: n.tenant, ReportKey: n.key, User: n.User, Text: n.Text, Created: n.Created})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportNote stores an exported note unless it already exists
+func (h *Memory) ImportNote(ctx context.Context, n ArchiveNote) (bool, error) {
+	note, err := validNote(Note{User: n.User, Text: n.Text, Created: n.Created})
+	if err != nil {
+		return false, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, o := range h.notes {
+		if o.tenant == n.Tenant && o.key == n.ReportKey && o.User == note.User && o.Text == note.Text && o.Created.Equal(note.Created) {
+			return false, nil
+		}
+	}
+	h.addNote(n.Tenant, n.ReportKey, note)
+	return true, nil
+}
+
+// find returns the report with the ID in the scope of the context
+func (h *Memory) find(ctx context.Context, id int64) (*memoryReport, error) {
+	tenant, scope := TenantFromContext(ctx), scopeFromContext(ctx)
+	for _, m := range h.reports {
+		if m.report.ID == id && (tenant == "" || m.tenant == tenant) && scope.allows(m.report.PolicyDomain) {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown report %d: %w", id, ErrNotFound)
+}
+
+// stored returns true if a revision of the report with the key in the tenant
+// is stored
+func (h *Memory) stored(tenant, key string) bool {
+	for _, m := range h.reports {
+		if m.tenant == tenant && m.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// addNote adds a note to the report with the key in the tenant
+func (h *Memory) addNote(tenant, key string, n Note) {
+	h.nextNote++
+	n.ID = h.nextNote
+	h.notes = append(h.notes, memoryNote{tenant: tenant, key: key, Note: n})
+}
+
+// ReadNotes fetches the notes of a report
+func (h *Memory) ReadNotes(ctx context.Context, report int64) ([]Note, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	m, err := h.find(ctx, report)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	for _, n := range h.notes {
+		if n.tenant == m.tenant && n.key == m.key {
+			notes = append(notes, n.Note)
+		}
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].Created.Before(notes[j].Created) })
+	return notes, nil
+}
+
+// WriteNote adds a note to a report
+func (h *Memory) WriteNote(ctx context.Context, report int64, n Note) error {
+	n, err := validNote(n)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m, err := h.find(ctx, report)
+	if err != nil {
+		return err
+	}
+	h.addNote(m.tenant, m.key, n)
+	return nil
+}
+
+// ReadDocument fetches the document a report was read from
+func (h *Memory) ReadDocument(ctx context.Context, id int64) (Document, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	m, err := h.find(ctx, id)
+	if err != nil {
+		return Document{}, err
+	}
+	if len(m.document) == 0 {
+		return Document{}, fmt.Errorf("Report %d has no document: %w", id, ErrNotFound)
+	}
+	return Document{Tenant: m.tenant, Source: m.source, Received: m.received, Data: m.document}, nil
+}
+
+// DeleteReport deletes a report with all revisions and notes
+func (h *Memory) DeleteReport(ctx context.Context, id int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m, err := h.find(ctx, id)
+	if err != nil {
+		return err
+	}
+	tenant, key := m.tenant, m.key
+
+	if current := h.latest(tenant, key); current != nil {
+		h.addStats(current, -1)
+	}
+
+	var keep []*memoryReport
+	for _, r := range h.reports {
+		if r.tenant == tenant && r.key == key {
+			delete(h.keys, r.uniqueKey())
+			continue
+		}
+		keep = append(keep, r)
+	}
+	h.reports = keep
+
+	var notes []memoryNote
+	for _, n := range h.notes {
+		if n.tenant != tenant || n.key != key {
+			notes = append(notes, n)
+		}
+	}
+	h.notes = notes
+	return nil
+}
+
+// ReadUser fetches a local user
+func (h *Memory) ReadUser(ctx context.Context, name string) (User, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	u, ok := h.users[userName(name)]
+	if !ok {
+		return User{}, fmt.Errorf("Unknown user %s: %w", name, ErrNotFound)
+	}
+	return u, nil
+}
+
+// ReadUsers fetches all local users
+func (h *Memory) ReadUsers(ctx context.Context) ([]User, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	us := make([]User, 0, len(h.users))
+	for _, u := range h.users {
+		us = append(us, u)
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].Name < us[j].Name })
+	return us, nil
+}
+
+// WriteUser creates a local user or replaces the password
+func (h *Memory) WriteUser(ctx context.Context, u User) error {
+	u, err := validUser(u)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.users == nil {
+		h.users = make(map[string]User)
+	}
+	if old, ok := h.users[u.Name]; ok {
+		u.Created = old.Created
+	} else {
+		u.Created = time.Now().UTC()
+	}
+	h.users[u.Name] = u
+	return nil
+}
+
+// DeleteUser removes a local user
+func (h *Memory) DeleteUser(ctx context.Context, name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name = userName(name)
+	if _, ok := h.users[name]; !ok {
+		return fmt.Errorf("Unknown user %s: %w", name, ErrNotFound)
+	}
+	delete(h.users, name)
+	return nil
+}
+
+// memoryGrant is the user and scope of a grant
+type memoryGrant struct {
+	user, scope string
+}
+
+// ReadGrants fetches the grants of a user or of all users
+func (h *Memory) ReadGrants(ctx context.Context, user string) ([]Grant, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	user = userName(user)
+	var gs []Grant
+	for k, role := range h.grants {
+		if user == "" || k.user == user {
+			gs = append(gs, Grant{User: k.user, Role: role, Scope: k.scope})
+		}
+	}
+	sort.Slice(gs, func(i, j int) bool {
+		if gs[i].User != gs[j].User {
+			return gs[i].User < gs[j].User
+		}
+		return gs[i].Scope < gs[j].Scope
+	})
+	return gs, nil
+}
+
+// WriteGrant adds a grant or replaces the role
+func (h *Memory) WriteGrant(ctx context.Context, g Grant) error {
+	g, err := validGrant(g)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.grants == nil {
+		h.grants = make(map[memoryGrant]string)
+	}
+	h.grants[memoryGrant{user: g.User, scope: g.Scope}] = g.Role
+	return nil
+}
+
+// DeleteGrant removes the grant of a user on a scope
+func (h *Memory) DeleteGrant(ctx context.Context, user, scope string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := memoryGrant{user: userName(user), scope: grantScope(scope)}
+	if _, ok := h.grants[k]; !ok {
+		return fmt.Errorf("Unknown grant of %s on %s: %w", user, scope, ErrNotFound)
+	}
+	delete(h.grants, k)
+	return nil
+}
+
+// ReadToken fetches an API token
+func (h *Memory) ReadToken(ctx context.Context, id string) (Token, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	t, ok := h.tokens[id]
+	if !ok {
+		return Token{}, fmt.Errorf("Unknown token %s: %w", id, ErrNotFound)
+	}
+	return t, nil
+}
+
+// ReadTokens fetches the API tokens of a user or all tokens
+func (h *Memory) ReadTokens(ctx context.Context, user string) ([]Token, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	user = userName(user)
+	var ts []Token
+	for _, t := range h.tokens {
+		if user == "" || t.User == user {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Created.After(ts[j].Created) })
+	return ts, nil
+}
+
+// WriteToken stores a new API token
+func (h *Memory) WriteToken(ctx context.Context, t Token) error {
+	t, err := validToken(t)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tokens == nil {
+		h.tokens = make(map[string]Token)
+	}
+	if _, ok := h.tokens[t.ID]; ok {
+		return fmt.Errorf("The token %s already exists", t.ID)
+	}
+	h.tokens[t.ID] = t
+	return nil
+}
+
+// RevokeToken marks an API token as revoked
+func (h *Memory) RevokeToken(ctx context.Context, id string) error {
+	return h.updateToken(id, func(t *Token) { t.Revoked = true })
+}
+
+// TouchToken sets the time an API token was last used
+func (h *Memory) TouchToken(ctx context.Context, id string, used time.Time) error {
+	return h.updateToken(id, func(t *Token) { t.LastUsed = used })
+}
+
+// updateToken changes a single API token
+func (h *Memory) updateToken(id string, update func(*Token)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.tokens[id]
+	if !ok {
+		return fmt.Errorf("Unknown token %s: %w", id, ErrNotFound)
+	}
+	update(&t)
+	h.tokens[id] = t
+	return nil
+}
@@ -0,0 +1,956 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+func feedback(t testing.TB, org, id string, begin int64, ip string) dmarc.Feedback {
+	t.Helper()
+
+	f, err := dmarc.Read([]byte(fmt.Sprintf(`<?xml version="1.0"?>
+<feedback>
+  <report_metadata>
+    <org_name>%s</org_name>
+    <email>noreply@%s</email>
+    <report_id>%s</report_id>
+    <date_range><begin>%d</begin><end>%d</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>Example.COM</domain><adkim>R</adkim><aspf>r</aspf><p>none</p><sp>none</sp><pct>100</pct>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>%s</source_ip>
+      <count>3</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><result>PASS</result></dkim>
+    </auth_results>
+  </record>
+</feedback>`, org, org, id, begin, begin+86400, ip)))
+	if err != nil {
+		t.Fatalf("Unable to create feedback: %v", err)
+	}
+	return f
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	writes := []dmarc.Feedback{
+		feedback(t, "google.com", "1", 1000, "10.0.0.1"),
+		feedback(t, "google.com", "2", 3000, "10.0.0.2"),
+		feedback(t, "google.com", "1", 1000, "10.0.0.3"),
+		feedback(t, "yahoo.com", "1", 2000, "10.0.0.4"),
+	}
+	for _, f := range writes {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	reports, err := m.ReadReports(ctx, ReportQuery{Offset: 0, PageSize: 30})
+	if err != nil {
+		t.Fatalf("Unable to read reports: %v", err)
+	}
+
+	if len(reports) != 3 {
+		t.Fatalf("Expected 3 reports after dedupe but got %d", len(reports))
+	}
+
+	for i, id := range []string{"2", "1", "1"} {
+		if reports[i].ReportID != id {
+			t.Errorf("Report %d should be %s but is %s", i, id, reports[i].ReportID)
+		}
+	}
+
+	if n, err := m.CountReports(ctx, ReportQuery{}); err != nil || n != 3 {
+		t.Errorf("Expected 3 reports but got %d: %v", n, err)
+	}
+
+	r := reports[0]
+	if r.PolicyDomain != "example.com" || r.PolicyAdkim != "r" {
+		t.Errorf("Policy should be lower case: %#v", r)
+	}
+	if r.Count != 3 || r.DKIMResult != "pass" || r.SPFResult != "neutral" {
+		t.Errorf("Unexpected aggregated results: %#v", r)
+	}
+
+	page, err := m.ReadReports(ctx, ReportQuery{Offset: 2, PageSize: 30})
+	if err != nil {
+		t.Fatalf("Unable to read reports: %v", err)
+	}
+	if len(page) != 1 || page[0].ReportOrg != "google.com" {
+		t.Errorf("Unexpected page: %#v", page)
+	}
+
+	rs, err := m.ReadReport(ctx, page[0].ID)
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	if len(rs.Rows) != 1 || rs.Rows[0].SourceIP != "10.0.0.3" {
+		t.Errorf("The changed report should have replaced the first: %#v", rs.Rows)
+	}
+
+	if _, err := m.ReadReport(ctx, 42); err == nil {
+		t.Error("Reading a missing report should fail")
+	}
+}
+
+func TestMemoryConcurrency(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f := feedback(t, "google.com", fmt.Sprint(i%10), 1000, "10.0.0.1")
+			if err := m.Write(ctx, f); err != nil {
+				t.Errorf("Unable to write: %v", err)
+			}
+			if _, err := m.ReadReports(ctx, ReportQuery{Offset: 0, PageSize: 5}); err != nil {
+				t.Errorf("Unable to read: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reports, err := m.ReadReports(ctx, ReportQuery{Offset: 0, PageSize: 100})
+	if err != nil {
+		t.Fatalf("Unable to read reports: %v", err)
+	}
+	if len(reports) != 10 {
+		t.Errorf("Expected 10 reports but got %d", len(reports))
+	}
+}
+
+func TestMemoryPurge(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "yahoo.com", "1", 10*day+60, "10.0.0.1"),
+		feedback(t, "google.com", "2", 20*day, "10.0.0.1"),
+		feedback(t, "google.com", "3", 40*day, "10.0.0.1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	res, err := m.Purge(ctx, time.Unix(30*day, 0), time.Time{})
+	if err != nil {
+		t.Fatalf("Unable to purge: %v", err)
+	}
+	if res.Reports != 3 || res.Rows != 3 || res.Stats != 0 {
+		t.Errorf("Unexpected purge result: %#v", res)
+	}
+	// The messages of purged reports stay in the daily statistics
+	if len(m.stats) != 4 {
+		t.Errorf("Expected 4 daily statistics but got %d", len(m.stats))
+	}
+
+	reports, err := m.ReadReports(ctx, ReportQuery{Offset: 0, PageSize: 30})
+	if err != nil {
+		t.Fatalf("Unable to read reports: %v", err)
+	}
+	if len(reports) != 1 || reports[0].ReportID != "3" {
+		t.Errorf("Only report 3 should remain: %#v", reports)
+	}
+
+	// Rows of purged reports can be stored again
+	if err := m.Write(ctx, feedback(t, "google.com", "1", 10*day, "10.0.0.1")); err != nil {
+		t.Fatalf("Unable to write: %v", err)
+	}
+
+	res, err = m.Purge(ctx, time.Time{}, time.Unix(15*day, 0))
+	if err != nil {
+		t.Fatalf("Unable to purge: %v", err)
+	}
+	if res.Reports != 0 || res.Stats != 2 {
+		t.Errorf("Unexpected purge result: %#v", res)
+	}
+}
+
+func TestMemoryQuery(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "Yahoo.com", "2", 11*day, "10.0.1.1"),
+		feedback(t, "google.com", "3", 12*day, "2001:db8::1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	tt := []struct {
+		name     string
+		query    ReportQuery
+		expected []string
+	}{
+		{"all", ReportQuery{}, []string{"3", "2", "1"}},
+		{"ascending", ReportQuery{Ascending: true}, []string{"1", "2", "3"}},
+		{"org", ReportQuery{ReportOrg: "yahoo.com"}, []string{"2"}},
+		{"sort_org", ReportQuery{Sort: SortOrg, Ascending: true}, []string{"1", "3", "2"}},
+		{"domain", ReportQuery{PolicyDomain: "example.com"}, []string{"3", "2", "1"}},
+		{"other_domain", ReportQuery{PolicyDomain: "example.org"}, nil},
+		{"from", ReportQuery{From: time.Unix(12*day, 0)}, []string{"3", "2"}},
+		{"to", ReportQuery{To: time.Unix(11*day, 0)}, []string{"1"}},
+		{"cidr", ReportQuery{SourceIP: "10.0.0.0/16"}, []string{"2", "1"}},
+		{"ip", ReportQuery{SourceIP: "10.0.1.1"}, []string{"2"}},
+		{"ipv6", ReportQuery{SourceIP: "2001:db8::/32"}, []string{"3"}},
+		{"disposition", ReportQuery{Disposition: "quarantine"}, nil},
+		{"rows", ReportQuery{Disposition: "none", DKIMResult: "pass", HeaderFrom: "EXAMPLE.com"}, []string{"3", "2", "1"}},
+		{"spf", ReportQuery{SPFResult: "pass"}, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.query.PageSize = 10
+
+			reports, err := m.ReadReports(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("Unable to read reports: %v", err)
+			}
+
+			var ids []string
+			for _, r := range reports {
+				ids = append(ids, r.ReportID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, ids)
+			}
+
+			n, err := m.CountReports(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("Unable to count reports: %v", err)
+			}
+			if n != len(tc.expected) {
+				t.Errorf("Expected %d reports but counted %d", len(tc.expected), n)
+			}
+		})
+	}
+
+	if _, err := m.ReadReports(ctx, ReportQuery{SourceIP: "10.0.0.0/33"}); err == nil {
+		t.Error("An invalid CIDR should fail")
+	}
+}
+
+func TestMemoryRows(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "Yahoo.com", "2", 11*day, "10.0.1.1"),
+		feedback(t, "google.com", "3", 12*day, "10.0.0.1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	tt := []struct {
+		name     string
+		query    ReportQuery
+		expected []string
+	}{
+		{"ip", ReportQuery{SourceIP: "10.0.0.1"}, []string{"3", "1"}},
+		{"limit", ReportQuery{SourceIP: "10.0.0.1", PageSize: 1}, []string{"3"}},
+		{"cidr_org", ReportQuery{SourceIP: "10.0.0.0/16", ReportOrg: "yahoo.com"}, []string{"2"}},
+		{"nomatch", ReportQuery{SourceIP: "10.0.0.1", SPFResult: "pass"}, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := m.ReadRows(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("Unable to read rows: %v", err)
+			}
+
+			var ids []string
+			for _, r := range rows {
+				ids = append(ids, r.Report.ReportID)
+				if r.Row.DKIMResult != "pass" || r.Report.PolicyDomain != "example.com" {
+					t.Errorf("Expected normalised row and report but got %+v", r)
+				}
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Errorf("Expected %v but got %v", tc.expected, ids)
+			}
+		})
+	}
+
+	stop := fmt.Errorf("stop")
+	var walked int
+	err := m.WalkRows(ctx, ReportQuery{}, func(r ReportRow) error {
+		walked++
+		return stop
+	})
+	if err != stop || walked != 1 {
+		t.Errorf("Expected the walk to stop at the first error but got %v after %d rows", err, walked)
+	}
+}
+
+func TestMemoryPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	reject := feedback(t, "google.com", "3", 12*day, "10.0.0.1")
+	reject.PolicyPublished.P = "Reject"
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "Yahoo.com", "2", 11*day, "10.0.1.1"),
+		reject,
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	ps, err := m.ReadPolicies(ctx, "EXAMPLE.com")
+	if err != nil {
+		t.Fatalf("Unable to read policies: %v", err)
+	}
+
+	expected := []PolicyState{
+		{Adkim: "r", Aspf: "r", P: "none", SP: "none", PCT: "100", First: time.Unix(10*day, 0), Last: time.Unix(12*day, 0), Reports: 2, Reporters: 2},
+		{Adkim: "r", Aspf: "r", P: "reject", SP: "none", PCT: "100", First: time.Unix(12*day, 0), Last: time.Unix(13*day, 0), Reports: 1, Reporters: 1},
+	}
+	if len(ps) != len(expected) {
+		t.Fatalf("Expected %d policies but got %+v", len(expected), ps)
+	}
+	for i := range expected {
+		if !ps[i].First.Equal(expected[i].First) || !ps[i].Last.Equal(expected[i].Last) {
+			t.Errorf("Expected period %v - %v but got %v - %v", expected[i].First, expected[i].Last, ps[i].First, ps[i].Last)
+		}
+		ps[i].First, ps[i].Last = expected[i].First, expected[i].Last
+		if ps[i] != expected[i] {
+			t.Errorf("Expected %+v but got %+v", expected[i], ps[i])
+		}
+	}
+
+	if ps, _ = m.ReadPolicies(ctx, "example.org"); len(ps) != 0 {
+		t.Errorf("Expected no policies but got %+v", ps)
+	}
+}
+
+func TestMemoryReporters(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "Yahoo.com", "2", 11*day, "10.0.1.1"),
+		feedback(t, "Google.com ", "3", 12*day, "10.0.0.1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	rs, err := m.ReadReporters(ctx, "")
+	if err != nil {
+		t.Fatalf("Unable to read reporters: %v", err)
+	}
+	if len(rs) != 2 || rs[0].Reporter != "google.com" || rs[1].Reporter != "yahoo.com" {
+		t.Fatalf("Expected google.com and yahoo.com got %+v", rs)
+	}
+	google := rs[0]
+	if google.Domain != "example.com" || google.Reports != 2 || google.Messages != 6 || google.Rows != 2 ||
+		!google.First.Equal(time.Unix(10*day, 0)) || !google.Last.Equal(time.Unix(13*day, 0)) {
+		t.Errorf("Unexpected summary of google.com %+v", google)
+	}
+
+	if rs, _ = m.ReadReporters(ctx, " YAHOO.com"); len(rs) != 1 || rs[0].Reports != 1 {
+		t.Errorf("Expected one report from yahoo.com got %+v", rs)
+	}
+
+	if err = m.AddMalformed(ctx, "Google.com"); err != nil {
+		t.Fatalf("Unable to count malformed report: %v", err)
+	}
+	if err = m.AddMalformed(ctx, " "); err == nil {
+		t.Error("A malformed report without reporter should fail")
+	}
+	cs, err := m.ReporterCounts(ctx)
+	if err != nil || len(cs) != 1 || cs[0] != (ReporterCount{Reporter: "google.com", Malformed: 1}) {
+		t.Errorf("Expected one malformed report from google.com got %+v: %v", cs, err)
+	}
+}
+
+func TestMemoryCursor(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	// Two reports share the same begin date so the ID decides the order
+	for i, begin := range []int64{100, 200, 200, 300, 400} {
+		if err := m.Write(ctx, feedback(t, "google.com", fmt.Sprint(i+1), begin, "10.0.0.1")); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	ids := func(q ReportQuery) string {
+		q.PageSize = 2
+		reports, err := m.ReadReports(ctx, q)
+		if err != nil {
+			t.Fatalf("Unable to read reports: %v", err)
+		}
+		var ids []string
+		for _, r := range reports {
+			ids = append(ids, r.ReportID)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	tt := []struct {
+		name     string
+		query    ReportQuery
+		expected string
+	}{
+		{"first", ReportQuery{}, "[5 4]"},
+		{"next", ReportQuery{Cursor: &Cursor{Begin: time.Unix(300, 0), ID: 4}}, "[3 2]"},
+		{"next_same_begin", ReportQuery{Cursor: &Cursor{Begin: time.Unix(200, 0), ID: 3}}, "[2 1]"},
+		{"previous", ReportQuery{Cursor: &Cursor{Begin: time.Unix(200, 0), ID: 2, Backward: true}}, "[4 3]"},
+		{"last", ReportQuery{Cursor: &Cursor{Backward: true}}, "[2 1]"},
+		{"ascending", ReportQuery{Ascending: true, Cursor: &Cursor{Begin: time.Unix(200, 0), ID: 2}}, "[3 4]"},
+		{"ignore_offset", ReportQuery{Offset: 4, Cursor: &Cursor{Begin: time.Unix(400, 0), ID: 5}}, "[4 3]"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ids(tc.query); got != tc.expected {
+				t.Errorf("Expected %s but got %s", tc.expected, got)
+			}
+		})
+	}
+
+	c, err := ParseCursor((&Cursor{Begin: time.Unix(200, 0), ID: 3}).String(), true)
+	if err != nil || c.Begin.Unix() != 200 || c.ID != 3 || !c.Backward {
+		t.Errorf("Cursor not parsed correctly: %#v %v", c, err)
+	}
+	if _, err := ParseCursor("yesterday", false); err == nil {
+		t.Error("Parsing an invalid cursor should fail")
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "google.com", "2", 10*day+60, "10.0.0.2"),
+		feedback(t, "yahoo.com", "1", 10*day+120, "10.0.0.1"),
+		feedback(t, "google.com", "3", 11*day, "10.0.0.1"),
+		// Duplicates are not counted
+		feedback(t, "google.com", "3", 11*day, "10.0.0.1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	stats, err := m.ReadStats(ctx, StatsQuery{GroupBy: []string{StatDay}})
+	if err != nil {
+		t.Fatalf("Unable to read stats: %v", err)
+	}
+	if len(stats) != 2 || stats[0].Messages != 9 || stats[1].Messages != 3 {
+		t.Fatalf("Unexpected stats per day: %#v", stats)
+	}
+	if !stats[0].Day.Equal(time.Unix(10*day, 0)) || stats[0].PolicyDomain != "" {
+		t.Errorf("Unexpected first day: %#v", stats[0])
+	}
+
+	stats, err = m.ReadStats(ctx, StatsQuery{GroupBy: []string{StatSourceIP}, Top: 1, Reporter: "Google.com"})
+	if err != nil {
+		t.Fatalf("Unable to read stats: %v", err)
+	}
+	if len(stats) != 1 || stats[0].SourceIP != "10.0.0.1" || stats[0].Messages != 6 {
+		t.Errorf("Unexpected top source IP: %#v", stats)
+	}
+
+	stats, err = m.ReadStats(ctx, StatsQuery{From: time.Unix(11*day, 0), SPFAlign: "fail"})
+	if err != nil {
+		t.Fatalf("Unable to read stats: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Messages != 3 {
+		t.Errorf("Unexpected total: %#v", stats)
+	}
+
+	if _, err = m.ReadStats(ctx, StatsQuery{GroupBy: []string{"month"}}); err == nil {
+		t.Errorf("Expected an error on unknown dimension")
+	}
+
+	// The statistics survives purging the reports
+	if _, err = m.Purge(ctx, time.Unix(20*day, 0), time.Time{}); err != nil {
+		t.Fatalf("Unable to purge: %v", err)
+	}
+	stats, _ = m.ReadStats(ctx, StatsQuery{})
+	if len(stats) != 1 || stats[0].Messages != 12 {
+		t.Errorf("Unexpected total after purge: %#v", stats)
+	}
+
+	res, err := m.Purge(ctx, time.Time{}, time.Unix(11*day, 0))
+	if err != nil {
+		t.Fatalf("Unable to purge: %v", err)
+	}
+	if res.Stats != 3 {
+		t.Errorf("Expected 3 daily statistics to be purged: %#v", res)
+	}
+}
+
+func TestMemoryTenants(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	acme := WithTenant(ctx, "acme")
+	other := WithTenant(ctx, "other")
+
+	if err := m.Write(acme, feedback(t, "google.com", "1", 1000, "10.0.0.1")); err != nil {
+		t.Fatalf("Unable to write: %v", err)
+	}
+	if err := m.Write(other, feedback(t, "google.com", "2", 2000, "10.0.0.2")); err != nil {
+		t.Fatalf("Unable to write: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ctx      context.Context
+		expected int
+	}{
+		{"acme", acme, 1},
+		{"other", other, 1},
+		{"unknown", WithTenant(ctx, "unknown"), 0},
+		{"unscoped", ctx, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reports, err := m.ReadReports(tc.ctx, ReportQuery{PageSize: 30})
+			if err != nil {
+				t.Fatalf("Unable to read reports: %v", err)
+			}
+			if len(reports) != tc.expected {
+				t.Errorf("Expected %d reports got %d", tc.expected, len(reports))
+			}
+
+			n, err := m.CountReports(tc.ctx, ReportQuery{})
+			if err != nil || n != tc.expected {
+				t.Errorf("Expected a count of %d got %d: %v", tc.expected, n, err)
+			}
+
+			stats, err := m.ReadStats(tc.ctx, StatsQuery{GroupBy: []string{StatSourceIP}})
+			if err != nil || len(stats) != tc.expected {
+				t.Errorf("Expected %d statistics got %#v: %v", tc.expected, stats, err)
+			}
+		})
+	}
+
+	if _, err := m.ReadReport(acme, 1); err != nil {
+		t.Errorf("Unable to read own report: %v", err)
+	}
+	if _, err := m.ReadReport(other, 1); err == nil {
+		t.Errorf("Expected report of another tenant to be hidden")
+	}
+
+	// The same report sent to both tenants is not a duplicate
+	for _, policy := range []DedupePolicy{{Identical: DedupeSkip, Changed: DedupeSkip}, {Identical: DedupeReplace, Changed: DedupeReplace}} {
+		m = &Memory{Dedupe: policy}
+		f := feedback(t, "google.com", "1", 1000, "10.0.0.1")
+		for _, tctx := range []context.Context{acme, other} {
+			if err := m.Write(tctx, f); err != nil {
+				t.Fatalf("Unable to write: %v", err)
+			}
+		}
+		for _, tctx := range []context.Context{acme, other} {
+			if n, err := m.CountReports(tctx, ReportQuery{}); err != nil || n != 1 {
+				t.Errorf("Expected the report in %s with %+v but got %d: %v", TenantFromContext(tctx), policy, n, err)
+			}
+		}
+	}
+}
+
+func TestMemoryDomains(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+	if err := m.Write(ctx, feedback(t, "google.com", "1", 1000, "10.0.0.1")); err != nil {
+		t.Fatalf("Unable to write: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ctx      context.Context
+		expected int
+	}{
+		{"granted", WithDomains(ctx, []string{"other.com", " EXAMPLE.com"}), 1},
+		{"other", WithDomains(ctx, []string{"other.com"}), 0},
+		{"none", WithDomains(ctx, nil), 0},
+		{"unscoped", ctx, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reports, err := m.ReadReports(tc.ctx, ReportQuery{PageSize: 30})
+			if err != nil || len(reports) != tc.expected {
+				t.Errorf("Expected %d reports got %d: %v", tc.expected, len(reports), err)
+			}
+
+			stats, err := m.ReadStats(tc.ctx, StatsQuery{GroupBy: []string{StatSourceIP}})
+			if err != nil || len(stats) != tc.expected {
+				t.Errorf("Expected %d statistics got %#v: %v", tc.expected, stats, err)
+			}
+
+			reporters, err := m.ReadReporters(tc.ctx, "")
+			if err != nil || len(reporters) != tc.expected {
+				t.Errorf("Expected %d reporters got %#v: %v", tc.expected, reporters, err)
+			}
+
+			_, err = m.ReadReport(tc.ctx, 1)
+			if tc.expected == 0 && !IsNotFound(err) {
+				t.Errorf("Expected the report to be hidden but got %v", err)
+			}
+			if tc.expected == 1 && err != nil {
+				t.Errorf("Unable to read report: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupe(t *testing.T) {
+	ctx := context.Background()
+
+	original := feedback(t, "google.com", "1", 1000, "10.0.0.1")
+	resent := feedback(t, " Google.COM", "1", 1000, "10.0.0.1")
+	corrected := feedback(t, "google.com", "1", 1000, "10.0.0.2")
+
+	for _, tc := range []struct {
+		name     string
+		policy   DedupePolicy
+		writes   []dmarc.Feedback
+		ip       string
+		reports  int
+		revision int
+	}{
+		{"identical", DedupePolicy{}, []dmarc.Feedback{original, resent}, "10.0.0.1", 1, 0},
+		{"replace", DedupePolicy{}, []dmarc.Feedback{original, corrected}, "10.0.0.2", 1, 0},
+		{"skip", DedupePolicy{Changed: DedupeSkip}, []dmarc.Feedback{original, corrected}, "10.0.0.1", 1, 0},
+		{"revision", DedupePolicy{Changed: DedupeRevision}, []dmarc.Feedback{original, corrected}, "10.0.0.2", 2, 1},
+		{"identical revision", DedupePolicy{Identical: DedupeRevision}, []dmarc.Feedback{original, resent, resent}, "10.0.0.1", 3, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &Memory{Dedupe: tc.policy}
+			for _, f := range tc.writes {
+				if err := m.Write(ctx, f); err != nil {
+					t.Fatalf("Unable to write: %v", err)
+				}
+			}
+
+			// Only the latest revision is listed and counted
+			reports, err := m.ReadReports(ctx, ReportQuery{PageSize: 30})
+			if err != nil || len(reports) != 1 {
+				t.Fatalf("Expected a single report got %#v: %v", reports, err)
+			}
+			rs, err := m.ReadReport(ctx, reports[0].ID)
+			if err != nil || len(rs.Rows) != 1 || rs.Rows[0].SourceIP != tc.ip {
+				t.Errorf("Expected the report from %s got %#v: %v", tc.ip, rs.Rows, err)
+			}
+
+			stats, err := m.ReadStats(ctx, StatsQuery{GroupBy: []string{StatSourceIP}})
+			if err != nil || len(stats) != 1 || stats[0].SourceIP != tc.ip || stats[0].Messages != 3 {
+				t.Errorf("Expected statistics of %s only got %#v: %v", tc.ip, stats, err)
+			}
+
+			if len(m.reports) != tc.reports {
+				t.Errorf("Expected %d stored revisions got %d", tc.reports, len(m.reports))
+			}
+			if latest := m.latest("", feedbackKey(original)); latest == nil || latest.revision != tc.revision {
+				t.Errorf("Expected revision %d to be the latest: %#v", tc.revision, latest)
+			}
+
+			ds, err := m.ReporterCounts(ctx)
+			expected := int64(len(tc.writes) - 1)
+			if err != nil || len(ds) != 1 || ds[0].Reporter != "google.com" || ds[0].Duplicates != expected {
+				t.Errorf("Expected %d duplicates from google.com got %#v: %v", expected, ds, err)
+			}
+		})
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	if _, err := m.ReadUser(ctx, "alice"); !IsNotFound(err) {
+		t.Errorf("Expected a missing user to be not found but got %v", err)
+	}
+	if err := m.WriteUser(ctx, User{Name: " ", PasswordHash: "x"}); err == nil {
+		t.Error("A user without a name should fail")
+	}
+	if err := m.WriteUser(ctx, User{Name: "alice"}); err == nil {
+		t.Error("A user without a password should fail")
+	}
+
+	for _, u := range []User{{Name: "Alice ", PasswordHash: "1"}, {Name: "bob", PasswordHash: "2"}, {Name: "alice", PasswordHash: "3"}} {
+		if err := m.WriteUser(ctx, u); err != nil {
+			t.Fatalf("Unable to write user: %v", err)
+		}
+	}
+
+	u, err := m.ReadUser(ctx, "ALICE")
+	if err != nil {
+		t.Fatalf("Unable to read user: %v", err)
+	}
+	if u.Name != "alice" || u.PasswordHash != "3" || u.Created.IsZero() {
+		t.Errorf("Expected alice with the new password but got %+v", u)
+	}
+
+	if err = m.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatalf("Unable to delete user: %v", err)
+	}
+	if err = m.DeleteUser(ctx, "bob"); !IsNotFound(err) {
+		t.Errorf("Expected a deleted user to be not found but got %v", err)
+	}
+
+	us, err := m.ReadUsers(ctx)
+	if err != nil {
+		t.Fatalf("Unable to read users: %v", err)
+	}
+	if len(us) != 1 || us[0].Name != "alice" {
+		t.Errorf("Expected only alice but got %+v", us)
+	}
+}
+
+func TestMemoryGrants(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	if err := m.WriteGrant(ctx, Grant{User: "alice", Role: "viewer"}); err == nil {
+		t.Error("A grant without a scope should fail")
+	}
+
+	for _, g := range []Grant{
+		{User: "Alice", Role: "viewer", Scope: "Example.com"},
+		{User: "alice", Role: "analyst", Scope: "group:emea"},
+		{User: "bob", Role: "admin", Scope: "*"},
+		{User: "alice", Role: "admin", Scope: "example.com "},
+	} {
+		if err := m.WriteGrant(ctx, g); err != nil {
+			t.Fatalf("Unable to write grant: %v", err)
+		}
+	}
+
+	gs, err := m.ReadGrants(ctx, "ALICE")
+	if err != nil {
+		t.Fatalf("Unable to read grants: %v", err)
+	}
+	expected := []Grant{{User: "alice", Role: "admin", Scope: "example.com"}, {User: "alice", Role: "analyst", Scope: "group:emea"}}
+	if fmt.Sprint(gs) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v but got %v", expected, gs)
+	}
+
+	if err = m.DeleteGrant(ctx, "alice", "Example.com"); err != nil {
+		t.Fatalf("Unable to delete grant: %v", err)
+	}
+	if err = m.DeleteGrant(ctx, "alice", "example.com"); !IsNotFound(err) {
+		t.Errorf("Expected a deleted grant to be not found but got %v", err)
+	}
+
+	if gs, err = m.ReadGrants(ctx, ""); err != nil || len(gs) != 2 {
+		t.Errorf("Expected 2 grants but got %v: %v", gs, err)
+	}
+}
+
+func TestMemoryTokens(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	if err := m.WriteToken(ctx, Token{ID: "a", Hash: "x", User: "alice"}); err == nil {
+		t.Error("A token without scopes should fail")
+	}
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tk := range []Token{
+		{ID: "a", Hash: "1", User: "Alice", Scopes: []string{"read"}, Created: created},
+		{ID: "b", Hash: "2", User: "ci", Service: true, Scopes: []string{"upload"}, Created: created.Add(time.Hour)},
+		{ID: "c", Hash: "3", User: "alice", Scopes: []string{"read", "admin"}, Created: created.Add(2 * time.Hour)},
+	} {
+		if err := m.WriteToken(ctx, tk); err != nil {
+			t.Fatalf("Unable to write token: %v", err)
+		}
+	}
+	if err := m.WriteToken(ctx, Token{ID: "a", Hash: "4", User: "bob", Scopes: []string{"read"}}); err == nil {
+		t.Error("Expected a token with an existing ID to fail")
+	}
+
+	ts, err := m.ReadTokens(ctx, "ALICE")
+	if err != nil || len(ts) != 2 || ts[0].ID != "c" || ts[1].ID != "a" {
+		t.Errorf("Expected the tokens of alice newest first but got %+v: %v", ts, err)
+	}
+	if ts, err = m.ReadTokens(ctx, ""); err != nil || len(ts) != 3 {
+		t.Errorf("Expected all tokens but got %+v: %v", ts, err)
+	}
+
+	used := created.Add(24 * time.Hour)
+	if err = m.TouchToken(ctx, "a", used); err != nil {
+		t.Fatalf("Unable to touch token: %v", err)
+	}
+	if err = m.RevokeToken(ctx, "a"); err != nil {
+		t.Fatalf("Unable to revoke token: %v", err)
+	}
+	tk, err := m.ReadToken(ctx, "a")
+	if err != nil || !tk.Revoked || !tk.LastUsed.Equal(used) || tk.User != "alice" {
+		t.Errorf("Expected a used and revoked token but got %+v: %v", tk, err)
+	}
+
+	for _, err = range []error{m.RevokeToken(ctx, "x"), m.TouchToken(ctx, "x", used)} {
+		if !IsNotFound(err) {
+			t.Errorf("Expected an unknown token to be not found but got %v", err)
+		}
+	}
+	if _, err = m.ReadToken(ctx, "x"); !IsNotFound(err) {
+		t.Errorf("Expected an unknown token to be not found but got %v", err)
+	}
+}
+
+func TestMemoryNotes(t *testing.T) {
+	ctx := context.Background()
+
+	m := &Memory{Dedupe: DedupePolicy{Changed: DedupeRevision}}
+	if err := m.Initialize(ctx); err != nil {
+		t.Fatalf("Unable to initialize: %v", err)
+	}
+
+	day := int64(86400)
+	for _, f := range []dmarc.Feedback{
+		feedback(t, "google.com", "1", 10*day, "10.0.0.1"),
+		feedback(t, "google.com", "1", 10*day, "10.0.0.2"),
+		feedback(t, "google.com", "2", 40*day, "10.0.0.1"),
+	} {
+		if err := m.Write(ctx, f); err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+	if err := m.WriteNote(ctx, 1, Note{User: "anna", Text: " Forwarded "}); err != nil {
+		t.Fatalf("Unable to write note: %v", err)
+	}
+	if err := m.WriteNote(ctx, 3, Note{User: "anna", Text: "Expected"}); err != nil {
+		t.Fatalf("Unable to write note: %v", err)
+	}
+
+	tt := []struct {
+		name  string
+		ctx   context.Context
+		id    int64
+		notes int
+		err   bool
+	}{
+		// Notes belong to all revisions of the report
+		{"revision", ctx, 2, 1, false},
+		{"other_report", ctx, 3, 1, false},
+		{"other_tenant", WithTenant(ctx, "acme"), 1, 0, true},
+		{"other_domain", WithDomains(ctx, []string{"example.org"}), 1, 0, true},
+		{"missing", ctx, 4, 0, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			notes, err := m.ReadNotes(tc.ctx, tc.id)
+			if tc.err != IsNotFound(err) || len(notes) != tc.notes {
+				t.Errorf("Expected %d notes and not found %v: %#v %v", tc.notes, tc.err, notes, err)
+			}
+		})
+	}
+
+	if err := m.WriteNote(ctx, 1, Note{User: "anna", Text: "  "}); err == nil {
+		t.Errorf("Expected an empty note to fail")
+	}
+
+	// Purged reports take their notes with them
+	if _, err := m.Purge(ctx, time.Unix(30*day, 0), time.Time{}); err != nil {
+		t.Fatalf("Unable to purge: %v", err)
+	}
+	if len(m.notes) != 1 || m.notes[0].Text != "Expected" {
+		t.Errorf("Expected only the note on report 3 to remain: %#v", m.notes)
+	}
+
+	// The statistics of the purged report stay
+	stats := len(m.stats)
+	if err := m.DeleteReport(ctx, 3); err != nil {
+		t.Fatalf("Unable to delete report: %v", err)
+	}
+	if len(m.notes) != 0 || len(m.reports) != 0 || len(m.stats) != stats-1 {
+		t.Errorf("Expected the report, notes and statistics to be deleted: %#v %#v %#v", m.notes, m.reports, m.stats)
+	}
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Migration is a single versioned step of the schema. All statements in a
+// step are applied within one transaction
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// MigrationStatus tells if and when a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator is implemented by drivers that has a versioned schema
+type Migrator interface {
+	// Migrations returns the status of all known migrations
+	Migrations(ctx context.Context) ([]MigrationStatus, error)
+	// Migrate applies all pending migrations and returns the ones applied
+	Migrate(ctx context.Context) ([]MigrationStatus, error)
+}
+
+// schema keeps track of the applied migrations in the schema_version table
+type schema struct {
+	db         *sql.DB
+	migrations []Migration
+
+	// The statements differ between the database dialects. exists returns
+	// true if schema_version has been created
+	create string
+	exists string
+	insert string
+	// lock is run as the first statement in each transaction to prevent
+	// two instances from applying the same migration
+	lock string
+	// sessionLock and sessionUnlock are run on a connection of their own
+	// around all migrations of databases where DDL can not be locked within
+	// a transaction. sessionLock returns 1 when the lock is taken
+	sessionLock   string
+	sessionUnlock string
+}
+
+// applied returns when each migration was applied without changing the
+// database, so nothing is applied before schema_version is created
+func (s schema) applied(ctx context.Context) (map[int]time.Time, error) {
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, s.exists).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("Unable to look up schema_version: %v", err)
+	}
+	if !exists {
+		return map[int]time.Time{}, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read schema_version: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("Unable to scan schema_version: %v", err)
+		}
+		applied[version] = at
+	}
+
+	return applied, rows.Err()
+}
+
+func (s schema) status(ctx context.Context) ([]MigrationStatus, error) {
+
+	applied, err := s.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, m := range s.migrations {
+		at, ok := applied[m.Version]
+		status = append(status, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: at})
+	}
+	return status, nil
+}
+
+func (s schema) migrate(ctx context.Context) (done []MigrationStatus, err error) {
+
+	if s.sessionLock != "" {
+		unlock, err := s.lockSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	if _, err = s.db.ExecContext(ctx, s.create); err != nil {
+		return nil, fmt.Errorf("Unable to create schema_version: %v", err)
+	}
+
+	status, err := s.status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, st := range status {
+		if st.Applied {
+			continue
+		}
+
+		m := s.migrations[i]
+		log.Infof("Applying migration %d: %s", m.Version, m.Name)
+
+		applied, err := s.apply(ctx, m)
+		if err != nil {
+			return done, err
+		}
+
+		if applied {
+			st.Applied = true
+			st.AppliedAt = time.Now().UTC()
+			done = append(done, st)
+		}
+	}
+
+	return done, nil
+}
+
+// lockSession takes the session lock on a connection of its own and returns
+// the function releasing it
+func (s schema) lockSession(ctx context.Context) (func(), error) {
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get connection: %v", err)
+	}
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, s.sessionLock).Scan(&locked); err != nil || locked.Int64 != 1 {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("timed out waiting for another instance")
+		}
+		return nil, fmt.Errorf("Unable to lock schema: %v", err)
+	}
+
+	return func() {
+		// The lock belongs to the session, so it is held until released
+		// even when the connection is returned to the pool
+		var released sql.NullInt64
+		if err := conn.QueryRowContext(context.Background(), s.sessionUnlock).Scan(&released); err != nil {
+			log.Errorf("Unable to unlock schema: %v", err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
+
+func (s schema) apply(ctx context.Context, m Migration) (bool, error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("Unable to begin transaction: %v", err)
+	}
+
+	rollback := func(err error) (bool, error) {
+		if rerr := tx.Rollback(); rerr != nil {
+			return false, fmt.Errorf("Error doing rollback after migration %d failed: %v %v", m.Version, err, rerr)
+		}
+		return false, err
+	}
+
+	if s.lock != "" {
+		if _, err = tx.ExecContext(ctx, s.lock); err != nil {
+			return rollback(fmt.Errorf("Unable to lock schema_version: %v", err))
+		}
+
+		// Another instance might have applied it while we waited for the lock
+		var n int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_version WHERE version = `+fmt.Sprint(m.Version)).Scan(&n)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to read schema_version: %v", err))
+		}
+		if n > 0 {
+			log.Infof("Migration %d has already been applied", m.Version)
+			return false, tx.Rollback()
+		}
+	}
+
+	for _, stmt := range m.Statements {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return rollback(fmt.Errorf("Migration %d (%s) failed: %v", m.Version, m.Name, err))
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, s.insert, m.Version, m.Name, time.Now().UTC()); err != nil {
+		return rollback(fmt.Errorf("Unable to update schema_version: %v", err))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("Unable to commit migration %d: %v", m.Version, err)
+	}
+	return true, nil
+}
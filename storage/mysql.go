@@ -0,0 +1,1515 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// mysqlBatchSize is the number of rows per INSERT. It has to stay below the
+// limit of 65535 placeholders per statement
+const mysqlBatchSize = 1000
+
+// MySQL storage (Also works for MariaDB)
+type MySQL struct {
+	db     *sql.DB
+	URL    string
+	Pool   Pool
+	Dedupe DedupePolicy
+}
+
+// mysqlMigrations is the schema history. Never change a released migration,
+// add a new one instead.
+//
+// DDL statements in MySQL does an implicit commit, so unlike PostgreSQL a
+// failed migration is not rolled back and may need manual cleanup
+var mysqlMigrations = []Migration{
+	// The unique key has to fit within the 3072 bytes index limit of InnoDB
+	// using utf8mb4, so the columns used in it has a fixed length
+	{1, "initial schema", []string{`
+		CREATE TABLE IF NOT EXISTS report(
+			id INTEGER AUTO_INCREMENT PRIMARY KEY,
+			report_begin VARCHAR(32),
+			report_end VARCHAR(32),
+			policy_domain VARCHAR(255),
+			report_org VARCHAR(255),
+			report_id VARCHAR(255),
+			report_email VARCHAR(255),
+			report_extra_contact_info VARCHAR(255),
+			policy_adkim VARCHAR(16),
+			policy_aspf VARCHAR(16),
+			policy_p VARCHAR(16),
+			policy_sp VARCHAR(16),
+			policy_pct VARCHAR(16),
+			UNIQUE(report_begin, report_end, report_org, report_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`, `
+		CREATE TABLE IF NOT EXISTS reportrow(
+			id INTEGER AUTO_INCREMENT PRIMARY KEY,
+			rid INTEGER,
+			row_ip VARCHAR(45),
+			row_count INTEGER,
+			eval_disposition VARCHAR(16),
+			eval_spf_align VARCHAR(16),
+			eval_dkim_align VARCHAR(16),
+			reason VARCHAR(255),
+			dkimdomain VARCHAR(255),
+			dkimresult VARCHAR(16),
+			spfdomain VARCHAR(255),
+			spfresult VARCHAR(16),
+			identifier_hfrom VARCHAR(255),
+			FOREIGN KEY (rid) REFERENCES report(id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	// MySQL has no type for IP addresses so row_ip is kept as a string
+	{2, "typed columns", []string{
+		`SET time_zone = '+00:00'`, `
+		UPDATE report SET
+			report_begin = FROM_UNIXTIME(NULLIF(TRIM(report_begin), '')),
+			report_end = FROM_UNIXTIME(NULLIF(TRIM(report_end), '')),
+			policy_pct = CASE WHEN TRIM(policy_pct) REGEXP '^[0-9]+$' THEN TRIM(policy_pct) END,
+			policy_adkim = CASE WHEN LOWER(TRIM(policy_adkim)) IN ('r', 's') THEN LOWER(TRIM(policy_adkim)) ELSE '' END,
+			policy_aspf = CASE WHEN LOWER(TRIM(policy_aspf)) IN ('r', 's') THEN LOWER(TRIM(policy_aspf)) ELSE '' END,
+			policy_p = CASE WHEN LOWER(TRIM(policy_p)) IN ('none', 'quarantine', 'reject') THEN LOWER(TRIM(policy_p)) ELSE '' END,
+			policy_sp = CASE WHEN LOWER(TRIM(policy_sp)) IN ('none', 'quarantine', 'reject') THEN LOWER(TRIM(policy_sp)) ELSE '' END;`, `
+		UPDATE reportrow SET
+			eval_disposition = CASE WHEN LOWER(TRIM(eval_disposition)) IN ('none', 'quarantine', 'reject') THEN LOWER(TRIM(eval_disposition)) ELSE '' END,
+			eval_spf_align = CASE WHEN LOWER(TRIM(eval_spf_align)) IN ('pass', 'fail') THEN LOWER(TRIM(eval_spf_align)) ELSE '' END,
+			eval_dkim_align = CASE WHEN LOWER(TRIM(eval_dkim_align)) IN ('pass', 'fail') THEN LOWER(TRIM(eval_dkim_align)) ELSE '' END,
+			dkimresult = LOWER(TRIM(dkimresult)),
+			spfresult = LOWER(TRIM(spfresult));`, `
+		ALTER TABLE report
+			MODIFY report_begin DATETIME,
+			MODIFY report_end DATETIME,
+			MODIFY policy_pct INTEGER,
+			MODIFY policy_adkim ENUM('', 'r', 's'),
+			MODIFY policy_aspf ENUM('', 'r', 's'),
+			MODIFY policy_p ENUM('', 'none', 'quarantine', 'reject'),
+			MODIFY policy_sp ENUM('', 'none', 'quarantine', 'reject');`, `
+		ALTER TABLE reportrow
+			MODIFY eval_disposition ENUM('', 'none', 'quarantine', 'reject'),
+			MODIFY eval_spf_align ENUM('', 'pass', 'fail'),
+			MODIFY eval_dkim_align ENUM('', 'pass', 'fail');`}},
+	// InnoDB already has an index on reportrow(rid) due to the foreign key
+	{3, "indexes", []string{
+		`CREATE INDEX reportrow_row_ip_idx ON reportrow(row_ip);`,
+		`CREATE INDEX report_policy_domain_idx ON report(policy_domain);`,
+		`CREATE INDEX report_report_begin_idx ON report(report_begin);`}},
+	// Domains and IP addresses are ASCII, which keeps the primary key within
+	// the index limit of InnoDB
+	{4, "daily statistics", []string{`
+		CREATE TABLE IF NOT EXISTS daily_stats(
+			day DATE NOT NULL,
+			policy_domain VARCHAR(255) CHARACTER SET ascii NOT NULL,
+			header_from VARCHAR(255) CHARACTER SET ascii NOT NULL,
+			source_ip VARCHAR(45) CHARACTER SET ascii NOT NULL,
+			reporter VARCHAR(255) NOT NULL,
+			disposition VARCHAR(16) CHARACTER SET ascii NOT NULL,
+			dkim_align VARCHAR(16) CHARACTER SET ascii NOT NULL,
+			spf_align VARCHAR(16) CHARACTER SET ascii NOT NULL,
+			messages BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align),
+			INDEX daily_stats_policy_domain_idx (policy_domain, day)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`, `
+		INSERT INTO daily_stats(day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+		SELECT DATE(r.report_begin) AS day,
+			CONVERT(COALESCE(LOWER(r.policy_domain), '') USING ascii) AS domain,
+			CONVERT(COALESCE(LOWER(rr.identifier_hfrom), '') USING ascii) AS hfrom,
+			COALESCE(rr.row_ip, '') AS ip,
+			COALESCE(r.report_org, '') AS reporter,
+			COALESCE(CAST(rr.eval_disposition AS CHAR), '') AS disposition,
+			COALESCE(CAST(rr.eval_dkim_align AS CHAR), '') AS dkim,
+			COALESCE(CAST(rr.eval_spf_align AS CHAR), '') AS spf,
+			COALESCE(SUM(rr.row_count), 0) AS messages
+		FROM reportrow AS rr
+			JOIN report AS r ON r.id = rr.rid
+		WHERE r.report_begin IS NOT NULL
+		GROUP BY day, domain, hfrom, ip, reporter, disposition, dkim, spf;`}},
+	// Data stored before tenants were configured belongs to no tenant
+	{5, "tenants", []string{`
+		ALTER TABLE report
+			ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT '',
+			ADD INDEX report_tenant_idx (tenant, report_begin);`, `
+		ALTER TABLE daily_stats
+			ADD COLUMN tenant VARCHAR(64) CHARACTER SET ascii NOT NULL DEFAULT '',
+			DROP PRIMARY KEY,
+			ADD PRIMARY KEY(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align),
+			DROP INDEX daily_stats_policy_domain_idx,
+			ADD INDEX daily_stats_policy_domain_idx (tenant, policy_domain, day);`}},
+	// Copies of a report in the same tenant that only differed by the casing
+	// of the organisation were stored more than once. The older copies are
+	// kept as superseded revisions and removed from the daily statistics. The
+	// content hash of existing reports is unknown
+	{6, "report revisions", []string{`
+		ALTER TABLE report
+			ADD COLUMN report_key CHAR(64) CHARACTER SET ascii,
+			ADD COLUMN content_hash CHAR(64) CHARACTER SET ascii NOT NULL DEFAULT '',
+			ADD COLUMN revision INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN superseded BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`SET time_zone = '+00:00'`, `
+		UPDATE report SET report_key = SHA2(CONCAT_WS('|',
+			COALESCE(UNIX_TIMESTAMP(report_begin), 0),
+			COALESCE(UNIX_TIMESTAMP(report_end), 0),
+			LOWER(TRIM(COALESCE(report_org, ''))),
+			TRIM(COALESCE(report_id, ''))), 256);`, `
+		UPDATE report AS r
+			JOIN (SELECT id, ROW_NUMBER() OVER (PARTITION BY tenant, report_key ORDER BY id) - 1 AS revision FROM report) AS d
+				ON d.id = r.id
+		SET r.revision = d.revision
+		WHERE d.revision > 0;`, `
+		UPDATE report AS r
+			JOIN (SELECT tenant, report_key, MAX(revision) AS latest FROM report GROUP BY tenant, report_key) AS l
+				ON l.tenant = r.tenant AND l.report_key = r.report_key
+		SET r.superseded = TRUE
+		WHERE r.revision < l.latest;`, `
+		UPDATE daily_stats AS d
+			JOIN (SELECT r.tenant,
+					DATE(r.report_begin) AS day,
+					CONVERT(COALESCE(LOWER(r.policy_domain), '') USING ascii) AS domain,
+					CONVERT(COALESCE(LOWER(rr.identifier_hfrom), '') USING ascii) AS hfrom,
+					COALESCE(rr.row_ip, '') AS ip,
+					COALESCE(r.report_org, '') AS reporter,
+					COALESCE(CAST(rr.eval_disposition AS CHAR), '') AS disposition,
+					COALESCE(CAST(rr.eval_dkim_align AS CHAR), '') AS dkim,
+					COALESCE(CAST(rr.eval_spf_align AS CHAR), '') AS spf,
+					COALESCE(SUM(rr.row_count), 0) AS messages
+				FROM reportrow AS rr
+					JOIN report AS r ON r.id = rr.rid
+				WHERE r.superseded AND r.report_begin IS NOT NULL
+				GROUP BY r.tenant, day, domain, hfrom, ip, reporter, disposition, dkim, spf) AS s
+				ON d.tenant = s.tenant AND d.day = s.day AND d.policy_domain = s.domain
+					AND d.header_from = s.hfrom AND d.source_ip = s.ip AND d.reporter = s.reporter
+					AND d.disposition = s.disposition AND d.dkim_align = s.dkim AND d.spf_align = s.spf
+		SET d.messages = d.messages - s.messages;`, `
+		ALTER TABLE report
+			MODIFY report_key CHAR(64) CHARACTER SET ascii NOT NULL,
+			DROP INDEX report_begin,
+			ADD UNIQUE INDEX report_tenant_key_revision (tenant, report_key, revision);`, `
+		CREATE TABLE IF NOT EXISTS reporter_stats(
+			tenant VARCHAR(64) CHARACTER SET ascii NOT NULL,
+			reporter VARCHAR(255) NOT NULL,
+			duplicates BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(tenant, reporter)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	{7, "malformed reports", []string{`
+		ALTER TABLE reporter_stats ADD COLUMN malformed BIGINT NOT NULL DEFAULT 0;`}},
+	{8, "users", []string{`
+		CREATE TABLE IF NOT EXISTS users(
+			name VARCHAR(255) NOT NULL PRIMARY KEY,
+			password_hash VARCHAR(255) CHARACTER SET ascii NOT NULL,
+			created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	{9, "grants", []string{`
+		CREATE TABLE IF NOT EXISTS grants(
+			user_name VARCHAR(255) NOT NULL,
+			scope VARCHAR(255) NOT NULL,
+			role VARCHAR(32) CHARACTER SET ascii NOT NULL,
+			PRIMARY KEY (user_name, scope)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	{10, "api tokens", []string{`
+		CREATE TABLE IF NOT EXISTS api_tokens(
+			id VARCHAR(64) CHARACTER SET ascii NOT NULL PRIMARY KEY,
+			hash VARCHAR(64) CHARACTER SET ascii NOT NULL,
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			user_name VARCHAR(255) NOT NULL,
+			tenant VARCHAR(255) NOT NULL DEFAULT '',
+			service BOOLEAN NOT NULL DEFAULT false,
+			scopes VARCHAR(255) CHARACTER SET ascii NOT NULL,
+			created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires DATETIME NULL,
+			last_used DATETIME NULL,
+			revoked BOOLEAN NOT NULL DEFAULT false,
+			INDEX api_tokens_user (user_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	{11, "report documents", []string{`
+		CREATE TABLE IF NOT EXISTS report_document(
+			rid INTEGER PRIMARY KEY,
+			source VARCHAR(1024) NOT NULL DEFAULT '',
+			received DATETIME NULL,
+			document LONGBLOB NOT NULL,
+			FOREIGN KEY (rid) REFERENCES report(id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+	// Notes belong to the report key so they are kept across revisions
+	{12, "report notes", []string{`
+		CREATE TABLE IF NOT EXISTS report_note(
+			id INTEGER AUTO_INCREMENT PRIMARY KEY,
+			tenant VARCHAR(64) CHARACTER SET ascii NOT NULL DEFAULT '',
+			report_key CHAR(64) CHARACTER SET ascii NOT NULL,
+			user_name VARCHAR(255) NOT NULL,
+			note TEXT NOT NULL,
+			created DATETIME NOT NULL,
+			INDEX report_note_key (tenant, report_key)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`}},
+}
+
+// mysqlUpdateStats adds the rows of a report to the daily statistics. The
+// messages are multiplied by the first argument so -1 removes a report again
+const mysqlUpdateStats = `
+	INSERT INTO daily_stats(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+	SELECT r.tenant,
+		DATE(r.report_begin) AS day,
+		CONVERT(COALESCE(LOWER(r.policy_domain), '') USING ascii) AS domain,
+		CONVERT(COALESCE(LOWER(rr.identifier_hfrom), '') USING ascii) AS hfrom,
+		COALESCE(rr.row_ip, '') AS ip,
+		COALESCE(r.report_org, '') AS reporter,
+		COALESCE(CAST(rr.eval_disposition AS CHAR), '') AS disposition,
+		COALESCE(CAST(rr.eval_dkim_align AS CHAR), '') AS dkim,
+		COALESCE(CAST(rr.eval_spf_align AS CHAR), '') AS spf,
+		? * COALESCE(SUM(rr.row_count), 0) AS messages
+	FROM reportrow AS rr
+		JOIN report AS r ON r.id = rr.rid
+	WHERE r.id = ?
+	GROUP BY r.tenant, day, domain, hfrom, ip, reporter, disposition, dkim, spf
+	ON DUPLICATE KEY UPDATE messages = daily_stats.messages + VALUES(messages)`
+
+func (h *MySQL) connect(ctx context.Context) (err error) {
+
+	if h.db != nil {
+		return nil
+	}
+
+	if h.URL == "" {
+		return fmt.Errorf("MySQL URL is empty")
+	}
+
+	// Dates are stored as UTC and has to be parsed into time.Time
+	c, err := mysql.ParseDSN(h.URL)
+	if err != nil {
+		return fmt.Errorf("Unable to parse mysql URL: %v", err)
+	}
+	c.ParseTime = true
+	c.Loc = time.UTC
+
+	h.db, err = sql.Open("mysql", c.FormatDSN())
+	if err != nil {
+		return fmt.Errorf("Unable to connect to mysql database: %v", err)
+	}
+	h.Pool.apply(h.db)
+
+	// sql.Open does not connect so wait for the database to be reachable
+	if err = ping(ctx, h.db); err != nil {
+		if cerr := h.db.Close(); cerr != nil {
+			log.Errorf("Unable to close database: %v", cerr)
+		}
+		h.db = nil
+		return err
+	}
+	return nil
+}
+
+func (h *MySQL) schema() schema {
+	return schema{
+		db:         h.db,
+		migrations: mysqlMigrations,
+		create: `CREATE TABLE IF NOT EXISTS schema_version(
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255),
+			applied_at DATETIME
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		exists: `SELECT COUNT(*) > 0 FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_name = 'schema_version'`,
+		insert: `INSERT INTO schema_version(version, name, applied_at) VALUES (?, ?, ?)`,
+		// DDL commits the transaction, so a table lock would be released
+		// by the first statement of a migration
+		sessionLock:   `SELECT GET_LOCK('godmarcparser_schema', 300)`,
+		sessionUnlock: `SELECT RELEASE_LOCK('godmarcparser_schema')`,
+	}
+}
+
+// Migrations returns the status of the schema migrations
+func (h *MySQL) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	if err := h.connect(ctx); err != nil {
+		return nil, err
+	}
+	return h.schema().status(ctx)
+}
+
+// Migrate applies the pending schema migrations
+func (h *MySQL) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	if err := h.connect(ctx); err != nil {
+		return nil, err
+	}
+	return h.schema().migrate(ctx)
+}
+
+// Ping checks that the database is reachable
+func (h *MySQL) Ping(ctx context.Context) error {
+	if h.db == nil {
+		return fmt.Errorf("Not connected")
+	}
+	return h.db.PingContext(ctx)
+}
+
+// Initialize connects and applies pending migrations
+func (h *MySQL) Initialize(ctx context.Context) (err error) {
+
+	if err = h.connect(ctx); err != nil {
+		return err
+	}
+
+	log.Debug("Initializing mysql")
+	if _, err = h.Migrate(ctx); err != nil {
+		return fmt.Errorf("Unable to migrate schema: %v", err)
+	}
+	return nil
+}
+
+// ReadReport fetches a report
+func (h *MySQL) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, err error) {
+
+	// MySQL and MariaDB in ONLY_FULL_GROUP_BY mode does not agree on functional
+	// dependencies so the aggregation is done in a sub query
+	queryStmt, err := h.db.PrepareContext(ctx,
+		`SELECT
+				r.id,
+				r.report_begin,
+				r.report_end,
+				r.policy_domain,
+				r.report_org,
+				r.report_id,
+				r.report_email,
+				r.report_extra_contact_info,
+				lower(r.policy_adkim),
+				lower(r.policy_aspf),
+				r.policy_p,
+				r.policy_sp,
+				COALESCE(CAST(r.policy_pct AS CHAR), ''),
+				COALESCE(rr.rowcount, 0),
+				COALESCE(rr.dkimresult, ''),
+				COALESCE(rr.spfresult, '')
+		 FROM   report AS r
+			LEFT JOIN (SELECT rid,
+					SUM(row_count) AS rowcount,
+					MIN(lower(dkimresult)) AS dkimresult,
+					MIN(lower(spfresult)) AS spfresult
+				FROM reportrow GROUP BY rid) AS rr ON r.id = rr.rid
+		 WHERE r.id = ? AND (? = '' OR r.tenant = ?)`)
+
+	if err != nil {
+		return rs, fmt.Errorf("failed to prepare report: %v", err)
+	}
+
+	defer func() {
+		if qerr := queryStmt.Close(); qerr != nil {
+			log.Errorf("Unable to close query: %v", qerr)
+		}
+	}()
+
+	tenant := TenantFromContext(ctx)
+	err = queryStmt.QueryRowContext(ctx, id, tenant, tenant).Scan(&rs.Report.ID,
+		&rs.Report.ReportBegin,
+		&rs.Report.ReportEnd,
+		&rs.Report.PolicyDomain,
+		&rs.Report.ReportOrg,
+		&rs.Report.ReportID,
+		&rs.Report.ReportEmail,
+		&rs.Report.ReportExtraContactInfo,
+		&rs.Report.PolicyAdkim,
+		&rs.Report.PolicyAspf,
+		&rs.Report.PolicyP,
+		&rs.Report.PolicySP,
+		&rs.Report.PolicyPCT,
+		&rs.Report.Count,
+		&rs.Report.DKIMResult,
+		&rs.Report.SPFResult,
+	)
+
+	if err == sql.ErrNoRows {
+		return rs, fmt.Errorf("Failed to query reportrow: report %d %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return rs, fmt.Errorf("Failed to query reportrow: %v", err)
+	}
+	if !scopeFromContext(ctx).allows(rs.Report.PolicyDomain) {
+		return dmarc.Rows{}, fmt.Errorf("Failed to query reportrow: report %d %w", id, ErrNotFound)
+	}
+
+	rowStmt, err := h.db.PrepareContext(ctx,
+		`SELECT
+			rr.row_ip,
+			rr.row_count,
+			rr.eval_disposition,
+			lower(rr.eval_spf_align),
+			lower(rr.eval_dkim_align),
+			rr.reason,
+			lower(rr.dkimdomain),
+			lower(rr.dkimresult),
+			lower(rr.spfdomain),
+			lower(rr.spfresult),
+			rr.identifier_hfrom
+		FROM reportrow rr
+		WHERE rr.rid = ?`)
+
+	if err != nil {
+		return rs, fmt.Errorf("Unable to prepare reportrow: %v", err)
+	}
+
+	defer func() {
+		if qerr := rowStmt.Close(); qerr != nil {
+			log.Errorf("Unable to close query: %v", qerr)
+		}
+	}()
+
+	rows, err := rowStmt.QueryContext(ctx, id)
+	switch {
+	case err == sql.ErrNoRows:
+		return rs, nil
+	case err != nil:
+		return rs, fmt.Errorf("Failed to fetch recordrows: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var d dmarc.Row
+
+		err = rows.Scan(
+			&d.SourceIP,
+			&d.Count,
+			&d.EvalDisposition,
+			&d.EvalSPFAlign,
+			&d.EvalDKIMAalign,
+			&d.Reason,
+			&d.DKIMDomain,
+			&d.DKIMResult,
+			&d.SPFDomain,
+			&d.SPFResult,
+			&d.IdentifierHFrom,
+		)
+		if err != nil {
+			return rs, fmt.Errorf("Unable to scan: %v", err)
+		}
+
+		if d.SPFResult == "" {
+			d.SPFResult = "neutral"
+		}
+		if d.DKIMResult == "" {
+			d.DKIMResult = "neutral"
+		}
+
+		rs.Rows = append(rs.Rows, d)
+	}
+
+	return rs, rows.Err()
+}
+
+// filter builds the WHERE clause of the reports query
+func (h *MySQL) filter(q ReportQuery) (*filter, error) {
+
+	f := &filter{bind: func(n int) string { return "?" }}
+	f.common(q)
+
+	// There is no type for IP addresses so the binary representations of
+	// the same length are compared instead
+	if q.SourceIP != "" {
+		n, err := q.network()
+		if err != nil {
+			return nil, err
+		}
+		f.rows = append(f.rows, fmt.Sprintf(
+			"LENGTH(INET6_ATON(fr.row_ip)) = %s AND INET6_ATON(fr.row_ip) BETWEEN INET6_ATON(%s) AND INET6_ATON(%s)",
+			f.arg(len(n.IP)), f.arg(n.IP.String()), f.arg(lastIP(n).String())))
+	}
+
+	return f, nil
+}
+
+// ReadReports fetches the list of reports matching the query paginated
+func (h *MySQL) ReadReports(ctx context.Context, q ReportQuery) (rs []dmarc.Report, err error) {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	f.cursor(q)
+	offset := q.Offset
+	if q.Cursor != nil {
+		offset = 0
+	}
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT
+				r.id,
+				r.report_begin,
+				r.report_end,
+				lower(r.policy_domain),
+				r.report_org,
+				r.report_id,
+				r.report_email,
+				r.report_extra_contact_info,
+				lower(r.policy_adkim),
+				lower(r.policy_aspf),
+				lower(r.policy_p),
+				lower(r.policy_sp),
+				COALESCE(CAST(r.policy_pct AS CHAR), ''),
+				COALESCE(rr.rowcount, 0) AS rowcount,
+				COALESCE(rr.dkimresult, ''),
+				COALESCE(rr.spfresult, '')
+		 FROM   report AS r
+			LEFT JOIN (SELECT rid,
+					SUM(row_count) AS rowcount,
+					MIN(lower(dkimresult)) AS dkimresult,
+					MIN(lower(spfresult)) AS spfresult
+				FROM reportrow GROUP BY rid) AS rr ON r.id = rr.rid
+		 `+f.clause()+`
+		 `+q.orderBy()+`
+		 LIMIT `+f.arg(q.PageSize)+` OFFSET `+f.arg(offset), f.args...)
+	switch {
+	case err == sql.ErrNoRows:
+		return []dmarc.Report{}, nil
+	case err != nil:
+		return nil, fmt.Errorf("Failed to fetch rows: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var r dmarc.Report
+
+		err = rows.Scan(&r.ID,
+			&r.ReportBegin,
+			&r.ReportEnd,
+			&r.PolicyDomain,
+			&r.ReportOrg,
+			&r.ReportID,
+			&r.ReportEmail,
+			&r.ReportExtraContactInfo,
+			&r.PolicyAdkim,
+			&r.PolicyAspf,
+			&r.PolicyP,
+			&r.PolicySP,
+			&r.PolicyPCT,
+			&r.Count,
+			&r.DKIMResult,
+			&r.SPFResult,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to scan: %v", err)
+		}
+
+		if r.SPFResult == "" {
+			r.SPFResult = "neutral"
+		}
+		if r.DKIMResult == "" {
+			r.DKIMResult = "neutral"
+		}
+
+		rs = append(rs, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to fetch rows: %v", err)
+	}
+
+	if q.Cursor != nil && q.Cursor.Backward {
+		reverse(rs)
+	}
+	return rs, nil
+}
+
+// CountReports returns the number of reports matching the query
+func (h *MySQL) CountReports(ctx context.Context, q ReportQuery) (n int, err error) {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return 0, err
+	}
+
+	err = h.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM report AS r `+f.clause(), f.args...).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to count reports: %v", err)
+	}
+	return n, nil
+}
+
+// ReadRows fetches the rows matching the query across reports
+func (h *MySQL) ReadRows(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	return collectRows(func(fn func(ReportRow) error) error {
+		return h.WalkRows(ctx, q, fn)
+	})
+}
+
+// WalkRows streams the rows matching the query across reports
+func (h *MySQL) WalkRows(ctx context.Context, q ReportQuery, fn func(ReportRow) error) error {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return err
+	}
+
+	return walkRows(ctx, h.db,
+		`SELECT
+				r.id,
+				r.report_begin,
+				r.report_end,
+				lower(r.policy_domain),
+				r.report_org,
+				r.report_id,
+				r.report_email,
+				r.report_extra_contact_info,
+				lower(r.policy_adkim),
+				lower(r.policy_aspf),
+				lower(r.policy_p),
+				lower(r.policy_sp),
+				COALESCE(CAST(r.policy_pct AS CHAR), ''),
+				COALESCE(fr.row_ip, ''),
+				fr.row_count,
+				fr.eval_disposition,
+				lower(fr.eval_spf_align),
+				lower(fr.eval_dkim_align),
+				fr.reason,
+				lower(fr.dkimdomain),
+				lower(fr.dkimresult),
+				lower(fr.spfdomain),
+				lower(fr.spfresult),
+				fr.identifier_hfrom
+		 FROM   report AS r
+		 JOIN   reportrow AS fr ON r.id = fr.rid
+		 `+f.rowsClause()+`
+		 ORDER BY r.report_begin DESC, r.id DESC, fr.id
+		 `+f.rowsLimit(q), f.args, fn)
+}
+
+// ReadPolicies fetches the policies seen for the policy domain
+func (h *MySQL) ReadPolicies(ctx context.Context, domain string) ([]PolicyState, error) {
+
+	q := ReportQuery{PolicyDomain: domain}
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPolicies(ctx, h.db,
+		`SELECT
+				COALESCE(lower(r.policy_adkim), ''),
+				COALESCE(lower(r.policy_aspf), ''),
+				COALESCE(lower(r.policy_p), ''),
+				COALESCE(lower(r.policy_sp), ''),
+				COALESCE(CAST(r.policy_pct AS CHAR), ''),
+				MIN(r.report_begin),
+				MAX(r.report_end),
+				COUNT(*),
+				COUNT(DISTINCT lower(r.report_org))
+		 FROM   report AS r
+		 `+f.clause()+`
+		 GROUP BY 1, 2, 3, 4, 5
+		 ORDER BY MIN(r.report_begin)`, f.args)
+}
+
+// Write stores the feedback. A report that already exists is skipped,
+// replaced or stored as a new revision depending on the dedupe policy
+func (h *MySQL) Write(ctx context.Context, f dmarc.Feedback) (err error) {
+
+	key, hash := feedbackKey(f), contentHash(f)
+	tenant := TenantFromContext(ctx)
+	setDuplicate(ctx, "")
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) error {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("Rollback failed after failed write: %w %v", err, rerr)
+		}
+		return err
+	}
+
+	var (
+		old      int64
+		oldHash  string
+		revision int
+		received sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT r.id, r.content_hash, r.revision, d.received
+		 FROM report AS r
+			LEFT JOIN report_document AS d ON d.rid = r.id
+		 WHERE r.tenant = ? AND r.report_key = ? AND NOT r.superseded
+		 ORDER BY r.revision DESC
+		 LIMIT 1
+		 FOR UPDATE`, tenant, key).Scan(&old, &oldHash, &revision, &received)
+	if err != nil && err != sql.ErrNoRows {
+		return rollback(fmt.Errorf("Unable to look up report: %w", err))
+	}
+
+	if old != 0 {
+		action := h.Dedupe.actionFor(ctx, oldHash == hash, f.Received, received.Time)
+		setDuplicate(ctx, action)
+		log.Debugf("Report %s from %s already exists, action %s", f.ReportMetadata.ReportID, f.ReportMetadata.OrgName, action)
+
+		if !replacing(ctx) {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO reporter_stats(tenant, reporter, duplicates) VALUES (?, ?, 1)
+				 ON DUPLICATE KEY UPDATE duplicates = duplicates + 1`,
+				tenant, reporter(f.ReportMetadata.OrgName))
+			if err != nil {
+				return rollback(fmt.Errorf("Unable to count duplicate: %w", err))
+			}
+		}
+
+		if action == DedupeSkip {
+			log.Debug("Comitting transaction")
+			return tx.Commit()
+		}
+
+		if _, err = tx.ExecContext(ctx, mysqlUpdateStats, -1, old); err != nil {
+			return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+		}
+
+		if action == DedupeRevision {
+			_, err = tx.ExecContext(ctx, `UPDATE report SET superseded = TRUE WHERE id = ?`, old)
+			revision++
+		} else if _, err = tx.ExecContext(ctx, `DELETE FROM reportrow WHERE rid = ?`, old); err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM report WHERE id = ?`, old)
+		}
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to %s report %d: %w", action, old, err))
+		}
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO report(
+			report_begin,
+			report_end,
+			policy_domain,
+			report_org,
+			report_id,
+			report_email,
+			report_extra_contact_info,
+			policy_adkim,
+			policy_aspf,
+			policy_p,
+			policy_sp,
+			policy_pct,
+			tenant,
+			report_key,
+			content_hash,
+			revision)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Unix(f.ReportMetadata.DateRange.Begin, 0).UTC(),
+		time.Unix(f.ReportMetadata.DateRange.End, 0).UTC(),
+		f.PolicyPublished.Domain,
+		f.ReportMetadata.OrgName,
+		f.ReportMetadata.ReportID,
+		f.ReportMetadata.Email,
+		f.ReportMetadata.ExtraContactInfo,
+		normalize(f.PolicyPublished.ADKIM, alignments...),
+		normalize(f.PolicyPublished.ASPF, alignments...),
+		normalize(f.PolicyPublished.P, dispositions...),
+		normalize(f.PolicyPublished.SP, dispositions...),
+		percentage(f.PolicyPublished.PCT),
+		tenant,
+		key,
+		hash,
+		revision,
+	)
+
+	if err != nil {
+		// 1062 is ER_DUP_ENTRY, another writer stored the same report in the
+		// meantime
+		if myerr, ok := err.(*mysql.MySQLError); ok && myerr.Number == 1062 {
+			log.Debug("Record already exists, skipping.")
+			if err = tx.Rollback(); err != nil {
+				return fmt.Errorf("Rollback failed: %w", err)
+			}
+			return nil
+		}
+		return rollback(fmt.Errorf("Failed to execute query: %w", err))
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil || id == 0 {
+		return rollback(fmt.Errorf("Invalid id returned: %d %v", id, err))
+	}
+
+	// Inserting the rows in batches is a lot faster than one at a time for
+	// the large reports
+	rows := feedbackRows(f)
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > mysqlBatchSize {
+			n = mysqlBatchSize
+		}
+
+		values := make([]string, 0, n)
+		args := make([]interface{}, 0, n*12)
+		for _, rw := range rows[:n] {
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args,
+				id,
+				rw.SourceIP,
+				rw.Count,
+				rw.EvalDisposition,
+				rw.EvalSPFAlign,
+				rw.EvalDKIMAalign,
+				rw.Reason,
+				rw.DKIMDomain,
+				rw.DKIMResult,
+				rw.SPFDomain,
+				rw.SPFResult,
+				rw.IdentifierHFrom,
+			)
+		}
+		rows = rows[n:]
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO reportrow(rid,
+					row_ip,
+					row_count,
+					eval_disposition,
+					eval_spf_align,
+					eval_dkim_align,
+					reason,
+					dkimdomain,
+					dkimresult,
+					spfdomain,
+					spfresult,
+					identifier_hfrom)
+			 VALUES `+strings.Join(values, ", "), args...)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into recordrow: %w", err))
+		}
+	}
+
+	if len(f.Raw) > 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO report_document(rid, source, received, document) VALUES (?, ?, ?, ?)`,
+			id, f.FromFile, nullTime(f.Received.UTC()), f.Raw)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into report_document: %w", err))
+		}
+	}
+
+	// The daily statistics are kept up to date with every report so the
+	// dashboards never has to scan reportrow
+	if _, err = tx.ExecContext(ctx, mysqlUpdateStats, 1, id); err != nil {
+		return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+	}
+
+	log.Debug("Comitting transaction")
+	return tx.Commit()
+}
+
+// ReporterCounts returns the number of duplicate and malformed reports
+// received per reporter
+func (h *MySQL) ReporterCounts(ctx context.Context) ([]ReporterCount, error) {
+	if scopeFromContext(ctx).restricted {
+		return nil, nil
+	}
+	tenant := TenantFromContext(ctx)
+	return readReporterCounts(ctx, h.db,
+		`SELECT reporter, SUM(duplicates), SUM(malformed)
+		 FROM reporter_stats
+		 WHERE ? = '' OR tenant = ?
+		 GROUP BY reporter
+		 ORDER BY reporter`, tenant, tenant)
+}
+
+// AddMalformed counts a malformed report from the reporter
+func (h *MySQL) AddMalformed(ctx context.Context, org string) error {
+	rp, err := malformedReporter(org)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO reporter_stats(tenant, reporter, malformed) VALUES (?, ?, 1)
+		 ON DUPLICATE KEY UPDATE malformed = malformed + 1`,
+		TenantFromContext(ctx), rp)
+	if err != nil {
+		return fmt.Errorf("Unable to count malformed report: %v", err)
+	}
+	return nil
+}
+
+// ReadReporters summarises the reports per reporter and policy domain
+func (h *MySQL) ReadReporters(ctx context.Context, org string) ([]ReporterDomain, error) {
+	f := &filter{bind: func(n int) string { return "?" }}
+	var q ReportQuery
+	q.fromContext(ctx)
+	query := f.reporters(q, org)
+	return readReporters(ctx, h.db, query, f.args)
+}
+
+// ReadStats sums the daily statistics
+func (h *MySQL) ReadStats(ctx context.Context, q StatsQuery) ([]DailyStat, error) {
+
+	q.fromContext(ctx)
+	f := &filter{bind: func(n int) string { return "?" }}
+	query, err := f.stats(q)
+	if err != nil {
+		return nil, err
+	}
+	return readStats(ctx, h.db, query, f.args)
+}
+
+// Purge deletes the reports ending before rows and the daily statistics older
+// than stats
+func (h *MySQL) Purge(ctx context.Context, rows time.Time, stats time.Time) (res PurgeResult, err error) {
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, fmt.Errorf("Unable to start transactions: %v", err)
+	}
+
+	rollback := func(err error) (PurgeResult, error) {
+		if rerr := tx.Rollback(); rerr != nil {
+			return PurgeResult{}, fmt.Errorf("Rollback failed after failed purge: %v %v", err, rerr)
+		}
+		return PurgeResult{}, err
+	}
+
+	if !rows.IsZero() {
+		r, err := tx.ExecContext(ctx,
+			`DELETE rr FROM reportrow AS rr JOIN report AS r ON r.id = rr.rid WHERE r.report_end < ?`, rows.UTC())
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from reportrow: %v", err))
+		}
+		res.Rows, _ = r.RowsAffected()
+
+		r, err = tx.ExecContext(ctx, `DELETE FROM report WHERE report_end < ?`, rows.UTC())
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from report: %v", err))
+		}
+		res.Reports, _ = r.RowsAffected()
+
+		_, err = tx.ExecContext(ctx,
+			`DELETE n FROM report_note AS n
+				LEFT JOIN report AS r ON r.tenant = n.tenant AND r.report_key = n.report_key
+			 WHERE r.id IS NULL`)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from report_note: %v", err))
+		}
+	}
+
+	if !stats.IsZero() {
+		r, err := tx.ExecContext(ctx, `DELETE FROM daily_stats WHERE day < DATE(?)`, stats.UTC())
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from daily_stats: %v", err))
+		}
+		res.Stats, _ = r.RowsAffected()
+	}
+
+	if err = tx.Commit(); err != nil {
+		return PurgeResult{}, fmt.Errorf("Unable to commit purge: %v", err)
+	}
+	return res, nil
+}
+
+// ExportReports reads all reports and their rows ordered by ID
+func (h *MySQL) ExportReports(ctx context.Context, fn func(ArchiveReport) error) error {
+	return exportReports(ctx, h.db,
+		`SELECT r.id,
+			r.tenant,
+			r.report_begin,
+			r.report_end,
+			COALESCE(r.policy_domain, ''),
+			COALESCE(r.report_org, ''),
+			COALESCE(r.report_id, ''),
+			COALESCE(r.report_email, ''),
+			COALESCE(r.report_extra_contact_info, ''),
+			COALESCE(CAST(r.policy_adkim AS CHAR), ''),
+			COALESCE(CAST(r.policy_aspf AS CHAR), ''),
+			COALESCE(CAST(r.policy_p AS CHAR), ''),
+			COALESCE(CAST(r.policy_sp AS CHAR), ''),
+			COALESCE(CAST(r.policy_pct AS CHAR), ''),
+			r.content_hash,
+			r.revision,
+			r.superseded,
+			COALESCE(d.source, ''),
+			d.received,
+			d.document
+		 FROM report AS r
+			LEFT JOIN report_document AS d ON d.rid = r.id
+		 ORDER BY r.id`,
+		`SELECT rid,
+			COALESCE(row_ip, ''),
+			COALESCE(row_count, 0),
+			COALESCE(CAST(eval_disposition AS CHAR), ''),
+			COALESCE(CAST(eval_spf_align AS CHAR), ''),
+			COALESCE(CAST(eval_dkim_align AS CHAR), ''),
+			COALESCE(reason, ''),
+			COALESCE(dkimdomain, ''),
+			COALESCE(dkimresult, ''),
+			COALESCE(spfdomain, ''),
+			COALESCE(spfresult, ''),
+			COALESCE(identifier_hfrom, '')
+		 FROM reportrow
+		 WHERE rid IS NOT NULL
+		 ORDER BY rid, id`, fn)
+}
+
+// ExportStats reads all daily statistics
+func (h *MySQL) ExportStats(ctx context.Context, fn func(ArchiveStat) error) error {
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages
+		 FROM daily_stats
+		 ORDER BY day`)
+	if err != nil {
+		return fmt.Errorf("Unable to query daily_stats: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s ArchiveStat
+		err = rows.Scan(&s.Tenant, &s.Day, &s.PolicyDomain, &s.HeaderFrom, &s.SourceIP, &s.Reporter,
+			&s.Disposition, &s.DKIMAlign, &s.SPFAlign, &s.Messages)
+		if err != nil {
+			return fmt.Errorf("Unable to scan daily_stats: %v", err)
+		}
+		if err = fn(s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ImportReport stores an exported report and its rows as they are
+func (h *MySQL) ImportReport(ctx context.Context, r ArchiveReport) (bool, error) {
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) (bool, error) {
+		if rerr := tx.Rollback(); rerr != nil {
+			return false, fmt.Errorf("Rollback failed after failed import: %w %v", err, rerr)
+		}
+		return false, err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO report(
+			tenant,
+			report_begin,
+			report_end,
+			policy_domain,
+			report_org,
+			report_id,
+			report_email,
+			report_extra_contact_info,
+			policy_adkim,
+			policy_aspf,
+			policy_p,
+			policy_sp,
+			policy_pct,
+			report_key,
+			content_hash,
+			revision,
+			superseded)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Tenant,
+		r.Begin.UTC(),
+		r.End.UTC(),
+		r.PolicyDomain,
+		r.ReportOrg,
+		r.ReportID,
+		r.ReportEmail,
+		r.ReportExtraContactInfo,
+		normalize(r.PolicyAdkim, alignments...),
+		normalize(r.PolicyAspf, alignments...),
+		normalize(r.PolicyP, dispositions...),
+		normalize(r.PolicySP, dispositions...),
+		percentage(r.PolicyPCT),
+		r.key(),
+		r.ContentHash,
+		r.Revision,
+		r.Superseded,
+	)
+	if err != nil {
+		// 1062 is ER_DUP_ENTRY
+		if myerr, ok := err.(*mysql.MySQLError); ok && myerr.Number == 1062 {
+			log.Debug("Record already exists, skipping.")
+			return false, tx.Rollback()
+		}
+		return rollback(fmt.Errorf("Unable to insert report: %w", err))
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil || id == 0 {
+		return rollback(fmt.Errorf("Invalid id returned: %d %v", id, err))
+	}
+
+	rows := r.Rows
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > mysqlBatchSize {
+			n = mysqlBatchSize
+		}
+
+		values := make([]string, 0, n)
+		args := make([]interface{}, 0, n*12)
+		for _, rw := range rows[:n] {
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args,
+				id,
+				rw.SourceIP,
+				rw.Count,
+				normalize(rw.EvalDisposition, dispositions...),
+				normalize(rw.EvalSPFAlign, evaluations...),
+				normalize(rw.EvalDKIMAlign, evaluations...),
+				rw.Reason,
+				rw.DKIMDomain,
+				rw.DKIMResult,
+				rw.SPFDomain,
+				rw.SPFResult,
+				rw.HeaderFrom,
+			)
+		}
+		rows = rows[n:]
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO reportrow(rid,
+					row_ip,
+					row_count,
+					eval_disposition,
+					eval_spf_align,
+					eval_dkim_align,
+					reason,
+					dkimdomain,
+					dkimresult,
+					spfdomain,
+					spfresult,
+					identifier_hfrom)
+			 VALUES `+strings.Join(values, ", "), args...)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into reportrow: %w", err))
+		}
+	}
+
+	if len(r.Document) > 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO report_document(rid, source, received, document) VALUES (?, ?, ?, ?)`,
+			id, r.Source, nullTime(r.Received.UTC()), r.Document)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into report_document: %w", err))
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("Unable to commit import: %w", err)
+	}
+	return true, nil
+}
+
+// ImportStat stores an exported entry of the daily statistics
+func (h *MySQL) ImportStat(ctx context.Context, s ArchiveStat) error {
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO daily_stats(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE messages = GREATEST(daily_stats.messages, VALUES(messages))`,
+		s.Tenant, statsDay(s.Day).Format("2006-01-02"), s.PolicyDomain, s.HeaderFrom, s.SourceIP, s.Reporter,
+		s.Disposition, s.DKIMAlign, s.SPFAlign, s.Messages)
+	if err != nil {
+		return fmt.Errorf("Unable to import into daily_stats: %w", err)
+	}
+	return nil
+}
+
+// ExportReporters reads the duplicate and malformed counts of all reporters
+func (h *MySQL) ExportReporters(ctx context.Context, fn func(ArchiveReporter) error) error {
+	return exportReporters(ctx, h.db,
+		`SELECT tenant, reporter, duplicates, malformed FROM reporter_stats ORDER BY tenant, reporter`, fn)
+}
+
+// ImportReporter stores the exported counts of a reporter
+func (h *MySQL) ImportReporter(ctx context.Context, r ArchiveReporter) error {
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO reporter_stats(tenant, reporter, duplicates, malformed) VALUES (?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE
+			duplicates = GREATEST(duplicates, VALUES(duplicates)),
+			malformed = GREATEST(malformed, VALUES(malformed))`,
+		r.Tenant, r.Reporter, r.Duplicates, r.Malformed)
+	if err != nil {
+		return fmt.Errorf("Unable to import into reporter_stats: %w", err)
+	}
+	return nil
+}
+
+// ExportNotes reads the notes on all reports
+func (h *MySQL) ExportNotes(ctx context.Context, fn func(ArchiveNote) error) error {
+	return exportNotes(ctx, h.db,
+		`SELECT tenant, report_key, user_name, note, created FROM report_note ORDER BY id`, fn)
+}
+
+// ImportNote stores an exported note unless it already exists
+func (h *MySQL) ImportNote(ctx context.Context, n ArchiveNote) (bool, error) {
+	note, err := validNote(Note{User: n.User, Text: n.Text, Created: n.Created})
+	if err != nil {
+		return false, err
+	}
+
+	r, err := h.db.ExecContext(ctx,
+		`INSERT INTO report_note(tenant, report_key, user_name, note, created)
+		 SELECT ?, ?, ?, ?, ? FROM DUAL
+		 WHERE NOT EXISTS (SELECT 1 FROM report_note
+			WHERE tenant = ? AND report_key = ? AND user_name = ? AND note = ? AND created = ?)`,
+		n.Tenant, n.ReportKey, note.User, note.Text, note.Created,
+		n.Tenant, n.ReportKey, note.User, note.Text, note.Created)
+	if err != nil {
+		return false, fmt.Errorf("Unable to import into report_note: %w", err)
+	}
+	added, _ := r.RowsAffected()
+	return added > 0, nil
+}
+
+// mysqlLookupReport selects where a report is stored for lookupReport
+const mysqlLookupReport = `
+	SELECT tenant, report_key, policy_domain
+	FROM report
+	WHERE id = ? AND tenant = COALESCE(NULLIF(?, ''), tenant)`
+
+// ReadNotes fetches the notes of a report
+func (h *MySQL) ReadNotes(ctx context.Context, report int64) ([]Note, error) {
+	ref, err := lookupReport(ctx, h.db, mysqlLookupReport, report)
+	if err != nil {
+		return nil, err
+	}
+	return readNotes(ctx, h.db,
+		`SELECT id, user_name, note, created
+		 FROM report_note
+		 WHERE tenant = ? AND report_key = ?
+		 ORDER BY created, id`, ref.tenant, ref.key)
+}
+
+// WriteNote adds a note to a report
+func (h *MySQL) WriteNote(ctx context.Context, report int64, n Note) error {
+	n, err := validNote(n)
+	if err != nil {
+		return err
+	}
+	ref, err := lookupReport(ctx, h.db, mysqlLookupReport, report)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO report_note(tenant, report_key, user_name, note, created) VALUES (?, ?, ?, ?, ?)`,
+		ref.tenant, ref.key, n.User, n.Text, n.Created)
+	if err != nil {
+		return fmt.Errorf("Unable to write note on report %d: %v", report, err)
+	}
+	return nil
+}
+
+// ReadDocument fetches the document a report was read from
+func (h *MySQL) ReadDocument(ctx context.Context, id int64) (Document, error) {
+	if _, err := lookupReport(ctx, h.db, mysqlLookupReport, id); err != nil {
+		return Document{}, err
+	}
+
+	var (
+		d        Document
+		received sql.NullTime
+	)
+	err := h.db.QueryRowContext(ctx,
+		`SELECT r.tenant, d.source, d.received, d.document
+		 FROM report_document AS d
+			JOIN report AS r ON r.id = d.rid
+		 WHERE d.rid = ?`, id).Scan(&d.Tenant, &d.Source, &received, &d.Data)
+	if err == sql.ErrNoRows {
+		return d, fmt.Errorf("Report %d has no document: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return d, fmt.Errorf("Unable to read document of report %d: %v", id, err)
+	}
+	if received.Valid {
+		d.Received = received.Time.UTC()
+	}
+	return d, nil
+}
+
+// DeleteReport deletes a report with all revisions and notes
+func (h *MySQL) DeleteReport(ctx context.Context, id int64) error {
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) error {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("Rollback failed after failed delete: %w %v", err, rerr)
+		}
+		return err
+	}
+
+	ref, err := lookupReport(ctx, tx, mysqlLookupReport+` FOR UPDATE`, id)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// Only the current revision is part of the daily statistics
+	var current int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id FROM report WHERE tenant = ? AND report_key = ? AND NOT superseded`,
+		ref.tenant, ref.key).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return rollback(fmt.Errorf("Unable to look up current revision: %w", err))
+	}
+	if current != 0 {
+		if _, err = tx.ExecContext(ctx, mysqlUpdateStats, -1, current); err != nil {
+			return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+		}
+	}
+
+	for _, stmt := range []string{
+		`DELETE rr FROM reportrow AS rr JOIN report AS r ON r.id = rr.rid WHERE r.tenant = ? AND r.report_key = ?`,
+		`DELETE FROM report WHERE tenant = ? AND report_key = ?`,
+		`DELETE FROM report_note WHERE tenant = ? AND report_key = ?`,
+	} {
+		if _, err = tx.ExecContext(ctx, stmt, ref.tenant, ref.key); err != nil {
+			return rollback(fmt.Errorf("Unable to delete report %d: %w", id, err))
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReadUser fetches a local user
+func (h *MySQL) ReadUser(ctx context.Context, name string) (User, error) {
+	return readUser(ctx, h.db, name,
+		`SELECT name, password_hash, created FROM users WHERE name = ?`, userName(name))
+}
+
+// ReadUsers fetches all local users
+func (h *MySQL) ReadUsers(ctx context.Context) ([]User, error) {
+	return readUsers(ctx, h.db, `SELECT name, password_hash, created FROM users ORDER BY name`)
+}
+
+// WriteUser creates a local user or replaces the password
+func (h *MySQL) WriteUser(ctx context.Context, u User) error {
+	u, err := validUser(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO users(name, password_hash) VALUES (?, ?)
+		 ON DUPLICATE KEY UPDATE password_hash = VALUES(password_hash)`,
+		u.Name, u.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("Unable to write user %s: %v", u.Name, err)
+	}
+	return nil
+}
+
+// DeleteUser removes a local user
+func (h *MySQL) DeleteUser(ctx context.Context, name string) error {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM users WHERE name = ?`, userName(name))
+	if err != nil {
+		return fmt.Errorf("Unable to delete user %s: %v", name, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Unknown user %s: %w", name, ErrNotFound)
+	}
+	return nil
+}
+
+// ReadGrants fetches the grants of a user or of all users
+func (h *MySQL) ReadGrants(ctx context.Context, user string) ([]Grant, error) {
+	user = userName(user)
+	return readGrants(ctx, h.db,
+		`SELECT user_name, role, scope FROM grants
+		 WHERE ? = '' OR user_name = ?
+		 ORDER BY user_name, scope`, user, user)
+}
+
+// WriteGrant adds a grant or replaces the role
+func (h *MySQL) WriteGrant(ctx context.Context, g Grant) error {
+	g, err := validGrant(g)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO grants(user_name, scope, role) VALUES (?, ?, ?)
+		 ON DUPLICATE KEY UPDATE role = VALUES(role)`,
+		g.User, g.Scope, g.Role)
+	if err != nil {
+		return fmt.Errorf("Unable to write grant of %s: %v", g.User, err)
+	}
+	return nil
+}
+
+// DeleteGrant removes the grant of a user on a scope
+func (h *MySQL) DeleteGrant(ctx context.Context, user, scope string) error {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM grants WHERE user_name = ? AND scope = ?`,
+		userName(user), grantScope(scope))
+	if err != nil {
+		return fmt.Errorf("Unable to delete grant of %s: %v", user, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Unknown grant of %s on %s: %w", user, scope, ErrNotFound)
+	}
+	return nil
+}
+
+// ReadToken fetches an API token
+func (h *MySQL) ReadToken(ctx context.Context, id string) (Token, error) {
+	return readToken(ctx, h.db, id, `SELECT `+tokenColumns+` FROM api_tokens WHERE id = ?`, id)
+}
+
+// ReadTokens fetches the API tokens of a user or all tokens
+func (h *MySQL) ReadTokens(ctx context.Context, user string) ([]Token, error) {
+	user = userName(user)
+	return readTokens(ctx, h.db,
+		`SELECT `+tokenColumns+` FROM api_tokens
+		 WHERE ? = '' OR user_name = ?
+		 ORDER BY created DESC`, user, user)
+}
+
+// WriteToken stores a new API token
+func (h *MySQL) WriteToken(ctx context.Context, t Token) error {
+	t, err := validToken(t)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO api_tokens(id, hash, name, user_name, tenant, service, scopes, created, expires)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Hash, t.Name, t.User, t.Tenant, t.Service, strings.Join(t.Scopes, ","), t.Created, nullTime(t.Expires))
+	if err != nil {
+		return fmt.Errorf("Unable to write token %s: %v", t.ID, err)
+	}
+	return nil
+}
+
+// RevokeToken marks an API token as revoked
+func (h *MySQL) RevokeToken(ctx context.Context, id string) error {
+	return h.updateToken(ctx, id, `UPDATE api_tokens SET revoked = true WHERE id = ?`, id)
+}
+
+// TouchToken sets the time an API token was last used
+func (h *MySQL) TouchToken(ctx context.Context, id string, used time.Time) error {
+	return h.updateToken(ctx, id, `UPDATE api_tokens SET last_used = ? WHERE id = ?`, used, id)
+}
+
+// updateToken runs an update of a single API token. MySQL does not count
+// rows that are left unchanged so the token is read to tell if it exists
+func (h *MySQL) updateToken(ctx context.Context, id, query string, args ...interface{}) error {
+	res, err := h.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("Unable to update token %s: %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		_, err = h.ReadToken(ctx, id)
+		return err
+	}
+	return nil
+}
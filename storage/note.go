@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Note is an annotation of a report. Notes belong to the report key within
+// the tenant, so they are kept across revisions and when the report is read
+// again from its document
+type Note struct {
+	ID      int64
+	User    string
+	Text    string
+	Created time.Time
+}
+
+// NoteStore is implemented by drivers that store notes on reports. The
+// report is scoped like ReadReport, so ErrNotFound is returned for reports
+// of other tenants and domains
+type NoteStore interface {
+	// ReadNotes fetches the notes of a report oldest first
+	ReadNotes(ctx context.Context, report int64) ([]Note, error)
+	WriteNote(ctx context.Context, report int64, n Note) error
+}
+
+// Document is the XML a report was read from, where it was read from and
+// when
+type Document struct {
+	Tenant   string
+	Source   string
+	Received time.Time
+	Data     []byte
+}
+
+// ReportManager is implemented by drivers that can delete single reports
+// and return the documents they were read from. The reports are scoped like
+// ReadReport
+type ReportManager interface {
+	// ReadDocument returns ErrNotFound if the report was stored before the
+	// documents were kept
+	ReadDocument(ctx context.Context, id int64) (Document, error)
+	// DeleteReport deletes the report with all revisions and notes and
+	// removes it from the daily statistics
+	DeleteReport(ctx context.Context, id int64) error
+}
+
+// maxNote is the longest note in characters
+const maxNote = 4000
+
+// validNote returns the note with the text trimmed or an error if it cannot
+// be stored
+func validNote(n Note) (Note, error) {
+	n.Text = strings.TrimSpace(n.Text)
+	if n.Text == "" {
+		return n, fmt.Errorf("The note is empty")
+	}
+	if len([]rune(n.Text)) > maxNote {
+		return n, fmt.Errorf("The note is longer than %d characters", maxNote)
+	}
+	if n.Created.IsZero() {
+		n.Created = time.Now()
+	}
+	// MySQL stores whole seconds, so imported notes compare equal
+	n.Created = n.Created.UTC().Truncate(time.Second)
+	return n, nil
+}
+
+// reportRef is the tenant and key a report is stored under
+type reportRef struct {
+	tenant, key string
+}
+
+// queryRower is a database or a transaction
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// lookupReport returns where a report in the scope of the context is stored.
+// query must select the tenant, key and policy domain of the report with
+// the ID and tenant as arguments
+func lookupReport(ctx context.Context, db queryRower, query string, id int64) (reportRef, error) {
+	var (
+		ref    reportRef
+		domain sql.NullString
+	)
+	err := db.QueryRowContext(ctx, query, id, TenantFromContext(ctx)).Scan(&ref.tenant, &ref.key, &domain)
+	if err == sql.ErrNoRows || (err == nil && !scopeFromContext(ctx).allows(domain.String)) {
+		return ref, fmt.Errorf("Unknown report %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return ref, fmt.Errorf("Unable to look up report %d: %v", id, err)
+	}
+	return ref, nil
+}
+
+// readNotes reads the notes selected by query
+func readNotes(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Note, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query notes: %v", err)
+	}
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var n Note
+		if err = rows.Scan(&n.ID, &n.User, &n.Text, &n.Created); err != nil {
+			return nil, fmt.Errorf("Unable to scan notes: %v", err)
+		}
+		n.Created = n.Created.UTC()
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
@@ -0,0 +1,25 @@
+package storage
+
+import "context"
+
+// WriteOutcome is what Write did with a report
+type WriteOutcome struct {
+	// Duplicate is the dedupe action taken on a report that was already
+	// stored. It is empty for new reports
+	Duplicate string
+}
+
+type outcomeKey struct{}
+
+// WithOutcome returns a context where Write records what it did with the
+// report in o
+func WithOutcome(ctx context.Context, o *WriteOutcome) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, o)
+}
+
+// setDuplicate records the dedupe action of a write
+func setDuplicate(ctx context.Context, action string) {
+	if o, ok := ctx.Value(outcomeKey{}).(*WriteOutcome); ok {
+		o.Duplicate = action
+	}
+}
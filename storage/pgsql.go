@@ -17,23 +17,16 @@ import (
 
 // Postgresql storage
 type Postgresql struct {
-	db  *sql.DB
-	URL string
+	db     *sql.DB
+	URL    string
+	Pool   Pool
+	Dedupe DedupePolicy
 }
 
-// Initialize creates the tables
-func (h *Postgresql) Initialize(ctx context.Context) (err error) {
-
-	if h.URL == "" {
-		return fmt.Errorf("DMARCURL environment variable is empty")
-	}
-
-	h.db, err = sql.Open("postgres", h.URL)
-	if err != nil {
-		return fmt.Errorf("Unable to connect to postgresql database: %v", err)
-	}
-
-	dbinit := []string{`
+// pgsqlMigrations is the schema history. Never change a released migration,
+// add a new one instead
+var pgsqlMigrations = []Migration{
+	{1, "initial schema", []string{`
 		CREATE TABLE IF NOT EXISTS report(
 			id SERIAL PRIMARY KEY,
 	        report_begin VARCHAR,
@@ -64,25 +57,274 @@ func (h *Postgresql) Initialize(ctx context.Context) (err error) {
 			spfdomain VARCHAR,
 			spfresult VARCHAR,
 			identifier_hfrom VARCHAR
-		);`}
+		);`}},
+	{2, "typed columns", []string{`
+		ALTER TABLE report
+			ALTER COLUMN report_begin TYPE TIMESTAMPTZ
+				USING to_timestamp(NULLIF(trim(report_begin), '')::BIGINT),
+			ALTER COLUMN report_end TYPE TIMESTAMPTZ
+				USING to_timestamp(NULLIF(trim(report_end), '')::BIGINT),
+			ALTER COLUMN policy_pct TYPE INTEGER
+				USING CASE WHEN trim(policy_pct) ~ '^[0-9]+$' THEN trim(policy_pct)::INTEGER END;`, `
+		ALTER TABLE reportrow
+			ALTER COLUMN row_ip TYPE INET USING NULLIF(trim(row_ip), '')::INET;`, `
+		UPDATE report SET
+			policy_adkim = CASE WHEN lower(trim(policy_adkim)) IN ('r', 's') THEN lower(trim(policy_adkim)) ELSE '' END,
+			policy_aspf = CASE WHEN lower(trim(policy_aspf)) IN ('r', 's') THEN lower(trim(policy_aspf)) ELSE '' END,
+			policy_p = CASE WHEN lower(trim(policy_p)) IN ('none', 'quarantine', 'reject') THEN lower(trim(policy_p)) ELSE '' END,
+			policy_sp = CASE WHEN lower(trim(policy_sp)) IN ('none', 'quarantine', 'reject') THEN lower(trim(policy_sp)) ELSE '' END;`, `
+		UPDATE reportrow SET
+			eval_disposition = CASE WHEN lower(trim(eval_disposition)) IN ('none', 'quarantine', 'reject') THEN lower(trim(eval_disposition)) ELSE '' END,
+			eval_spf_align = CASE WHEN lower(trim(eval_spf_align)) IN ('pass', 'fail') THEN lower(trim(eval_spf_align)) ELSE '' END,
+			eval_dkim_align = CASE WHEN lower(trim(eval_dkim_align)) IN ('pass', 'fail') THEN lower(trim(eval_dkim_align)) ELSE '' END,
+			dkimresult = lower(trim(dkimresult)),
+			spfresult = lower(trim(spfresult));`, `
+		ALTER TABLE report
+			ADD CONSTRAINT report_policy_adkim_check CHECK (policy_adkim IN ('', 'r', 's')),
+			ADD CONSTRAINT report_policy_aspf_check CHECK (policy_aspf IN ('', 'r', 's')),
+			ADD CONSTRAINT report_policy_p_check CHECK (policy_p IN ('', 'none', 'quarantine', 'reject')),
+			ADD CONSTRAINT report_policy_sp_check CHECK (policy_sp IN ('', 'none', 'quarantine', 'reject'));`, `
+		ALTER TABLE reportrow
+			ADD CONSTRAINT reportrow_eval_disposition_check CHECK (eval_disposition IN ('', 'none', 'quarantine', 'reject')),
+			ADD CONSTRAINT reportrow_eval_spf_align_check CHECK (eval_spf_align IN ('', 'pass', 'fail')),
+			ADD CONSTRAINT reportrow_eval_dkim_align_check CHECK (eval_dkim_align IN ('', 'pass', 'fail'));`}},
+	{3, "indexes", []string{
+		`CREATE INDEX IF NOT EXISTS reportrow_rid_idx ON reportrow(rid);`,
+		`CREATE INDEX IF NOT EXISTS reportrow_row_ip_idx ON reportrow(row_ip);`,
+		`CREATE INDEX IF NOT EXISTS report_policy_domain_idx ON report(policy_domain);`,
+		`CREATE INDEX IF NOT EXISTS report_report_begin_idx ON report(report_begin);`}},
+	{4, "daily statistics", []string{`
+		CREATE TABLE IF NOT EXISTS daily_stats(
+			day DATE NOT NULL,
+			policy_domain VARCHAR NOT NULL,
+			header_from VARCHAR NOT NULL,
+			source_ip VARCHAR NOT NULL,
+			reporter VARCHAR NOT NULL,
+			disposition VARCHAR NOT NULL,
+			dkim_align VARCHAR NOT NULL,
+			spf_align VARCHAR NOT NULL,
+			messages BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align)
+		);`,
+		`CREATE INDEX IF NOT EXISTS daily_stats_policy_domain_idx ON daily_stats(policy_domain, day);`, `
+		INSERT INTO daily_stats(day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+		SELECT (r.report_begin AT TIME ZONE 'UTC')::DATE,
+			COALESCE(lower(r.policy_domain), ''),
+			COALESCE(lower(rr.identifier_hfrom), ''),
+			COALESCE(host(rr.row_ip), ''),
+			COALESCE(r.report_org, ''),
+			COALESCE(rr.eval_disposition, ''),
+			COALESCE(rr.eval_dkim_align, ''),
+			COALESCE(rr.eval_spf_align, ''),
+			COALESCE(SUM(rr.row_count), 0)
+		FROM reportrow AS rr
+			JOIN report AS r ON r.id = rr.rid
+		WHERE r.report_begin IS NOT NULL
+		GROUP BY 1, 2, 3, 4, 5, 6, 7, 8;`}},
+	// Data stored before tenants were configured belongs to no tenant
+	{5, "tenants", []string{
+		`ALTER TABLE report ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS report_tenant_idx ON report(tenant, report_begin);`, `
+		ALTER TABLE daily_stats
+			ADD COLUMN IF NOT EXISTS tenant VARCHAR NOT NULL DEFAULT '',
+			DROP CONSTRAINT daily_stats_pkey,
+			ADD PRIMARY KEY(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align);`,
+		`DROP INDEX IF EXISTS daily_stats_policy_domain_idx;`,
+		`CREATE INDEX IF NOT EXISTS daily_stats_policy_domain_idx ON daily_stats(tenant, policy_domain, day);`}},
+	// Copies of a report in the same tenant that only differed by the casing
+	// of the organisation were stored more than once. The older copies are
+	// kept as superseded revisions and removed from the daily statistics. The
+	// content hash of existing reports is unknown
+	{6, "report revisions", []string{`
+		ALTER TABLE report
+			ADD COLUMN IF NOT EXISTS report_key CHAR(64),
+			ADD COLUMN IF NOT EXISTS content_hash VARCHAR NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS superseded BOOLEAN NOT NULL DEFAULT false;`, `
+		UPDATE report SET report_key = encode(sha256(convert_to(concat_ws('|',
+			COALESCE(extract(epoch FROM report_begin)::BIGINT, 0),
+			COALESCE(extract(epoch FROM report_end)::BIGINT, 0),
+			lower(trim(COALESCE(report_org, ''))),
+			trim(COALESCE(report_id, ''))), 'UTF8')), 'hex');`, `
+		UPDATE report AS r SET revision = d.revision
+		FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY tenant, report_key ORDER BY id) - 1 AS revision FROM report) AS d
+		WHERE r.id = d.id AND d.revision > 0;`, `
+		UPDATE report AS r SET superseded = true
+		WHERE EXISTS (SELECT 1 FROM report AS n WHERE n.tenant = r.tenant AND n.report_key = r.report_key AND n.revision > r.revision);`, `
+		UPDATE daily_stats AS d SET messages = d.messages - s.messages
+		FROM (SELECT r.tenant,
+				(r.report_begin AT TIME ZONE 'UTC')::DATE AS day,
+				COALESCE(lower(r.policy_domain), '') AS policy_domain,
+				COALESCE(lower(rr.identifier_hfrom), '') AS header_from,
+				COALESCE(host(rr.row_ip), '') AS source_ip,
+				COALESCE(r.report_org, '') AS reporter,
+				COALESCE(rr.eval_disposition, '') AS disposition,
+				COALESCE(rr.eval_dkim_align, '') AS dkim_align,
+				COALESCE(rr.eval_spf_align, '') AS spf_align,
+				COALESCE(SUM(rr.row_count), 0) AS messages
+			FROM reportrow AS rr
+				JOIN report AS r ON r.id = rr.rid
+			WHERE r.superseded AND r.report_begin IS NOT NULL
+			GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9) AS s
+		WHERE d.tenant = s.tenant AND d.day = s.day AND d.policy_domain = s.policy_domain
+			AND d.header_from = s.header_from AND d.source_ip = s.source_ip AND d.reporter = s.reporter
+			AND d.disposition = s.disposition AND d.dkim_align = s.dkim_align AND d.spf_align = s.spf_align;`, `
+		ALTER TABLE report
+			ALTER COLUMN report_key SET NOT NULL,
+			DROP CONSTRAINT IF EXISTS report_report_begin_report_end_report_org_report_id_key,
+			ADD CONSTRAINT report_tenant_report_key_revision_key UNIQUE(tenant, report_key, revision);`, `
+		CREATE TABLE IF NOT EXISTS reporter_stats(
+			tenant VARCHAR NOT NULL,
+			reporter VARCHAR NOT NULL,
+			duplicates BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(tenant, reporter)
+		);`}},
+	{7, "malformed reports", []string{`
+		ALTER TABLE reporter_stats ADD COLUMN IF NOT EXISTS malformed BIGINT NOT NULL DEFAULT 0;`}},
+	{8, "users", []string{`
+		CREATE TABLE IF NOT EXISTS users(
+			name VARCHAR PRIMARY KEY,
+			password_hash VARCHAR NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`}},
+	{9, "grants", []string{`
+		CREATE TABLE IF NOT EXISTS grants(
+			user_name VARCHAR NOT NULL,
+			scope VARCHAR NOT NULL,
+			role VARCHAR NOT NULL,
+			PRIMARY KEY (user_name, scope)
+		);`}},
+	{10, "api tokens", []string{`
+		CREATE TABLE IF NOT EXISTS api_tokens(
+			id VARCHAR PRIMARY KEY,
+			hash VARCHAR NOT NULL,
+			name VARCHAR NOT NULL DEFAULT '',
+			user_name VARCHAR NOT NULL,
+			tenant VARCHAR NOT NULL DEFAULT '',
+			service BOOLEAN NOT NULL DEFAULT false,
+			scopes VARCHAR NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires TIMESTAMPTZ NULL,
+			last_used TIMESTAMPTZ NULL,
+			revoked BOOLEAN NOT NULL DEFAULT false
+		);`,
+		`CREATE INDEX IF NOT EXISTS api_tokens_user ON api_tokens(user_name);`}},
+	{11, "report documents", []string{`
+		CREATE TABLE IF NOT EXISTS report_document(
+			rid INTEGER PRIMARY KEY REFERENCES report(id) ON DELETE CASCADE,
+			source VARCHAR NOT NULL DEFAULT '',
+			received TIMESTAMPTZ,
+			document BYTEA NOT NULL
+		);`}},
+	// Notes belong to the report key so they are kept across revisions
+	{12, "report notes", []string{`
+		CREATE TABLE IF NOT EXISTS report_note(
+			id SERIAL PRIMARY KEY,
+			tenant VARCHAR NOT NULL DEFAULT '',
+			report_key CHAR(64) NOT NULL,
+			user_name VARCHAR NOT NULL,
+			note TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS report_note_key_idx ON report_note(tenant, report_key);`}},
+}
 
-	log.Debug("Initializing postgresql")
-	tx, err := h.db.BeginTx(ctx, nil)
+// pgsqlUpdateStats adds the rows of report $1 to the daily statistics. The
+// messages are multiplied by $2 so -1 removes a report again
+const pgsqlUpdateStats = `
+	INSERT INTO daily_stats(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+	SELECT r.tenant,
+		(r.report_begin AT TIME ZONE 'UTC')::DATE,
+		COALESCE(lower(r.policy_domain), ''),
+		COALESCE(lower(rr.identifier_hfrom), ''),
+		COALESCE(host(rr.row_ip), ''),
+		COALESCE(r.report_org, ''),
+		COALESCE(rr.eval_disposition, ''),
+		COALESCE(rr.eval_dkim_align, ''),
+		COALESCE(rr.eval_spf_align, ''),
+		$2::BIGINT * COALESCE(SUM(rr.row_count), 0)
+	FROM reportrow AS rr
+		JOIN report AS r ON r.id = rr.rid
+	WHERE r.id = $1
+	GROUP BY 1, 2, 3, 4, 5, 6, 7, 8, 9
+	ON CONFLICT (tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align)
+	DO UPDATE SET messages = daily_stats.messages + EXCLUDED.messages`
+
+func (h *Postgresql) connect(ctx context.Context) (err error) {
+
+	if h.db != nil {
+		return nil
+	}
+
+	if h.URL == "" {
+		return fmt.Errorf("DMARCURL environment variable is empty")
+	}
+
+	h.db, err = sql.Open("postgres", h.URL)
 	if err != nil {
-		return fmt.Errorf("Unable to begin transaction: %v", err)
+		return fmt.Errorf("Unable to connect to postgresql database: %v", err)
 	}
-	for _, d := range dbinit {
-		_, err = tx.ExecContext(ctx, d)
-		if err != nil {
-			if rerr := tx.Rollback(); rerr != nil {
-				return fmt.Errorf("Error doing rollback after table creation failed: %v %v", err, rerr)
-			}
+	h.Pool.apply(h.db)
 
-			return fmt.Errorf("Unable to create table: %v", err)
+	// sql.Open does not connect so wait for the database to be reachable
+	if err = ping(ctx, h.db); err != nil {
+		if cerr := h.db.Close(); cerr != nil {
+			log.Errorf("Unable to close database: %v", cerr)
 		}
+		h.db = nil
+		return err
 	}
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("Unable to commit while create tables: %v", err)
+	return nil
+}
+
+func (h *Postgresql) schema() schema {
+	return schema{
+		db:         h.db,
+		migrations: pgsqlMigrations,
+		create: `CREATE TABLE IF NOT EXISTS schema_version(
+			version INTEGER PRIMARY KEY,
+			name VARCHAR,
+			applied_at TIMESTAMPTZ)`,
+		exists: `SELECT to_regclass('schema_version') IS NOT NULL`,
+		insert: `INSERT INTO schema_version(version, name, applied_at) VALUES ($1, $2, $3)`,
+		lock:   `LOCK TABLE schema_version IN EXCLUSIVE MODE`,
+	}
+}
+
+// Migrations returns the status of the schema migrations
+func (h *Postgresql) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	if err := h.connect(ctx); err != nil {
+		return nil, err
+	}
+	return h.schema().status(ctx)
+}
+
+// Migrate applies the pending schema migrations
+func (h *Postgresql) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	if err := h.connect(ctx); err != nil {
+		return nil, err
+	}
+	return h.schema().migrate(ctx)
+}
+
+// Ping checks that the database is reachable
+func (h *Postgresql) Ping(ctx context.Context) error {
+	if h.db == nil {
+		return fmt.Errorf("Not connected")
+	}
+	return h.db.PingContext(ctx)
+}
+
+// Initialize connects and applies pending migrations
+func (h *Postgresql) Initialize(ctx context.Context) (err error) {
+
+	if err = h.connect(ctx); err != nil {
+		return err
+	}
+
+	log.Debug("Initializing postgresql")
+	if _, err = h.Migrate(ctx); err != nil {
+		return fmt.Errorf("Unable to migrate schema: %v", err)
 	}
 	return nil
 }
@@ -104,13 +346,13 @@ func (h *Postgresql) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, e
         		lower(r.policy_aspf),
         		r.policy_p,
         		r.policy_sp,
-        		r.policy_pct,
-        		SUM(rr.row_count) AS rowcount,
-        		MIN(lower(rr.dkimresult)) AS dkimresult,
-        		MIN(lower(rr.spfresult)) AS spfresult
+        		COALESCE(r.policy_pct::VARCHAR, ''),
+        		COALESCE(SUM(rr.row_count), 0) AS rowcount,
+        		COALESCE(MIN(lower(rr.dkimresult)), '') AS dkimresult,
+        		COALESCE(MIN(lower(rr.spfresult)), '') AS spfresult
 		 FROM   report AS r
 		 	LEFT JOIN reportrow AS rr ON r.id = rr.rid
-		 		WHERE r.id = $1
+		 		WHERE r.id = $1 AND ($2::VARCHAR = '' OR r.tenant = $2)
 		 GROUP BY r.id
 		 ORDER BY r.report_begin DESC`)
 
@@ -124,13 +366,9 @@ func (h *Postgresql) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, e
 		}
 	}()
 
-	var (
-		r          dmarc.Report
-		begin, end int64
-	)
-	err = queryStmt.QueryRowContext(ctx, id).Scan(&r.ID,
-		&begin,
-		&end,
+	err = queryStmt.QueryRowContext(ctx, id, TenantFromContext(ctx)).Scan(&rs.Report.ID,
+		&rs.Report.ReportBegin,
+		&rs.Report.ReportEnd,
 		&rs.Report.PolicyDomain,
 		&rs.Report.ReportOrg,
 		&rs.Report.ReportID,
@@ -146,16 +384,19 @@ func (h *Postgresql) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, e
 		&rs.Report.SPFResult,
 	)
 
+	if err == sql.ErrNoRows {
+		return rs, fmt.Errorf("Failed to query reportrow: report %d %w", id, ErrNotFound)
+	}
 	if err != nil {
 		return rs, fmt.Errorf("Failed to query reportrow: %v", err)
 	}
-
-	rs.Report.ReportBegin = time.Unix(begin, 0)
-	rs.Report.ReportEnd = time.Unix(end, 0)
+	if !scopeFromContext(ctx).allows(rs.Report.PolicyDomain) {
+		return dmarc.Rows{}, fmt.Errorf("Failed to query reportrow: report %d %w", id, ErrNotFound)
+	}
 
 	rowStmt, err := h.db.PrepareContext(ctx,
 		`SELECT
-			rr.row_ip,
+			COALESCE(host(rr.row_ip), ''),
 			rr.row_count,
 			rr.eval_disposition,
 			lower(rr.eval_spf_align),
@@ -215,10 +456,39 @@ func (h *Postgresql) ReadReport(ctx context.Context, id int64) (rs dmarc.Rows, e
 	return rs, nil
 }
 
-// ReadReports fetches the list of reports paginated
-func (h *Postgresql) ReadReports(ctx context.Context, offset int, pagesize int) (rs []dmarc.Report, err error) {
+// filter builds the WHERE clause of the reports query
+func (h *Postgresql) filter(q ReportQuery) (*filter, error) {
 
-	queryStmt, err := h.db.PrepareContext(ctx,
+	f := &filter{bind: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	f.common(q)
+
+	if q.SourceIP != "" {
+		n, err := q.network()
+		if err != nil {
+			return nil, err
+		}
+		f.rows = append(f.rows, "fr.row_ip <<= "+f.arg(n.String())+"::INET")
+	}
+
+	return f, nil
+}
+
+// ReadReports fetches the list of reports matching the query paginated
+func (h *Postgresql) ReadReports(ctx context.Context, q ReportQuery) (rs []dmarc.Report, err error) {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	f.cursor(q)
+	offset := q.Offset
+	if q.Cursor != nil {
+		offset = 0
+	}
+
+	rows, err := h.db.QueryContext(ctx,
 		`SELECT 
 				r.id,
         		r.report_begin,
@@ -232,44 +502,31 @@ func (h *Postgresql) ReadReports(ctx context.Context, offset int, pagesize int)
         		lower(r.policy_aspf),
         		lower(r.policy_p),
         		lower(r.policy_sp),
-        		r.policy_pct,
-        		SUM(rr.row_count) AS rowcount,
-        		MIN(lower(rr.dkimresult)) AS dkimresult,
-        		MIN(lower(rr.spfresult)) AS spfresult,
-				(SELECT COUNT(*) FROM report) as items
+        		COALESCE(r.policy_pct::VARCHAR, ''),
+        		COALESCE(SUM(rr.row_count), 0) AS rowcount,
+        		COALESCE(MIN(lower(rr.dkimresult)), '') AS dkimresult,
+        		COALESCE(MIN(lower(rr.spfresult)), '') AS spfresult
 		 FROM   report AS r
 		 LEFT JOIN reportrow AS rr ON r.id = rr.rid
+		 `+f.clause()+`
 		 GROUP BY r.id
-		 ORDER BY r.report_begin DESC OFFSET $1 LIMIT $2`)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare report: %v", err)
-	}
-
-	defer func() {
-		if qerr := queryStmt.Close(); qerr != nil {
-			log.Errorf("Unable to close query: %v", qerr)
-		}
-	}()
-
-	rows, err := queryStmt.QueryContext(ctx, offset, pagesize)
+		 `+q.orderBy()+`
+		 OFFSET `+f.arg(offset)+` LIMIT `+f.arg(q.PageSize), f.args...)
 	switch {
 	case err == sql.ErrNoRows:
 		return []dmarc.Report{}, nil
 	case err != nil:
 		return nil, fmt.Errorf("Failed to fetch rows: %v", err)
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 
-		var (
-			r          dmarc.Report
-			begin, end int64
-		)
+		var r dmarc.Report
 
 		err = rows.Scan(&r.ID,
-			&begin,
-			&end,
+			&r.ReportBegin,
+			&r.ReportEnd,
 			&r.PolicyDomain,
 			&r.ReportOrg,
 			&r.ReportID,
@@ -283,15 +540,11 @@ func (h *Postgresql) ReadReports(ctx context.Context, offset int, pagesize int)
 			&r.Count,
 			&r.DKIMResult,
 			&r.SPFResult,
-			&r.Items,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to scan: %v", err)
 		}
 
-		r.ReportBegin = time.Unix(begin, 0)
-		r.ReportEnd = time.Unix(end, 0)
-
 		if r.SPFResult == "" {
 			r.SPFResult = "neutral"
 		}
@@ -301,14 +554,184 @@ func (h *Postgresql) ReadReports(ctx context.Context, offset int, pagesize int)
 
 		rs = append(rs, r)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to fetch rows: %v", err)
+	}
 
+	if q.Cursor != nil && q.Cursor.Backward {
+		reverse(rs)
+	}
 	return rs, nil
 }
 
+// CountReports returns the number of reports matching the query
+func (h *Postgresql) CountReports(ctx context.Context, q ReportQuery) (n int, err error) {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return 0, err
+	}
+
+	err = h.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM report AS r `+f.clause(), f.args...).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to count reports: %v", err)
+	}
+	return n, nil
+}
+
+// ReadRows fetches the rows matching the query across reports
+func (h *Postgresql) ReadRows(ctx context.Context, q ReportQuery) ([]ReportRow, error) {
+	return collectRows(func(fn func(ReportRow) error) error {
+		return h.WalkRows(ctx, q, fn)
+	})
+}
+
+// WalkRows streams the rows matching the query across reports
+func (h *Postgresql) WalkRows(ctx context.Context, q ReportQuery, fn func(ReportRow) error) error {
+
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return err
+	}
+
+	return walkRows(ctx, h.db,
+		`SELECT
+				r.id,
+				r.report_begin,
+				r.report_end,
+				lower(r.policy_domain),
+				r.report_org,
+				r.report_id,
+				r.report_email,
+				r.report_extra_contact_info,
+				lower(r.policy_adkim),
+				lower(r.policy_aspf),
+				lower(r.policy_p),
+				lower(r.policy_sp),
+				COALESCE(r.policy_pct::VARCHAR, ''),
+				COALESCE(host(fr.row_ip), ''),
+				fr.row_count,
+				fr.eval_disposition,
+				lower(fr.eval_spf_align),
+				lower(fr.eval_dkim_align),
+				fr.reason,
+				lower(fr.dkimdomain),
+				lower(fr.dkimresult),
+				lower(fr.spfdomain),
+				lower(fr.spfresult),
+				fr.identifier_hfrom
+		 FROM   report AS r
+		 JOIN   reportrow AS fr ON r.id = fr.rid
+		 `+f.rowsClause()+`
+		 ORDER BY r.report_begin DESC, r.id DESC, fr.id
+		 `+f.rowsLimit(q), f.args, fn)
+}
+
+// ReadPolicies fetches the policies seen for the policy domain
+func (h *Postgresql) ReadPolicies(ctx context.Context, domain string) ([]PolicyState, error) {
+
+	q := ReportQuery{PolicyDomain: domain}
+	q.fromContext(ctx)
+	f, err := h.filter(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPolicies(ctx, h.db,
+		`SELECT
+				COALESCE(lower(r.policy_adkim), ''),
+				COALESCE(lower(r.policy_aspf), ''),
+				COALESCE(lower(r.policy_p), ''),
+				COALESCE(lower(r.policy_sp), ''),
+				COALESCE(r.policy_pct::VARCHAR, ''),
+				MIN(r.report_begin),
+				MAX(r.report_end),
+				COUNT(*),
+				COUNT(DISTINCT lower(r.report_org))
+		 FROM   report AS r
+		 `+f.clause()+`
+		 GROUP BY 1, 2, 3, 4, 5
+		 ORDER BY MIN(r.report_begin)`, f.args)
+}
+
+// Write stores the feedback. A report that already exists is skipped,
+// replaced or stored as a new revision depending on the dedupe policy
 func (h *Postgresql) Write(ctx context.Context, f dmarc.Feedback) (err error) {
 
-	log.Debug("Preparing context for report")
-	queryStmt, err := h.db.PrepareContext(ctx,
+	key, hash := feedbackKey(f), contentHash(f)
+	tenant := TenantFromContext(ctx)
+	setDuplicate(ctx, "")
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) error {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("Rollback failed after failed write: %w %v", err, rerr)
+		}
+		return err
+	}
+
+	var (
+		old      int64
+		oldHash  string
+		revision int
+		received sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT r.id, r.content_hash, r.revision, d.received
+		 FROM report AS r
+			LEFT JOIN report_document AS d ON d.rid = r.id
+		 WHERE r.tenant = $1 AND r.report_key = $2 AND NOT r.superseded
+		 ORDER BY r.revision DESC
+		 LIMIT 1
+		 FOR UPDATE OF r`, tenant, key).Scan(&old, &oldHash, &revision, &received)
+	if err != nil && err != sql.ErrNoRows {
+		return rollback(fmt.Errorf("Unable to look up report: %w", err))
+	}
+
+	if old != 0 {
+		action := h.Dedupe.actionFor(ctx, oldHash == hash, f.Received, received.Time)
+		setDuplicate(ctx, action)
+		log.Debugf("Report %s from %s already exists, action %s", f.ReportMetadata.ReportID, f.ReportMetadata.OrgName, action)
+
+		if !replacing(ctx) {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO reporter_stats(tenant, reporter, duplicates) VALUES ($1, $2, 1)
+				 ON CONFLICT (tenant, reporter) DO UPDATE SET duplicates = reporter_stats.duplicates + 1`,
+				tenant, reporter(f.ReportMetadata.OrgName))
+			if err != nil {
+				return rollback(fmt.Errorf("Unable to count duplicate: %w", err))
+			}
+		}
+
+		if action == DedupeSkip {
+			log.Debug("Comitting transaction")
+			return tx.Commit()
+		}
+
+		if _, err = tx.ExecContext(ctx, pgsqlUpdateStats, old, -1); err != nil {
+			return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+		}
+
+		if action == DedupeRevision {
+			_, err = tx.ExecContext(ctx, `UPDATE report SET superseded = true WHERE id = $1`, old)
+			revision++
+		} else if _, err = tx.ExecContext(ctx, `DELETE FROM reportrow WHERE rid = $1`, old); err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM report WHERE id = $1`, old)
+		}
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to %s report %d: %w", action, old, err))
+		}
+	}
+
+	var id int64
+
+	err = tx.QueryRowContext(ctx,
 		`INSERT INTO report(
 			report_begin,
 			report_end,
@@ -321,145 +744,715 @@ func (h *Postgresql) Write(ctx context.Context, f dmarc.Feedback) (err error) {
 			policy_aspf,
 			policy_p,
 			policy_sp,
-			policy_pct)
-	     VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) 
-		 RETURNING id`)
+			policy_pct,
+			tenant,
+			report_key,
+			content_hash,
+			revision)
+	     VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		 RETURNING id`,
+		time.Unix(f.ReportMetadata.DateRange.Begin, 0).UTC(),
+		time.Unix(f.ReportMetadata.DateRange.End, 0).UTC(),
+		f.PolicyPublished.Domain,
+		f.ReportMetadata.OrgName,
+		f.ReportMetadata.ReportID,
+		f.ReportMetadata.Email,
+		f.ReportMetadata.ExtraContactInfo,
+		normalize(f.PolicyPublished.ADKIM, alignments...),
+		normalize(f.PolicyPublished.ASPF, alignments...),
+		normalize(f.PolicyPublished.P, dispositions...),
+		normalize(f.PolicyPublished.SP, dispositions...),
+		percentage(f.PolicyPublished.PCT),
+		tenant,
+		key,
+		hash,
+		revision,
+	).Scan(&id)
 
 	if err != nil {
-		return fmt.Errorf("failed to prepare report: %v", err)
+		// Another writer stored the same report in the meantime
+		if pgerr, ok := err.(*pq.Error); ok && pgerr.Code == "23505" {
+			log.Debug("Record already exists, skipping.")
+			if err = tx.Rollback(); err != nil {
+				return fmt.Errorf("Rollback failed: %w", err)
+			}
+			return nil
+		}
+		return rollback(fmt.Errorf("Failed to execute query: %w", err))
 	}
 
-	defer func() {
-		if qerr := queryStmt.Close(); qerr != nil {
-			log.Errorf("Unable to close query: %v", qerr)
+	if id == 0 {
+		return rollback(fmt.Errorf("Invalid id returned: %d", id))
+	}
+
+	// COPY is a lot faster than an INSERT per row for the large reports
+	rowStmt, err := tx.PrepareContext(ctx, pq.CopyIn("reportrow",
+		"rid",
+		"row_ip",
+		"row_count",
+		"eval_disposition",
+		"eval_spf_align",
+		"eval_dkim_align",
+		"reason",
+		"dkimdomain",
+		"dkimresult",
+		"spfdomain",
+		"spfresult",
+		"identifier_hfrom"))
+	if err != nil {
+		return rollback(fmt.Errorf("Unable to prepare copy into reportrow: %w", err))
+	}
+
+	for _, rw := range feedbackRows(f) {
+		_, err = rowStmt.ExecContext(ctx,
+			id,
+			ipaddress(rw.SourceIP),
+			rw.Count,
+			rw.EvalDisposition,
+			rw.EvalSPFAlign,
+			rw.EvalDKIMAalign,
+			rw.Reason,
+			rw.DKIMDomain,
+			rw.DKIMResult,
+			rw.SPFDomain,
+			rw.SPFResult,
+			rw.IdentifierHFrom,
+		)
+		if err != nil {
+			break
 		}
-	}()
+	}
 
-	log.Debug("Preparing context for reportrow")
-	rowStmt, err := h.db.PrepareContext(ctx,
-		`INSERT INTO reportrow(rid,
-                               row_ip,
-                               row_count,
-                               eval_disposition,
-                               eval_spf_align,
-                               eval_dkim_align,
-                               reason,
-                               dkimdomain,
-                               dkimresult,
-                               spfdomain,
-                               spfresult,
-                               identifier_hfrom)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare reportrow: %v", err)
+	// An Exec without arguments flushes the buffered rows
+	if err == nil {
+		_, err = rowStmt.ExecContext(ctx)
+	}
+	if cerr := rowStmt.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return rollback(fmt.Errorf("Unable to copy into reportrow: %w", err))
 	}
 
-	defer func() {
-		if rerr := rowStmt.Close(); rerr != nil {
-			log.Errorf("Unable to close statement: %v", rerr)
+	if len(f.Raw) > 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO report_document(rid, source, received, document) VALUES ($1, $2, $3, $4)`,
+			id, f.FromFile, nullTime(f.Received), f.Raw)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into report_document: %w", err))
 		}
-	}()
+	}
+
+	// The daily statistics are kept up to date with every report so the
+	// dashboards never has to scan reportrow
+	if _, err = tx.ExecContext(ctx, pgsqlUpdateStats, id, 1); err != nil {
+		return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+	}
+
+	log.Debug("Comitting transaction")
+	return tx.Commit()
+}
+
+// ReporterCounts returns the number of duplicate and malformed reports
+// received per reporter
+func (h *Postgresql) ReporterCounts(ctx context.Context) ([]ReporterCount, error) {
+	if scopeFromContext(ctx).restricted {
+		return nil, nil
+	}
+	return readReporterCounts(ctx, h.db,
+		`SELECT reporter, SUM(duplicates), SUM(malformed)
+		 FROM reporter_stats
+		 WHERE $1::VARCHAR = '' OR tenant = $1
+		 GROUP BY reporter
+		 ORDER BY reporter`, TenantFromContext(ctx))
+}
+
+// AddMalformed counts a malformed report from the reporter
+func (h *Postgresql) AddMalformed(ctx context.Context, org string) error {
+	rp, err := malformedReporter(org)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO reporter_stats(tenant, reporter, malformed) VALUES ($1, $2, 1)
+		 ON CONFLICT (tenant, reporter) DO UPDATE SET malformed = reporter_stats.malformed + 1`,
+		TenantFromContext(ctx), rp)
+	if err != nil {
+		return fmt.Errorf("Unable to count malformed report: %v", err)
+	}
+	return nil
+}
+
+// ReadReporters summarises the reports per reporter and policy domain
+func (h *Postgresql) ReadReporters(ctx context.Context, org string) ([]ReporterDomain, error) {
+	f := &filter{bind: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	var q ReportQuery
+	q.fromContext(ctx)
+	query := f.reporters(q, org)
+	return readReporters(ctx, h.db, query, f.args)
+}
+
+// ReadStats sums the daily statistics
+func (h *Postgresql) ReadStats(ctx context.Context, q StatsQuery) ([]DailyStat, error) {
+
+	q.fromContext(ctx)
+	f := &filter{bind: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	query, err := f.stats(q)
+	if err != nil {
+		return nil, err
+	}
+	return readStats(ctx, h.db, query, f.args)
+}
+
+// Purge deletes the reports ending before rows and the daily statistics older
+// than stats
+func (h *Postgresql) Purge(ctx context.Context, rows time.Time, stats time.Time) (res PurgeResult, err error) {
 
 	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("Unable to start transactions: %v", err)
+		return res, fmt.Errorf("Unable to start transactions: %v", err)
 	}
 
-	recordStmt := tx.StmtContext(ctx, queryStmt)
+	rollback := func(err error) (PurgeResult, error) {
+		if rerr := tx.Rollback(); rerr != nil {
+			return PurgeResult{}, fmt.Errorf("Rollback failed after failed purge: %v %v", err, rerr)
+		}
+		return PurgeResult{}, err
+	}
 
-	var id int64
+	if !rows.IsZero() {
+		r, err := tx.ExecContext(ctx,
+			`DELETE FROM reportrow AS rr USING report AS r WHERE r.id = rr.rid AND r.report_end < $1`, rows)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from reportrow: %v", err))
+		}
+		res.Rows, _ = r.RowsAffected()
 
-	err = recordStmt.QueryRowContext(ctx,
-		f.ReportMetadata.DateRange.Begin,
-		f.ReportMetadata.DateRange.End,
-		f.PolicyPublished.Domain,
-		f.ReportMetadata.OrgName,
-		f.ReportMetadata.ReportID,
-		f.ReportMetadata.Email,
-		f.ReportMetadata.ExtraContactInfo,
-		f.PolicyPublished.ADKIM,
-		f.PolicyPublished.ASPF,
-		f.PolicyPublished.P,
-		f.PolicyPublished.SP,
-		f.PolicyPublished.PCT,
-	).Scan(&id)
+		r, err = tx.ExecContext(ctx, `DELETE FROM report WHERE report_end < $1`, rows)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from report: %v", err))
+		}
+		res.Reports, _ = r.RowsAffected()
 
-	switch {
-	case err != nil:
-		if pgerr, ok := err.(*pq.Error); ok {
-			if pgerr.Code == "23505" {
-				log.Debug("Record already exists, skipping.")
-				if err = tx.Rollback(); err != nil {
-					return fmt.Errorf("Rollback failed: %v", err)
-				}
-				return nil
-			}
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM report_note AS n
+			 WHERE NOT EXISTS (SELECT 1 FROM report AS r WHERE r.tenant = n.tenant AND r.report_key = n.report_key)`)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from report_note: %v", err))
+		}
+	}
+
+	if !stats.IsZero() {
+		r, err := tx.ExecContext(ctx, `DELETE FROM daily_stats WHERE day < $1::DATE`, stats.UTC())
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to delete from daily_stats: %v", err))
+		}
+		res.Stats, _ = r.RowsAffected()
+	}
+
+	if err = tx.Commit(); err != nil {
+		return PurgeResult{}, fmt.Errorf("Unable to commit purge: %v", err)
+	}
+	return res, nil
+}
+
+// ExportReports reads all reports and their rows ordered by ID
+func (h *Postgresql) ExportReports(ctx context.Context, fn func(ArchiveReport) error) error {
+	return exportReports(ctx, h.db,
+		`SELECT r.id,
+			r.tenant,
+			r.report_begin,
+			r.report_end,
+			COALESCE(r.policy_domain, ''),
+			COALESCE(r.report_org, ''),
+			COALESCE(r.report_id, ''),
+			COALESCE(r.report_email, ''),
+			COALESCE(r.report_extra_contact_info, ''),
+			COALESCE(r.policy_adkim, ''),
+			COALESCE(r.policy_aspf, ''),
+			COALESCE(r.policy_p, ''),
+			COALESCE(r.policy_sp, ''),
+			COALESCE(r.policy_pct::VARCHAR, ''),
+			r.content_hash,
+			r.revision,
+			r.superseded,
+			COALESCE(d.source, ''),
+			d.received,
+			d.document
+		 FROM report AS r
+			LEFT JOIN report_document AS d ON d.rid = r.id
+		 ORDER BY r.id`,
+		`SELECT rid,
+			COALESCE(host(row_ip), ''),
+			COALESCE(row_count, 0),
+			COALESCE(eval_disposition, ''),
+			COALESCE(eval_spf_align, ''),
+			COALESCE(eval_dkim_align, ''),
+			COALESCE(reason, ''),
+			COALESCE(dkimdomain, ''),
+			COALESCE(dkimresult, ''),
+			COALESCE(spfdomain, ''),
+			COALESCE(spfresult, ''),
+			COALESCE(identifier_hfrom, '')
+		 FROM reportrow
+		 WHERE rid IS NOT NULL
+		 ORDER BY rid, id`, fn)
+}
+
+// ExportStats reads all daily statistics
+func (h *Postgresql) ExportStats(ctx context.Context, fn func(ArchiveStat) error) error {
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages
+		 FROM daily_stats
+		 ORDER BY day`)
+	if err != nil {
+		return fmt.Errorf("Unable to query daily_stats: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s ArchiveStat
+		err = rows.Scan(&s.Tenant, &s.Day, &s.PolicyDomain, &s.HeaderFrom, &s.SourceIP, &s.Reporter,
+			&s.Disposition, &s.DKIMAlign, &s.SPFAlign, &s.Messages)
+		if err != nil {
+			return fmt.Errorf("Unable to scan daily_stats: %v", err)
+		}
+		s.Day = s.Day.UTC()
+		if err = fn(s); err != nil {
+			return err
 		}
+	}
+	return rows.Err()
+}
+
+// ImportReport stores an exported report and its rows as they are
+func (h *Postgresql) ImportReport(ctx context.Context, r ArchiveReport) (bool, error) {
 
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) (bool, error) {
 		if rerr := tx.Rollback(); rerr != nil {
-			return fmt.Errorf("Rollback failed after failed to execute query: %v %v", err, rerr)
+			return false, fmt.Errorf("Rollback failed after failed import: %w %v", err, rerr)
 		}
-		return fmt.Errorf("Failed to execute query: %v", err)
+		return false, err
 	}
 
-	if id == 0 {
-		if err := tx.Rollback(); err != nil {
-			return fmt.Errorf("Rollback failed after invalid id returned: %d %v", id, err)
+	var id int64
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO report(
+			tenant,
+			report_begin,
+			report_end,
+			policy_domain,
+			report_org,
+			report_id,
+			report_email,
+			report_extra_contact_info,
+			policy_adkim,
+			policy_aspf,
+			policy_p,
+			policy_sp,
+			policy_pct,
+			report_key,
+			content_hash,
+			revision,
+			superseded)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		 ON CONFLICT DO NOTHING
+		 RETURNING id`,
+		r.Tenant,
+		r.Begin.UTC(),
+		r.End.UTC(),
+		r.PolicyDomain,
+		r.ReportOrg,
+		r.ReportID,
+		r.ReportEmail,
+		r.ReportExtraContactInfo,
+		normalize(r.PolicyAdkim, alignments...),
+		normalize(r.PolicyAspf, alignments...),
+		normalize(r.PolicyP, dispositions...),
+		normalize(r.PolicySP, dispositions...),
+		percentage(r.PolicyPCT),
+		r.key(),
+		r.ContentHash,
+		r.Revision,
+		r.Superseded,
+	).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		log.Debug("Record already exists, skipping.")
+		return false, tx.Rollback()
+	}
+	if err != nil {
+		return rollback(fmt.Errorf("Unable to insert report: %w", err))
+	}
+
+	rowStmt, err := tx.PrepareContext(ctx, pq.CopyIn("reportrow",
+		"rid",
+		"row_ip",
+		"row_count",
+		"eval_disposition",
+		"eval_spf_align",
+		"eval_dkim_align",
+		"reason",
+		"dkimdomain",
+		"dkimresult",
+		"spfdomain",
+		"spfresult",
+		"identifier_hfrom"))
+	if err != nil {
+		return rollback(fmt.Errorf("Unable to prepare copy into reportrow: %w", err))
+	}
+
+	for _, rw := range r.Rows {
+		_, err = rowStmt.ExecContext(ctx,
+			id,
+			ipaddress(rw.SourceIP),
+			rw.Count,
+			normalize(rw.EvalDisposition, dispositions...),
+			normalize(rw.EvalSPFAlign, evaluations...),
+			normalize(rw.EvalDKIMAlign, evaluations...),
+			rw.Reason,
+			rw.DKIMDomain,
+			rw.DKIMResult,
+			rw.SPFDomain,
+			rw.SPFResult,
+			rw.HeaderFrom,
+		)
+		if err != nil {
+			break
 		}
-		return fmt.Errorf("Invalid id returned: %d", id)
+	}
+	if err == nil {
+		_, err = rowStmt.ExecContext(ctx)
+	}
+	if cerr := rowStmt.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return rollback(fmt.Errorf("Unable to copy into reportrow: %w", err))
 	}
 
-	for _, r := range f.Records {
-		for _, rw := range r.Rows {
+	if len(r.Document) > 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO report_document(rid, source, received, document) VALUES ($1, $2, $3, $4)`,
+			id, r.Source, nullTime(r.Received), r.Document)
+		if err != nil {
+			return rollback(fmt.Errorf("Unable to insert into report_document: %w", err))
+		}
+	}
 
-			var (
-				dkimdomain, dkimresult string
-				spfdomain, spfresult   string
-			)
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("Unable to commit import: %w", err)
+	}
+	return true, nil
+}
 
-			if len(r.AuthResults.SPF) == 1 {
-				spfdomain = f.PolicyPublished.Domain
-				spfresult = r.AuthResults.SPF[0].Result
-			}
+// ImportStat stores an exported entry of the daily statistics
+func (h *Postgresql) ImportStat(ctx context.Context, s ArchiveStat) error {
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO daily_stats(tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align, messages)
+		 VALUES ($1, $2::DATE, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (tenant, day, policy_domain, header_from, source_ip, reporter, disposition, dkim_align, spf_align)
+		 DO UPDATE SET messages = GREATEST(daily_stats.messages, EXCLUDED.messages)`,
+		s.Tenant, statsDay(s.Day).Format("2006-01-02"), s.PolicyDomain, s.HeaderFrom, s.SourceIP, s.Reporter,
+		s.Disposition, s.DKIMAlign, s.SPFAlign, s.Messages)
+	if err != nil {
+		return fmt.Errorf("Unable to import into daily_stats: %w", err)
+	}
+	return nil
+}
 
-			if len(r.AuthResults.DKIM) == 1 {
-				dkimdomain = f.PolicyPublished.Domain
-				dkimresult = r.AuthResults.DKIM[0].Result
-			}
+// ExportReporters reads the duplicate and malformed counts of all reporters
+func (h *Postgresql) ExportReporters(ctx context.Context, fn func(ArchiveReporter) error) error {
+	return exportReporters(ctx, h.db,
+		`SELECT tenant, reporter, duplicates, malformed FROM reporter_stats ORDER BY tenant, reporter`, fn)
+}
 
-			reason := ""
-			if len(rw.PolicyEvaluated.Reasons) > 0 {
-				var reasons []string
-				for _, rs := range rw.PolicyEvaluated.Reasons {
-					reasons = append(reasons, rs.Type)
-				}
-				reason = strings.Join(reasons, ",")
-			}
+// ImportReporter stores the exported counts of a reporter
+func (h *Postgresql) ImportReporter(ctx context.Context, r ArchiveReporter) error {
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO reporter_stats(tenant, reporter, duplicates, malformed) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (tenant, reporter) DO UPDATE SET
+			duplicates = GREATEST(reporter_stats.duplicates, EXCLUDED.duplicates),
+			malformed = GREATEST(reporter_stats.malformed, EXCLUDED.malformed)`,
+		r.Tenant, r.Reporter, r.Duplicates, r.Malformed)
+	if err != nil {
+		return fmt.Errorf("Unable to import into reporter_stats: %w", err)
+	}
+	return nil
+}
 
-			rowtxStmt := tx.StmtContext(ctx, rowStmt)
-			_, err = rowtxStmt.ExecContext(ctx,
-				id,
-				rw.SourceIP,
-				rw.Count,
-				rw.PolicyEvaluated.Disposition,
-				rw.PolicyEvaluated.SPF,
-				rw.PolicyEvaluated.DKIM,
-				reason,
-				dkimdomain,
-				dkimresult,
-				spfdomain,
-				spfresult,
-				r.Identifiers.HeaderFrom,
-			)
-			if err != nil {
-				if rerr := tx.Rollback(); rerr != nil {
-					return fmt.Errorf("Rollback failed after unable to insert into recordrow: %d %v", err, rerr)
-				}
-				return fmt.Errorf("Unable to insert into recordrow: %v", err)
-			}
+// ExportNotes reads the notes on all reports
+func (h *Postgresql) ExportNotes(ctx context.Context, fn func(ArchiveNote) error) error {
+	return exportNotes(ctx, h.db,
+		`SELECT tenant, report_key, user_name, note, created FROM report_note ORDER BY id`, fn)
+}
+
+// ImportNote stores an exported note unless it already exists
+func (h *Postgresql) ImportNote(ctx context.Context, n ArchiveNote) (bool, error) {
+	note, err := validNote(Note{User: n.User, Text: n.Text, Created: n.Created})
+	if err != nil {
+		return false, err
+	}
+
+	r, err := h.db.ExecContext(ctx,
+		`INSERT INTO report_note(tenant, report_key, user_name, note, created)
+		 SELECT $1, $2, $3, $4, $5
+		 WHERE NOT EXISTS (SELECT 1 FROM report_note
+			WHERE tenant = $1 AND report_key = $2 AND user_name = $3 AND note = $4 AND created = $5)`,
+		n.Tenant, n.ReportKey, note.User, note.Text, note.Created)
+	if err != nil {
+		return false, fmt.Errorf("Unable to import into report_note: %w", err)
+	}
+	added, _ := r.RowsAffected()
+	return added > 0, nil
+}
+
+// pgsqlLookupReport selects where a report is stored for lookupReport
+const pgsqlLookupReport = `
+	SELECT tenant, report_key, policy_domain
+	FROM report
+	WHERE id = $1 AND ($2::VARCHAR = '' OR tenant = $2)`
+
+// ReadNotes fetches the notes of a report
+func (h *Postgresql) ReadNotes(ctx context.Context, report int64) ([]Note, error) {
+	ref, err := lookupReport(ctx, h.db, pgsqlLookupReport, report)
+	if err != nil {
+		return nil, err
+	}
+	return readNotes(ctx, h.db,
+		`SELECT id, user_name, note, created
+		 FROM report_note
+		 WHERE tenant = $1 AND report_key = $2
+		 ORDER BY created, id`, ref.tenant, ref.key)
+}
+
+// WriteNote adds a note to a report
+func (h *Postgresql) WriteNote(ctx context.Context, report int64, n Note) error {
+	n, err := validNote(n)
+	if err != nil {
+		return err
+	}
+	ref, err := lookupReport(ctx, h.db, pgsqlLookupReport, report)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO report_note(tenant, report_key, user_name, note, created) VALUES ($1, $2, $3, $4, $5)`,
+		ref.tenant, ref.key, n.User, n.Text, n.Created)
+	if err != nil {
+		return fmt.Errorf("Unable to write note on report %d: %v", report, err)
+	}
+	return nil
+}
+
+// ReadDocument fetches the document a report was read from
+func (h *Postgresql) ReadDocument(ctx context.Context, id int64) (Document, error) {
+	if _, err := lookupReport(ctx, h.db, pgsqlLookupReport, id); err != nil {
+		return Document{}, err
+	}
+
+	var (
+		d        Document
+		received sql.NullTime
+	)
+	err := h.db.QueryRowContext(ctx,
+		`SELECT r.tenant, d.source, d.received, d.document
+		 FROM report_document AS d
+			JOIN report AS r ON r.id = d.rid
+		 WHERE d.rid = $1`, id).Scan(&d.Tenant, &d.Source, &received, &d.Data)
+	if err == sql.ErrNoRows {
+		return d, fmt.Errorf("Report %d has no document: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return d, fmt.Errorf("Unable to read document of report %d: %v", id, err)
+	}
+	if received.Valid {
+		d.Received = received.Time.UTC()
+	}
+	return d, nil
+}
+
+// DeleteReport deletes a report with all revisions and notes
+func (h *Postgresql) DeleteReport(ctx context.Context, id int64) error {
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to start transactions: %w", err)
+	}
+
+	rollback := func(err error) error {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("Rollback failed after failed delete: %w %v", err, rerr)
+		}
+		return err
+	}
+
+	ref, err := lookupReport(ctx, tx, pgsqlLookupReport+` FOR UPDATE`, id)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// Only the current revision is part of the daily statistics
+	var current int64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id FROM report WHERE tenant = $1 AND report_key = $2 AND NOT superseded`,
+		ref.tenant, ref.key).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return rollback(fmt.Errorf("Unable to look up current revision: %w", err))
+	}
+	if current != 0 {
+		if _, err = tx.ExecContext(ctx, pgsqlUpdateStats, current, -1); err != nil {
+			return rollback(fmt.Errorf("Unable to update daily_stats: %w", err))
+		}
+	}
+
+	for _, stmt := range []string{
+		`DELETE FROM reportrow AS rr USING report AS r WHERE r.id = rr.rid AND r.tenant = $1 AND r.report_key = $2`,
+		`DELETE FROM report WHERE tenant = $1 AND report_key = $2`,
+		`DELETE FROM report_note WHERE tenant = $1 AND report_key = $2`,
+	} {
+		if _, err = tx.ExecContext(ctx, stmt, ref.tenant, ref.key); err != nil {
+			return rollback(fmt.Errorf("Unable to delete report %d: %w", id, err))
 		}
 	}
 
-	log.Debug("Comitting transaction")
 	return tx.Commit()
 }
+
+// ReadUser fetches a local user
+func (h *Postgresql) ReadUser(ctx context.Context, name string) (User, error) {
+	return readUser(ctx, h.db, name,
+		`SELECT name, password_hash, created FROM users WHERE name = $1`, userName(name))
+}
+
+// ReadUsers fetches all local users
+func (h *Postgresql) ReadUsers(ctx context.Context) ([]User, error) {
+	return readUsers(ctx, h.db, `SELECT name, password_hash, created FROM users ORDER BY name`)
+}
+
+// WriteUser creates a local user or replaces the password
+func (h *Postgresql) WriteUser(ctx context.Context, u User) error {
+	u, err := validUser(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO users(name, password_hash) VALUES ($1, $2)
+		 ON CONFLICT (name) DO UPDATE SET password_hash = EXCLUDED.password_hash`,
+		u.Name, u.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("Unable to write user %s: %v", u.Name, err)
+	}
+	return nil
+}
+
+// DeleteUser removes a local user
+func (h *Postgresql) DeleteUser(ctx context.Context, name string) error {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM users WHERE name = $1`, userName(name))
+	if err != nil {
+		return fmt.Errorf("Unable to delete user %s: %v", name, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Unknown user %s: %w", name, ErrNotFound)
+	}
+	return nil
+}
+
+// ReadGrants fetches the grants of a user or of all users
+func (h *Postgresql) ReadGrants(ctx context.Context, user string) ([]Grant, error) {
+	return readGrants(ctx, h.db,
+		`SELECT user_name, role, scope FROM grants
+		 WHERE $1::VARCHAR = '' OR user_name = $1
+		 ORDER BY user_name, scope`, userName(user))
+}
+
+// WriteGrant adds a grant or replaces the role
+func (h *Postgresql) WriteGrant(ctx context.Context, g Grant) error {
+	g, err := validGrant(g)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO grants(user_name, scope, role) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_name, scope) DO UPDATE SET role = EXCLUDED.role`,
+		g.User, g.Scope, g.Role)
+	if err != nil {
+		return fmt.Errorf("Unable to write grant of %s: %v", g.User, err)
+	}
+	return nil
+}
+
+// DeleteGrant removes the grant of a user on a scope
+func (h *Postgresql) DeleteGrant(ctx context.Context, user, scope string) error {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM grants WHERE user_name = $1 AND scope = $2`,
+		userName(user), grantScope(scope))
+	if err != nil {
+		return fmt.Errorf("Unable to delete grant of %s: %v", user, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Unknown grant of %s on %s: %w", user, scope, ErrNotFound)
+	}
+	return nil
+}
+
+// ReadToken fetches an API token
+func (h *Postgresql) ReadToken(ctx context.Context, id string) (Token, error) {
+	return readToken(ctx, h.db, id, `SELECT `+tokenColumns+` FROM api_tokens WHERE id = $1`, id)
+}
+
+// ReadTokens fetches the API tokens of a user or all tokens
+func (h *Postgresql) ReadTokens(ctx context.Context, user string) ([]Token, error) {
+	return readTokens(ctx, h.db,
+		`SELECT `+tokenColumns+` FROM api_tokens
+		 WHERE $1::VARCHAR = '' OR user_name = $1
+		 ORDER BY created DESC`, userName(user))
+}
+
+// WriteToken stores a new API token
+func (h *Postgresql) WriteToken(ctx context.Context, t Token) error {
+	t, err := validToken(t)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.ExecContext(ctx,
+		`INSERT INTO api_tokens(id, hash, name, user_name, tenant, service, scopes, created, expires)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		t.ID, t.Hash, t.Name, t.User, t.Tenant, t.Service, strings.Join(t.Scopes, ","), t.Created, nullTime(t.Expires))
+	if err != nil {
+		return fmt.Errorf("Unable to write token %s: %v", t.ID, err)
+	}
+	return nil
+}
+
+// RevokeToken marks an API token as revoked
+func (h *Postgresql) RevokeToken(ctx context.Context, id string) error {
+	return h.updateToken(ctx, id, `UPDATE api_tokens SET revoked = true WHERE id = $1`, id)
+}
+
+// TouchToken sets the time an API token was last used
+func (h *Postgresql) TouchToken(ctx context.Context, id string, used time.Time) error {
+	return h.updateToken(ctx, id, `UPDATE api_tokens SET last_used = $2 WHERE id = $1`, id, used)
+}
+
+// updateToken runs an update of a single API token
+func (h *Postgresql) updateToken(ctx context.Context, id, query string, args ...interface{}) error {
+	res, err := h.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("Unable to update token %s: %v", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Unknown token %s: %w", id, ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PolicyState is a policy of a domain as published when the reports were
+// made. First is the begin of the first report and Last the end of the last
+type PolicyState struct {
+	Adkim, Aspf string
+	P, SP       string
+	PCT         string
+	First, Last time.Time
+	Reports     int64
+	Reporters   int64
+}
+
+// PolicyReader is implemented by drivers that read the policies seen for a
+// policy domain, oldest first. The policies are scoped to the tenant of the
+// context like the reports
+type PolicyReader interface {
+	ReadPolicies(ctx context.Context, domain string) ([]PolicyState, error)
+}
+
+// readPolicies scans the policies selected by query
+func readPolicies(ctx context.Context, db *sql.DB, query string, args []interface{}) (ps []PolicyState, err error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query policies: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p PolicyState
+		err = rows.Scan(&p.Adkim, &p.Aspf, &p.P, &p.SP, &p.PCT, &p.First, &p.Last, &p.Reports, &p.Reporters)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to scan policies: %v", err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// Sort orders for the reports list
+const (
+	SortBegin  = "begin"
+	SortEnd    = "end"
+	SortDomain = "domain"
+	SortOrg    = "org"
+	SortCount  = "count"
+)
+
+// ReportQuery filters and sorts the list of reports. Empty fields are not
+// used for filtering. The row filters (Disposition, DKIMResult, SPFResult,
+// SourceIP and HeaderFrom) must all match the same row of a report
+type ReportQuery struct {
+	PolicyDomain string
+	ReportOrg    string
+	// From and To selects the reports overlapping the period
+	From time.Time
+	To   time.Time
+
+	Disposition string
+	DKIMResult  string
+	SPFResult   string
+	// SourceIP is either an IP address or a CIDR
+	SourceIP   string
+	HeaderFrom string
+
+	Sort      string
+	Ascending bool
+
+	// Cursor selects the page next to a report using keyset pagination which
+	// is always sorted by begin date. Offset is ignored when it is set
+	Cursor   *Cursor
+	Offset   int
+	PageSize int
+
+	// tenant and scope are set by the drivers from the context
+	tenant string
+	scope  domainScope
+}
+
+// fromContext scopes the query to the tenant and domains of the context
+func (q *ReportQuery) fromContext(ctx context.Context) {
+	q.tenant = TenantFromContext(ctx)
+	q.scope = scopeFromContext(ctx)
+}
+
+// Cursor is the position of a report in the list sorted by begin date and
+// ID. A Backward cursor selects the reports before the position and a zero
+// Begin means from the end of the list
+type Cursor struct {
+	Begin    time.Time
+	ID       int64
+	Backward bool
+}
+
+// String encodes the cursor for use in a URL
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.Begin.Unix(), c.ID)
+}
+
+// ParseCursor decodes a cursor encoded by String
+func ParseCursor(v string, backward bool) (*Cursor, error) {
+	var begin, id int64
+	if _, err := fmt.Sscanf(v, "%d-%d", &begin, &id); err != nil {
+		return nil, fmt.Errorf("Invalid cursor %q", v)
+	}
+	return &Cursor{Begin: time.Unix(begin, 0), ID: id, Backward: backward}, nil
+}
+
+// descending returns true if the rows are read in descending order. A
+// backward cursor reads in the opposite order of the list
+func (q ReportQuery) descending() bool {
+	desc := !q.Ascending
+	if q.Cursor != nil && q.Cursor.Backward {
+		desc = !desc
+	}
+	return desc
+}
+
+// sortColumns maps the sort orders to the columns of the reports query
+var sortColumns = map[string]string{
+	SortBegin:  "r.report_begin",
+	SortEnd:    "r.report_end",
+	SortDomain: "lower(r.policy_domain)",
+	SortOrg:    "lower(r.report_org)",
+	SortCount:  "rowcount",
+}
+
+// orderBy returns the ORDER BY clause for the query
+func (q ReportQuery) orderBy() string {
+	column, ok := sortColumns[q.Sort]
+	if !ok || q.Cursor != nil {
+		column = sortColumns[SortBegin]
+	}
+
+	direction := "ASC"
+	if q.descending() {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s, r.id %s", column, direction, direction)
+}
+
+// network parses the source IP filter as a network. An IP address is a
+// network with a single address
+func (q ReportQuery) network() (*net.IPNet, error) {
+	v := strings.TrimSpace(q.SourceIP)
+	if strings.Contains(v, "/") {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source IP %q: %v", q.SourceIP, err)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid source IP %q", q.SourceIP)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// lastIP returns the last address of the network
+func lastIP(n *net.IPNet) net.IP {
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return last
+}
+
+// filter builds the WHERE clause for a ReportQuery. The conditions on the
+// rows of a report uses the alias fr for reportrow
+type filter struct {
+	bind  func(n int) string
+	args  []interface{}
+	where []string
+	rows  []string
+}
+
+// arg adds an argument and returns its placeholder
+func (f *filter) arg(v interface{}) string {
+	f.args = append(f.args, v)
+	return f.bind(len(f.args))
+}
+
+// in returns the condition that the column is one of the values
+func (f *filter) in(column string, values []string) string {
+	if len(values) == 0 {
+		return "1 = 0"
+	}
+	ps := make([]string, len(values))
+	for i, v := range values {
+		ps[i] = f.arg(v)
+	}
+	return column + " IN (" + strings.Join(ps, ", ") + ")"
+}
+
+// common adds the conditions that are the same for all SQL dialects
+func (f *filter) common(q ReportQuery) {
+
+	// Older revisions of a report are only shown on their own
+	f.where = append(f.where, "NOT r.superseded")
+
+	if q.tenant != "" {
+		f.where = append(f.where, "r.tenant = "+f.arg(q.tenant))
+	}
+	if q.scope.restricted {
+		f.where = append(f.where, f.in("lower(r.policy_domain)", q.scope.domains))
+	}
+
+	if q.PolicyDomain != "" {
+		f.where = append(f.where, "lower(r.policy_domain) = "+f.arg(strings.ToLower(q.PolicyDomain)))
+	}
+	if q.ReportOrg != "" {
+		f.where = append(f.where, "lower(r.report_org) = "+f.arg(strings.ToLower(q.ReportOrg)))
+	}
+	if !q.From.IsZero() {
+		f.where = append(f.where, "r.report_end >= "+f.arg(q.From.UTC()))
+	}
+	if !q.To.IsZero() {
+		f.where = append(f.where, "r.report_begin < "+f.arg(q.To.UTC()))
+	}
+
+	if q.Disposition != "" {
+		f.rows = append(f.rows, "fr.eval_disposition = "+f.arg(strings.ToLower(q.Disposition)))
+	}
+	if q.DKIMResult != "" {
+		f.rows = append(f.rows, "lower(fr.dkimresult) = "+f.arg(strings.ToLower(q.DKIMResult)))
+	}
+	if q.SPFResult != "" {
+		f.rows = append(f.rows, "lower(fr.spfresult) = "+f.arg(strings.ToLower(q.SPFResult)))
+	}
+	if q.HeaderFrom != "" {
+		f.rows = append(f.rows, "lower(fr.identifier_hfrom) = "+f.arg(strings.ToLower(q.HeaderFrom)))
+	}
+}
+
+// cursor adds the keyset condition of the query
+func (f *filter) cursor(q ReportQuery) {
+	if q.Cursor == nil || q.Cursor.Begin.IsZero() {
+		return
+	}
+
+	op := ">"
+	if q.descending() {
+		op = "<"
+	}
+	f.where = append(f.where, fmt.Sprintf("(r.report_begin, r.id) %s (%s, %s)",
+		op, f.arg(q.Cursor.Begin.UTC()), f.arg(q.Cursor.ID)))
+}
+
+// clause returns the WHERE clause including the row conditions
+func (f *filter) clause() string {
+	where := f.where
+	if len(f.rows) > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM reportrow AS fr WHERE fr.rid = r.id AND "+
+			strings.Join(f.rows, " AND ")+")")
+	}
+
+	if len(where) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(where, " AND ")
+}
+
+// reverse reverses the order of the reports read by a backward cursor
+func reverse(rs []dmarc.Report) {
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReporterCount is the number of duplicate and malformed reports received
+// from a reporter
+type ReporterCount struct {
+	Reporter   string
+	Duplicates int64
+	Malformed  int64
+}
+
+// ReporterCounter is implemented by drivers that count the duplicate and
+// malformed reports per reporter. The counts are scoped to the tenant of the
+// context and the reporters are in lower case. The counts are not kept per
+// domain so nothing is returned when the context is scoped to domains
+type ReporterCounter interface {
+	ReporterCounts(ctx context.Context) ([]ReporterCount, error)
+	// AddMalformed counts a report from the reporter that could not be read
+	AddMalformed(ctx context.Context, reporter string) error
+}
+
+// ReporterDomain summarises the reports of a reporter for a policy domain.
+// First is the begin of the first report and Last the end of the last
+type ReporterDomain struct {
+	Reporter string
+	Domain   string
+	Reports  int64
+	Messages int64
+	Rows     int64
+	First    time.Time
+	Last     time.Time
+}
+
+// ReporterReader is implemented by drivers that summarise the reports per
+// reporter and policy domain. An empty reporter reads all of them. The
+// reporters are in lower case and the summaries are scoped to the tenant of
+// the context
+type ReporterReader interface {
+	ReadReporters(ctx context.Context, reporter string) ([]ReporterDomain, error)
+}
+
+// reporters builds the query summarising the reports per reporter and policy
+// domain which is the same for all SQL dialects
+func (f *filter) reporters(q ReportQuery, org string) string {
+
+	f.common(q)
+	if org != "" {
+		f.where = append(f.where, "lower(trim(r.report_org)) = "+f.arg(reporter(org)))
+	}
+
+	return `SELECT
+			COALESCE(lower(trim(r.report_org)), ''),
+			COALESCE(lower(r.policy_domain), ''),
+			COUNT(*),
+			COALESCE(SUM(rr.messages), 0),
+			COALESCE(SUM(rr.nrows), 0),
+			MIN(r.report_begin),
+			MAX(r.report_end)
+		FROM report AS r
+		LEFT JOIN (SELECT rid, SUM(row_count) AS messages, COUNT(*) AS nrows
+			FROM reportrow GROUP BY rid) AS rr ON r.id = rr.rid
+		` + f.clause() + `
+		GROUP BY 1, 2
+		ORDER BY 1, 2`
+}
+
+// readReporters runs a query built by filter.reporters
+func readReporters(ctx context.Context, db *sql.DB, query string, args []interface{}) (rs []ReporterDomain, err error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query reporters: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r ReporterDomain
+		if err = rows.Scan(&r.Reporter, &r.Domain, &r.Reports, &r.Messages, &r.Rows, &r.First, &r.Last); err != nil {
+			return nil, fmt.Errorf("Unable to scan reporters: %v", err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, rows.Err()
+}
+
+// readReporterCounts reads the reporter, duplicates and malformed reports
+// selected by query
+func readReporterCounts(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]ReporterCount, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query reporter_stats: %v", err)
+	}
+	defer rows.Close()
+
+	var cs []ReporterCount
+	for rows.Next() {
+		var c ReporterCount
+		if err = rows.Scan(&c.Reporter, &c.Duplicates, &c.Malformed); err != nil {
+			return nil, fmt.Errorf("Unable to scan reporter_stats: %v", err)
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+// malformedReporter returns the reporter of a malformed report or an error
+// if it is unknown
+func malformedReporter(org string) (string, error) {
+	if strings.TrimSpace(org) == "" {
+		return "", fmt.Errorf("The reporter of the malformed report is unknown")
+	}
+	return reporter(org), nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// startupPings is the number of times the database is pinged before giving
+// up on startup. The wait doubles after each attempt up to maxBackoff
+const (
+	startupPings = 7
+	maxBackoff   = 30 * time.Second
+)
+
+// Pool holds the connection pool settings of the SQL drivers. Zero values
+// keeps the defaults of database/sql
+type Pool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (p Pool) apply(db *sql.DB) {
+	if p.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// Pinger is implemented by drivers that can check that the database is
+// reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Backoff returns the time to wait before attempt number n (starting at 1)
+func Backoff(n int) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	d := time.Second
+	for i := 1; i < n && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// ping waits for the database to become reachable. Only transient errors
+// are retried
+func ping(ctx context.Context, db *sql.DB) (err error) {
+	for n := 1; n <= startupPings; n++ {
+		if err = db.PingContext(ctx); err == nil || !IsTransient(err) || n == startupPings {
+			break
+		}
+
+		wait := Backoff(n)
+		log.Warnf("Database is not reachable, retrying in %v: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to reach database: %w", err)
+	}
+	return nil
+}
+
+// IsTransient returns true if the error is likely to go away by itself, like
+// a lost connection, a restarting database or a deadlock, so the operation
+// can be retried
+func IsTransient(err error) bool {
+
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var pgerr *pq.Error
+	if errors.As(err, &pgerr) {
+		switch pgerr.Code.Class() {
+		// connection_exception, insufficient_resources and operator_intervention
+		case "08", "53", "57":
+			return true
+		}
+		switch pgerr.Code {
+		// serialization_failure and deadlock_detected
+		case "40001", "40P01":
+			return true
+		}
+		return false
+	}
+
+	var myerr *mysql.MySQLError
+	if errors.As(err, &myerr) {
+		switch myerr.Number {
+		// ER_CON_COUNT_ERROR, ER_LOCK_WAIT_TIMEOUT, ER_LOCK_DEADLOCK,
+		// ER_SERVER_SHUTDOWN and ER_QUERY_INTERRUPTED
+		case 1040, 1205, 1213, 1053, 1317:
+			return true
+		}
+		return false
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
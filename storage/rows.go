@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/desdic/godmarcparser/dmarc"
+)
+
+// ReportRow is a row together with the report it belongs to. The aggregated
+// Count and results of the report are not set
+type ReportRow struct {
+	Report dmarc.Report
+	Row    dmarc.Row
+}
+
+// RowReader is implemented by drivers that read the rows across reports.
+// Only the rows matching the row filters of the query are returned, newest
+// report first and at most PageSize rows unless it is zero. Sort and the
+// pagination are ignored
+type RowReader interface {
+	ReadRows(ctx context.Context, q ReportQuery) ([]ReportRow, error)
+	// WalkRows calls fn with the rows in the order of ReadRows without
+	// holding them all in memory and stops at the first error from fn
+	WalkRows(ctx context.Context, q ReportQuery, fn func(ReportRow) error) error
+}
+
+// rowsClause returns the WHERE clause for the reports joined with their rows
+// as fr
+func (f *filter) rowsClause() string {
+	where := append(append([]string{}, f.where...), f.rows...)
+	if len(where) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(where, " AND ")
+}
+
+// rowsLimit returns the LIMIT clause of the rows query
+func (f *filter) rowsLimit(q ReportQuery) string {
+	if q.PageSize <= 0 {
+		return ""
+	}
+	return "LIMIT " + f.arg(q.PageSize)
+}
+
+// collectRows returns the rows walked by walk
+func collectRows(walk func(fn func(ReportRow) error) error) (rs []ReportRow, err error) {
+	err = walk(func(r ReportRow) error {
+		rs = append(rs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// walkRows scans the rows selected by a rows query calling fn with each
+func walkRows(ctx context.Context, db *sql.DB, query string, args []interface{}, fn func(ReportRow) error) error {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch rows: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r ReportRow
+		err = rows.Scan(&r.Report.ID,
+			&r.Report.ReportBegin,
+			&r.Report.ReportEnd,
+			&r.Report.PolicyDomain,
+			&r.Report.ReportOrg,
+			&r.Report.ReportID,
+			&r.Report.ReportEmail,
+			&r.Report.ReportExtraContactInfo,
+			&r.Report.PolicyAdkim,
+			&r.Report.PolicyAspf,
+			&r.Report.PolicyP,
+			&r.Report.PolicySP,
+			&r.Report.PolicyPCT,
+			&r.Row.SourceIP,
+			&r.Row.Count,
+			&r.Row.EvalDisposition,
+			&r.Row.EvalSPFAlign,
+			&r.Row.EvalDKIMAalign,
+			&r.Row.Reason,
+			&r.Row.DKIMDomain,
+			&r.Row.DKIMResult,
+			&r.Row.SPFDomain,
+			&r.Row.SPFResult,
+			&r.Row.IdentifierHFrom,
+		)
+		if err != nil {
+			return fmt.Errorf("Unable to scan: %v", err)
+		}
+
+		if r.Row.SPFResult == "" {
+			r.Row.SPFResult = "neutral"
+		}
+		if r.Row.DKIMResult == "" {
+			r.Row.DKIMResult = "neutral"
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Failed to fetch rows: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Dimensions of the daily statistics that can be grouped by
+const (
+	StatDay         = "day"
+	StatDomain      = "domain"
+	StatHeaderFrom  = "hfrom"
+	StatSourceIP    = "ip"
+	StatReporter    = "reporter"
+	StatDisposition = "disposition"
+	StatDKIMAlign   = "dkim"
+	StatSPFAlign    = "spf"
+)
+
+// statColumns maps the dimensions to the columns of daily_stats in the order
+// they are selected
+var statColumns = []struct{ dim, column string }{
+	{StatDay, "day"},
+	{StatDomain, "policy_domain"},
+	{StatHeaderFrom, "header_from"},
+	{StatSourceIP, "source_ip"},
+	{StatReporter, "reporter"},
+	{StatDisposition, "disposition"},
+	{StatDKIMAlign, "dkim_align"},
+	{StatSPFAlign, "spf_align"},
+}
+
+// DailyStat is the number of messages per day, policy domain, header from,
+// source IP, reporter, disposition and alignment. Dimensions that are not
+// grouped by are empty and Day is the first day of the aggregate
+type DailyStat struct {
+	Day          time.Time
+	PolicyDomain string
+	HeaderFrom   string
+	SourceIP     string
+	Reporter     string
+	Disposition  string
+	DKIMAlign    string
+	SPFAlign     string
+	Messages     int64
+}
+
+// StatsQuery filters and groups the daily statistics. Empty fields are not
+// used for filtering
+type StatsQuery struct {
+	PolicyDomain string
+	HeaderFrom   string
+	SourceIP     string
+	Reporter     string
+	Disposition  string
+	DKIMAlign    string
+	SPFAlign     string
+	// From and To are days where To is not included
+	From time.Time
+	To   time.Time
+
+	// GroupBy is the dimensions to sum the messages by
+	GroupBy []string
+	// Top returns only the Top groups with the most messages
+	Top int
+
+	// tenant and scope are set by the drivers from the context
+	tenant string
+	scope  domainScope
+}
+
+// fromContext scopes the query to the tenant and domains of the context
+func (q *StatsQuery) fromContext(ctx context.Context) {
+	q.tenant = TenantFromContext(ctx)
+	q.scope = scopeFromContext(ctx)
+}
+
+// StatsReader is implemented by drivers that maintain the daily statistics.
+// The statistics are updated when a report is written so they are not
+// affected when the reports are purged. The statistics are scoped to the
+// tenant of the context like the reports
+type StatsReader interface {
+	ReadStats(ctx context.Context, q StatsQuery) ([]DailyStat, error)
+}
+
+// grouped returns true if the query groups by the dimension
+func (q StatsQuery) grouped(dim string) bool {
+	for _, g := range q.GroupBy {
+		if g == dim {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error on unknown dimensions
+func (q StatsQuery) validate() error {
+	for _, g := range q.GroupBy {
+		found := false
+		for _, c := range statColumns {
+			if c.dim == g {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown statistics dimension %q", g)
+		}
+	}
+	return nil
+}
+
+// statsDay returns the day of t as stored in daily_stats
+func statsDay(t time.Time) time.Time {
+	u := t.UTC()
+	return time.Date(u.Year(), u.Month(), u.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// stats builds the query for the daily statistics which is the same for all
+// SQL dialects
+func (f *filter) stats(q StatsQuery) (string, error) {
+
+	if err := q.validate(); err != nil {
+		return "", err
+	}
+
+	if q.tenant != "" {
+		f.where = append(f.where, "tenant = "+f.arg(q.tenant))
+	}
+	if q.scope.restricted {
+		f.where = append(f.where, f.in("policy_domain", q.scope.domains))
+	}
+
+	for _, c := range []struct{ column, value string }{
+		{"policy_domain", q.PolicyDomain},
+		{"header_from", q.HeaderFrom},
+		{"source_ip", q.SourceIP},
+		{"reporter", q.Reporter},
+		{"disposition", q.Disposition},
+		{"dkim_align", q.DKIMAlign},
+		{"spf_align", q.SPFAlign},
+	} {
+		if c.value == "" {
+			continue
+		}
+		value := strings.ToLower(strings.TrimSpace(c.value))
+		if c.column == "reporter" {
+			f.where = append(f.where, "lower(reporter) = "+f.arg(value))
+			continue
+		}
+		f.where = append(f.where, c.column+" = "+f.arg(value))
+	}
+	if !q.From.IsZero() {
+		f.where = append(f.where, "day >= "+f.arg(statsDay(q.From).Format("2006-01-02")))
+	}
+	if !q.To.IsZero() {
+		f.where = append(f.where, "day < "+f.arg(statsDay(q.To).Format("2006-01-02")))
+	}
+
+	var columns, group []string
+	for _, c := range statColumns {
+		switch {
+		case q.grouped(c.dim):
+			columns = append(columns, c.column)
+			group = append(group, c.column)
+		case c.dim == StatDay:
+			columns = append(columns, "MIN(day)")
+		default:
+			columns = append(columns, "''")
+		}
+	}
+
+	query := "SELECT " + strings.Join(columns, ", ") + ", SUM(messages) FROM daily_stats " + f.clause()
+	if len(group) > 0 {
+		query += " GROUP BY " + strings.Join(group, ", ")
+	}
+	// Without a group there is always one row even if nothing matches
+	query += " HAVING COUNT(*) > 0"
+
+	switch {
+	case q.Top > 0:
+		query += fmt.Sprintf(" ORDER BY SUM(messages) DESC LIMIT %d", q.Top)
+	case len(group) > 0:
+		query += " ORDER BY " + strings.Join(group, ", ")
+	}
+	return query, nil
+}
+
+// readStats runs a query built by filter.stats
+func readStats(ctx context.Context, db *sql.DB, query string, args []interface{}) (stats []DailyStat, err error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query daily_stats: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s DailyStat
+		err = rows.Scan(&s.Day, &s.PolicyDomain, &s.HeaderFrom, &s.SourceIP, &s.Reporter,
+			&s.Disposition, &s.DKIMAlign, &s.SPFAlign, &s.Messages)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to scan daily_stats: %v", err)
+		}
+		s.Day = s.Day.UTC()
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -2,6 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/desdic/godmarcparser/dmarc"
 )
@@ -11,6 +16,112 @@ import (
 type Storage interface {
 	Initialize(ctx context.Context) error
 	Write(ctx context.Context, f dmarc.Feedback) error
-	ReadReports(ctx context.Context, offset int, pagesize int) ([]dmarc.Report, error)
+	ReadReports(ctx context.Context, q ReportQuery) ([]dmarc.Report, error)
+	CountReports(ctx context.Context, q ReportQuery) (int, error)
 	ReadReport(ctx context.Context, id int64) (dmarc.Rows, error)
 }
+
+// ErrNotFound is returned when a report does not exist or belongs to another
+// tenant or domain scope and when a user, grant or token does not exist
+var ErrNotFound = errors.New("not found")
+
+// IsNotFound returns true if the error is caused by a missing report
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// PurgeResult is the number of entries removed by a purge
+type PurgeResult struct {
+	Reports int64
+	Rows    int64
+	Stats   int64
+}
+
+// Purger is implemented by drivers that can expire old data. Reports ending
+// before rows are deleted while their messages stay in the daily statistics
+// until those are older than stats. A zero time keeps the data forever
+type Purger interface {
+	Purge(ctx context.Context, rows time.Time, stats time.Time) (PurgeResult, error)
+}
+
+// The allowed values of the enum-like columns as defined in RFC 7489
+var (
+	alignments   = []string{"r", "s"}
+	dispositions = []string{"none", "quarantine", "reject"}
+	evaluations  = []string{"pass", "fail"}
+)
+
+// normalize lower cases v and returns an empty string unless it is one of the
+// allowed values
+func normalize(v string, allowed ...string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	return ""
+}
+
+// percentage returns the pct as an integer or nil if it is not a number
+func percentage(v string) interface{} {
+	pct, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return nil
+	}
+	return pct
+}
+
+// ipaddress returns nil if v is not a valid IP address
+func ipaddress(v string) interface{} {
+	ip := net.ParseIP(strings.TrimSpace(v))
+	if ip == nil {
+		return nil
+	}
+	return ip.String()
+}
+
+// feedbackRows flattens the records of a feedback into normalized rows
+func feedbackRows(f dmarc.Feedback) []dmarc.Row {
+
+	var rows []dmarc.Row
+	for _, r := range f.Records {
+		for _, rw := range r.Rows {
+
+			var (
+				dkimdomain, dkimresult string
+				spfdomain, spfresult   string
+			)
+
+			if len(r.AuthResults.SPF) == 1 {
+				spfdomain = f.PolicyPublished.Domain
+				spfresult = r.AuthResults.SPF[0].Result
+			}
+
+			if len(r.AuthResults.DKIM) == 1 {
+				dkimdomain = f.PolicyPublished.Domain
+				dkimresult = r.AuthResults.DKIM[0].Result
+			}
+
+			var reasons []string
+			for _, rs := range rw.PolicyEvaluated.Reasons {
+				reasons = append(reasons, rs.Type)
+			}
+
+			rows = append(rows, dmarc.Row{
+				SourceIP:        strings.TrimSpace(rw.SourceIP),
+				Count:           rw.Count,
+				EvalDisposition: normalize(rw.PolicyEvaluated.Disposition, dispositions...),
+				EvalSPFAlign:    normalize(rw.PolicyEvaluated.SPF, evaluations...),
+				EvalDKIMAalign:  normalize(rw.PolicyEvaluated.DKIM, evaluations...),
+				Reason:          strings.Join(reasons, ","),
+				DKIMDomain:      dkimdomain,
+				DKIMResult:      strings.ToLower(strings.TrimSpace(dkimresult)),
+				SPFDomain:       spfdomain,
+				SPFResult:       strings.ToLower(strings.TrimSpace(spfresult)),
+				IdentifierHFrom: r.Identifiers.HeaderFrom,
+			})
+		}
+	}
+	return rows
+}
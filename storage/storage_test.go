@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestNormalize(t *testing.T) {
+
+	tt := []struct {
+		name     string
+		value    string
+		allowed  []string
+		expected string
+	}{
+		{"lowercase", "none", dispositions, "none"},
+		{"uppercase", " Quarantine", dispositions, "quarantine"},
+		{"unknown", "discard", dispositions, ""},
+		{"empty", "", alignments, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if v := normalize(tc.value, tc.allowed...); v != tc.expected {
+				t.Errorf("Expected %q but got %q", tc.expected, v)
+			}
+		})
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+
+	if v := percentage("100"); v != 100 {
+		t.Errorf("Expected 100 but got %#v", v)
+	}
+	if v := percentage("all"); v != nil {
+		t.Errorf("Expected nil but got %#v", v)
+	}
+	if v := ipaddress("2001:DB8::1"); v != "2001:db8::1" {
+		t.Errorf("Expected 2001:db8::1 but got %#v", v)
+	}
+	if v := ipaddress("10.0.0.256"); v != nil {
+		t.Errorf("Expected nil but got %#v", v)
+	}
+}
+
+func TestStatsQuery(t *testing.T) {
+	f := &filter{bind: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	query, err := f.stats(StatsQuery{
+		PolicyDomain: "Example.com",
+		From:         time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		GroupBy:      []string{StatSourceIP},
+		Top:          10,
+	})
+	if err != nil {
+		t.Fatalf("Unable to build query: %v", err)
+	}
+
+	expected := "SELECT MIN(day), '', '', source_ip, '', '', '', '', SUM(messages) FROM daily_stats " +
+		"WHERE policy_domain = $1 AND day >= $2 GROUP BY source_ip HAVING COUNT(*) > 0 " +
+		"ORDER BY SUM(messages) DESC LIMIT 10"
+	if query != expected {
+		t.Errorf("Expected %q got %q", expected, query)
+	}
+	if len(f.args) != 2 || f.args[0] != "example.com" || f.args[1] != "2024-01-01" {
+		t.Errorf("Unexpected arguments %#v", f.args)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+
+	tt := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"badconn", driver.ErrBadConn, true},
+		{"wrapped", fmt.Errorf("Unable to start transactions: %w", driver.ErrBadConn), true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"pg_shutdown", &pq.Error{Code: "57P01"}, true},
+		{"pg_connection", &pq.Error{Code: "08006"}, true},
+		{"pg_deadlock", &pq.Error{Code: "40P01"}, true},
+		{"pg_syntax", &pq.Error{Code: "42601"}, false},
+		{"pg_unique", fmt.Errorf("Failed to execute query: %w", &pq.Error{Code: "23505"}), false},
+		{"mysql_deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql_invalid", mysql.ErrInvalidConn, true},
+		{"mysql_duplicate", &mysql.MySQLError{Number: 1062}, false},
+		{"canceled", context.Canceled, false},
+		{"other", fmt.Errorf("Invalid id returned: 0"), false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsTransient(tc.err); got != tc.transient {
+				t.Errorf("Expected %v got %v", tc.transient, got)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for n, expected := range map[int]time.Duration{
+		0: 0,
+		1: time.Second,
+		2: 2 * time.Second,
+		5: 16 * time.Second,
+		6: 30 * time.Second,
+		9: 30 * time.Second,
+	} {
+		if got := Backoff(n); got != expected {
+			t.Errorf("Expected backoff %v for attempt %d got %v", expected, n, got)
+		}
+	}
+}
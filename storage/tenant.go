@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"strings"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context that scopes the storage to a tenant. Reports
+// written with the context belongs to the tenant and only the data of the
+// tenant is read
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the context. An empty tenant means
+// that the storage is not scoped
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+type domainsKey struct{}
+
+// domainScope is the policy domains the storage is scoped to
+type domainScope struct {
+	restricted bool
+	domains    []string
+}
+
+// allows returns true if the policy domain is in the scope
+func (d domainScope) allows(domain string) bool {
+	if !d.restricted {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	for _, v := range d.domains {
+		if v == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDomains returns a context that scopes the storage to the policy
+// domains within the tenant. Only the reports and statistics of the domains
+// are read so an empty list reads nothing
+func WithDomains(ctx context.Context, domains []string) context.Context {
+	scope := domainScope{restricted: true}
+	for _, d := range domains {
+		scope.domains = append(scope.domains, strings.ToLower(strings.TrimSpace(d)))
+	}
+	return context.WithValue(ctx, domainsKey{}, scope)
+}
+
+// DomainsFromContext returns the policy domains of the context and false if
+// the storage is not scoped to domains
+func DomainsFromContext(ctx context.Context) ([]string, bool) {
+	scope := scopeFromContext(ctx)
+	return scope.domains, scope.restricted
+}
+
+// scopeFromContext returns the domain scope of the context
+func scopeFromContext(ctx context.Context) domainScope {
+	scope, _ := ctx.Value(domainsKey{}).(domainScope)
+	return scope
+}
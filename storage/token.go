@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token is an API token. Only the hash of the secret is stored and the token
+// is found by its ID. Service tokens belong to a service instead of a person
+// and a zero Expires never expires. The token is only valid on the hosts of
+// the Tenant it was created for
+type Token struct {
+	ID       string
+	Hash     string
+	Name     string
+	User     string
+	Tenant   string
+	Service  bool
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+	Revoked  bool
+}
+
+// TokenStore is implemented by drivers that store API tokens. The tokens of
+// all tenants are read. ReadToken, RevokeToken and TouchToken returns
+// ErrNotFound if the token does not exist
+type TokenStore interface {
+	ReadToken(ctx context.Context, id string) (Token, error)
+	// ReadTokens fetches the tokens of a user or all tokens if user is
+	// empty, newest first
+	ReadTokens(ctx context.Context, user string) ([]Token, error)
+	WriteToken(ctx context.Context, t Token) error
+	RevokeToken(ctx context.Context, id string) error
+	// TouchToken sets the time the token was last used
+	TouchToken(ctx context.Context, id string, used time.Time) error
+}
+
+// validToken returns the token with the user normalised or an error if it
+// cannot be stored
+func validToken(t Token) (Token, error) {
+	t.User = userName(t.User)
+	if t.ID == "" || t.Hash == "" {
+		return t, fmt.Errorf("The token has no ID or hash")
+	}
+	if t.User == "" {
+		return t, fmt.Errorf("The token %s has no user", t.ID)
+	}
+	if len(t.Scopes) == 0 {
+		return t, fmt.Errorf("The token %s has no scopes", t.ID)
+	}
+	if t.Created.IsZero() {
+		t.Created = time.Now().UTC()
+	}
+	return t, nil
+}
+
+// nullTime returns NULL for the zero time
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// readTokens reads the tokens selected by query
+func readTokens(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Token, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query tokens: %v", err)
+	}
+	defer rows.Close()
+
+	var ts []Token
+	for rows.Next() {
+		var (
+			t                Token
+			scopes           string
+			expires, lastUse sql.NullTime
+		)
+		if err = rows.Scan(&t.ID, &t.Hash, &t.Name, &t.User, &t.Tenant, &t.Service, &scopes, &t.Created, &expires, &lastUse, &t.Revoked); err != nil {
+			return nil, fmt.Errorf("Unable to scan tokens: %v", err)
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		t.Expires, t.LastUsed = expires.Time, lastUse.Time
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+// readToken reads a single token selected by query
+func readToken(ctx context.Context, db *sql.DB, id, query string, args ...interface{}) (Token, error) {
+	ts, err := readTokens(ctx, db, query, args...)
+	if err != nil {
+		return Token{}, err
+	}
+	if len(ts) == 0 {
+		return Token{}, fmt.Errorf("Unknown token %s: %w", id, ErrNotFound)
+	}
+	return ts[0], nil
+}
+
+// tokenColumns are the columns read by readTokens
+const tokenColumns = `id, hash, name, user_name, tenant, service, scopes, created, expires, last_used, revoked`
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// User is a local user of the web interface with a bcrypt hash of the
+// password
+type User struct {
+	Name         string
+	PasswordHash string
+	Created      time.Time
+}
+
+// UserStore is implemented by drivers that store the local users. The users
+// are shared by all tenants and the names are in lower case. ReadUser returns
+// ErrNotFound if the user does not exist
+type UserStore interface {
+	ReadUser(ctx context.Context, name string) (User, error)
+	ReadUsers(ctx context.Context) ([]User, error)
+	// WriteUser creates the user or replaces the password of an existing one
+	WriteUser(ctx context.Context, u User) error
+	DeleteUser(ctx context.Context, name string) error
+}
+
+// userName normalises the name of a user
+func userName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// validUser returns the user with the name normalised or an error if it
+// cannot be stored
+func validUser(u User) (User, error) {
+	u.Name = userName(u.Name)
+	if u.Name == "" {
+		return u, fmt.Errorf("The user has no name")
+	}
+	if u.PasswordHash == "" {
+		return u, fmt.Errorf("The user %s has no password", u.Name)
+	}
+	return u, nil
+}
+
+// readUsers reads the name, password hash and creation time of the users
+// selected by query
+func readUsers(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]User, error) {
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query users: %v", err)
+	}
+	defer rows.Close()
+
+	var us []User
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.Name, &u.PasswordHash, &u.Created); err != nil {
+			return nil, fmt.Errorf("Unable to scan users: %v", err)
+		}
+		us = append(us, u)
+	}
+	return us, rows.Err()
+}
+
+// readUser reads a single user selected by query
+func readUser(ctx context.Context, db *sql.DB, name, query string, args ...interface{}) (User, error) {
+	us, err := readUsers(ctx, db, query, args...)
+	if err != nil {
+		return User{}, err
+	}
+	if len(us) == 0 {
+		return User{}, fmt.Errorf("Unknown user %s: %w", name, ErrNotFound)
+	}
+	return us[0], nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// tenantRouter maps reports and requests to the configured tenants. Without
+// tenants nothing is scoped
+type tenantRouter struct {
+	tenants []cfg.TenantCfg
+}
+
+// enabled returns true if any tenants are configured
+func (t *tenantRouter) enabled() bool {
+	return t != nil && len(t.tenants) > 0
+}
+
+// forReport returns the tenant owning the policy domain or a parent of it.
+// If no tenant owns the domain the tenant of the mailbox the file was found
+// in is used
+func (t *tenantRouter) forReport(domain, file string) string {
+	if !t.enabled() {
+		return ""
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+
+	owner, longest := "", 0
+	for _, tc := range t.tenants {
+		for _, d := range tc.Domains {
+			if (domain == d || strings.HasSuffix(domain, "."+d)) && len(d) > longest {
+				owner, longest = tc.Name, len(d)
+			}
+		}
+	}
+	if owner != "" {
+		return owner
+	}
+
+	dir := filepath.Clean(filepath.Dir(file))
+	for _, tc := range t.tenants {
+		for _, m := range tc.Mailboxes {
+			if filepath.Clean(m) == dir {
+				return tc.Name
+			}
+		}
+	}
+	return ""
+}
+
+// forRequest returns the tenant of the host the request was made to. It
+// returns false if tenants are configured but none of them has the host
+func (t *tenantRouter) forRequest(r *http.Request) (string, bool) {
+	if !t.enabled() {
+		return "", true
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, tc := range t.tenants {
+		for _, h := range tc.Hosts {
+			if h == host {
+				return tc.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// mailboxes returns the directories of all tenants
+func (t *tenantRouter) mailboxes() (dirs []string) {
+	if t == nil {
+		return nil
+	}
+	for _, tc := range t.tenants {
+		dirs = append(dirs, tc.Mailboxes...)
+	}
+	return dirs
+}
+
+// tenantContext scopes the storage to the tenant of the request
+func tenantContext(ctx context.Context, r *http.Request) (context.Context, bool) {
+	tenant, ok := tenants.forRequest(r)
+	if !ok {
+		return ctx, false
+	}
+	if tenant == "" {
+		return ctx, true
+	}
+	return storage.WithTenant(ctx, tenant), true
+}
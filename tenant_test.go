@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func testTenants() *tenantRouter {
+	return &tenantRouter{tenants: []cfg.TenantCfg{
+		{Name: "acme", Domains: []string{"acme.com"}, Mailboxes: []string{"/mail/acme/"}, Hosts: []string{"dmarc.acme.com"}},
+		{Name: "greyhat", Domains: []string{"greyhat.dk"}, Hosts: []string{"dmarc.greyhat.dk"}},
+		{Name: "mail", Domains: []string{"mail.acme.com"}},
+	}}
+}
+
+func TestTenantForReport(t *testing.T) {
+	r := testTenants()
+
+	tt := []struct {
+		name     string
+		domain   string
+		file     string
+		expected string
+	}{
+		{"domain", "Acme.com", "/files/report.xml", "acme"},
+		{"subdomain", "www.acme.com.", "/files/report.xml", "acme"},
+		{"longest", "smtp.mail.acme.com", "/files/report.xml", "mail"},
+		{"suffix", "notacme.com", "/files/report.xml", ""},
+		{"mailbox", "example.com", "/mail/acme/report.xml.gz", "acme"},
+		{"domain_before_mailbox", "greyhat.dk", "/mail/acme/report.xml", "greyhat"},
+		{"unknown", "example.com", "/files/report.xml", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := r.forReport(tc.domain, tc.file); got != tc.expected {
+				t.Errorf("Expected tenant %q got %q", tc.expected, got)
+			}
+		})
+	}
+
+	var none *tenantRouter
+	if got := none.forReport("acme.com", "/mail/acme/report.xml"); got != "" {
+		t.Errorf("Expected no tenant got %q", got)
+	}
+}
+
+func TestTenantHandlers(t *testing.T) {
+
+	ctx := setupMemory(t)
+	tenants = testTenants()
+
+	// Store the report again routed to its tenant
+	b, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	f, err := dmarc.Read(b)
+	if err != nil {
+		t.Fatalf("Unable to parse report: %v", err)
+	}
+	s = &storage.Memory{}
+	tenant := tenants.forReport(f.PolicyPublished.Domain, "/files/valid.xml")
+	if err := s.Write(storage.WithTenant(ctx, tenant), f); err != nil {
+		t.Fatalf("Unable to store report: %v", err)
+	}
+
+	tt := []struct {
+		name   string
+		host   string
+		path   string
+		status int
+		found  bool
+	}{
+		{"owner", "dmarc.greyhat.dk", "/reports", http.StatusOK, true},
+		{"owner_port", "DMARC.greyhat.dk:8080", "/reports", http.StatusOK, true},
+		{"other", "dmarc.acme.com", "/reports", http.StatusOK, false},
+		{"other_report", "dmarc.acme.com", "/report/1", http.StatusNotFound, false},
+		{"unknown", "localhost", "/reports", http.StatusNotFound, false},
+	}
+
+	h := httpHandler(ctx)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Host = tc.host
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d", tc.status, w.Code)
+			}
+			if found := strings.Contains(w.Body.String(), "myid123"); found != tc.found && tc.status == http.StatusOK {
+				t.Errorf("Expected report to be found %v:\n%s", tc.found, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTenantIdentity(t *testing.T) {
+
+	ctx := setupMemory(t)
+	tenants = testTenants()
+	t.Cleanup(func() { tenants = nil })
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "local", SessionTTL: 3600, DefaultRole: "none"}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	if err = s.(storage.GrantStore).WriteGrant(ctx, storage.Grant{User: "root", Role: "admin", Scope: "*"}); err != nil {
+		t.Fatalf("Unable to write grant: %v", err)
+	}
+	if err = s.(storage.UserStore).WriteUser(ctx, storage.User{Name: "root", PasswordHash: "x"}); err != nil {
+		t.Fatalf("Unable to write user: %v", err)
+	}
+
+	// The session and token are issued on the hosts of acme
+	session, err := auth.sessions.create("root", "acme")
+	if err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+	cookie := &http.Cookie{Name: sessionCookie, Value: session}
+
+	tk, raw, err := newToken("root", "", false, []string{scopeRead}, 0)
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+	tk.Tenant = "acme"
+	if err = s.(storage.TokenStore).WriteToken(ctx, tk); err != nil {
+		t.Fatalf("Unable to write token: %v", err)
+	}
+
+	tt := []struct {
+		name   string
+		host   string
+		path   string
+		token  bool
+		status int
+	}{
+		{"session", "dmarc.acme.com", "/reports", false, http.StatusOK},
+		{"session_other", "dmarc.greyhat.dk", "/reports", false, http.StatusSeeOther},
+		{"token", "dmarc.acme.com", "/api/v1/reports", true, http.StatusOK},
+		{"token_other", "dmarc.greyhat.dk", "/api/v1/reports", true, http.StatusForbidden},
+	}
+
+	h := httpHandler(ctx)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Host = tc.host
+			if tc.token {
+				req.Header.Set("Authorization", "Bearer "+raw)
+			} else {
+				req.AddCookie(cookie)
+			}
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
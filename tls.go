@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves a certificate and key pair. The files are read again
+// when they change so renewed certificates are used without a restart
+type certReloader struct {
+	cert string
+	key  string
+
+	mu       sync.Mutex
+	certTime time.Time
+	keyTime  time.Time
+	current  *tls.Certificate
+}
+
+// loadCertificate reads a certificate and its key
+func loadCertificate(cert, key string) (*certReloader, error) {
+	if cert == "" || key == "" {
+		return nil, fmt.Errorf("Both a certificate and a key are needed")
+	}
+	c := &certReloader{cert: cert, key: key}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files if they have changed since they were last read
+func (c *certReloader) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfi, err := os.Stat(c.cert)
+	if err != nil {
+		return fmt.Errorf("Unable to stat %s: %v", c.cert, err)
+	}
+	kfi, err := os.Stat(c.key)
+	if err != nil {
+		return fmt.Errorf("Unable to stat %s: %v", c.key, err)
+	}
+	if c.current != nil && cfi.ModTime().Equal(c.certTime) && kfi.ModTime().Equal(c.keyTime) {
+		return nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return fmt.Errorf("Unable to load %s and %s: %v", c.cert, c.key, err)
+	}
+	if c.current != nil {
+		log.Infof("Reloaded certificate %s", c.cert)
+	}
+	c.current = &pair
+	c.certTime = cfi.ModTime()
+	c.keyTime = kfi.ModTime()
+	return nil
+}
+
+// getCertificate returns the certificate for a handshake. The last good
+// certificate is kept if the files cannot be read again
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		log.Warnf("Keeping the current certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current, nil
+}
+
+// tlsConfig returns the TLS configuration of the web server
+func tlsConfig(c cfg.TLSCfg) (*tls.Config, error) {
+	certs, err := loadCertificate(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if c.MinVersion == "1.3" {
+		tc.MinVersion = tls.VersionTLS13
+	}
+
+	switch c.ClientAuth {
+	case "", "none":
+		return tc, nil
+	case "optional":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown client auth %s", c.ClientAuth)
+	}
+
+	if c.ClientCA == "" {
+		return nil, fmt.Errorf("Client certificates need a CA bundle to be verified against")
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %v", c.ClientCA, err)
+	}
+	tc.ClientCAs = x509.NewCertPool()
+	if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", c.ClientCA)
+	}
+	return tc, nil
+}
+
+// clientCertUser returns the user of a client certificate from its common
+// name or first email address
+func clientCertUser(cert *x509.Certificate, field string) string {
+	switch field {
+	case "cn":
+		return strings.TrimSpace(cert.Subject.CommonName)
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return strings.ToLower(strings.TrimSpace(cert.EmailAddresses[0]))
+		}
+	}
+	return ""
+}
+
+// certUser returns the user of the verified client certificate of the
+// request
+func (a *authenticator) certUser(r *http.Request) (string, bool) {
+	if a.clientUser == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	user := clientCertUser(r.TLS.VerifiedChains[0][0], a.clientUser)
+	return user, user != ""
+}
+
+// redirectHandler sends plain HTTP requests to the same page over HTTPS on
+// the port of the web server
+func redirectHandler(port string) http.Handler {
+	_, p, _ := net.SplitHostPort(port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if p != "" && p != "443" {
+			host = net.JoinHostPort(host, p)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+// testCert is a certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate signed by the parent or self signed if
+// the parent is nil
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %v", err)
+	}
+	return testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files
+func (c testCert) write(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatalf("Unable to write certificate: %v", err)
+	}
+	if keyPath == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unable to write key: %v", err)
+	}
+}
+
+func newTestCA(t *testing.T) testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func TestCertReloader(t *testing.T) {
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "first"}}, nil)
+	first.write(t, certPath, keyPath)
+
+	c, err := loadCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %v", err)
+	}
+	leaf := func() string {
+		cert, err := c.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("Unable to get certificate: %v", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Unable to parse certificate: %v", err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if cn := leaf(); cn != "first" {
+		t.Errorf("Expected first but got %s", cn)
+	}
+
+	// A renewed certificate is used without a restart
+	second := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "second"}}, nil)
+	second.write(t, certPath, keyPath)
+	future := time.Now().Add(time.Hour)
+	for _, p := range []string{certPath, keyPath} {
+		if err = os.Chtimes(p, future, future); err != nil {
+			t.Fatalf("Unable to touch %s: %v", p, err)
+		}
+	}
+	if cn := leaf(); cn != "second" {
+		t.Errorf("Expected second but got %s", cn)
+	}
+
+	// A broken certificate keeps the last good one
+	if err = os.WriteFile(keyPath, []byte("broken"), 0600); err != nil {
+		t.Fatalf("Unable to write key: %v", err)
+	}
+	future = future.Add(time.Hour)
+	if err = os.Chtimes(keyPath, future, future); err != nil {
+		t.Fatalf("Unable to touch key: %v", err)
+	}
+	if cn := leaf(); cn != "second" {
+		t.Errorf("Expected second to be kept but got %s", cn)
+	}
+
+	if _, err = loadCertificate(certPath, ""); err == nil {
+		t.Error("A certificate without a key should fail")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCA(t)
+	ca.write(t, caPath, "")
+	newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}}, &ca).write(t, certPath, keyPath)
+
+	tt := []struct {
+		name       string
+		c          cfg.TLSCfg
+		fail       bool
+		minVersion uint16
+		clientAuth tls.ClientAuthType
+	}{
+		{"plain", cfg.TLSCfg{Cert: certPath, Key: keyPath, MinVersion: "1.2", ClientAuth: "none"}, false, tls.VersionTLS12, tls.NoClientCert},
+		{"tls13", cfg.TLSCfg{Cert: certPath, Key: keyPath, MinVersion: "1.3"}, false, tls.VersionTLS13, tls.NoClientCert},
+		{"optional", cfg.TLSCfg{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: "optional"}, false, tls.VersionTLS12, tls.VerifyClientCertIfGiven},
+		{"require", cfg.TLSCfg{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: "require"}, false, tls.VersionTLS12, tls.RequireAndVerifyClientCert},
+		{"no_ca", cfg.TLSCfg{Cert: certPath, Key: keyPath, ClientAuth: "require"}, true, 0, 0},
+		{"bad_ca", cfg.TLSCfg{Cert: certPath, Key: keyPath, ClientCA: keyPath, ClientAuth: "require"}, true, 0, 0},
+		{"missing_cert", cfg.TLSCfg{Cert: filepath.Join(dir, "missing.pem"), Key: keyPath}, true, 0, 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := tlsConfig(tc.c)
+			if tc.fail {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unable to set up TLS: %v", err)
+			}
+			if c.MinVersion != tc.minVersion {
+				t.Errorf("Expected minimum version %x but got %x", tc.minVersion, c.MinVersion)
+			}
+			if c.ClientAuth != tc.clientAuth {
+				t.Errorf("Expected client auth %v but got %v", tc.clientAuth, c.ClientAuth)
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCA(t)
+	ca.write(t, caPath, "")
+	newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca).write(t, certPath, keyPath)
+
+	tc, err := tlsConfig(cfg.TLSCfg{Cert: certPath, Key: keyPath, ClientCA: caPath, ClientAuth: "optional"})
+	if err != nil {
+		t.Fatalf("Unable to set up TLS: %v", err)
+	}
+
+	oldAuth := auth
+	defer func() { auth = oldAuth }()
+	auth = &authenticator{sessions: &sessionStore{ttl: time.Hour}, clientUser: "email"}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth.user(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, user)
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := func(certs ...testCert) *http.Client {
+		var pairs []tls.Certificate
+		for _, c := range certs {
+			pairs = append(pairs, tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key})
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: pairs}}}
+	}
+	clientTmpl := func(cn string, emails ...string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:        pkix.Name{CommonName: cn},
+			EmailAddresses: emails,
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+
+	tt := []struct {
+		name   string
+		client *http.Client
+		status int
+		user   string
+	}{
+		{"no_certificate", client(), http.StatusUnauthorized, ""},
+		{"email", client(newTestCert(t, clientTmpl("Alice", "Alice@Example.com"), &ca)), http.StatusOK, "alice@example.com"},
+		{"no_email", client(newTestCert(t, clientTmpl("Bob"), &ca)), http.StatusUnauthorized, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := tc.client.Get("https://" + ln.Addr().String() + "/")
+			if err != nil {
+				t.Fatalf("Unable to get page: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.status {
+				t.Errorf("Expected status %d but got %d", tc.status, resp.StatusCode)
+			}
+			if string(body) != tc.user {
+				t.Errorf("Expected user %q but got %q", tc.user, body)
+			}
+		})
+	}
+
+	// Certificates from other CAs are refused during the handshake
+	other := newTestCA(t)
+	if _, err = client(newTestCert(t, clientTmpl("Mallory", "mallory@example.com"), &other)).Get("https://" + ln.Addr().String() + "/"); err == nil {
+		t.Error("A certificate from another CA should be refused")
+	}
+}
+
+func TestCertificateForms(t *testing.T) {
+
+	ctx := setupMemory(t)
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "certificate", SessionTTL: 3600, DefaultRole: "none"}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	if err = s.(storage.GrantStore).WriteGrant(ctx, storage.Grant{User: "carol", Role: "admin", Scope: "*"}); err != nil {
+		t.Fatalf("Unable to write grant: %v", err)
+	}
+
+	// Certificate users have no session cookie
+	cert := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}, nil)
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.cert}}}
+	csrf := csrfToken(&http.Request{TLS: state})
+	if csrf == "" {
+		t.Fatal("Expected a form token for the certificate user")
+	}
+
+	tt := []struct {
+		name     string
+		method   string
+		path     string
+		form     url.Values
+		status   int
+		contains string
+	}{
+		{"note", http.MethodPost, "/report/1", url.Values{"csrf": {csrf}, "action": {"note"}, "note": {"Checked"}}, http.StatusSeeOther, ""},
+		{"no_token", http.MethodPost, "/report/1", url.Values{"action": {"note"}, "note": {"Checked"}}, http.StatusBadRequest, "form is not valid"},
+		{"grant", http.MethodPost, "/admin/users", url.Values{"csrf": {csrf}, "action": {"grant"}, "user": {"vera"}, "role": {"viewer"}, "scope": {"greyhat.dk"}}, http.StatusSeeOther, ""},
+		{"logout_page", http.MethodGet, "/logout", nil, http.StatusOK, csrf},
+	}
+
+	h := httpHandler(ctx)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.form != nil {
+				req = httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.TLS = state
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected response to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+
+	tt := []struct {
+		port, host, uri, expected string
+	}{
+		{":443", "dmarc.example.com", "/domain/example.com?q=1", "https://dmarc.example.com/domain/example.com?q=1"},
+		{":443", "dmarc.example.com:80", "/", "https://dmarc.example.com/"},
+		{":8443", "dmarc.example.com:8080", "/login", "https://dmarc.example.com:8443/login"},
+		{":8443", "[::1]", "/", "https://[::1]:8443/"},
+	}
+
+	for _, tc := range tt {
+		r := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		redirectHandler(tc.port).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("Expected %d but got %d", http.StatusMovedPermanently, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != tc.expected {
+			t.Errorf("Expected %s but got %s", tc.expected, loc)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenPrefix starts every API token so leaked tokens are easy to find
+	tokenPrefix = "gdp_"
+	// servicePrefix is the user of service tokens that roles are granted to
+	servicePrefix = "service:"
+	// tokenTouch is how often the last use of a token is written
+	tokenTouch = time.Minute
+)
+
+// The scopes of an API token
+const (
+	scopeRead   = "read"
+	scopeUpload = "upload"
+	scopeAdmin  = "admin"
+	// scopeMetrics can read the metrics of all tenants
+	scopeMetrics = "metrics"
+)
+
+// tokenScopes are the scopes a token can have
+var tokenScopes = []string{scopeRead, scopeUpload, scopeAdmin, scopeMetrics}
+
+// errInvalidToken is returned for unknown, revoked and expired tokens
+var errInvalidToken = fmt.Errorf("Invalid or expired token")
+
+// hashToken returns the hash of a token as stored. Tokens are long random
+// strings so a fast hash is enough
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a token for the user or service with the secret that is
+// only shown once. A zero ttl never expires
+func newToken(user, name string, service bool, scopes []string, ttl time.Duration) (storage.Token, string, error) {
+
+	user = strings.ToLower(strings.TrimSpace(user))
+	if user == "" {
+		return storage.Token{}, "", fmt.Errorf("The token needs a user or service")
+	}
+	if service {
+		user = servicePrefix + strings.TrimPrefix(user, servicePrefix)
+	}
+	if len(scopes) == 0 {
+		return storage.Token{}, "", fmt.Errorf("The token needs at least one scope")
+	}
+	for _, sc := range scopes {
+		if !hasScope(tokenScopes, sc) {
+			return storage.Token{}, "", fmt.Errorf("Unknown scope %q, use %s", sc, strings.Join(tokenScopes, ", "))
+		}
+	}
+
+	id, err := randomToken(8)
+	if err != nil {
+		return storage.Token{}, "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return storage.Token{}, "", err
+	}
+	raw := tokenPrefix + id + "_" + secret
+
+	now := time.Now().UTC()
+	t := storage.Token{
+		ID:      id,
+		Hash:    hashToken(raw),
+		Name:    strings.TrimSpace(name),
+		User:    user,
+		Service: service,
+		Scopes:  scopes,
+		Created: now,
+	}
+	if ttl > 0 {
+		t.Expires = now.Add(ttl)
+	}
+	return t, raw, nil
+}
+
+// hasScope returns true if the scope is in scopes
+func hasScope(scopes []string, scope string) bool {
+	for _, sc := range scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// bearer returns the token of the Authorization header of the request and
+// false if there is none. Unknown, revoked and expired tokens returns
+// errInvalidToken
+func (a *authenticator) bearer(ctx context.Context, r *http.Request) (storage.Token, bool, error) {
+
+	h := r.Header.Get("Authorization")
+	if a == nil || h == "" {
+		return storage.Token{}, false, nil
+	}
+
+	raw := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	id := strings.SplitN(strings.TrimPrefix(raw, tokenPrefix), "_", 2)[0]
+	if !strings.HasPrefix(h, "Bearer ") || !strings.HasPrefix(raw, tokenPrefix) || id == "" {
+		return storage.Token{}, true, errInvalidToken
+	}
+
+	ts, ok := s.(storage.TokenStore)
+	if !ok {
+		return storage.Token{}, true, errInvalidToken
+	}
+	t, err := ts.ReadToken(ctx, id)
+	if storage.IsNotFound(err) {
+		return storage.Token{}, true, errInvalidToken
+	}
+	if err != nil {
+		return storage.Token{}, true, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(raw))) != 1 ||
+		t.Revoked || (!t.Expires.IsZero() && now.After(t.Expires)) {
+		log.Warnf("Rejected token %s from %s", id, r.RemoteAddr)
+		return storage.Token{}, true, errInvalidToken
+	}
+
+	if now.Sub(t.LastUsed) > tokenTouch {
+		if err = ts.TouchToken(ctx, id, now.UTC()); err != nil {
+			log.Errorf("Unable to update last use of token %s: %v", id, err)
+		}
+	}
+	return t, true, nil
+}
+
+// apiToken is a token in the API without its hash
+type apiToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	User     string     `json:"user"`
+	Tenant   string     `json:"tenant,omitempty"`
+	Service  bool       `json:"service"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Revoked  bool       `json:"revoked"`
+}
+
+// optionalTime returns nil for the zero time
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newAPIToken(t storage.Token) apiToken {
+	return apiToken{
+		ID:       t.ID,
+		Name:     t.Name,
+		User:     t.User,
+		Tenant:   t.Tenant,
+		Service:  t.Service,
+		Scopes:   t.Scopes,
+		Created:  t.Created,
+		Expires:  optionalTime(t.Expires),
+		LastUsed: optionalTime(t.LastUsed),
+		Revoked:  t.Revoked,
+	}
+}
+
+func handleAPITokens(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if !isAdmin(ctx) {
+		writeError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+	ts, ok := s.(storage.TokenStore)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "The storage driver does not support API tokens")
+		return
+	}
+
+	tokens, err := ts.ReadTokens(ctx, r.URL.Query().Get("user"))
+	if err != nil {
+		errors <- err
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	list := struct {
+		Tokens []apiToken `json:"tokens"`
+	}{Tokens: make([]apiToken, 0, len(tokens))}
+	for _, t := range tokens {
+		list.Tokens = append(list.Tokens, newAPIToken(t))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleAPIRevokeToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if !isAdmin(ctx) {
+		writeError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+	ts, ok := s.(storage.TokenStore)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "The storage driver does not support API tokens")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	err := ts.RevokeToken(ctx, id)
+	if storage.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, "Unknown token")
+		return
+	}
+	if err != nil {
+		errors <- err
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	log.Infof("%s revoked token %s", userFromContext(ctx), id)
+	w.WriteHeader(http.StatusNoContent)
+}
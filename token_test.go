@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/desdic/godmarcparser/cfg"
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestNewToken(t *testing.T) {
+
+	tk, raw, err := newToken(" CI ", "nightly", true, []string{scopeUpload}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+	if tk.User != "service:ci" || !tk.Service || tk.Expires.Sub(tk.Created) != 24*time.Hour {
+		t.Errorf("Unexpected token %+v", tk)
+	}
+	if !strings.HasPrefix(raw, tokenPrefix+tk.ID+"_") || tk.Hash != hashToken(raw) || strings.Contains(tk.Hash, raw) {
+		t.Errorf("Expected the token %s to be hashed but got %+v", raw, tk)
+	}
+
+	for _, tc := range []struct {
+		user   string
+		scopes []string
+	}{
+		{"", []string{scopeRead}},
+		{"alice", nil},
+		{"alice", []string{"write"}},
+	} {
+		if _, _, err = newToken(tc.user, "", false, tc.scopes, 0); err == nil {
+			t.Errorf("Expected a token for %q with %v to fail", tc.user, tc.scopes)
+		}
+	}
+
+	if _, _, err = newToken("alice", "", false, []string{"write"}, 0); err == nil || !strings.Contains(err.Error(), "read, upload, admin, metrics") {
+		t.Errorf("Expected the error to list the scopes but got %v", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+
+	ctx := setupMemory(t)
+	ts := s.(storage.TokenStore)
+
+	var err error
+	if auth, err = newAuthenticator(ctx, cfg.AuthCfg{Type: "local", SessionTTL: 3600, DefaultRole: "none"}); err != nil {
+		t.Fatalf("Unable to create authenticator: %v", err)
+	}
+	t.Cleanup(func() { auth = nil })
+
+	queue = make(chan dmarc.Content, 10)
+	t.Cleanup(func() { queue = nil })
+
+	for _, g := range []storage.Grant{
+		{User: "root", Role: "admin", Scope: "*"},
+		{User: "vera", Role: "viewer", Scope: "greyhat.dk"},
+		{User: "service:ci", Role: "analyst", Scope: "greyhat.dk"},
+	} {
+		if err = s.(storage.GrantStore).WriteGrant(ctx, g); err != nil {
+			t.Fatalf("Unable to write grant: %v", err)
+		}
+	}
+	for _, user := range []string{"root", "vera"} {
+		if err = s.(storage.UserStore).WriteUser(ctx, storage.User{Name: user, PasswordHash: "x"}); err != nil {
+			t.Fatalf("Unable to write user: %v", err)
+		}
+	}
+
+	session, err := auth.sessions.create("root", "")
+	if err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+	cookie := &http.Cookie{Name: sessionCookie, Value: session}
+
+	h := httpHandler(ctx)
+	do := func(method, path, token string, body []byte, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, path, bytes.NewReader(body))
+		}
+		// The admin pages are used by root while the API gets a token
+		if strings.HasPrefix(path, "/admin/") {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Tokens are created on the admin page which shows the secret once
+	csrf := csrfToken(&http.Request{Header: http.Header{"Cookie": {cookie.String()}}})
+	create := func(kind, user string, days string, scopes ...string) string {
+		t.Helper()
+		w := do(http.MethodPost, "/admin/tokens", "", nil, url.Values{
+			"csrf": {csrf}, "action": {"create"}, "kind": {kind}, "user": {user}, "days": {days}, "scope": scopes,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the token to be created but got %d: %s", w.Code, w.Body.String())
+		}
+		raw := regexp.MustCompile(tokenPrefix + `[0-9a-f]+_[0-9a-f]+`).FindString(w.Body.String())
+		if raw == "" {
+			t.Fatalf("Expected the new token on the page:\n%s", w.Body.String())
+		}
+		return raw
+	}
+
+	viewer := create("personal", "vera", "30", scopeRead)
+	service := create("service", "ci", "0", scopeUpload)
+	admin := create("personal", "root", "1", scopeRead, scopeAdmin)
+
+	if w := do(http.MethodPost, "/admin/tokens", "", nil, url.Values{"csrf": {csrf}, "action": {"create"}, "user": {"vera"}, "days": {"1"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a token without scopes to fail but got %d", w.Code)
+	}
+
+	report, err := ioutil.ReadFile("dmarc/testdata/valid.xml")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+	gz, err := ioutil.ReadFile("input/testdata/valid.xml.gz")
+	if err != nil {
+		t.Fatalf("Unable to read report: %v", err)
+	}
+
+	tt := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     []byte
+		status   int
+		contains string
+	}{
+		{"no_token", http.MethodGet, "/api/v1/reports", "", nil, http.StatusUnauthorized, "Authentication required"},
+		{"read", http.MethodGet, "/api/v1/reports", viewer, nil, http.StatusOK, "myid123"},
+		{"unknown", http.MethodGet, "/api/v1/reports", tokenPrefix + "00_00", nil, http.StatusUnauthorized, "Invalid or expired token"},
+		{"wrong_secret", http.MethodGet, "/api/v1/reports", viewer + "0", nil, http.StatusUnauthorized, "Invalid or expired token"},
+		{"not_ours", http.MethodGet, "/api/v1/reports", "abc", nil, http.StatusUnauthorized, "Invalid or expired token"},
+		{"missing_scope", http.MethodGet, "/api/v1/reports", service, nil, http.StatusForbidden, "does not have the read scope"},
+		{"viewer_analyse", http.MethodGet, "/api/v1/analyse/greyhat.dk/10.10.10.1", viewer, nil, http.StatusForbidden, "Access denied"},
+		{"viewer_upload", http.MethodPost, "/api/v1/reports", viewer, report, http.StatusForbidden, "does not have the upload scope"},
+		{"upload", http.MethodPost, "/api/v1/reports?name=valid.xml", service, report, http.StatusAccepted, `"accepted": 1`},
+		{"upload_gzip", http.MethodPost, "/api/v1/reports", service, gz, http.StatusAccepted, `"accepted": 1`},
+		{"upload_text", http.MethodPost, "/api/v1/reports", service, []byte("hello"), http.StatusBadRequest, "not a zip, gzip or xml"},
+		{"upload_other_domain", http.MethodPost, "/api/v1/reports", service, bytes.Replace(report, []byte("<domain>greyhat.dk"), []byte("<domain>other.com"), 1), http.StatusForbidden, "Access denied to other.com"},
+		{"tokens_not_admin", http.MethodGet, "/api/v1/tokens", viewer, nil, http.StatusForbidden, "does not have the admin scope"},
+		{"tokens", http.MethodGet, "/api/v1/tokens", admin, nil, http.StatusOK, `"user": "service:ci"`},
+		{"web_pages", http.MethodGet, "/reports", viewer, nil, http.StatusSeeOther, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := do(tc.method, tc.path, tc.token, tc.body, nil)
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d but got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("Expected response to contain %q:\n%s", tc.contains, w.Body.String())
+			}
+		})
+	}
+
+	if len(queue) != 2 {
+		t.Errorf("Expected 2 queued uploads but got %d", len(queue))
+	}
+	if c := <-queue; c.From != "upload/valid.xml" {
+		t.Errorf("Expected the upload to be named but got %s", c.From)
+	}
+
+	tokens, err := ts.ReadTokens(ctx, "vera")
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Expected one token of vera but got %v: %v", tokens, err)
+	}
+	if tokens[0].LastUsed.IsZero() || tokens[0].Expires.IsZero() {
+		t.Errorf("Expected the token to be used and expire but got %+v", tokens[0])
+	}
+
+	if w := do(http.MethodDelete, "/api/v1/tokens/"+tokens[0].ID, admin, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the token to be revoked but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/api/v1/reports", viewer, nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked token to fail but got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/v1/tokens/00", admin, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown token to be not found but got %d", w.Code)
+	}
+
+	expired, raw, err := newToken("root", "", false, []string{scopeRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+	expired.Expires = time.Now().Add(-time.Minute)
+	if err = ts.WriteToken(ctx, expired); err != nil {
+		t.Fatalf("Unable to write token: %v", err)
+	}
+	if w := do(http.MethodGet, "/api/v1/reports", raw, nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired token to fail but got %d", w.Code)
+	}
+
+	// Revoking from the admin page
+	tokens, _ = ts.ReadTokens(ctx, "service:ci")
+	if w := do(http.MethodPost, "/admin/tokens", "", nil, url.Values{"csrf": {csrf}, "action": {"revoke"}, "id": {tokens[0].ID}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the revoke to redirect but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/admin/tokens", "", nil, nil); !strings.Contains(w.Body.String(), "revoked") {
+		t.Errorf("Expected the token to be shown as revoked")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/desdic/godmarcparser/dmarc"
+	"github.com/desdic/godmarcparser/input"
+	"github.com/desdic/godmarcparser/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxUploadSize is the largest report file accepted by the upload API
+const maxUploadSize = 20 << 20
+
+// apiUpload is the response of an upload
+type apiUpload struct {
+	Accepted int `json:"accepted"`
+}
+
+// handleAPIUpload queues the reports of an uploaded XML, zip or gzip file.
+// Every report is parsed first so nothing is queued if any of them is not
+// valid or belongs to a domain the user cannot analyse
+func handleAPIUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The upload is larger than %d bytes", maxUploadSize))
+		return
+	}
+
+	name := path.Base("/" + r.URL.Query().Get("name"))
+	if name == "/" {
+		name = "report"
+	}
+	from := "upload/" + name
+
+	cs, err := input.Contents(from, data)
+	if err != nil {
+		parseFailures.WithLabelValues(failureUnreadable).Inc()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tenant := storage.TenantFromContext(ctx)
+	for _, c := range cs {
+		f, err := dmarc.Read(c.Data.Bytes())
+		if err != nil {
+			parseFailures.WithLabelValues(failureInvalidXML).Inc()
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to parse %s: %v", c.Name, err))
+			return
+		}
+		domain := f.PolicyPublished.Domain
+		if !allowed(ctx, domain, roleAnalyst) || tenants.forReport(domain, "") != tenant {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Access denied to %s", domain))
+			return
+		}
+	}
+
+	for _, c := range cs {
+		select {
+		case queue <- c:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	log.Infof("%s uploaded %d reports in %s", userFromContext(ctx), len(cs), name)
+	writeJSON(w, http.StatusAccepted, apiUpload{Accepted: len(cs)})
+}
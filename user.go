@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/desdic/godmarcparser/storage"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userCommand manages the local users and the grants of all users. set reads
+// the password from the first line of in and def is the role of users
+// without grants
+func userCommand(ctx context.Context, s storage.Storage, def role, args []string, in io.Reader, out io.Writer) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("user needs an action: set NAME, delete NAME, list, grant NAME ROLE [SCOPE], revoke NAME SCOPE or grants [NAME]")
+	}
+
+	var min, max int
+	switch args[0] {
+	case "set", "delete":
+		min, max = 2, 2
+	case "list":
+		min, max = 1, 1
+	case "grants":
+		min, max = 1, 2
+	case "grant":
+		min, max = 3, 4
+	case "revoke":
+		min, max = 3, 3
+	default:
+		return fmt.Errorf("Unknown user action %q, use set, delete, list, grant, revoke or grants", args[0])
+	}
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("Wrong number of arguments to user %s", args[0])
+	}
+
+	us, users := s.(storage.UserStore)
+	gs, grants := s.(storage.GrantStore)
+	switch args[0] {
+	case "set", "delete", "list":
+		if !users {
+			return fmt.Errorf("The storage driver does not support local users")
+		}
+	default:
+		if !grants {
+			return fmt.Errorf("The storage driver does not support grants")
+		}
+	}
+
+	if err := s.Initialize(ctx); err != nil {
+		return fmt.Errorf("Unable to initialize storage: %v", err)
+	}
+
+	switch args[0] {
+	case "set":
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Unable to read password: %v", err)
+		}
+		hash, err := hashPassword(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			return err
+		}
+		if err = us.WriteUser(ctx, storage.User{Name: args[1], PasswordHash: hash}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Password of %s is set\n", args[1])
+	case "delete":
+		gs, _ := s.(storage.GrantStore)
+		ts, _ := s.(storage.TokenStore)
+		if err := deleteUser(ctx, us, gs, ts, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted %s\n", args[1])
+	case "list":
+		users, err := us.ReadUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Fprintf(out, "%-30s %s\n", u.Name, u.Created.Local().Format("2006-01-02 15:04"))
+		}
+	case "grant":
+		scope := "*"
+		if len(args) == 4 {
+			scope = args[3]
+		}
+		g, err := newGrant(args[1], args[2], scope)
+		if err != nil {
+			return err
+		}
+		if err = gs.WriteGrant(ctx, g); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Granted %s %s on %s\n", g.User, g.Role, g.Scope)
+	case "revoke":
+		if err := revokeGrant(ctx, gs, args[1], args[2], def); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked %s on %s\n", args[1], args[2])
+	case "grants":
+		var user string
+		if len(args) == 2 {
+			user = args[1]
+		}
+		grants, err := gs.ReadGrants(ctx, user)
+		if err != nil {
+			return err
+		}
+		for _, g := range grants {
+			fmt.Fprintf(out, "%-30s %-8s %s\n", g.User, g.Role, g.Scope)
+		}
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of a password
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("The password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("Unable to hash password: %v", err)
+	}
+	return string(hash), nil
+}
+
+// newGrant returns a grant of the role on the scope after checking them
+func newGrant(user, name, scope string) (storage.Grant, error) {
+	r, err := parseRole(name)
+	if err != nil {
+		return storage.Grant{}, err
+	}
+	if r == roleNone {
+		return storage.Grant{}, fmt.Errorf("Revoke the grant instead of granting none")
+	}
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	if err = validScope(scope); err != nil {
+		return storage.Grant{}, err
+	}
+	return storage.Grant{User: strings.ToLower(strings.TrimSpace(user)), Role: r.String(), Scope: scope}, nil
+}
+
+// revokeGrant deletes the grant of a user on the scope. A user who loses the
+// last grant is granted none on * instead so the default role does not give
+// more than the grant did
+func revokeGrant(ctx context.Context, gs storage.GrantStore, user, scope string, def role) error {
+	if err := gs.DeleteGrant(ctx, user, scope); err != nil {
+		return err
+	}
+	if def == roleNone {
+		return nil
+	}
+	grants, err := gs.ReadGrants(ctx, user)
+	if err != nil {
+		return err
+	}
+	if len(grants) > 0 {
+		return nil
+	}
+	return gs.WriteGrant(ctx, storage.Grant{User: user, Role: roleNone.String(), Scope: "*"})
+}
+
+// deleteUser deletes a local user with the grants and revokes the tokens of
+// the user. gs and ts are nil if the driver does not store them
+func deleteUser(ctx context.Context, us storage.UserStore, gs storage.GrantStore, ts storage.TokenStore, user string) error {
+	if err := us.DeleteUser(ctx, user); err != nil {
+		return err
+	}
+	if gs != nil {
+		grants, err := gs.ReadGrants(ctx, user)
+		if err != nil {
+			return err
+		}
+		for _, g := range grants {
+			if err = gs.DeleteGrant(ctx, g.User, g.Scope); err != nil {
+				return err
+			}
+		}
+	}
+	if ts != nil {
+		tokens, err := ts.ReadTokens(ctx, user)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.Revoked {
+				continue
+			}
+			if err = ts.RevokeToken(ctx, t.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/desdic/godmarcparser/storage"
+)
+
+func TestUserCommand(t *testing.T) {
+
+	ctx := context.Background()
+	m := &storage.Memory{}
+
+	def := roleNone
+	run := func(in string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := userCommand(ctx, m, def, args, strings.NewReader(in), &out)
+		return out.String(), err
+	}
+
+	if _, err := run("secret\n", "set", "Alice"); err != nil {
+		t.Fatalf("Unable to set user: %v", err)
+	}
+	if ok, err := (localUsers{store: m}).checkPassword(ctx, "alice", "secret"); err != nil || !ok {
+		t.Errorf("Expected the password of alice to be set but got %v %v", ok, err)
+	}
+
+	out, err := run("", "list")
+	if err != nil || !strings.HasPrefix(out, "alice ") {
+		t.Errorf("Expected alice to be listed but got %q %v", out, err)
+	}
+
+	for _, args := range [][]string{{}, {"set"}, {"set", "bob"}, {"rename", "alice"}, {"delete", "bob"}} {
+		if _, err = run("", args...); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+
+	if _, err = run("", "delete", "alice"); err != nil {
+		t.Errorf("Unable to delete user: %v", err)
+	}
+	if out, err = run("", "grant", "Alice", "viewer", "Example.com"); err != nil || out != "Granted alice viewer on example.com\n" {
+		t.Errorf("Unable to grant role: %q %v", out, err)
+	}
+	if _, err = run("", "grant", "bob", "admin"); err != nil {
+		t.Errorf("Unable to grant role on all domains: %v", err)
+	}
+	out, err = run("", "grants")
+	if err != nil || !strings.Contains(out, "alice") || !strings.Contains(out, "admin    *") {
+		t.Errorf("Expected the grants to be listed but got %q %v", out, err)
+	}
+	for _, args := range [][]string{{"grant", "alice"}, {"grant", "alice", "owner"}, {"grant", "alice", "viewer", "not a domain"}, {"revoke", "alice", "other.com"}} {
+		if _, err = run("", args...); err == nil {
+			t.Errorf("Expected %v to fail", args)
+		}
+	}
+	if _, err = run("", "revoke", "alice", "example.com"); err != nil {
+		t.Errorf("Unable to revoke role: %v", err)
+	}
+	if out, _ = run("", "grants", "alice"); out != "" {
+		t.Errorf("Expected alice to have no grants but got %q", out)
+	}
+
+	// The default role does not replace the last grant
+	def = roleViewer
+	if _, err = run("", "revoke", "bob", "*"); err != nil {
+		t.Errorf("Unable to revoke role: %v", err)
+	}
+	if out, _ = run("", "grants", "bob"); !strings.Contains(out, "none     *") {
+		t.Errorf("Expected bob to keep none on all domains but got %q", out)
+	}
+
+	// Deleting a user removes the grants and revokes the tokens
+	if _, err = run("secret\n", "set", "carol"); err != nil {
+		t.Fatalf("Unable to set user: %v", err)
+	}
+	if _, err = run("", "grant", "carol", "viewer"); err != nil {
+		t.Fatalf("Unable to grant role: %v", err)
+	}
+	tk, _, err := newToken("carol", "laptop", false, []string{scopeRead}, 0)
+	if err != nil {
+		t.Fatalf("Unable to create token: %v", err)
+	}
+	if err = m.WriteToken(ctx, tk); err != nil {
+		t.Fatalf("Unable to write token: %v", err)
+	}
+	if _, err = run("", "delete", "carol"); err != nil {
+		t.Fatalf("Unable to delete user: %v", err)
+	}
+	if out, _ = run("", "grants", "carol"); out != "" {
+		t.Errorf("Expected carol to have no grants but got %q", out)
+	}
+	if tk, err = m.ReadToken(ctx, tk.ID); err != nil || !tk.Revoked {
+		t.Errorf("Expected the token of carol to be revoked but got %+v %v", tk, err)
+	}
+}
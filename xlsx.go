@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The parts of a workbook with a single sheet. The sheet is written last so
+// its rows can be streamed
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Rows" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxWriter streams rows to a workbook with a single sheet. The strings are
+// written inline so nothing but the current row is held in memory
+type xlsxWriter struct {
+	z       *zip.Writer
+	sheet   *bufio.Writer
+	numeric map[int]bool
+	err     error
+}
+
+// newXLSXWriter starts a workbook on w. The columns in numeric are written
+// as numbers when they can be parsed as one
+func newXLSXWriter(w io.Writer, numeric ...int) (*xlsxWriter, error) {
+
+	x := &xlsxWriter{z: zip.NewWriter(w), numeric: make(map[int]bool)}
+	for _, n := range numeric {
+		x.numeric[n] = true
+	}
+
+	for _, p := range xlsxParts {
+		f, err := x.z.Create(p.name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create %s: %v", p.name, err)
+		}
+		if _, err = io.WriteString(f, p.content); err != nil {
+			return nil, fmt.Errorf("Unable to write %s: %v", p.name, err)
+		}
+	}
+
+	f, err := x.z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create sheet: %v", err)
+	}
+	x.sheet = bufio.NewWriter(f)
+	x.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	return x, nil
+}
+
+// Write adds a row to the sheet
+func (x *xlsxWriter) Write(record []string) error {
+	if x.err != nil {
+		return x.err
+	}
+
+	x.sheet.WriteString("<row>")
+	for i, v := range record {
+		if x.numeric[i] {
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				x.sheet.WriteString("<c><v>" + v + "</v></c>")
+				continue
+			}
+		}
+		x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		if err := xml.EscapeText(x.sheet, []byte(v)); err != nil {
+			x.err = err
+			return err
+		}
+		x.sheet.WriteString("</t></is></c>")
+	}
+	_, x.err = x.sheet.WriteString("</row>")
+	return x.err
+}
+
+// Close ends the sheet and the workbook
+func (x *xlsxWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+
+	x.sheet.WriteString("</sheetData></worksheet>")
+	if err := x.sheet.Flush(); err != nil {
+		return fmt.Errorf("Unable to write sheet: %v", err)
+	}
+	return x.z.Close()
+}
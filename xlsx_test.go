@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestXLSXWriter(t *testing.T) {
+
+	var b bytes.Buffer
+	x, err := newXLSXWriter(&b, 1)
+	if err != nil {
+		t.Fatalf("Unable to create workbook: %v", err)
+	}
+	for _, r := range [][]string{{"name", "count"}, {"a<b & c", "42"}} {
+		if err = x.Write(r); err != nil {
+			t.Fatalf("Unable to write row: %v", err)
+		}
+	}
+	if err = x.Close(); err != nil {
+		t.Fatalf("Unable to close workbook: %v", err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Unable to read workbook: %v", err)
+	}
+
+	var names []string
+	var sheet string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Unable to open sheet: %v", err)
+		}
+		data, _ := io.ReadAll(r)
+		sheet = string(data)
+	}
+	if len(names) != 5 {
+		t.Errorf("Expected 5 parts but got %v", names)
+	}
+
+	for _, expected := range []string{
+		`<t xml:space="preserve">count</t>`,
+		`<t xml:space="preserve">a&lt;b &amp; c</t>`,
+		`<c><v>42</v></c>`,
+		`</sheetData></worksheet>`,
+	} {
+		if !strings.Contains(sheet, expected) {
+			t.Errorf("Expected sheet to contain %q:\n%s", expected, sheet)
+		}
+	}
+}